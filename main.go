@@ -1,10 +1,16 @@
 package main
 
 import (
+	"context"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/blendlabs/chatbus/server"
 	"github.com/blendlabs/chatbus/server/db"
+	"github.com/blendlabs/chatbus/server/store"
 	"github.com/blendlabs/spiffy"
 )
 
@@ -31,20 +37,43 @@ func main() {
 		log.Fatal(err)
 	}
 
-	err = connectDB()
+	if server.DefaultConfig().Store == store.KindPostgres {
+		err = connectDB()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		err = db.Migrate()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	app, err := server.New()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	err = db.Migrate()
-	if err != nil {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- app.Start()
+	}()
+
+	select {
+	case err = <-serveErr:
 		log.Fatal(err)
+	case sig := <-signals:
+		log.Printf("%v received, shutting down", sig)
 	}
 
-	app, err := server.New()
+	timeout := time.Duration(server.DefaultConfig().ShutdownTimeoutMillis) * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err = app.Shutdown(ctx)
 	if err != nil {
 		log.Fatal(err)
 	}
-
-	log.Fatal(app.Start())
 }
@@ -0,0 +1,134 @@
+package cluster
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+)
+
+const (
+	// KindReconnect is the kind of the notification a bus delivers after it reconnects; notifications published while it was away are lost.
+	KindReconnect = "reconnect"
+
+	// NotificationBufferSize is how many notifications a bus holds for its node before publishing blocks.
+	NotificationBufferSize = 1024
+)
+
+// Notification is a change published to every node in a cluster.
+type Notification struct {
+	Kind    string          `json:"kind"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+	// Sequences are the message sequences the bus allocated for the users the notification was published for, by user id.
+	Sequences map[int]int64 `json:"sequences,omitempty"`
+}
+
+// NewNotification returns a notification of a kind with a payload marshalled to json.
+func NewNotification(kind string, payload interface{}) (Notification, error) {
+	contents, err := json.Marshal(payload)
+	if err != nil {
+		return Notification{}, err
+	}
+	return Notification{Kind: kind, Payload: contents}, nil
+}
+
+// Bus carries notifications between the nodes of a cluster.
+// Every node, including the one that published it, gets every notification, and every node gets them in the same order.
+type Bus interface {
+	// Publish sends a notification to every node. Each of the users in `after` gets their next message sequence allocated
+	// along with the publish, so sequences for a user are always delivered in order; a sequence comes after both
+	// the last one the cluster allocated for the user and the one in `after`, the last the publishing node knows of.
+	// If `prepare` is set it is called with the sequences before any node can see the notification; if it fails nothing is published.
+	Publish(notification Notification, after map[int]int64, prepare func(sequences map[int]int64) error) (map[int]int64, error)
+	// Notifications returns the notifications for this node.
+	Notifications() <-chan Notification
+	// Close stops the bus.
+	Close() error
+}
+
+// sortedUserIDs returns the user ids in a map of sequences in order, so sequences are always allocated in the same order.
+func sortedUserIDs(sequences map[int]int64) []int {
+	userIDs := make([]int, 0, len(sequences))
+	for userID := range sequences {
+		userIDs = append(userIDs, userID)
+	}
+	sort.Ints(userIDs)
+	return userIDs
+}
+
+// NewLocal returns a bus for nodes in the same process, i.e. for tests. Every node joins with Join.
+func NewLocal() *Local {
+	return &Local{sequences: map[int]int64{}}
+}
+
+// Local is a bus for nodes in the same process; it allocates sequences from memory.
+type Local struct {
+	lock      sync.Mutex
+	sequences map[int]int64
+	nodes     []*localNode
+}
+
+// Join returns the bus for a new node.
+func (l *Local) Join() Bus {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	node := &localNode{local: l, notifications: make(chan Notification, NotificationBufferSize)}
+	l.nodes = append(l.nodes, node)
+	return node
+}
+
+func (l *Local) publish(notification Notification, after map[int]int64, prepare func(map[int]int64) error) (map[int]int64, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if len(after) > 0 {
+		notification.Sequences = map[int]int64{}
+		for _, userID := range sortedUserIDs(after) {
+			sequence := l.sequences[userID]
+			if after[userID] > sequence {
+				sequence = after[userID]
+			}
+			notification.Sequences[userID] = sequence + 1
+		}
+	}
+	if prepare != nil {
+		if err := prepare(notification.Sequences); err != nil {
+			return nil, err
+		}
+	}
+	for userID, sequence := range notification.Sequences {
+		l.sequences[userID] = sequence
+	}
+	for _, node := range l.nodes {
+		if !node.closed {
+			node.notifications <- notification
+		}
+	}
+	return notification.Sequences, nil
+}
+
+type localNode struct {
+	local         *Local
+	notifications chan Notification
+	closed        bool
+}
+
+// Publish implements Bus.
+func (ln *localNode) Publish(notification Notification, after map[int]int64, prepare func(map[int]int64) error) (map[int]int64, error) {
+	return ln.local.publish(notification, after, prepare)
+}
+
+// Notifications implements Bus.
+func (ln *localNode) Notifications() <-chan Notification {
+	return ln.notifications
+}
+
+// Close implements Bus.
+func (ln *localNode) Close() error {
+	ln.local.lock.Lock()
+	defer ln.local.lock.Unlock()
+	if !ln.closed {
+		ln.closed = true
+		close(ln.notifications)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package cluster
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	assert "github.com/blendlabs/go-assert"
+)
+
+func TestLocal(t *testing.T) {
+	assert := assert.New(t)
+
+	local := NewLocal()
+	node1 := local.Join()
+	node2 := local.Join()
+
+	notification, err := NewNotification("test", map[string]string{"hello": "world"})
+	assert.Nil(err)
+	sequences, err := node1.Publish(notification, map[int]int64{1: 0, 2: 10}, nil)
+	assert.Nil(err)
+	assert.Equal(int64(1), sequences[1])
+	assert.Equal(int64(11), sequences[2])
+
+	// sequences come after what the cluster allocated even if the publishing node is behind.
+	sequences, err = node2.Publish(notification, map[int]int64{2: 5}, nil)
+	assert.Nil(err)
+	assert.Equal(int64(12), sequences[2])
+
+	// a publish whose prepare fails goes nowhere, and doesn't use up its sequences.
+	_, err = node1.Publish(notification, map[int]int64{2: 0}, func(sequences map[int]int64) error {
+		assert.Equal(int64(13), sequences[2])
+		return errors.New("prepare failed")
+	})
+	assert.NotNil(err)
+
+	for _, node := range []Bus{node1, node2} {
+		first := <-node.Notifications()
+		assert.Equal("test", first.Kind)
+		assert.Equal(int64(11), first.Sequences[2])
+		assert.Equal(int64(12), (<-node.Notifications()).Sequences[2])
+	}
+
+	assert.Nil(node2.Close())
+	sequences, err = node1.Publish(notification, map[int]int64{2: 0}, nil)
+	assert.Nil(err)
+	assert.Equal(int64(13), sequences[2])
+	assert.Len(node1.Notifications(), 1)
+	_, open := <-node2.Notifications()
+	assert.False(open)
+}
+
+func TestPostgresReadChunk(t *testing.T) {
+	assert := assert.New(t)
+
+	p := &Postgres{chunks: map[string]*postgresChunks{}}
+	contents, err := json.Marshal(Notification{Kind: "test", Payload: json.RawMessage(`"` + strings.Repeat("x", 100) + `"`), Sequences: map[int]int64{1: 2}})
+	assert.Nil(err)
+	encoded := base64.StdEncoding.EncodeToString(contents)
+
+	now := time.Now()
+	notification, complete, err := p.readChunk("a:0:1:"+encoded, now)
+	assert.Nil(err)
+	assert.True(complete)
+	assert.Equal("test", notification.Kind)
+	assert.Equal(int64(2), notification.Sequences[1])
+
+	// chunks can arrive in any order.
+	half := len(encoded) / 2
+	_, complete, err = p.readChunk("b:1:2:"+encoded[half:], now)
+	assert.Nil(err)
+	assert.False(complete)
+	notification, complete, err = p.readChunk("b:0:2:"+encoded[:half], now)
+	assert.Nil(err)
+	assert.True(complete)
+	assert.Equal("test", notification.Kind)
+	assert.Empty(p.chunks)
+
+	// partial notifications are dropped once they're stale.
+	_, _, err = p.readChunk("c:0:2:"+encoded[:half], now)
+	assert.Nil(err)
+	_, complete, err = p.readChunk("c:1:2:"+encoded[half:], now.Add(2*PostgresChunkTimeout))
+	assert.Nil(err)
+	assert.False(complete)
+
+	for _, invalid := range []string{"", "a:0:1", "a:x:1:data", "a:1:1:data", "a:0:0:data"} {
+		_, _, err = p.readChunk(invalid, now)
+		assert.Equal(ErrInvalidChunk, err, invalid)
+	}
+}
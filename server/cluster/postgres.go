@@ -0,0 +1,270 @@
+package cluster
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// PostgresChunkSize is the most payload sent in one NOTIFY; postgres caps a payload at just under 8000 bytes.
+	PostgresChunkSize = 7000
+
+	// PostgresChunkTimeout is how long a node waits for the rest of a notification that was split across NOTIFYs.
+	PostgresChunkTimeout = time.Minute
+
+	postgresMinReconnectInterval = 10 * time.Millisecond
+	postgresMaxReconnectInterval = time.Minute
+)
+
+var (
+	// ErrInvalidChunk is returned for a NOTIFY that isn't a chunk of a notification.
+	ErrInvalidChunk = errors.New("Invalid cluster notification chunk!")
+)
+
+// OpenPostgres connects to postgres, listens on a channel and returns a bus that publishes to it.
+// Notifications are json, base64 encoded and split into chunks that fit in a NOTIFY.
+// Sequences are allocated from `user_sequences` in the same transaction as the NOTIFY, so they're delivered in commit order;
+// retention keeps its high-water marks in the same table, so they never go backwards.
+func OpenPostgres(connectionString, channel string) (*Postgres, error) {
+	db, err := sql.Open("postgres", connectionString)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Postgres{
+		db:            db,
+		channel:       channel,
+		chunks:        map[string]*postgresChunks{},
+		notifications: make(chan Notification, NotificationBufferSize),
+		done:          make(chan struct{}),
+	}
+	p.listener = pq.NewListener(connectionString, postgresMinReconnectInterval, postgresMaxReconnectInterval, p.listenerEvent)
+	if err = p.listener.Listen(channel); err != nil {
+		p.listener.Close()
+		db.Close()
+		return nil, err
+	}
+	p.listening.Add(1)
+	go p.listen()
+	return p, nil
+}
+
+// Postgres is a bus over postgres LISTEN / NOTIFY.
+type Postgres struct {
+	// OnError is called with each NOTIFY that can't be read, and each error the listener reports; the notification is dropped.
+	OnError func(error)
+
+	db       *sql.DB
+	channel  string
+	listener *pq.Listener
+
+	chunks        map[string]*postgresChunks
+	notifications chan Notification
+	done          chan struct{}
+	closeOnce     sync.Once
+	listening     sync.WaitGroup
+}
+
+type postgresChunks struct {
+	parts    []string
+	received int
+	started  time.Time
+}
+
+// Publish implements Bus.
+// The notification only goes out when the transaction that allocated the sequences commits, which is after `prepare` returns.
+func (p *Postgres) Publish(notification Notification, after map[int]int64, prepare func(map[int]int64) error) (map[int]int64, error) {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	sequences, err := p.publishInTx(notification, after, prepare, tx)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return sequences, tx.Commit()
+}
+
+func (p *Postgres) publishInTx(notification Notification, after map[int]int64, prepare func(map[int]int64) error, tx *sql.Tx) (map[int]int64, error) {
+	if len(after) > 0 {
+		notification.Sequences = map[int]int64{}
+		// the users are locked in order, so two publishes can't deadlock on each other.
+		for _, userID := range sortedUserIDs(after) {
+			var sequence int64
+			err := tx.QueryRow(`
+			INSERT INTO user_sequences (user_id, seq) VALUES ($1, $2 + 1)
+			ON CONFLICT (user_id) DO UPDATE SET seq = GREATEST(user_sequences.seq, $2) + 1
+			RETURNING seq
+			`, userID, after[userID]).Scan(&sequence)
+			if err != nil {
+				return nil, err
+			}
+			notification.Sequences[userID] = sequence
+		}
+	}
+	if prepare != nil {
+		if err := prepare(notification.Sequences); err != nil {
+			return nil, err
+		}
+	}
+
+	contents, err := json.Marshal(notification)
+	if err != nil {
+		return nil, err
+	}
+	encoded := base64.StdEncoding.EncodeToString(contents)
+	id, err := newChunkID()
+	if err != nil {
+		return nil, err
+	}
+	count := (len(encoded) + PostgresChunkSize - 1) / PostgresChunkSize
+	for index := 0; index < count; index++ {
+		end := (index + 1) * PostgresChunkSize
+		if end > len(encoded) {
+			end = len(encoded)
+		}
+		chunk := id + ":" + strconv.Itoa(index) + ":" + strconv.Itoa(count) + ":" + encoded[index*PostgresChunkSize:end]
+		if _, err = tx.Exec("SELECT pg_notify($1, $2)", p.channel, chunk); err != nil {
+			return nil, err
+		}
+	}
+	return notification.Sequences, nil
+}
+
+func newChunkID() (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// Notifications implements Bus.
+func (p *Postgres) Notifications() <-chan Notification {
+	return p.notifications
+}
+
+// Close implements Bus.
+func (p *Postgres) Close() error {
+	var err error
+	p.closeOnce.Do(func() {
+		close(p.done)
+		err = p.listener.Close()
+		p.listening.Wait()
+		close(p.notifications)
+		if closeErr := p.db.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	})
+	return err
+}
+
+func (p *Postgres) listenerEvent(event pq.ListenerEventType, err error) {
+	if err != nil {
+		p.reportError(err)
+	}
+}
+
+func (p *Postgres) reportError(err error) {
+	if p.OnError != nil {
+		p.OnError(err)
+	}
+}
+
+// listen reads NOTIFYs until the bus is closed, putting notifications back together from their chunks.
+func (p *Postgres) listen() {
+	defer p.listening.Done()
+	for {
+		select {
+		case <-p.done:
+			return
+		case raw, ok := <-p.listener.Notify:
+			if !ok {
+				return
+			}
+			// the listener sends nil once it has reconnected.
+			if raw == nil {
+				p.chunks = map[string]*postgresChunks{}
+				p.deliver(Notification{Kind: KindReconnect})
+				continue
+			}
+			notification, complete, err := p.readChunk(raw.Extra, time.Now())
+			if err != nil {
+				p.reportError(err)
+				continue
+			}
+			if complete {
+				p.deliver(notification)
+			}
+		}
+	}
+}
+
+func (p *Postgres) deliver(notification Notification) {
+	select {
+	case p.notifications <- notification:
+	case <-p.done:
+	}
+}
+
+// readChunk adds a chunk to the notification it is part of, returning the notification once every chunk is in.
+func (p *Postgres) readChunk(chunk string, now time.Time) (Notification, bool, error) {
+	var notification Notification
+	fields := strings.SplitN(chunk, ":", 4)
+	if len(fields) != 4 {
+		return notification, false, ErrInvalidChunk
+	}
+	index, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return notification, false, ErrInvalidChunk
+	}
+	count, err := strconv.Atoi(fields[2])
+	if err != nil || count < 1 || index < 0 || index >= count {
+		return notification, false, ErrInvalidChunk
+	}
+
+	for id, partial := range p.chunks {
+		if now.Sub(partial.started) > PostgresChunkTimeout {
+			delete(p.chunks, id)
+		}
+	}
+
+	encoded := fields[3]
+	if count > 1 {
+		partial, hasPartial := p.chunks[fields[0]]
+		if !hasPartial {
+			partial = &postgresChunks{parts: make([]string, count), started: now}
+			p.chunks[fields[0]] = partial
+		}
+		if len(partial.parts) != count {
+			return notification, false, ErrInvalidChunk
+		}
+		if len(partial.parts[index]) == 0 {
+			partial.parts[index] = encoded
+			partial.received++
+		}
+		if partial.received < count {
+			return notification, false, nil
+		}
+		delete(p.chunks, fields[0])
+		encoded = strings.Join(partial.parts, "")
+	}
+
+	contents, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return notification, false, err
+	}
+	err = json.Unmarshal(contents, &notification)
+	return notification, err == nil, err
+}
@@ -35,6 +35,66 @@ type AppConfig struct {
 	AppName     string `env:"APP_NAME" env_default:"Chat Bus"`
 	Environment string `env:"ENV" env_default:"dev"`
 	Port        string `env:"PORT" env_default:"8080"`
+	// Store is the kind of store to persist to, `postgres`, `sqlite` or `memory`.
+	Store string `env:"STORE" env_default:"postgres"`
+	// SqlitePath is the database file for the sqlite store.
+	SqlitePath string `env:"SQLITE_PATH" env_default:"chatbus.db"`
+	// WALPath is the write-ahead log sent messages are synced to before they're acknowledged; empty disables it.
+	// It isn't used with the memory store, which doesn't outlive the process anyway.
+	WALPath string `env:"WAL_PATH" env_default:"chatbus.wal"`
+	// WALFlushIntervalMillis is how often the write-ahead log is flushed to the store.
+	WALFlushIntervalMillis int `env:"WAL_FLUSH_INTERVAL_MS" env_default:"500"`
+	// MessageBatchSize is the most messages written to the store in one insert.
+	MessageBatchSize int `env:"MESSAGE_BATCH_SIZE" env_default:"100"`
+	// MessageBatchIntervalMillis is the longest a sent message waits for its batch to fill when there's no write-ahead log.
+	MessageBatchIntervalMillis int `env:"MESSAGE_BATCH_INTERVAL_MS" env_default:"50"`
+	// RetentionMaxAge is how long messages are kept, as a go duration (i.e. `720h`); empty keeps them forever.
+	RetentionMaxAge string `env:"RETENTION_MAX_AGE"`
+	// RetentionRooms overrides the max age per room, i.e. `12=24h,15=0s`; zero keeps a room's messages forever.
+	RetentionRooms string `env:"RETENTION_ROOMS"`
+	// RetentionConversations overrides the max age per pair of users, i.e. `3:7=1h`.
+	RetentionConversations string `env:"RETENTION_CONVERSATIONS"`
+	// RetentionBatchSize is how many messages the expiry job deletes at a time.
+	RetentionBatchSize int `env:"RETENTION_BATCH_SIZE" env_default:"500"`
+	// RetentionArchivePath is a file expired messages are appended to before they're deleted; empty just deletes them.
+	RetentionArchivePath string `env:"RETENTION_ARCHIVE_PATH"`
+	// SessionTokenSecret signs the bearer tokens sessions are given; empty generates one at startup, so tokens don't survive a restart.
+	// Cluster mode needs it, so every node accepts the tokens the others issue.
+	SessionTokenSecret string `env:"SESSION_TOKEN_SECRET"`
+	// SessionTokenTTL is how long a session token is good for, as a go duration.
+	SessionTokenTTL string `env:"SESSION_TOKEN_TTL" env_default:"24h"`
+	// SessionPathsEnabled keeps the routes that take the session id in the path, i.e. `/api/messages/:session_id`, alongside the `/api/me` token routes.
+	SessionPathsEnabled bool `env:"SESSION_PATHS_ENABLED" env_default:"true"`
+	// AdminSigningSecret is the secret shared with the gateway that signs requests to the admin routes; empty leaves them unsigned.
+	AdminSigningSecret string `env:"ADMIN_SIGNING_SECRET"`
+	// AdminSigningWindow is how old (or far ahead) a signed request's timestamp can be, as a go duration; signatures can't be reused within it.
+	AdminSigningWindow string `env:"ADMIN_SIGNING_WINDOW" env_default:"5m"`
+	// IdentityJWKSPath is a json web key set file the identity provider signs its tokens with; set it (or IdentityJWKS)
+	// to require a token for the user on `POST /api/session/:user_id`.
+	IdentityJWKSPath string `env:"IDENTITY_JWKS_PATH"`
+	// IdentityJWKS is the identity provider's json web key set inline, used if there isn't a path.
+	IdentityJWKS string `env:"IDENTITY_JWKS"`
+	// IdentityIssuer is the issuer identity tokens must have; empty accepts any.
+	IdentityIssuer string `env:"IDENTITY_ISSUER"`
+	// IdentityAudience is an audience identity tokens must have; empty accepts any.
+	IdentityAudience string `env:"IDENTITY_AUDIENCE"`
+	// RateLimitSessionSends and the other rate limits are `count/duration[:burst]`, i.e. `5/s` or `300/1m:20`; empty doesn't limit.
+	// Each request is checked against both the limit for its session and the limit for its user.
+	RateLimitSessionSends    string `env:"RATE_LIMIT_SESSION_SENDS"`
+	RateLimitUserSends       string `env:"RATE_LIMIT_USER_SENDS"`
+	RateLimitSessionPolls    string `env:"RATE_LIMIT_SESSION_POLLS"`
+	RateLimitUserPolls       string `env:"RATE_LIMIT_USER_POLLS"`
+	RateLimitSessionContacts string `env:"RATE_LIMIT_SESSION_CONTACTS"`
+	RateLimitUserContacts    string `env:"RATE_LIMIT_USER_CONTACTS"`
+	// Cluster runs the server as one node of a cluster; messages and cache changes are published over postgres NOTIFY
+	// to every node, so a user's sessions can be spread across them. It needs the postgres store.
+	Cluster bool `env:"CLUSTER" env_default:"false"`
+	// ClusterChannel is the postgres channel the nodes of a cluster LISTEN on.
+	ClusterChannel string `env:"CLUSTER_CHANNEL" env_default:"chatbus"`
+	// DatabaseURL is the postgres connection string the cluster listens with.
+	DatabaseURL string `env:"DATABASE_URL"`
+	// ShutdownTimeoutMillis is how long a graceful shutdown gets before the process exits anyway.
+	ShutdownTimeoutMillis int `env:"SHUTDOWN_TIMEOUT_MS" env_default:"30000"`
 }
 
 // FromEnvironment reads the config from the environment.
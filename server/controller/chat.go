@@ -2,12 +2,16 @@ package controller
 
 import (
 	"database/sql"
+	"errors"
 	"strconv"
 	"sync"
 	"time"
 
+	"github.com/blendlabs/chatbus/server/cluster"
 	"github.com/blendlabs/chatbus/server/model"
+	"github.com/blendlabs/chatbus/server/store"
 	"github.com/blendlabs/chatbus/server/viewmodel"
+	"github.com/blendlabs/chatbus/server/wal"
 	util "github.com/blendlabs/go-util"
 	"github.com/blendlabs/go-util/collections"
 	web "github.com/wcharczuk/go-web"
@@ -16,23 +20,77 @@ import (
 const (
 	// MessageQueueMaxLength is the maximum queue length per user.
 	MessageQueueMaxLength = 1 << 10 //1 << 18 // 256k
+
+	// MessageWaitMaxDuration is the longest a long poll for messages can park.
+	MessageWaitMaxDuration = time.Minute
+)
+
+var (
+	// ErrRecipientNotFound is returned when a message is sent to a user that doesn't exist.
+	ErrRecipientNotFound = errors.New("Recipient not found!")
 )
 
 // Chat is the chat controller
 type Chat struct {
 	usersLock         sync.RWMutex
 	contactsLock      sync.RWMutex
+	roomsLock         sync.RWMutex
+	roomMembersLock   sync.RWMutex
 	sessionLock       sync.RWMutex
 	sessionByUserLock sync.RWMutex
 	messageQueueLock  sync.RWMutex
+	messageSignalLock sync.Mutex
+	sequenceLock      sync.Mutex
+	typingLock        sync.Mutex
+	scheduledLock     sync.Mutex
+	inboxLock         sync.Mutex
+	drainLock         sync.Mutex
+
+	sessionActivityLock sync.Mutex
+	sessionActivity     map[string]time.Time
+
+	drainSignal chan struct{}
+	isDraining  bool
+	websockets  sync.WaitGroup
 
 	App *web.App
 
+	// Store is where the controller persists its state; if it isn't set the default store is used.
+	Store store.Store
+	// WAL is the write-ahead log sent messages are synced to before they're acknowledged; if it isn't set messages are queued to the store directly.
+	WAL *wal.Log
+	// Batcher groups sent messages into multi-row writes when there isn't a write-ahead log; if neither is set messages are queued one at a time.
+	Batcher *store.Batcher
+	// Retention is how long messages are kept; the zero value keeps them forever.
+	Retention Retention
+	// Tokens sign the bearer tokens new sessions are given. The server always sets them, generating a secret if none is configured;
+	// only a zero value (i.e. in tests) issues no tokens, and then the `/api/me` routes reject every request.
+	Tokens SessionTokens
+	// Signer checks the signatures on the admin routes; if it isn't set they're open to anyone that can reach them.
+	Signer *RequestSigner
+	// Identity checks the identity token new sessions have to present; if it isn't set anyone can start a session for any user.
+	Identity *IdentityVerifier
+	// RateLimits throttle sends, polls and contact changes per session and per user.
+	RateLimits RateLimits
+	// Cluster carries messages and cache changes between the nodes of a cluster; if it isn't set the controller runs on its own.
+	Cluster cluster.Bus
+	// OnClusterError is called with each error publishing to, or applying a notification from, the cluster.
+	OnClusterError func(error)
+
 	Users          map[int]*model.User
 	Contacts       map[int]collections.SetOfInt
+	Rooms          map[int]*model.Room
+	RoomMembers    map[int]collections.SetOfInt
 	Sessions       map[string]*model.Session
 	SessionsByUser map[int]collections.SetOfString
 	MessageQueues  map[int]*collections.RingBuffer
+	// Inboxes hold the messages routed to users without a session, by user id, until they start one.
+	Inboxes        map[int]*collections.RingBuffer
+	MessageSignals map[int]chan struct{}
+	Sequences      map[int]int64
+	Typing         map[int]map[int]time.Time
+	// ScheduledMessages are the messages waiting to be delivered, by uuid.
+	ScheduledMessages map[string]model.ScheduledMessage
 }
 
 // Register registers the controller.
@@ -41,38 +99,108 @@ func (c *Chat) Register(app *web.App) {
 	c.App = app
 
 	// user actions
-	app.GET("/api/users", c.getUsersAction, web.APIProviderAsDefault)
-	app.POST("/api/user", c.newUserAction, web.APIProviderAsDefault)
+	app.GET("/api/users", c.getUsersAction, web.APIProviderAsDefault, c.requireSignature)
+	app.POST("/api/user", c.newUserAction, web.APIProviderAsDefault, c.requireSignature)
 	app.GET("/api/user/:id", c.getUserAction, web.APIProviderAsDefault)
 	app.GET("/api/user.uuid/:uuid", c.getUserByUUIDAction, web.APIProviderAsDefault)
-	app.PUT("/api/user/:id", c.updateUserAction, web.APIProviderAsDefault)
-	app.DELETE("/api/user/:id", c.deleteUserAction, web.APIProviderAsDefault)
+	app.PUT("/api/user/:id", c.updateUserAction, web.APIProviderAsDefault, c.requireSignature)
+	app.DELETE("/api/user/:id", c.deleteUserAction, web.APIProviderAsDefault, c.requireSignature)
 
 	// session actions
-	app.GET("/api/sessions", c.getSessionsAction, web.APIProviderAsDefault)
+	app.GET("/api/sessions", c.getSessionsAction, web.APIProviderAsDefault, c.requireSignature)
 	app.POST("/api/session/:user_id", c.newSessionAction, web.APIProviderAsDefault)
-	app.DELETE("/api/session/:id", c.deleteSessionAction, web.APIProviderAsDefault)
+
+	// monitoring actions
+	app.GET("/api/rate_limits", c.getRateLimitsAction, web.APIProviderAsDefault, c.requireSignature)
+
+	if !c.Tokens.DisablePaths {
+		c.registerSessionPathRoutes(app)
+	}
+	c.registerSessionTokenRoutes(app)
+}
+
+// registerSessionPathRoutes registers the session scoped routes that take the session id in the path.
+func (c *Chat) registerSessionPathRoutes(app *web.App) {
+	// session actions
+	app.DELETE("/api/session/:session_id", c.deleteSessionAction, web.APIProviderAsDefault)
 
 	// contacts actions
 	app.GET("/api/contacts/:session_id", c.getContactsAction, web.APIProviderAsDefault)
 	app.POST("/api/contact/:session_id/:user_id", c.createContactAction, web.APIProviderAsDefault)
 	app.DELETE("/api/contact/:session_id/:user_id", c.deleteContactAction, web.APIProviderAsDefault)
 
+	// room actions
+	app.GET("/api/rooms/:session_id", c.getRoomsAction, web.APIProviderAsDefault)
+	app.POST("/api/room/:session_id", c.createRoomAction, web.APIProviderAsDefault)
+	app.GET("/api/room/:session_id/:room_id", c.getRoomAction, web.APIProviderAsDefault)
+	app.POST("/api/room.member/:session_id/:room_id/:user_id", c.createRoomMemberAction, web.APIProviderAsDefault)
+	app.DELETE("/api/room.member/:session_id/:room_id/:user_id", c.deleteRoomMemberAction, web.APIProviderAsDefault)
+	app.POST("/api/room.message/:session_id/:room_id", c.sendRoomMessageAction, web.APIProviderAsDefault)
+
+	// typing actions
+	app.POST("/api/typing/:session_id/:user_id", c.startTypingAction, web.APIProviderAsDefault)
+	app.DELETE("/api/typing/:session_id/:user_id", c.stopTypingAction, web.APIProviderAsDefault)
+
 	// messages actions
 	app.GET("/api/messages/:session_id", c.getMessagesAction, web.APIProviderAsDefault)
 	app.GET("/api/messages/:session_id/:after", c.getMessagesAction, web.APIProviderAsDefault)
 	app.GET("/api/messages/:session_id/:after/:nano", c.getMessagesAction, web.APIProviderAsDefault)
 	app.POST("/api/message/:session_id", c.sendMessageAction, web.APIProviderAsDefault)
+	app.PUT("/api/message/:session_id/:uuid", c.editMessageAction, web.APIProviderAsDefault)
+	app.DELETE("/api/message/:session_id/:uuid", c.deleteMessageAction, web.APIProviderAsDefault)
+	app.GET("/api/history/:session_id/:user_id", c.getHistoryAction, web.APIProviderAsDefault)
+	app.POST("/api/read/:session_id", c.markReadAction, web.APIProviderAsDefault)
+	app.GET("/api/scheduled/:session_id", c.getScheduledMessagesAction, web.APIProviderAsDefault)
+	app.DELETE("/api/scheduled/:session_id/:uuid", c.cancelScheduledMessageAction, web.APIProviderAsDefault)
+
+	// push actions
+	app.GET("/api/ws/:session_id", c.websocketAction, web.APIProviderAsDefault)
+	app.GET("/api/events/:session_id", c.eventsAction, web.APIProviderAsDefault)
+}
+
+// registerSessionTokenRoutes registers the same routes under `/api/me`, for the session in the bearer token.
+func (c *Chat) registerSessionTokenRoutes(app *web.App) {
+	// session actions
+	app.POST("/api/me/token", c.refreshSessionTokenAction, web.APIProviderAsDefault)
+	app.DELETE("/api/me/session", c.deleteSessionAction, web.APIProviderAsDefault)
+
+	// contacts actions
+	app.GET("/api/me/contacts", c.getContactsAction, web.APIProviderAsDefault)
+	app.POST("/api/me/contact/:user_id", c.createContactAction, web.APIProviderAsDefault)
+	app.DELETE("/api/me/contact/:user_id", c.deleteContactAction, web.APIProviderAsDefault)
+
+	// room actions
+	app.GET("/api/me/rooms", c.getRoomsAction, web.APIProviderAsDefault)
+	app.POST("/api/me/room", c.createRoomAction, web.APIProviderAsDefault)
+	app.GET("/api/me/room/:room_id", c.getRoomAction, web.APIProviderAsDefault)
+	app.POST("/api/me/room.member/:room_id/:user_id", c.createRoomMemberAction, web.APIProviderAsDefault)
+	app.DELETE("/api/me/room.member/:room_id/:user_id", c.deleteRoomMemberAction, web.APIProviderAsDefault)
+	app.POST("/api/me/room.message/:room_id", c.sendRoomMessageAction, web.APIProviderAsDefault)
+
+	// typing actions
+	app.POST("/api/me/typing/:user_id", c.startTypingAction, web.APIProviderAsDefault)
+	app.DELETE("/api/me/typing/:user_id", c.stopTypingAction, web.APIProviderAsDefault)
+
+	// messages actions
+	app.GET("/api/me/messages", c.getMessagesAction, web.APIProviderAsDefault)
+	app.GET("/api/me/messages/:after", c.getMessagesAction, web.APIProviderAsDefault)
+	app.GET("/api/me/messages/:after/:nano", c.getMessagesAction, web.APIProviderAsDefault)
+	app.POST("/api/me/message", c.sendMessageAction, web.APIProviderAsDefault)
+	app.PUT("/api/me/message/:uuid", c.editMessageAction, web.APIProviderAsDefault)
+	app.DELETE("/api/me/message/:uuid", c.deleteMessageAction, web.APIProviderAsDefault)
+	app.GET("/api/me/history/:user_id", c.getHistoryAction, web.APIProviderAsDefault)
+	app.POST("/api/me/read", c.markReadAction, web.APIProviderAsDefault)
+	app.GET("/api/me/scheduled", c.getScheduledMessagesAction, web.APIProviderAsDefault)
+	app.DELETE("/api/me/scheduled/:uuid", c.cancelScheduledMessageAction, web.APIProviderAsDefault)
+
+	// push actions
+	app.GET("/api/me/ws", c.websocketAction, web.APIProviderAsDefault)
+	app.GET("/api/me/events", c.eventsAction, web.APIProviderAsDefault)
 }
 
-// Restore restores the chat controller from state in the db
+// Restore restores the chat controller from state in the store
 func (c *Chat) Restore(txs ...*sql.Tx) error {
-	var tx *sql.Tx
-	if len(txs) > 0 {
-		tx = txs[0]
-	}
-	var users []model.User
-	err := model.DB().GetAllInTransaction(&users, tx)
+	users, err := c.store().GetUsers(txs...)
 	if err != nil {
 		return err
 	}
@@ -81,8 +209,7 @@ func (c *Chat) Restore(txs ...*sql.Tx) error {
 		c.cacheUser(&user)
 	}
 
-	var sessions []model.Session
-	err = model.DB().GetAllInTransaction(&sessions, tx)
+	sessions, err := c.store().GetSessions(txs...)
 	if err != nil {
 		return err
 	}
@@ -96,8 +223,7 @@ func (c *Chat) Restore(txs ...*sql.Tx) error {
 		c.cacheSessionByUser(&session)
 	}
 
-	var contacts []model.Contacts
-	err = model.DB().GetAllInTransaction(&contacts, tx)
+	contacts, err := c.store().GetContacts(txs...)
 	if err != nil {
 		return err
 	}
@@ -106,17 +232,75 @@ func (c *Chat) Restore(txs ...*sql.Tx) error {
 		c.cacheContact(contact.Sender, contact.Receiver)
 	}
 
-	messages, err := model.GetAllMessagesWithLimit(MessageQueueMaxLength, tx)
+	rooms, err := c.store().GetRooms(txs...)
 	if err != nil {
 		return err
 	}
+	for x := 0; x < len(rooms); x++ {
+		room := rooms[x]
+		c.cacheRoom(&room)
+	}
+
+	roomMembers, err := c.store().GetRoomMembers(txs...)
+	if err != nil {
+		return err
+	}
+	for x := 0; x < len(roomMembers); x++ {
+		roomMember := roomMembers[x]
+		c.cacheRoomMember(roomMember.RoomID, roomMember.UserID)
+	}
+
+	// replay the messages that were acknowledged but never made it to the store.
+	if c.WAL != nil {
+		err = c.WAL.Flush(c.store(), txs...)
+		if err != nil {
+			return err
+		}
+	}
+
+	sequences, err := c.store().GetMessageSequences(txs...)
+	if err != nil {
+		return err
+	}
+	for userID, sequence := range sequences {
+		c.nextSequence(userID, sequence)
+	}
+
+	messages, err := c.store().GetAllMessagesWithLimit(MessageQueueMaxLength, txs...)
+	if err != nil {
+		return err
+	}
+
+	messageUUIDs := make([]string, len(messages))
+	for x := 0; x < len(messages); x++ {
+		messageUUIDs[x] = messages[x].UUID
+	}
+	receipts, err := c.store().GetMessageReceipts(messageUUIDs, txs...)
+	if err != nil {
+		return err
+	}
+	for x := 0; x < len(messages); x++ {
+		messages[x].Receipts = receipts[messages[x].UUID]
+	}
 
 	for x := 0; x < len(messages); x++ {
 		message := messages[x]
-		c.queueMessage(&message)
+		c.routeMessage(&message, false)
 	}
 
-	return nil
+	err = c.restoreInboxes(txs...)
+	if err != nil {
+		return err
+	}
+	return c.restoreScheduledMessages(txs...)
+}
+
+// store returns the store the controller persists to.
+func (c *Chat) store() store.Store {
+	if c.Store == nil {
+		return store.Default()
+	}
+	return c.Store
 }
 
 func (c *Chat) cacheUser(user *model.User) {
@@ -175,7 +359,10 @@ func (c *Chat) userHasSession(userID int) bool {
 	return false
 }
 
-func (c *Chat) addMessageQueue(session *model.Session) {
+// addMessageQueue makes sure there is a queue for a session's user, starting it from the user's inbox if they have one.
+// Queues are shared by all of a user's sessions; reads don't consume messages, so each session keeps its own cursor.
+// It returns if the queue was started from an inbox.
+func (c *Chat) addMessageQueue(session *model.Session) bool {
 	c.messageQueueLock.Lock()
 	defer c.messageQueueLock.Unlock()
 
@@ -183,13 +370,38 @@ func (c *Chat) addMessageQueue(session *model.Session) {
 		c.MessageQueues = map[int]*collections.RingBuffer{}
 	}
 
+	if _, hasQueue := c.MessageQueues[session.UserID]; hasQueue {
+		return false
+	}
+	if inbox := c.takeInbox(session.UserID); inbox != nil {
+		c.MessageQueues[session.UserID] = inbox
+		return true
+	}
 	c.MessageQueues[session.UserID] = collections.NewRingBufferWithCapacity(1024)
+	return false
+}
+
+// removeMessageQueue tears down a user's queue if the user has no sessions left.
+func (c *Chat) removeMessageQueue(userID int) {
+	c.messageQueueLock.Lock()
+	defer c.messageQueueLock.Unlock()
+
+	// check under the queue lock so we can't race a new session for the user.
+	if c.userHasSession(userID) {
+		return
+	}
+	delete(c.MessageQueues, userID)
 }
 
 func (c *Chat) setCachedSessionLastActive(sessionID string) {
 	c.sessionLock.Lock()
 	defer c.sessionLock.Unlock()
-	c.Sessions[sessionID].LastActiveUTC = time.Now().UTC()
+	if session, hasSession := c.Sessions[sessionID]; hasSession {
+		session.LastActiveUTC = time.Now().UTC()
+		if c.Cluster != nil {
+			c.recordSessionActivity(sessionID, session.LastActiveUTC)
+		}
+	}
 }
 
 func (c *Chat) getCachedUser(userID int) *model.User {
@@ -212,35 +424,157 @@ func (c *Chat) hasCachedUser(userID int) bool {
 	return false
 }
 
-func (c *Chat) queueMessage(message *model.Message) {
+// queueMessage routes a message to its recipients' queues; recipients without a session get it in their inbox.
+// In a cluster the message is published instead, and every node routes it when it comes back.
+func (c *Chat) queueMessage(message *model.Message) error {
+	if c.Cluster != nil {
+		return c.publishNewMessage(message, nil)
+	}
+	c.routeMessage(message, true)
+	return nil
+}
+
+// persistAndQueueMessage stamps a sent message with its recipients' sequences and persists it before routing (or publishing) it,
+// so a message that couldn't be persisted never reaches anyone.
+func (c *Chat) persistAndQueueMessage(message *model.Message) error {
+	return c.commitAndQueueMessage(message, c.persistMessage)
+}
+
+// commitAndQueueMessage stamps a message with its recipients' sequences and hands it to `commit`, only routing (or publishing) it if that succeeds.
+func (c *Chat) commitAndQueueMessage(message *model.Message, commit func(*model.Message) error) error {
+	if c.Cluster != nil {
+		return c.publishNewMessage(message, commit)
+	}
+
+	// the queues are held until the message is routed, so nothing can take a later sequence and be queued ahead of it.
+	c.messageQueueLock.Lock()
+	defer c.messageQueueLock.Unlock()
+
+	if message.RoomID != 0 {
+		message.RoomSequences = map[int]int64{}
+		for _, userID := range c.getCachedRoomMembers(message.RoomID) {
+			message.RoomSequences[userID] = c.nextSequence(userID, 0)
+		}
+	} else {
+		message.SenderSequence = c.nextSequence(message.SenderID, 0)
+		message.ReceiverSequence = c.nextSequence(message.ReceiverID, 0)
+	}
+	if err := commit(message); err != nil {
+		return err
+	}
+	c.routeLockedMessage(message, true)
+	return nil
+}
+
+// routeMessage routes a message to its recipients' queues; recipients without a session only get it in their inbox if `toInbox` is set.
+func (c *Chat) routeMessage(message *model.Message, toInbox bool) {
 	c.messageQueueLock.RLock()
 	defer c.messageQueueLock.RUnlock()
+	c.routeLockedMessage(message, toInbox)
+}
 
-	if c.MessageQueues == nil {
+// routeLockedMessage is routeMessage for callers that hold the message queue lock.
+func (c *Chat) routeLockedMessage(message *model.Message, toInbox bool) {
+	if message.RoomID != 0 {
+		if message.RoomSequences == nil {
+			message.RoomSequences = map[int]int64{}
+		}
+		for _, userID := range c.getCachedRoomMembers(message.RoomID) {
+			message.RoomSequences[userID] = c.enqueueMessage(userID, message.RoomSequences[userID], message, toInbox)
+		}
 		return
 	}
 
-	if queue, hasQueue := c.MessageQueues[message.SenderID]; hasQueue {
-		func() {
-			queue.SyncRoot().Lock()
-			defer queue.SyncRoot().Unlock()
-			if queue.Len() >= MessageQueueMaxLength {
-				queue.Dequeue()
-			}
-			queue.Enqueue(message)
-		}()
+	message.SenderSequence = c.enqueueMessage(message.SenderID, message.SenderSequence, message, toInbox)
+	message.ReceiverSequence = c.enqueueMessage(message.ReceiverID, message.ReceiverSequence, message, toInbox)
+}
+
+// enqueueMessage puts a copy of a message stamped with the user's next sequence number (or the existing one, if set) onto the user's queue,
+// or their inbox if they have no session and `toInbox` is set.
+// The sequence is allocated under the queue lock so a queue is always in sequence order. Callers must hold the message queue read lock.
+func (c *Chat) enqueueMessage(userID int, sequence int64, message *model.Message, toInbox bool) int64 {
+	queue, hasQueue := c.MessageQueues[userID]
+	isInbox := !hasQueue && toInbox && c.hasCachedUser(userID)
+	if isInbox {
+		queue = c.getInbox(userID)
+	}
+	if !hasQueue && !isInbox {
+		return c.nextSequence(userID, sequence)
 	}
 
-	if queue, hasQueue := c.MessageQueues[message.ReceiverID]; hasQueue {
-		func() {
-			queue.SyncRoot().Lock()
-			defer queue.SyncRoot().Unlock()
+	func() {
+		queue.SyncRoot().Lock()
+		defer queue.SyncRoot().Unlock()
 
-			if queue.Len() >= MessageQueueMaxLength {
-				queue.Dequeue()
-			}
-			queue.Enqueue(message)
-		}()
+		sequence = c.nextSequence(userID, sequence)
+		queued := *message
+		queued.Sequence = sequence
+		queued.RoomSequences = nil
+
+		if queue.Len() >= MessageQueueMaxLength {
+			queue.Dequeue()
+		}
+		queue.Enqueue(&queued)
+	}()
+	if isInbox {
+		// in a cluster the node that published the message records it in the inbox.
+		if len(message.Event) == 0 && c.Cluster == nil {
+			store.QueueCreateInboxMessage(c.store(), model.InboxMessage{UserID: userID, MessageUUID: message.UUID, Sequence: sequence, CreatedUTC: time.Now().UTC()})
+		}
+		return sequence
+	}
+	c.signalMessage(userID)
+	return sequence
+}
+
+// nextSequence returns the next sequence number for a user, or if one is given, advances the user's high-water mark to it.
+func (c *Chat) nextSequence(userID int, sequence int64) int64 {
+	c.sequenceLock.Lock()
+	defer c.sequenceLock.Unlock()
+
+	if c.Sequences == nil {
+		c.Sequences = map[int]int64{}
+	}
+	if sequence == 0 {
+		sequence = c.Sequences[userID] + 1
+	}
+	if sequence > c.Sequences[userID] {
+		c.Sequences[userID] = sequence
+	}
+	return sequence
+}
+
+// getSequence returns the last sequence number allocated for a user.
+func (c *Chat) getSequence(userID int) int64 {
+	c.sequenceLock.Lock()
+	defer c.sequenceLock.Unlock()
+	return c.Sequences[userID]
+}
+
+// getMessageSignal returns a channel that is closed the next time a message is queued for a user.
+func (c *Chat) getMessageSignal(userID int) <-chan struct{} {
+	c.messageSignalLock.Lock()
+	defer c.messageSignalLock.Unlock()
+
+	if c.MessageSignals == nil {
+		c.MessageSignals = map[int]chan struct{}{}
+	}
+	if signal, hasSignal := c.MessageSignals[userID]; hasSignal {
+		return signal
+	}
+	signal := make(chan struct{})
+	c.MessageSignals[userID] = signal
+	return signal
+}
+
+// signalMessage wakes up anything waiting on messages for a user.
+func (c *Chat) signalMessage(userID int) {
+	c.messageSignalLock.Lock()
+	defer c.messageSignalLock.Unlock()
+
+	if signal, hasSignal := c.MessageSignals[userID]; hasSignal {
+		close(signal)
+		delete(c.MessageSignals, userID)
 	}
 }
 
@@ -303,21 +637,33 @@ func (c *Chat) removeCachedContacts(sender, receiver int) {
 	}
 }
 
-func (c *Chat) getCachedMessagesAfter(userID int, cutoff time.Time) []model.Message {
+// reverseEachCachedMessageUntil walks a user's queue newest first, under the queue lock, until the handler returns false.
+func (c *Chat) reverseEachCachedMessageUntil(userID int, handler func(*model.Message) bool) {
 	c.messageQueueLock.RLock()
 	defer c.messageQueueLock.RUnlock()
 
-	messages := []model.Message{}
 	if queue, hasQueue := c.MessageQueues[userID]; hasQueue {
+		queue.SyncRoot().Lock()
+		defer queue.SyncRoot().Unlock()
 		queue.ReverseEachUntil(func(v interface{}) bool {
-			message := model.TryCastMessage(v)
-			if message.CreatedUTC.After(cutoff) {
-				messages = append(messages, *message)
-				return true
-			}
-			return false
+			return handler(model.TryCastMessage(v))
 		})
 	}
+}
+
+func (c *Chat) getCachedMessagesAfter(userID int, cutoff time.Time) []model.Message {
+	messages := []model.Message{}
+	c.reverseEachCachedMessageUntil(userID, func(message *model.Message) bool {
+		// change events keep the message's timestamp, so they're out of order here; timestamp polling doesn't see them.
+		if len(message.Event) > 0 {
+			return true
+		}
+		if message.CreatedUTC.After(cutoff) {
+			messages = append(messages, *message)
+			return true
+		}
+		return false
+	})
 
 	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
 		messages[i], messages[j] = messages[j], messages[i]
@@ -326,10 +672,87 @@ func (c *Chat) getCachedMessagesAfter(userID int, cutoff time.Time) []model.Mess
 	return messages
 }
 
+// getCachedMessagesAfterEventID returns the messages queued for a user after the one with a given event id (see `model.Message.EventID`).
+// If the id isn't in the queue (it's blank or has been evicted) every queued message is returned.
+func (c *Chat) getCachedMessagesAfterEventID(userID int, eventID string) []model.Message {
+	messages := []model.Message{}
+	c.reverseEachCachedMessageUntil(userID, func(message *model.Message) bool {
+		if message.EventID() != eventID {
+			messages = append(messages, *message)
+			return true
+		}
+		return false
+	})
+
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+
+	return messages
+}
+
+// getLastCachedEventID returns the event id of the newest message queued for a user.
+func (c *Chat) getLastCachedEventID(userID int) string {
+	var eventID string
+	c.reverseEachCachedMessageUntil(userID, func(message *model.Message) bool {
+		eventID = message.EventID()
+		return false
+	})
+	return eventID
+}
+
+// getCachedMessagesAfterSequence returns the messages queued for a user with a sequence number greater than a given one.
+func (c *Chat) getCachedMessagesAfterSequence(userID int, sequence int64) []model.Message {
+	messages := []model.Message{}
+	c.reverseEachCachedMessageUntil(userID, func(message *model.Message) bool {
+		if message.Sequence > sequence {
+			messages = append(messages, *message)
+			return true
+		}
+		return false
+	})
+
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+
+	return messages
+}
+
+// waitForCachedMessagesAfter blocks until there are messages after the cutoff for a user or the wait elapses.
+func (c *Chat) waitForCachedMessagesAfter(userID int, cutoff time.Time, wait time.Duration) []model.Message {
+	return c.waitForCachedMessages(userID, wait, func() []model.Message {
+		return c.getCachedMessagesAfter(userID, cutoff)
+	})
+}
+
+// waitForCachedMessages blocks until fetch returns messages for a user, the wait elapses or the controller starts draining.
+func (c *Chat) waitForCachedMessages(userID int, wait time.Duration, fetch func() []model.Message) []model.Message {
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+	drain := c.getDrainSignal()
+
+	for {
+		// grab the signal before checking the queue so we can't miss a message queued in between.
+		signal := c.getMessageSignal(userID)
+		messages := fetch()
+		if len(messages) > 0 {
+			return messages
+		}
+
+		select {
+		case <-signal:
+		case <-timeout.C:
+			return messages
+		case <-drain:
+			return messages
+		}
+	}
+}
+
 // GET /api/users
 func (c *Chat) getUsersAction(rc *web.RequestContext) web.ControllerResult {
-	users := []model.User{}
-	err := model.DB().GetAllInTransaction(&users, rc.Tx())
+	users, err := c.store().GetUsers(rc.Tx())
 	if err != nil {
 		return rc.API().InternalError(err)
 	}
@@ -344,7 +767,7 @@ func (c *Chat) newUserAction(rc *web.RequestContext) web.ControllerResult {
 		return rc.API().BadRequest(err.Error())
 	}
 
-	existingUser, err := model.GetUserByUUID(user.UUID)
+	existingUser, err := c.store().GetUserByUUID(user.UUID, rc.Tx())
 	if err != nil {
 		return rc.API().InternalError(err)
 	}
@@ -353,11 +776,12 @@ func (c *Chat) newUserAction(rc *web.RequestContext) web.ControllerResult {
 		return rc.API().JSON(existingUser)
 	}
 
-	err = model.DB().CreateInTransaction(&user, rc.Tx())
+	err = c.store().CreateUser(&user, rc.Tx())
 	if err != nil {
 		return rc.API().InternalError(err)
 	}
 	c.cacheUser(&user)
+	c.publish(clusterUser, user)
 	return rc.API().JSON(user)
 }
 
@@ -368,15 +792,14 @@ func (c *Chat) getUserAction(rc *web.RequestContext) web.ControllerResult {
 		return rc.API().BadRequest(err.Error())
 	}
 
-	var user model.User
-	err = model.DB().GetByIDInTransaction(&user, rc.Tx(), userID)
+	user, err := c.store().GetUser(userID, rc.Tx())
 	if err != nil {
 		return rc.API().InternalError(err)
 	}
 	if user.IsZero() {
 		return rc.API().NotFound()
 	}
-	c.cacheUser(&user)
+	c.cacheUser(user)
 	return rc.API().JSON(user)
 }
 
@@ -387,7 +810,7 @@ func (c *Chat) getUserByUUIDAction(rc *web.RequestContext) web.ControllerResult
 		return rc.API().BadRequest(err.Error())
 	}
 
-	user, err := model.GetUserByUUID(uuid, rc.Tx())
+	user, err := c.store().GetUserByUUID(uuid, rc.Tx())
 	if err != nil {
 		return rc.API().InternalError(err)
 	}
@@ -405,8 +828,7 @@ func (c *Chat) updateUserAction(rc *web.RequestContext) web.ControllerResult {
 		return rc.API().BadRequest(err.Error())
 	}
 
-	var user model.User
-	err = model.DB().GetByIDInTransaction(&user, rc.Tx(), userID)
+	user, err := c.store().GetUser(userID, rc.Tx())
 	if err != nil {
 		return rc.API().InternalError(err)
 	}
@@ -421,7 +843,7 @@ func (c *Chat) updateUserAction(rc *web.RequestContext) web.ControllerResult {
 	}
 	postedUser.ID = user.ID
 	postedUser.UUID = user.UUID
-	err = model.DB().UpdateInTransaction(&postedUser, rc.Tx())
+	err = c.store().UpdateUser(&postedUser, rc.Tx())
 	if err != nil {
 		return rc.API().InternalError(err)
 	}
@@ -435,19 +857,19 @@ func (c *Chat) deleteUserAction(rc *web.RequestContext) web.ControllerResult {
 		return rc.API().BadRequest(err.Error())
 	}
 
-	var user model.User
-	err = model.DB().GetByIDInTransaction(&user, rc.Tx(), userID)
+	user, err := c.store().GetUser(userID, rc.Tx())
 	if err != nil {
 		return rc.API().InternalError(err)
 	}
 	if user.IsZero() {
 		return rc.API().NotFound()
 	}
-	err = model.DB().DeleteInTransaction(&user, rc.Tx())
+	err = c.store().DeleteUser(user, rc.Tx())
 	if err != nil {
 		return rc.API().InternalError(err)
 	}
 	c.removeCachedUser(user.ID)
+	c.publish(clusterUserDeleted, user.ID)
 	return rc.API().OK()
 }
 
@@ -465,54 +887,64 @@ func (c *Chat) getSessionsAction(rc *web.RequestContext) web.ControllerResult {
 
 // POST /api/session
 func (c *Chat) newSessionAction(rc *web.RequestContext) web.ControllerResult {
-	userID, err := rc.RouteParameter("user_id")
+	userID, err := rc.RouteParameterInt("user_id")
 	if err != nil {
 		return rc.API().BadRequest(err.Error())
 	}
-	var user model.User
-	err = model.DB().GetByIDInTransaction(&user, rc.Tx(), userID)
+
+	// with an identity verifier the caller has to prove who they are, and can only start a session for themselves.
+	var subject string
+	if c.Identity != nil {
+		subject, err = c.Identity.Verify(getBearerToken(rc), time.Now())
+		if err != nil {
+			return rc.API().NotAuthorized()
+		}
+	}
+
+	user, err := c.store().GetUser(userID, rc.Tx())
 	if err != nil {
 		return rc.API().InternalError(err)
 	}
 	if user.IsZero() {
 		return rc.API().NotFound()
 	}
+	if c.Identity != nil && user.UUID != subject {
+		return rc.API().NotAuthorized()
+	}
 
 	newSession := &model.Session{
 		UUID:          util.UUIDv4().ToShortString(),
 		CreatedUTC:    time.Now().UTC(),
 		LastActiveUTC: time.Now().UTC(),
 		UserID:        user.ID,
-		User:          &user,
+		User:          user,
 	}
 
-	err = model.DB().CreateInTransaction(newSession, rc.Tx())
+	err = c.store().CreateSession(newSession, rc.Tx())
 	if err != nil {
 		return rc.API().InternalError(err)
 	}
 
-	c.cacheUser(&user)
+	c.cacheUser(user)
 	c.cacheSession(newSession)
 	c.cacheSessionByUser(newSession)
-	c.addMessageQueue(newSession)
-	return rc.API().JSON(newSession)
+	if c.addMessageQueue(newSession) {
+		err = c.store().DeleteInboxMessages(user.ID, rc.Tx())
+		if err != nil {
+			return rc.API().InternalError(err)
+		}
+	}
+	c.publish(clusterSession, newSession)
+	return rc.API().JSON(c.newSessionViewModel(newSession))
 }
 
-// DELETE /api/session/:id
+// DELETE /api/session/:session_id
 func (c *Chat) deleteSessionAction(rc *web.RequestContext) web.ControllerResult {
-	sessionID, err := rc.RouteParameter("id")
-	if err != nil {
-		return rc.API().BadRequest(err.Error())
-	}
-	var session model.Session
-	err = model.DB().GetByIDInTransaction(&session, rc.Tx(), sessionID)
-	if err != nil {
-		return rc.API().InternalError(err)
-	}
-	if session.IsZero() {
-		return rc.API().NotFound()
+	session, result := c.getRequestSession(rc)
+	if result != nil {
+		return result
 	}
-	err = c.deleteSession(&session)
+	err := c.deleteSession(session, rc.Tx())
 	if err != nil {
 		return rc.API().InternalError(err)
 	}
@@ -520,48 +952,44 @@ func (c *Chat) deleteSessionAction(rc *web.RequestContext) web.ControllerResult
 }
 
 func (c *Chat) deleteSession(session *model.Session, txs ...*sql.Tx) error {
-	var tx *sql.Tx
-	if len(txs) > 0 {
-		tx = txs[0]
-	}
-	err := model.DB().DeleteInTransaction(session, tx)
+	err := c.store().DeleteSession(session, txs...)
 	if err != nil {
 		return err
 	}
 	c.removeCachedSession(session.UUID)
 	c.removeCachedSessionByUser(session)
+	c.removeMessageQueue(session.UserID)
+	c.publish(clusterSessionDeleted, session)
 	return nil
 }
 
 // GET /api/contacts/:session_id
 func (c *Chat) getContactsAction(rc *web.RequestContext) web.ControllerResult {
-	sessionID, err := rc.RouteParameter("session_id")
-	if err != nil {
-		return rc.API().BadRequest(err.Error())
-	}
-	session, hasSession := c.getCachedSession(sessionID)
-	if !hasSession {
-		return rc.API().NotFound()
+	session, result := c.getRequestSession(rc)
+	if result != nil {
+		return result
 	}
 	contactIDs := c.getCachedContacts(session.UserID)
 
 	output := []viewmodel.Contact{}
 	for _, id := range contactIDs {
 		isOnline := c.userHasSession(id)
+		isTyping := c.isCachedTyping(id, session.UserID)
 		if user, hasUser := c.Users[id]; hasUser {
 			output = append(output, viewmodel.Contact{
 				User:     user,
 				IsOnline: isOnline,
+				IsTyping: isTyping,
 			})
 		} else {
-			var user model.User
-			err = model.DB().GetByIDInTransaction(&user, rc.Tx(), id)
+			user, err := c.store().GetUser(id, rc.Tx())
 			if err != nil {
 				return rc.API().InternalError(err)
 			}
 			output = append(output, viewmodel.Contact{
-				User:     &user,
+				User:     user,
 				IsOnline: isOnline,
+				IsTyping: isTyping,
 			})
 		}
 	}
@@ -570,13 +998,12 @@ func (c *Chat) getContactsAction(rc *web.RequestContext) web.ControllerResult {
 
 // POST /api/contacts/:session_id/:user_id
 func (c *Chat) createContactAction(rc *web.RequestContext) web.ControllerResult {
-	sessionID, err := rc.RouteParameter("session_id")
-	if err != nil {
-		return rc.API().BadRequest(err.Error())
+	session, result := c.getRequestSession(rc)
+	if result != nil {
+		return result
 	}
-	session, hasSession := c.getCachedSession(sessionID)
-	if !hasSession {
-		return rc.API().NotFound()
+	if result = c.checkRateLimit(rc, RateLimitContacts, session); result != nil {
+		return result
 	}
 
 	userID, err := rc.RouteParameterInt("user_id")
@@ -584,8 +1011,7 @@ func (c *Chat) createContactAction(rc *web.RequestContext) web.ControllerResult
 		return rc.API().BadRequest(err.Error())
 	}
 
-	var user model.User
-	err = model.DB().GetByIDInTransaction(&user, rc.Tx(), userID)
+	user, err := c.store().GetUser(userID, rc.Tx())
 	if err != nil {
 		return rc.API().InternalError(err)
 	}
@@ -593,37 +1019,25 @@ func (c *Chat) createContactAction(rc *web.RequestContext) web.ControllerResult
 		return rc.API().NotFound()
 	}
 
-	c1 := model.Contacts{Sender: session.UserID, Receiver: user.ID}
-	c2 := model.Contacts{Sender: user.ID, Receiver: session.UserID}
-
-	if exists, _ := model.DB().ExistsInTransaction(c1, rc.Tx()); !exists {
-		err = model.DB().CreateInTransaction(c1, rc.Tx())
-		if err != nil {
-			return rc.API().InternalError(err)
-		}
-	}
-
-	if exists, _ := model.DB().ExistsInTransaction(c2, rc.Tx()); !exists {
-		err = model.DB().CreateInTransaction(c2, rc.Tx())
-		if err != nil {
-			return rc.API().InternalError(err)
-		}
+	err = c.store().CreateContacts(session.UserID, user.ID, rc.Tx())
+	if err != nil {
+		return rc.API().InternalError(err)
 	}
 
 	c.cacheContact(session.UserID, userID)
 	c.cacheContact(userID, session.UserID)
+	c.publish(clusterContact, model.Contacts{Sender: session.UserID, Receiver: userID})
 	return rc.API().OK()
 }
 
 // DELETE /api/contacts/:session_id/:user_id
 func (c *Chat) deleteContactAction(rc *web.RequestContext) web.ControllerResult {
-	sessionID, err := rc.RouteParameter("session_id")
-	if err != nil {
-		return rc.API().BadRequest(err.Error())
+	session, result := c.getRequestSession(rc)
+	if result != nil {
+		return result
 	}
-	session, hasSession := c.getCachedSession(sessionID)
-	if !hasSession {
-		return rc.API().NotFound()
+	if result = c.checkRateLimit(rc, RateLimitContacts, session); result != nil {
+		return result
 	}
 
 	userID, err := rc.RouteParameterInt("user_id")
@@ -631,32 +1045,57 @@ func (c *Chat) deleteContactAction(rc *web.RequestContext) web.ControllerResult
 		return rc.API().BadRequest(err.Error())
 	}
 
-	var user model.User
-	err = model.DB().GetByIDInTransaction(&user, rc.Tx(), userID)
+	user, err := c.store().GetUser(userID, rc.Tx())
 	if err != nil {
 		return rc.API().InternalError(err)
 	}
 	if user.IsZero() {
 		return rc.API().NotFound()
 	}
-	err = model.DeleteContacts(session.UserID, userID)
+	err = c.store().DeleteContacts(session.UserID, userID, rc.Tx())
 	if err != nil {
 		return rc.API().InternalError(err)
 	}
 
 	c.removeCachedContacts(session.UserID, userID)
+	c.publish(clusterContactDeleted, model.Contacts{Sender: session.UserID, Receiver: userID})
 	return rc.API().OK()
 }
 
-// GET /api/messages/:id/:after
+// GET /api/messages/:id/:after?wait=30s
+// GET /api/messages/:id?after_seq=N&wait=30s
 func (c *Chat) getMessagesAction(rc *web.RequestContext) web.ControllerResult {
-	sessionID, err := rc.RouteParameter("session_id")
-	if err != nil {
-		return rc.API().BadRequest(err.Error())
+	session, result := c.getRequestSession(rc)
+	if result != nil {
+		return result
 	}
-	session, hasSession := c.getCachedSession(sessionID)
-	if !hasSession {
-		return rc.API().NotFound()
+	if result = c.checkRateLimit(rc, RateLimitPolls, session); result != nil {
+		return result
+	}
+
+	var wait time.Duration
+	var err error
+	waitStr := rc.Request.URL.Query().Get("wait")
+	if len(waitStr) > 0 {
+		wait, err = time.ParseDuration(waitStr)
+		if err != nil {
+			return rc.API().BadRequest(err.Error())
+		}
+		if wait > MessageWaitMaxDuration {
+			wait = MessageWaitMaxDuration
+		}
+	}
+
+	afterSeqStr := rc.Request.URL.Query().Get("after_seq")
+	if len(afterSeqStr) > 0 {
+		afterSeq, err := strconv.ParseInt(afterSeqStr, 10, 64)
+		if err != nil {
+			return rc.API().BadRequest(err.Error())
+		}
+		c.setCachedSessionLastActive(session.UUID)
+		result := c.getMessagesAfterSequence(session.UserID, afterSeq, wait)
+		c.markDelivered(session.UserID, result.Messages)
+		return rc.API().JSON(result)
 	}
 
 	var after int64
@@ -679,38 +1118,126 @@ func (c *Chat) getMessagesAction(rc *web.RequestContext) web.ControllerResult {
 
 	c.setCachedSessionLastActive(session.UUID)
 	cutoff := time.Unix(after, afterNano).UTC()
-	messages := c.getCachedMessagesAfter(session.UserID, cutoff)
+	var messages []model.Message
+	if wait > 0 {
+		messages = c.waitForCachedMessagesAfter(session.UserID, cutoff, wait)
+	} else {
+		messages = c.getCachedMessagesAfter(session.UserID, cutoff)
+	}
+	c.markDelivered(session.UserID, messages)
 	return rc.API().JSON(messages)
 }
 
+// getMessagesAfterSequence returns the messages for a user after a sequence number along with the new high-water mark.
+func (c *Chat) getMessagesAfterSequence(userID int, afterSeq int64, wait time.Duration) viewmodel.MessagesAfterSequence {
+	// read the high-water mark before the queue so it can't get ahead of what we return.
+	highWater := c.getSequence(userID)
+	fetch := func() []model.Message {
+		return c.getCachedMessagesAfterSequence(userID, afterSeq)
+	}
+
+	var messages []model.Message
+	if wait > 0 {
+		messages = c.waitForCachedMessages(userID, wait, fetch)
+	} else {
+		messages = fetch()
+	}
+
+	if len(messages) > 0 {
+		highWater = messages[len(messages)-1].Sequence
+	} else if afterSeq < highWater {
+		highWater = afterSeq
+	}
+	return viewmodel.MessagesAfterSequence{Messages: messages, Sequence: highWater, Typing: c.getCachedTypingTo(userID)}
+}
+
 // POST /api/send/:id
 func (c *Chat) sendMessageAction(rc *web.RequestContext) web.ControllerResult {
-	sessionID, err := rc.RouteParameter("session_id")
-	if err != nil {
-		return rc.API().BadRequest(err.Error())
+	session, result := c.getRequestSession(rc)
+	if result != nil {
+		return result
 	}
-	session, hasSession := c.getCachedSession(sessionID)
-	if !hasSession {
-		return rc.API().NotFound()
+	if result = c.checkRateLimit(rc, RateLimitSends, session); result != nil {
+		return result
 	}
 
 	var message model.Message
-	err = rc.PostBodyAsJSON(&message)
+	err := rc.PostBodyAsJSON(&message)
 	if err != nil {
 		return rc.API().BadRequest(err.Error())
 	}
 
+	if isScheduled(&message, time.Now().UTC()) {
+		scheduled, err := c.scheduleMessage(session, &message, rc.Tx())
+		if err == ErrRecipientNotFound || err == ErrInvalidTTL || err == wal.ErrEntryTooLarge {
+			return rc.API().BadRequest(err.Error())
+		}
+		if err != nil {
+			return rc.API().InternalError(err)
+		}
+		return rc.API().JSON(scheduled)
+	}
+
+	err = c.sendMessage(session, &message)
+	if err == ErrRecipientNotFound || err == ErrInvalidTTL || err == wal.ErrEntryTooLarge {
+		return rc.API().BadRequest(err.Error())
+	}
+	if err != nil {
+		return rc.API().InternalError(err)
+	}
+	return rc.API().JSON(message)
+}
+
+// sendMessage stamps a message from a session, routes it to the cached queues and persists it.
+func (c *Chat) sendMessage(session *model.Session, message *model.Message) error {
 	if !c.hasCachedUser(message.ReceiverID) {
-		return rc.API().BadRequest("Recipient not found!")
+		return ErrRecipientNotFound
 	}
 
 	message.CreatedUTC = time.Now().UTC()
 	message.SenderID = session.UserID
 	message.UUID = util.UUIDv4().ToShortString()
+	message.DeliverAt = nil
+	if err := setMessageExpiry(message); err != nil {
+		return err
+	}
+	if err := c.checkMessageLog(message); err != nil {
+		return err
+	}
 
-	c.queueMessage(&message)
+	c.removeCachedTyping(session.UserID, message.ReceiverID)
+	if err := c.persistAndQueueMessage(message); err != nil {
+		return err
+	}
 	c.setCachedSessionLastActive(session.UUID)
+	return nil
+}
 
-	message.QueueCreate()
-	return rc.API().JSON(message)
+// checkMessageLog returns wal.ErrEntryTooLarge for a message too big for the write-ahead log, before it's queued anywhere.
+func (c *Chat) checkMessageLog(message *model.Message) error {
+	if c.WAL == nil {
+		return nil
+	}
+	return wal.Check(*message)
+}
+
+// persistMessage syncs a sent message to the write-ahead log, or hands it to the batcher or work queue if there isn't one.
+// The message needs its sequences, so it is persisted once they are allocated but before anyone can see it.
+func (c *Chat) persistMessage(message *model.Message) error {
+	if c.WAL != nil {
+		return c.WAL.Append(*message)
+	}
+	if c.Batcher != nil {
+		return c.Batcher.Add(*message)
+	}
+	store.QueueCreateMessage(c.store(), *message)
+	return nil
+}
+
+// flushMessageLog writes the messages in the write-ahead log to the store.
+func (c *Chat) flushMessageLog() error {
+	if c.WAL == nil {
+		return nil
+	}
+	return c.WAL.Flush(c.store())
 }
@@ -1,11 +1,16 @@
 package controller
 
 import (
+	"fmt"
+	"io/ioutil"
 	"net/http"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/blendlabs/chatbus/server/model"
+	"github.com/blendlabs/chatbus/server/wal"
 	assert "github.com/blendlabs/go-assert"
 	util "github.com/blendlabs/go-util"
 	web "github.com/wcharczuk/go-web"
@@ -48,16 +53,17 @@ func TestChatRegister(t *testing.T) {
 
 func TestChatRestore(t *testing.T) {
 	assert := assert.New(t)
-	tx, err := model.DB().Begin()
+	ts, err := newTestStore()
 	assert.Nil(err)
-	defer tx.Rollback()
+	defer ts.Close()
+	tx := ts.Tx
 
 	u1 := &model.User{UUID: util.UUIDv4().ToShortString(), DisplayName: "Test User"}
 	u2 := &model.User{UUID: util.UUIDv4().ToShortString(), DisplayName: "Test User2"}
 	u3 := &model.User{UUID: util.UUIDv4().ToShortString(), DisplayName: "Test User3"}
-	assert.Nil(model.DB().CreateInTransaction(u1, tx))
-	assert.Nil(model.DB().CreateInTransaction(u2, tx))
-	assert.Nil(model.DB().CreateInTransaction(u3, tx))
+	assert.Nil(ts.CreateUser(u1, tx))
+	assert.Nil(ts.CreateUser(u2, tx))
+	assert.Nil(ts.CreateUser(u3, tx))
 
 	s1 := &model.Session{
 		UUID:          util.UUIDv4().ToShortString(),
@@ -80,31 +86,25 @@ func TestChatRestore(t *testing.T) {
 		UserID:        u3.ID,
 		User:          u3,
 	}
-	assert.Nil(model.DB().CreateInTransaction(s1, tx))
-	assert.Nil(model.DB().CreateInTransaction(s2, tx))
-	assert.Nil(model.DB().CreateInTransaction(s3, tx))
-
-	c1 := &model.Contacts{Sender: u1.ID, Receiver: u2.ID}
-	c2 := &model.Contacts{Sender: u2.ID, Receiver: u1.ID}
-	c3 := &model.Contacts{Sender: u1.ID, Receiver: u3.ID}
-	c4 := &model.Contacts{Sender: u3.ID, Receiver: u1.ID}
-	assert.Nil(model.DB().CreateInTransaction(c1, tx))
-	assert.Nil(model.DB().CreateInTransaction(c2, tx))
-	assert.Nil(model.DB().CreateInTransaction(c3, tx))
-	assert.Nil(model.DB().CreateInTransaction(c4, tx))
-
-	assert.Nil(model.DB().CreateInTransaction(&model.Message{UUID: util.UUIDv4().ToShortString(), CreatedUTC: time.Now().UTC(), SenderID: u1.ID, ReceiverID: u2.ID, Body: "Test"}, tx))
-	assert.Nil(model.DB().CreateInTransaction(&model.Message{UUID: util.UUIDv4().ToShortString(), CreatedUTC: time.Now().UTC(), SenderID: u1.ID, ReceiverID: u2.ID, Body: "Test"}, tx))
-	assert.Nil(model.DB().CreateInTransaction(&model.Message{UUID: util.UUIDv4().ToShortString(), CreatedUTC: time.Now().UTC(), SenderID: u1.ID, ReceiverID: u2.ID, Body: "Test"}, tx))
-	assert.Nil(model.DB().CreateInTransaction(&model.Message{UUID: util.UUIDv4().ToShortString(), CreatedUTC: time.Now().UTC(), SenderID: u1.ID, ReceiverID: u2.ID, Body: "Test"}, tx))
-	assert.Nil(model.DB().CreateInTransaction(&model.Message{UUID: util.UUIDv4().ToShortString(), CreatedUTC: time.Now().UTC(), SenderID: u1.ID, ReceiverID: u2.ID, Body: "Test"}, tx))
-	assert.Nil(model.DB().CreateInTransaction(&model.Message{UUID: util.UUIDv4().ToShortString(), CreatedUTC: time.Now().UTC(), SenderID: u1.ID, ReceiverID: u2.ID, Body: "Test"}, tx))
-	assert.Nil(model.DB().CreateInTransaction(&model.Message{UUID: util.UUIDv4().ToShortString(), CreatedUTC: time.Now().UTC(), SenderID: u1.ID, ReceiverID: u2.ID, Body: "Test"}, tx))
-	assert.Nil(model.DB().CreateInTransaction(&model.Message{UUID: util.UUIDv4().ToShortString(), CreatedUTC: time.Now().UTC(), SenderID: u1.ID, ReceiverID: u3.ID, Body: "Test"}, tx))
-	assert.Nil(model.DB().CreateInTransaction(&model.Message{UUID: util.UUIDv4().ToShortString(), CreatedUTC: time.Now().UTC(), SenderID: u1.ID, ReceiverID: u3.ID, Body: "Test"}, tx))
-	assert.Nil(model.DB().CreateInTransaction(&model.Message{UUID: util.UUIDv4().ToShortString(), CreatedUTC: time.Now().UTC(), SenderID: u1.ID, ReceiverID: u3.ID, Body: "Test"}, tx))
-
-	chat := new(Chat)
+	assert.Nil(ts.CreateSession(s1, tx))
+	assert.Nil(ts.CreateSession(s2, tx))
+	assert.Nil(ts.CreateSession(s3, tx))
+
+	assert.Nil(ts.CreateContacts(u1.ID, u2.ID, tx))
+	assert.Nil(ts.CreateContacts(u1.ID, u3.ID, tx))
+
+	assert.Nil(ts.CreateMessage(model.Message{UUID: util.UUIDv4().ToShortString(), CreatedUTC: time.Now().UTC(), SenderID: u1.ID, ReceiverID: u2.ID, Body: "Test"}, tx))
+	assert.Nil(ts.CreateMessage(model.Message{UUID: util.UUIDv4().ToShortString(), CreatedUTC: time.Now().UTC(), SenderID: u1.ID, ReceiverID: u2.ID, Body: "Test"}, tx))
+	assert.Nil(ts.CreateMessage(model.Message{UUID: util.UUIDv4().ToShortString(), CreatedUTC: time.Now().UTC(), SenderID: u1.ID, ReceiverID: u2.ID, Body: "Test"}, tx))
+	assert.Nil(ts.CreateMessage(model.Message{UUID: util.UUIDv4().ToShortString(), CreatedUTC: time.Now().UTC(), SenderID: u1.ID, ReceiverID: u2.ID, Body: "Test"}, tx))
+	assert.Nil(ts.CreateMessage(model.Message{UUID: util.UUIDv4().ToShortString(), CreatedUTC: time.Now().UTC(), SenderID: u1.ID, ReceiverID: u2.ID, Body: "Test"}, tx))
+	assert.Nil(ts.CreateMessage(model.Message{UUID: util.UUIDv4().ToShortString(), CreatedUTC: time.Now().UTC(), SenderID: u1.ID, ReceiverID: u2.ID, Body: "Test"}, tx))
+	assert.Nil(ts.CreateMessage(model.Message{UUID: util.UUIDv4().ToShortString(), CreatedUTC: time.Now().UTC(), SenderID: u1.ID, ReceiverID: u2.ID, Body: "Test"}, tx))
+	assert.Nil(ts.CreateMessage(model.Message{UUID: util.UUIDv4().ToShortString(), CreatedUTC: time.Now().UTC(), SenderID: u1.ID, ReceiverID: u3.ID, Body: "Test"}, tx))
+	assert.Nil(ts.CreateMessage(model.Message{UUID: util.UUIDv4().ToShortString(), CreatedUTC: time.Now().UTC(), SenderID: u1.ID, ReceiverID: u3.ID, Body: "Test"}, tx))
+	assert.Nil(ts.CreateMessage(model.Message{UUID: util.UUIDv4().ToShortString(), CreatedUTC: time.Now().UTC(), SenderID: u1.ID, ReceiverID: u3.ID, Body: "Test"}, tx))
+
+	chat := &Chat{Store: ts}
 	assert.Nil(chat.Restore(tx))
 	assert.NotEmpty(chat.Users)
 	assert.NotEmpty(chat.Sessions)
@@ -113,6 +113,57 @@ func TestChatRestore(t *testing.T) {
 	assert.NotEmpty(chat.MessageQueues)
 }
 
+func TestChatRestoreReplaysMessageLog(t *testing.T) {
+	assert := assert.New(t)
+	ts, err := newTestStore()
+	assert.Nil(err)
+	defer ts.Close()
+	tx := ts.Tx
+
+	dir, err := ioutil.TempDir("", "chatbus_controller_wal")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	messageLog, err := wal.Open(filepath.Join(dir, "chatbus.wal"))
+	assert.Nil(err)
+	defer messageLog.Close()
+
+	u1 := &model.User{UUID: util.UUIDv4().ToShortString(), DisplayName: "Test User"}
+	u2 := &model.User{UUID: util.UUIDv4().ToShortString(), DisplayName: "Test User2"}
+	assert.Nil(ts.CreateUser(u1, tx))
+	assert.Nil(ts.CreateUser(u2, tx))
+	assert.Nil(ts.CreateSession(&model.Session{UUID: util.UUIDv4().ToShortString(), CreatedUTC: time.Now().UTC(), LastActiveUTC: time.Now().UTC(), UserID: u2.ID}, tx))
+
+	// a message that was acknowledged but never flushed before the process died.
+	message := model.Message{UUID: util.UUIDv4().ToShortString(), CreatedUTC: time.Now().UTC(), SenderID: u1.ID, ReceiverID: u2.ID, Body: "Test", SenderSequence: 1, ReceiverSequence: 1}
+	assert.Nil(messageLog.Append(message))
+
+	chat := &Chat{Store: ts, WAL: messageLog}
+	assert.Nil(chat.Restore(tx))
+	assert.Empty(messageLog.Pending())
+
+	verify, err := ts.GetMessage(message.UUID, tx)
+	assert.Nil(err)
+	assert.Equal(message.UUID, verify.UUID)
+
+	messages := chat.getCachedMessagesAfterSequence(u2.ID, 0)
+	assert.Len(messages, 1)
+	assert.Equal(message.UUID, messages[0].UUID)
+
+	// sent messages are logged with their sequences until they're flushed.
+	sent := &model.Message{ReceiverID: u2.ID, Body: "Test2"}
+	assert.Nil(chat.sendMessage(&model.Session{UUID: "test_session", UserID: u1.ID}, sent))
+	pending := messageLog.Pending()
+	assert.Len(pending, 1)
+	assert.Equal(sent.UUID, pending[0].UUID)
+	assert.Equal(int64(2), pending[0].ReceiverSequence)
+	assert.Len(chat.getCachedMessagesAfterSequence(u2.ID, 0), 2)
+
+	// a message that can't be logged isn't routed to anyone.
+	assert.Nil(messageLog.Close())
+	assert.NotNil(chat.sendMessage(&model.Session{UUID: "test_session", UserID: u1.ID}, &model.Message{ReceiverID: u2.ID, Body: "Test3"}))
+	assert.Len(chat.getCachedMessagesAfterSequence(u2.ID, 0), 2)
+}
+
 func TestChatCacheUser(t *testing.T) {
 	assert := assert.New(t)
 
@@ -178,6 +229,49 @@ func TestChatAddMessageQueue(t *testing.T) {
 	assert.Nil(chat.MessageQueues[2])
 }
 
+func TestChatAddMessageQueueSharedBySessions(t *testing.T) {
+	assert := assert.New(t)
+	chat := new(Chat)
+
+	phone := &model.Session{
+		UUID:       "test_session_phone",
+		CreatedUTC: time.Now().UTC(),
+		UserID:     1,
+		User:       &model.User{ID: 1, UUID: "test_user"},
+	}
+	chat.cacheSession(phone)
+	chat.cacheSessionByUser(phone)
+	chat.addMessageQueue(phone)
+
+	chat.queueMessage(&model.Message{UUID: "m1", SenderID: 2, ReceiverID: 1})
+
+	laptop := &model.Session{
+		UUID:       "test_session_laptop",
+		CreatedUTC: time.Now().UTC(),
+		UserID:     1,
+		User:       &model.User{ID: 1, UUID: "test_user"},
+	}
+	chat.cacheSession(laptop)
+	chat.cacheSessionByUser(laptop)
+	chat.addMessageQueue(laptop)
+
+	chat.queueMessage(&model.Message{UUID: "m2", SenderID: 2, ReceiverID: 1})
+
+	// both devices read the whole stream.
+	assert.Len(chat.getCachedMessagesAfterSequence(1, 0), 2)
+	assert.Len(chat.getCachedMessagesAfterSequence(1, 0), 2)
+
+	chat.removeCachedSession(phone.UUID)
+	chat.removeCachedSessionByUser(phone)
+	chat.removeMessageQueue(1)
+	assert.NotNil(chat.MessageQueues[1])
+
+	chat.removeCachedSession(laptop.UUID)
+	chat.removeCachedSessionByUser(laptop)
+	chat.removeMessageQueue(1)
+	assert.Nil(chat.MessageQueues[1])
+}
+
 func TestChatSetCachedSessionLastActive(t *testing.T) {
 	assert := assert.New(t)
 	chat := new(Chat)
@@ -367,15 +461,184 @@ func TestChatGetCachedMessagesAfter(t *testing.T) {
 	assert.Len(messages, 0)
 }
 
+func TestChatGetCachedMessagesAfterEventID(t *testing.T) {
+	assert := assert.New(t)
+
+	session1 := &model.Session{
+		UUID:       "test_session",
+		CreatedUTC: time.Now().UTC(),
+		UserID:     1,
+		User:       &model.User{ID: 1, UUID: "test_user1"},
+	}
+
+	chat := new(Chat)
+	chat.cacheSession(session1)
+	chat.addMessageQueue(session1)
+	assert.Empty(chat.getLastCachedEventID(1))
+
+	chat.queueMessage(&model.Message{UUID: "m1", SenderID: 1, ReceiverID: 2})
+	chat.queueMessage(&model.Message{UUID: "m2", SenderID: 1, ReceiverID: 2})
+	chat.queueMessage(&model.Message{UUID: "m3", SenderID: 1, ReceiverID: 2})
+	assert.Equal("m3", chat.getLastCachedEventID(1))
+
+	messages := chat.getCachedMessagesAfterEventID(1, "m1")
+	assert.Len(messages, 2)
+	assert.Equal("m2", messages[0].UUID)
+	assert.Equal("m3", messages[1].UUID)
+
+	messages = chat.getCachedMessagesAfterEventID(1, "m3")
+	assert.Len(messages, 0)
+
+	messages = chat.getCachedMessagesAfterEventID(1, "not_a_message")
+	assert.Len(messages, 3)
+}
+
+func TestChatGetCachedMessagesAfterSequence(t *testing.T) {
+	assert := assert.New(t)
+
+	session1 := &model.Session{
+		UUID:       "test_session",
+		CreatedUTC: time.Now().UTC(),
+		UserID:     1,
+		User:       &model.User{ID: 1, UUID: "test_user1"},
+	}
+	session2 := &model.Session{
+		UUID:       "test_session2",
+		CreatedUTC: time.Now().UTC(),
+		UserID:     2,
+		User:       &model.User{ID: 2, UUID: "test_user2"},
+	}
+
+	chat := new(Chat)
+	chat.cacheSession(session1)
+	chat.addMessageQueue(session1)
+	chat.cacheSession(session2)
+	chat.addMessageQueue(session2)
+
+	// messages sharing a timestamp still get distinct sequence numbers.
+	now := time.Now().UTC()
+	chat.queueMessage(&model.Message{UUID: "m1", CreatedUTC: now, SenderID: 1, ReceiverID: 2})
+	chat.queueMessage(&model.Message{UUID: "m2", CreatedUTC: now, SenderID: 1, ReceiverID: 2})
+	chat.queueMessage(&model.Message{UUID: "m3", CreatedUTC: now, SenderID: 2, ReceiverID: 3})
+	chat.queueMessage(&model.Message{UUID: "m4", CreatedUTC: now, SenderID: 1, ReceiverID: 2, SenderSequence: 10, ReceiverSequence: 20})
+
+	assert.Equal(int64(10), chat.getSequence(1))
+	assert.Equal(int64(20), chat.getSequence(2))
+	assert.Equal(int64(1), chat.getSequence(3))
+
+	messages := chat.getCachedMessagesAfterSequence(2, 1)
+	assert.Len(messages, 3)
+	assert.Equal("m2", messages[0].UUID)
+	assert.Equal(int64(2), messages[0].Sequence)
+	assert.Equal("m3", messages[1].UUID)
+	assert.Equal(int64(3), messages[1].Sequence)
+	assert.Equal("m4", messages[2].UUID)
+	assert.Equal(int64(20), messages[2].Sequence)
+
+	result := chat.getMessagesAfterSequence(1, 1, 0)
+	assert.Len(result.Messages, 2)
+	assert.Equal(int64(10), result.Sequence)
+
+	result = chat.getMessagesAfterSequence(1, 10, 0)
+	assert.Len(result.Messages, 0)
+	assert.Equal(int64(10), result.Sequence)
+
+	result = chat.getMessagesAfterSequence(1, 50, 0)
+	assert.Len(result.Messages, 0)
+	assert.Equal(int64(10), result.Sequence)
+}
+
+func TestChatWaitForCachedMessagesAfter(t *testing.T) {
+	assert := assert.New(t)
+
+	session1 := &model.Session{
+		UUID:       "test_session",
+		CreatedUTC: time.Now().UTC(),
+		UserID:     1,
+		User:       &model.User{ID: 1, UUID: "test_user1"},
+	}
+	session2 := &model.Session{
+		UUID:       "test_session2",
+		CreatedUTC: time.Now().UTC(),
+		UserID:     2,
+		User:       &model.User{ID: 2, UUID: "test_user2"},
+	}
+
+	chat := new(Chat)
+	chat.cacheSession(session1)
+	chat.addMessageQueue(session1)
+	chat.cacheSession(session2)
+	chat.addMessageQueue(session2)
+
+	now := time.Now().UTC()
+	messages := chat.waitForCachedMessagesAfter(2, now, 10*time.Millisecond)
+	assert.Len(messages, 0)
+
+	// a waiter holding the user's signal is woken by the next message.
+	signal := chat.getMessageSignal(2)
+	chat.queueMessage(&model.Message{
+		CreatedUTC: time.Now().UTC(),
+		SenderID:   1,
+		ReceiverID: 2,
+		Body:       "This is a test message.",
+	})
+	select {
+	case <-signal:
+	default:
+		assert.FailNow("the message didn't signal the user")
+	}
+
+	messages = chat.waitForCachedMessagesAfter(2, now, 5*time.Second)
+	assert.Len(messages, 1)
+}
+
+func TestChatQueueRoomMessage(t *testing.T) {
+	assert := assert.New(t)
+	chat := new(Chat)
+
+	for userID := 1; userID <= 3; userID++ {
+		session := &model.Session{
+			UUID:       fmt.Sprintf("test_session%d", userID),
+			CreatedUTC: time.Now().UTC(),
+			UserID:     userID,
+			User:       &model.User{ID: userID, UUID: fmt.Sprintf("test_user%d", userID)},
+		}
+		chat.cacheSession(session)
+		chat.addMessageQueue(session)
+	}
+
+	chat.cacheRoom(&model.Room{ID: 1, UUID: "test_room", Name: "Test Room"})
+	chat.cacheRoomMember(1, 1)
+	chat.cacheRoomMember(1, 2)
+	assert.True(chat.isCachedRoomMember(1, 2))
+	assert.False(chat.isCachedRoomMember(1, 3))
+	assert.Len(chat.getCachedRoomsForUser(1), 1)
+	assert.Len(chat.getCachedRoomsForUser(3), 0)
+
+	message := &model.Message{SenderID: 1, ReceiverID: 1, RoomID: 1, Body: "This is a test message."}
+	chat.queueMessage(message)
+	assert.Equal(1, chat.MessageQueues[1].Len())
+	assert.Equal(1, chat.MessageQueues[2].Len())
+	assert.Equal(0, chat.MessageQueues[3].Len())
+	assert.Len(message.RoomSequences, 2)
+
+	chat.removeCachedRoomMember(1, 2)
+	assert.False(chat.isCachedRoomMember(1, 2))
+	chat.queueMessage(&model.Message{SenderID: 1, ReceiverID: 1, RoomID: 1, Body: "This is a test message."})
+	assert.Equal(2, chat.MessageQueues[1].Len())
+	assert.Equal(1, chat.MessageQueues[2].Len())
+}
+
 func TestChatNewUserAction(t *testing.T) {
 	assert := assert.New(t)
-	tx, err := model.DB().Begin()
+	ts, err := newTestStore()
 	assert.Nil(err)
-	defer tx.Rollback()
+	defer ts.Close()
+	tx := ts.Tx
 
 	app := web.New()
 	app.IsolateTo(tx)
-	chat := new(Chat)
+	chat := &Chat{Store: ts}
 	app.Register(chat)
 
 	newUser := model.User{UUID: "a_test_user", DisplayName: "A Test user"}
@@ -389,16 +652,17 @@ func TestChatNewUserAction(t *testing.T) {
 
 func TestChatGetUserAction(t *testing.T) {
 	assert := assert.New(t)
-	tx, err := model.DB().Begin()
+	ts, err := newTestStore()
 	assert.Nil(err)
-	defer tx.Rollback()
+	defer ts.Close()
+	tx := ts.Tx
 
 	u1 := &model.User{UUID: util.UUIDv4().ToShortString(), DisplayName: "Test User"}
-	assert.Nil(model.DB().CreateInTransaction(u1, tx))
+	assert.Nil(ts.CreateUser(u1, tx))
 
 	app := web.New()
 	app.IsolateTo(tx)
-	chat := new(Chat)
+	chat := &Chat{Store: ts}
 	app.Register(chat)
 
 	var response serviceResponseOfUser
@@ -412,16 +676,17 @@ func TestChatGetUserAction(t *testing.T) {
 
 func TestChatUpdateUserAction(t *testing.T) {
 	assert := assert.New(t)
-	tx, err := model.DB().Begin()
+	ts, err := newTestStore()
 	assert.Nil(err)
-	defer tx.Rollback()
+	defer ts.Close()
+	tx := ts.Tx
 
 	u1 := &model.User{UUID: util.UUIDv4().ToShortString(), DisplayName: "Test User"}
-	assert.Nil(model.DB().CreateInTransaction(u1, tx))
+	assert.Nil(ts.CreateUser(u1, tx))
 
 	app := web.New()
 	app.IsolateTo(tx)
-	chat := new(Chat)
+	chat := &Chat{Store: ts}
 	app.Register(chat)
 
 	u2 := &model.User{UUID: u1.UUID, DisplayName: "Not Test User"}
@@ -431,46 +696,48 @@ func TestChatUpdateUserAction(t *testing.T) {
 	assert.Equal(http.StatusOK, response.Meta["http_code"], response.Meta["exception"])
 	assert.Equal(u1.ID, response.Response.ID)
 
-	var verify model.User
-	err = model.DB().GetByIDInTransaction(&verify, tx, u1.ID)
+	verify, err := ts.GetUser(u1.ID, tx)
+	assert.Nil(err)
 	assert.Equal("Not Test User", verify.DisplayName)
 }
 
 func TestChatDeleteUserAction(t *testing.T) {
 	assert := assert.New(t)
-	tx, err := model.DB().Begin()
+	ts, err := newTestStore()
 	assert.Nil(err)
-	defer tx.Rollback()
+	defer ts.Close()
+	tx := ts.Tx
 
 	u1 := &model.User{UUID: util.UUIDv4().ToShortString(), DisplayName: "Test User"}
-	assert.Nil(model.DB().CreateInTransaction(u1, tx))
+	assert.Nil(ts.CreateUser(u1, tx))
 
 	app := web.New()
 	app.IsolateTo(tx)
-	chat := new(Chat)
+	chat := &Chat{Store: ts}
 	app.Register(chat)
 
 	meta, err := app.Mock().WithPathf("/api/user/%d", u1.ID).WithVerb("DELETE").ExecuteWithMeta()
 	assert.Nil(err)
 	assert.Equal(http.StatusOK, meta.StatusCode)
 
-	var verify model.User
-	err = model.DB().GetByIDInTransaction(&verify, tx, u1.ID)
+	verify, err := ts.GetUser(u1.ID, tx)
+	assert.Nil(err)
 	assert.True(verify.IsZero())
 }
 
 func TestSessionActions(t *testing.T) {
 	assert := assert.New(t)
-	tx, err := model.DB().Begin()
+	ts, err := newTestStore()
 	assert.Nil(err)
-	defer tx.Rollback()
+	defer ts.Close()
+	tx := ts.Tx
 
 	u1 := &model.User{UUID: util.UUIDv4().ToShortString(), DisplayName: "Test User"}
-	assert.Nil(model.DB().CreateInTransaction(u1, tx))
+	assert.Nil(ts.CreateUser(u1, tx))
 
 	app := web.New()
 	app.IsolateTo(tx)
-	chat := new(Chat)
+	chat := &Chat{Store: ts}
 	app.Register(chat)
 
 	var response serviceResponseOfSession
@@ -494,15 +761,16 @@ func TestSessionActions(t *testing.T) {
 
 func TestCreateContact(t *testing.T) {
 	assert := assert.New(t)
-	tx, err := model.DB().Begin()
+	ts, err := newTestStore()
 	assert.Nil(err)
-	defer tx.Rollback()
+	defer ts.Close()
+	tx := ts.Tx
 
 	u1 := &model.User{UUID: util.UUIDv4().ToShortString(), DisplayName: "Test User"}
-	assert.Nil(model.DB().CreateInTransaction(u1, tx))
+	assert.Nil(ts.CreateUser(u1, tx))
 
 	u2 := &model.User{UUID: util.UUIDv4().ToShortString(), DisplayName: "Test User"}
-	assert.Nil(model.DB().CreateInTransaction(u2, tx))
+	assert.Nil(ts.CreateUser(u2, tx))
 
 	s1 := &model.Session{
 		UUID:          util.UUIDv4().ToShortString(),
@@ -511,11 +779,11 @@ func TestCreateContact(t *testing.T) {
 		UserID:        u1.ID,
 		User:          u1,
 	}
-	assert.Nil(model.DB().CreateInTransaction(s1, tx))
+	assert.Nil(ts.CreateSession(s1, tx))
 
 	app := web.New()
 	app.IsolateTo(tx)
-	chat := new(Chat)
+	chat := &Chat{Store: ts}
 	err = chat.Restore(tx)
 	assert.Nil(err)
 	app.Register(chat)
@@ -524,10 +792,15 @@ func TestCreateContact(t *testing.T) {
 	assert.Nil(err)
 	assert.Equal(http.StatusOK, meta.StatusCode)
 
-	var verify model.Contacts
-	err = model.DB().QueryInTransaction("select * from contacts where sender = $1", tx, u1.ID).Out(&verify)
-	assert.Equal(u1.ID, verify.Sender)
-	assert.Equal(u2.ID, verify.Receiver)
+	contacts, err := ts.GetContacts(tx)
+	assert.Nil(err)
+	var hasContact bool
+	for _, contact := range contacts {
+		if contact.Sender == u1.ID && contact.Receiver == u2.ID {
+			hasContact = true
+		}
+	}
+	assert.True(hasContact)
 
 	meta, err = app.Mock().WithVerb("POST").WithPathf("/api/contact/%s/%d", s1.UUID, u2.ID).ExecuteWithMeta()
 	assert.Nil(err)
@@ -536,15 +809,16 @@ func TestCreateContact(t *testing.T) {
 
 func TestSendMethod(t *testing.T) {
 	assert := assert.New(t)
-	tx, err := model.DB().Begin()
+	ts, err := newTestStore()
 	assert.Nil(err)
-	defer tx.Rollback()
+	defer ts.Close()
+	tx := ts.Tx
 
 	u1 := &model.User{UUID: util.UUIDv4().ToShortString(), DisplayName: "Test User"}
-	assert.Nil(model.DB().CreateInTransaction(u1, tx))
+	assert.Nil(ts.CreateUser(u1, tx))
 
 	u2 := &model.User{UUID: util.UUIDv4().ToShortString(), DisplayName: "Test User"}
-	assert.Nil(model.DB().CreateInTransaction(u2, tx))
+	assert.Nil(ts.CreateUser(u2, tx))
 
 	s1 := &model.Session{
 		UUID:          "test_session",
@@ -560,12 +834,12 @@ func TestSendMethod(t *testing.T) {
 		UserID:        u2.ID,
 		User:          u2,
 	}
-	assert.Nil(model.DB().CreateInTransaction(s1, tx))
-	assert.Nil(model.DB().CreateInTransaction(s2, tx))
+	assert.Nil(ts.CreateSession(s1, tx))
+	assert.Nil(ts.CreateSession(s2, tx))
 
 	app := web.New()
 	app.IsolateTo(tx)
-	chat := new(Chat)
+	chat := &Chat{Store: ts}
 	err = chat.Restore(tx)
 	assert.Nil(err)
 	app.Register(chat)
@@ -586,15 +860,16 @@ func TestSendMethod(t *testing.T) {
 
 func TestGetMessages(t *testing.T) {
 	assert := assert.New(t)
-	tx, err := model.DB().Begin()
+	ts, err := newTestStore()
 	assert.Nil(err)
-	defer tx.Rollback()
+	defer ts.Close()
+	tx := ts.Tx
 
 	u1 := &model.User{UUID: util.UUIDv4().ToShortString(), DisplayName: "Test User"}
-	assert.Nil(model.DB().CreateInTransaction(u1, tx))
+	assert.Nil(ts.CreateUser(u1, tx))
 
 	u2 := &model.User{UUID: util.UUIDv4().ToShortString(), DisplayName: "Test User"}
-	assert.Nil(model.DB().CreateInTransaction(u2, tx))
+	assert.Nil(ts.CreateUser(u2, tx))
 
 	s1 := &model.Session{
 		UUID:          "test_session",
@@ -610,8 +885,8 @@ func TestGetMessages(t *testing.T) {
 		UserID:        u2.ID,
 		User:          u2,
 	}
-	assert.Nil(model.DB().CreateInTransaction(s1, tx))
-	assert.Nil(model.DB().CreateInTransaction(s2, tx))
+	assert.Nil(ts.CreateSession(s1, tx))
+	assert.Nil(ts.CreateSession(s2, tx))
 
 	message2 := model.Message{
 		UUID:       util.UUIDv4().ToShortString(),
@@ -620,7 +895,7 @@ func TestGetMessages(t *testing.T) {
 		ReceiverID: u2.ID,
 		Body:       "this is a test",
 	}
-	assert.Nil(model.DB().CreateInTransaction(message2, tx))
+	assert.Nil(ts.CreateMessage(message2, tx))
 
 	message3 := model.Message{
 		UUID:       util.UUIDv4().ToShortString(),
@@ -629,7 +904,7 @@ func TestGetMessages(t *testing.T) {
 		ReceiverID: u2.ID,
 		Body:       "this is a test",
 	}
-	assert.Nil(model.DB().CreateInTransaction(message3, tx))
+	assert.Nil(ts.CreateMessage(message3, tx))
 
 	message := model.Message{
 		UUID:       util.UUIDv4().ToShortString(),
@@ -638,16 +913,21 @@ func TestGetMessages(t *testing.T) {
 		ReceiverID: u2.ID,
 		Body:       "this is a test",
 	}
-	assert.Nil(model.DB().CreateInTransaction(message, tx))
+	assert.Nil(ts.CreateMessage(message, tx))
 
-	var messagesForU1 []model.Message
-	err = model.DB().QueryInTransaction("select * from messages where sender = $1 or receiver = $1", tx, u1.ID).OutMany(&messagesForU1)
+	stored, err := ts.GetAllMessagesWithLimit(MessageQueueMaxLength, tx)
 	assert.Nil(err)
+	var messagesForU1 []model.Message
+	for _, storedMessage := range stored {
+		if storedMessage.SenderID == u1.ID || storedMessage.ReceiverID == u1.ID {
+			messagesForU1 = append(messagesForU1, storedMessage)
+		}
+	}
 	assert.Len(messagesForU1, 3)
 
 	app := web.New()
 	app.IsolateTo(tx)
-	chat := new(Chat)
+	chat := &Chat{Store: ts}
 	err = chat.Restore(tx)
 	assert.Nil(err)
 
@@ -0,0 +1,496 @@
+package controller
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/blendlabs/chatbus/server/cluster"
+	"github.com/blendlabs/chatbus/server/model"
+	"github.com/blendlabs/chatbus/server/store"
+	"github.com/blendlabs/go-util/collections"
+)
+
+// the kinds of notification the controller publishes to the cluster.
+const (
+	clusterMessage           = "message"
+	clusterMessageEvent      = "message_event"
+	clusterUser              = "user"
+	clusterUserDeleted       = "user_deleted"
+	clusterSession           = "session"
+	clusterSessionDeleted    = "session_deleted"
+	clusterSessionActivity   = "session_activity"
+	clusterContact           = "contact"
+	clusterContactDeleted    = "contact_deleted"
+	clusterRoom              = "room"
+	clusterRoomMember        = "room_member"
+	clusterRoomMemberDeleted = "room_member_deleted"
+)
+
+// ErrUnknownClusterNotification is reported for a notification of a kind the controller doesn't publish.
+var ErrUnknownClusterNotification = errors.New("Unknown cluster notification kind!")
+
+// reportClusterError hands an error publishing or applying a notification to the error callback, if there is one.
+func (c *Chat) reportClusterError(err error) {
+	if c.OnClusterError != nil {
+		c.OnClusterError(err)
+	}
+}
+
+// publish sends a cache change to every node in the cluster, if there is one; this node applies it again when it comes back,
+// so every change has to be safe to apply twice.
+func (c *Chat) publish(kind string, payload interface{}) {
+	if c.Cluster == nil {
+		return
+	}
+	notification, err := cluster.NewNotification(kind, payload)
+	if err == nil {
+		_, err = c.Cluster.Publish(notification, nil, nil)
+	}
+	if err != nil {
+		c.reportClusterError(err)
+	}
+}
+
+// getLastSequences returns the last sequence this node knows of for each user.
+func (c *Chat) getLastSequences(userIDs []int) map[int]int64 {
+	c.sequenceLock.Lock()
+	defer c.sequenceLock.Unlock()
+
+	sequences := map[int]int64{}
+	for _, userID := range userIDs {
+		sequences[userID] = c.Sequences[userID]
+	}
+	return sequences
+}
+
+// publishMessage publishes a message (or change event) for a set of users, returning the sequence the cluster allocated each of them.
+// Every node, this one included, queues it when it comes back; `prepare`, if set, is called with the sequences before then.
+func (c *Chat) publishMessage(kind string, message *model.Message, userIDs []int, prepare func(map[int]int64) error) (map[int]int64, error) {
+	published := *message
+	published.Sequence = 0
+	published.RoomSequences = nil
+	notification, err := cluster.NewNotification(kind, published)
+	if err != nil {
+		return nil, err
+	}
+	return c.Cluster.Publish(notification, c.getLastSequences(userIDs), prepare)
+}
+
+// publishNewMessage publishes a new message to its recipients and stamps it with their sequences; if `persist` is set the stamped
+// message is persisted before any node can see it, and isn't published if that fails.
+// Every node queues it for users without a session, but only this one records it in their inbox.
+func (c *Chat) publishNewMessage(message *model.Message, persist func(*model.Message) error) error {
+	sequences, err := c.publishMessage(clusterMessage, message, c.getMessageRecipients(message), func(sequences map[int]int64) error {
+		if message.RoomID != 0 {
+			message.RoomSequences = sequences
+		} else {
+			message.SenderSequence = sequences[message.SenderID]
+			message.ReceiverSequence = sequences[message.ReceiverID]
+		}
+		if persist == nil {
+			return nil
+		}
+		return persist(message)
+	})
+	if err != nil {
+		return err
+	}
+
+	for userID, sequence := range sequences {
+		if !c.userHasSession(userID) && c.hasCachedUser(userID) {
+			store.QueueCreateInboxMessage(c.store(), model.InboxMessage{UserID: userID, MessageUUID: message.UUID, Sequence: sequence, CreatedUTC: time.Now().UTC()})
+		}
+	}
+	return nil
+}
+
+// ListenCluster applies the notifications from the cluster until the bus is closed.
+func (c *Chat) ListenCluster() {
+	for notification := range c.Cluster.Notifications() {
+		if err := c.applyNotification(notification); err != nil {
+			c.reportClusterError(err)
+		}
+	}
+}
+
+// applyNotification applies a notification from the cluster to the caches.
+func (c *Chat) applyNotification(notification cluster.Notification) error {
+	switch notification.Kind {
+	case cluster.KindReconnect:
+		return c.resync()
+	case clusterMessage, clusterMessageEvent:
+		var message model.Message
+		if err := json.Unmarshal(notification.Payload, &message); err != nil {
+			return err
+		}
+		c.routeClusterMessage(&message, notification.Sequences)
+	case clusterUser:
+		var user model.User
+		if err := json.Unmarshal(notification.Payload, &user); err != nil {
+			return err
+		}
+		c.cacheUser(&user)
+	case clusterUserDeleted:
+		var userID int
+		if err := json.Unmarshal(notification.Payload, &userID); err != nil {
+			return err
+		}
+		c.removeCachedUser(userID)
+	case clusterSession:
+		var session model.Session
+		if err := json.Unmarshal(notification.Payload, &session); err != nil {
+			return err
+		}
+		if _, hasSession := c.getCachedSession(session.UUID); hasSession {
+			return nil
+		}
+		if session.User != nil {
+			c.cacheUser(session.User)
+		}
+		c.cacheSession(&session)
+		c.cacheSessionByUser(&session)
+		// the node that started the session clears the stored inbox.
+		c.addMessageQueue(&session)
+	case clusterSessionDeleted:
+		var session model.Session
+		if err := json.Unmarshal(notification.Payload, &session); err != nil {
+			return err
+		}
+		c.removeCachedSession(session.UUID)
+		c.removeCachedSessionByUser(&session)
+		c.removeMessageQueue(session.UserID)
+	case clusterSessionActivity:
+		var activity map[string]time.Time
+		if err := json.Unmarshal(notification.Payload, &activity); err != nil {
+			return err
+		}
+		c.applySessionActivity(activity)
+	case clusterContact, clusterContactDeleted:
+		var contact model.Contacts
+		if err := json.Unmarshal(notification.Payload, &contact); err != nil {
+			return err
+		}
+		if notification.Kind == clusterContactDeleted {
+			c.removeCachedContacts(contact.Sender, contact.Receiver)
+		} else {
+			c.cacheContact(contact.Sender, contact.Receiver)
+		}
+	case clusterRoom:
+		var room model.Room
+		if err := json.Unmarshal(notification.Payload, &room); err != nil {
+			return err
+		}
+		c.cacheRoom(&room)
+	case clusterRoomMember, clusterRoomMemberDeleted:
+		var member model.RoomMember
+		if err := json.Unmarshal(notification.Payload, &member); err != nil {
+			return err
+		}
+		if notification.Kind == clusterRoomMemberDeleted {
+			c.removeCachedRoomMember(member.RoomID, member.UserID)
+		} else {
+			c.cacheRoomMember(member.RoomID, member.UserID)
+		}
+	default:
+		return ErrUnknownClusterNotification
+	}
+	return nil
+}
+
+// resync rebuilds the caches from the store once the cluster bus reconnects, since the notifications published while it was away were lost.
+// Users, contacts and rooms are reloaded, sessions are added or dropped to match the store, and the stored messages sequenced
+// after the last sequence this node knows of for each user are queued.
+func (c *Chat) resync(txs ...*sql.Tx) error {
+	lastSequences := c.getAllLastSequences()
+
+	users, err := c.store().GetUsers(txs...)
+	if err != nil {
+		return err
+	}
+	cachedUsers := map[int]*model.User{}
+	for x := 0; x < len(users); x++ {
+		user := users[x]
+		cachedUsers[user.ID] = &user
+	}
+	c.usersLock.Lock()
+	c.Users = cachedUsers
+	c.usersLock.Unlock()
+
+	if err = c.resyncSessions(txs...); err != nil {
+		return err
+	}
+
+	contacts, err := c.store().GetContacts(txs...)
+	if err != nil {
+		return err
+	}
+	cachedContacts := map[int]collections.SetOfInt{}
+	for _, contact := range contacts {
+		for _, pair := range [][2]int{{contact.Sender, contact.Receiver}, {contact.Receiver, contact.Sender}} {
+			if _, hasContacts := cachedContacts[pair[0]]; !hasContacts {
+				cachedContacts[pair[0]] = collections.NewSetOfInt()
+			}
+			cachedContacts[pair[0]].Add(pair[1])
+		}
+	}
+	c.contactsLock.Lock()
+	c.Contacts = cachedContacts
+	c.contactsLock.Unlock()
+
+	rooms, err := c.store().GetRooms(txs...)
+	if err != nil {
+		return err
+	}
+	cachedRooms := map[int]*model.Room{}
+	for x := 0; x < len(rooms); x++ {
+		room := rooms[x]
+		cachedRooms[room.ID] = &room
+	}
+	c.roomsLock.Lock()
+	c.Rooms = cachedRooms
+	c.roomsLock.Unlock()
+
+	roomMembers, err := c.store().GetRoomMembers(txs...)
+	if err != nil {
+		return err
+	}
+	cachedRoomMembers := map[int]collections.SetOfInt{}
+	for _, member := range roomMembers {
+		if _, hasMembers := cachedRoomMembers[member.RoomID]; !hasMembers {
+			cachedRoomMembers[member.RoomID] = collections.NewSetOfInt()
+		}
+		cachedRoomMembers[member.RoomID].Add(member.UserID)
+	}
+	c.roomMembersLock.Lock()
+	c.RoomMembers = cachedRoomMembers
+	c.roomMembersLock.Unlock()
+
+	return c.resyncMessages(users, lastSequences, txs...)
+}
+
+// getAllLastSequences returns the last sequence this node knows of for every user.
+func (c *Chat) getAllLastSequences() map[int]int64 {
+	c.sequenceLock.Lock()
+	defer c.sequenceLock.Unlock()
+
+	sequences := make(map[int]int64, len(c.Sequences))
+	for userID, sequence := range c.Sequences {
+		sequences[userID] = sequence
+	}
+	return sequences
+}
+
+// resyncSessions caches the stored sessions this node doesn't have, and drops the cached ones that were deleted from the store.
+func (c *Chat) resyncSessions(txs ...*sql.Tx) error {
+	sessions, err := c.store().GetSessions(txs...)
+	if err != nil {
+		return err
+	}
+	stored := map[string]bool{}
+	for x := 0; x < len(sessions); x++ {
+		session := sessions[x]
+		stored[session.UUID] = true
+		if _, hasSession := c.getCachedSession(session.UUID); hasSession {
+			continue
+		}
+		session.User = c.getCachedUser(session.UserID)
+		c.addMessageQueue(&session)
+		c.cacheSession(&session)
+		c.cacheSessionByUser(&session)
+	}
+
+	c.sessionLock.RLock()
+	var deleted []*model.Session
+	for sessionID, session := range c.Sessions {
+		if !stored[sessionID] {
+			deleted = append(deleted, session)
+		}
+	}
+	c.sessionLock.RUnlock()
+	for _, session := range deleted {
+		c.removeCachedSession(session.UUID)
+		c.removeCachedSessionByUser(session)
+		c.removeMessageQueue(session.UserID)
+	}
+	return nil
+}
+
+// resyncMessages queues the stored messages, and change events, that were sequenced for each user after the last sequence this node knew of for them.
+// It only sees what the other nodes have written to the store: a message a node has acknowledged but still holds in its write-ahead log or batcher
+// was published while this node was away, so it is missed here until the user's next restore.
+func (c *Chat) resyncMessages(users []model.User, lastSequences map[int]int64, txs ...*sql.Tx) error {
+	var entries []model.MessageEvent
+	for _, user := range users {
+		stream, err := c.store().GetUserStreamAfterSequence(user.ID, lastSequences[user.ID], MessageQueueMaxLength, txs...)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, stream...)
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	var messageUUIDs []string
+	seen := map[string]bool{}
+	for _, entry := range entries {
+		if !seen[entry.MessageUUID] {
+			seen[entry.MessageUUID] = true
+			messageUUIDs = append(messageUUIDs, entry.MessageUUID)
+		}
+	}
+	stored, err := c.store().GetMessagesByUUID(messageUUIDs, txs...)
+	if err != nil {
+		return err
+	}
+	receipts, err := c.store().GetMessageReceipts(messageUUIDs, txs...)
+	if err != nil {
+		return err
+	}
+	messages := map[string]model.Message{}
+	for _, message := range stored {
+		message.Receipts = receipts[message.UUID]
+		messages[message.UUID] = message
+	}
+
+	// each user's entries are in sequence order, so their queue stays in order.
+	for _, entry := range entries {
+		message, hasMessage := messages[entry.MessageUUID]
+		if !hasMessage {
+			continue
+		}
+		message.Event = entry.Event
+		c.routeClusterMessage(&message, map[int]int64{entry.UserID: entry.Sequence})
+	}
+	return nil
+}
+
+// routeClusterMessage queues a message (or change event) from the cluster for each user it was sequenced for.
+func (c *Chat) routeClusterMessage(message *model.Message, sequences map[int]int64) {
+	userIDs := make([]int, 0, len(sequences))
+	for userID := range sequences {
+		userIDs = append(userIDs, userID)
+	}
+	sort.Ints(userIDs)
+
+	for _, userID := range userIDs {
+		sequence := sequences[userID]
+		if c.hasCachedSequence(userID, sequence) {
+			continue
+		}
+		if len(message.Event) > 0 {
+			c.applyCachedChange(userID, message)
+		}
+		c.messageQueueLock.RLock()
+		c.enqueueMessage(userID, sequence, message, true)
+		c.messageQueueLock.RUnlock()
+	}
+}
+
+// hasCachedSequence returns if a user's queue, or inbox, already has the message with a sequence;
+// a node that is restoring can see a message in the store as well as in the notifications that came in meanwhile.
+func (c *Chat) hasCachedSequence(userID int, sequence int64) bool {
+	c.messageQueueLock.RLock()
+	queue, hasQueue := c.MessageQueues[userID]
+	c.messageQueueLock.RUnlock()
+	if !hasQueue {
+		c.inboxLock.Lock()
+		queue, hasQueue = c.Inboxes[userID]
+		c.inboxLock.Unlock()
+	}
+	if !hasQueue {
+		return false
+	}
+
+	queue.SyncRoot().Lock()
+	defer queue.SyncRoot().Unlock()
+	var found bool
+	queue.ReverseEachUntil(func(v interface{}) bool {
+		message := model.TryCastMessage(v)
+		found = message.Sequence == sequence
+		return !found && message.Sequence > sequence
+	})
+	return found
+}
+
+// applyCachedChange applies a change event from the cluster to the cached copies of the message, as the node that made the change did.
+func (c *Chat) applyCachedChange(userID int, message *model.Message) {
+	switch message.Event {
+	case model.MessageEventReceipt:
+		for _, receipt := range message.Receipts {
+			c.updateCachedMessage(receipt.UserID, message.UUID, func(cached *model.Message) {
+				cached.Receipts = cached.WithReceipt(receipt)
+			})
+		}
+		c.updateCachedMessage(userID, message.UUID, func(cached *model.Message) {
+			cached.Receipts = message.Receipts
+		})
+	case model.MessageEventEdit, model.MessageEventDelete:
+		c.updateCachedMessage(userID, message.UUID, func(cached *model.Message) {
+			cached.Body = message.Body
+			cached.Attachments = message.Attachments
+			cached.EditedUTC = message.EditedUTC
+			cached.DeletedUTC = message.DeletedUTC
+		})
+	case model.MessageEventExpire:
+		c.evictCachedUserMessages(userID, func(cached *model.Message) bool {
+			return cached.UUID == message.UUID && cached.Event != model.MessageEventExpire
+		})
+	}
+}
+
+// evictCachedUserMessages removes the messages matching a predicate from a user's queue and inbox.
+func (c *Chat) evictCachedUserMessages(userID int, evict func(*model.Message) bool) {
+	c.messageQueueLock.RLock()
+	queue, hasQueue := c.MessageQueues[userID]
+	c.messageQueueLock.RUnlock()
+	if hasQueue {
+		evictQueuedMessages(queue, evict)
+	}
+
+	c.inboxLock.Lock()
+	inbox, hasInbox := c.Inboxes[userID]
+	c.inboxLock.Unlock()
+	if hasInbox {
+		evictQueuedMessages(inbox, evict)
+	}
+}
+
+// recordSessionActivity notes that a session was active, for the next batch of activity published to the cluster.
+func (c *Chat) recordSessionActivity(sessionID string, lastActive time.Time) {
+	c.sessionActivityLock.Lock()
+	defer c.sessionActivityLock.Unlock()
+	if c.sessionActivity == nil {
+		c.sessionActivity = map[string]time.Time{}
+	}
+	c.sessionActivity[sessionID] = lastActive
+}
+
+// publishSessionActivity publishes when each session was last active on this node, so no node culls a session that is in use elsewhere.
+func (c *Chat) publishSessionActivity() {
+	if c.Cluster == nil {
+		return
+	}
+	c.sessionActivityLock.Lock()
+	activity := c.sessionActivity
+	c.sessionActivity = nil
+	c.sessionActivityLock.Unlock()
+
+	if len(activity) > 0 {
+		c.publish(clusterSessionActivity, activity)
+	}
+}
+
+// applySessionActivity moves sessions' last active times up to the ones from another node.
+func (c *Chat) applySessionActivity(activity map[string]time.Time) {
+	c.sessionLock.Lock()
+	defer c.sessionLock.Unlock()
+	for sessionID, lastActive := range activity {
+		if session, hasSession := c.Sessions[sessionID]; hasSession && lastActive.After(session.LastActiveUTC) {
+			session.LastActiveUTC = lastActive
+		}
+	}
+}
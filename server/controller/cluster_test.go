@@ -0,0 +1,206 @@
+package controller
+
+import (
+	"testing"
+	"time"
+
+	"github.com/blendlabs/chatbus/server/cluster"
+	"github.com/blendlabs/chatbus/server/model"
+	"github.com/blendlabs/chatbus/server/store"
+	assert "github.com/blendlabs/go-assert"
+)
+
+// applyClusterNotifications applies the notifications waiting for each node.
+func applyClusterNotifications(assert *assert.Assertions, nodes ...*Chat) {
+	for _, node := range nodes {
+		for len(node.Cluster.Notifications()) > 0 {
+			assert.Nil(node.applyNotification(<-node.Cluster.Notifications()))
+		}
+	}
+}
+
+func TestChatCluster(t *testing.T) {
+	assert := assert.New(t)
+
+	local := cluster.NewLocal()
+	node1 := &Chat{Cluster: local.Join()}
+	node2 := &Chat{Cluster: local.Join()}
+
+	u1 := model.User{ID: 1, UUID: "test_user1"}
+	u2 := model.User{ID: 2, UUID: "test_user2"}
+	node1.publish(clusterUser, u1)
+	node1.publish(clusterUser, u2)
+	node1.publish(clusterSession, model.Session{UUID: "test_session1", UserID: 1, User: &u1, LastActiveUTC: time.Now().UTC()})
+	node2.publish(clusterSession, model.Session{UUID: "test_session2", UserID: 2, User: &u2, LastActiveUTC: time.Now().UTC()})
+	node2.publish(clusterContact, model.Contacts{Sender: 2, Receiver: 1})
+	applyClusterNotifications(assert, node1, node2)
+
+	for _, node := range []*Chat{node1, node2} {
+		assert.True(node.hasCachedUser(2))
+		assert.True(node.userHasSession(1))
+		assert.True(node.userHasSession(2))
+		assert.Equal([]int{1}, node.getCachedContacts(2))
+	}
+
+	// a message sent on one node is queued on every node, with the same sequences.
+	message := &model.Message{UUID: "m1", CreatedUTC: time.Now().UTC(), SenderID: 1, ReceiverID: 2, Body: "hello"}
+	assert.Nil(node1.queueMessage(message))
+	assert.Equal(int64(1), message.SenderSequence)
+	assert.Equal(int64(1), message.ReceiverSequence)
+	assert.Empty(node2.getCachedMessagesAfterSequence(2, 0))
+	applyClusterNotifications(assert, node1, node2)
+
+	for _, node := range []*Chat{node1, node2} {
+		received := node.getCachedMessagesAfterSequence(2, 0)
+		assert.Len(received, 1)
+		assert.Equal("m1", received[0].UUID)
+		assert.Equal(int64(1), received[0].Sequence)
+		assert.Len(node.getCachedMessagesAfterSequence(1, 0), 1)
+	}
+
+	// a notification seen twice (i.e. while restoring) is only queued once.
+	notification, err := cluster.NewNotification(clusterMessage, message)
+	assert.Nil(err)
+	notification.Sequences = map[int]int64{1: 1, 2: 1}
+	assert.Nil(node2.applyNotification(notification))
+	assert.Len(node2.getCachedMessagesAfterSequence(2, 0), 1)
+
+	// receipts made on one node show up on the sender's copy on the other.
+	node2.saveReceipt(2, "m1", true)
+	applyClusterNotifications(assert, node1, node2)
+	sent := node1.getCachedMessagesAfterSequence(1, 0)
+	assert.Len(sent, 2)
+	assert.Equal(model.MessageEventReceipt, sent[1].Event)
+	assert.Equal(int64(2), sent[1].Sequence)
+	receipt, hasReceipt := sent[0].GetReceipt(2)
+	assert.True(hasReceipt)
+	assert.NotNil(receipt.ReadUTC)
+
+	// session activity keeps other nodes from culling a session.
+	later := time.Now().UTC().Add(time.Minute)
+	node2.recordSessionActivity("test_session2", later)
+	node2.publishSessionActivity()
+	applyClusterNotifications(assert, node1, node2)
+	session, hasSession := node1.getCachedSession("test_session2")
+	assert.True(hasSession)
+	assert.Equal(later, session.LastActiveUTC)
+
+	node1.publish(clusterSessionDeleted, model.Session{UUID: "test_session2", UserID: 2})
+	node1.publish(clusterContactDeleted, model.Contacts{Sender: 2, Receiver: 1})
+	applyClusterNotifications(assert, node1, node2)
+	for _, node := range []*Chat{node1, node2} {
+		assert.False(node.userHasSession(2))
+		assert.Empty(node.getCachedContacts(2))
+	}
+
+	// a message for a user without a session goes to their inbox on every node.
+	assert.Nil(node1.queueMessage(&model.Message{UUID: "m2", CreatedUTC: time.Now().UTC(), SenderID: 1, ReceiverID: 2, Body: "offline"}))
+	applyClusterNotifications(assert, node1, node2)
+	for _, node := range []*Chat{node1, node2} {
+		assert.Equal(1, node.getInbox(2).Len())
+	}
+}
+
+func TestChatClusterReconnect(t *testing.T) {
+	assert := assert.New(t)
+
+	memory := store.NewMemory()
+	local := cluster.NewLocal()
+	node := &Chat{Store: memory, Cluster: local.Join()}
+
+	u1 := &model.User{UUID: "test_user1"}
+	u2 := &model.User{UUID: "test_user2"}
+	assert.Nil(memory.CreateUser(u1))
+	assert.Nil(memory.CreateUser(u2))
+	stale := &model.Session{UUID: "test_session1", UserID: u1.ID, LastActiveUTC: time.Now().UTC()}
+	assert.Nil(memory.CreateSession(stale))
+	assert.Nil(node.Restore())
+	assert.Nil(node.queueMessage(&model.Message{UUID: "m1", CreatedUTC: time.Now().UTC(), SenderID: u1.ID, ReceiverID: u2.ID, Body: "seen"}))
+	applyClusterNotifications(assert, node)
+	seen := node.getCachedMessagesAfterSequence(u1.ID, 0)
+	assert.Len(seen, 1)
+	assert.Nil(memory.CreateMessage(seen[0]))
+
+	// while the node was away another one dropped a session, started one, added a contact, sent a message and edited one.
+	assert.Nil(memory.DeleteSession(stale))
+	assert.Nil(memory.CreateSession(&model.Session{UUID: "test_session2", UserID: u2.ID, LastActiveUTC: time.Now().UTC()}))
+	assert.Nil(memory.CreateContacts(u1.ID, u2.ID))
+	assert.Nil(memory.CreateMessage(model.Message{UUID: "m2", CreatedUTC: time.Now().UTC(), SenderID: u1.ID, ReceiverID: u2.ID, SenderSequence: 2, ReceiverSequence: 2, Body: "missed"}))
+	edited := seen[0]
+	edited.Body = "edited"
+	assert.Nil(memory.UpdateMessageContent(edited))
+	assert.Nil(memory.CreateMessageEvent(model.MessageEvent{MessageUUID: "m1", UserID: u2.ID, Sequence: 3, Event: model.MessageEventEdit, CreatedUTC: time.Now().UTC()}))
+
+	assert.Nil(node.applyNotification(cluster.Notification{Kind: cluster.KindReconnect}))
+	assert.False(node.userHasSession(u1.ID))
+	assert.True(node.userHasSession(u2.ID))
+	assert.Equal([]int{u2.ID}, node.getCachedContacts(u1.ID))
+
+	// the new session picks up the inbox, which already had the first message, then the missed message and edit.
+	received := node.getCachedMessagesAfterSequence(u2.ID, 0)
+	assert.Len(received, 3)
+	assert.Equal("m2", received[1].UUID)
+	assert.Equal(int64(2), received[1].Sequence)
+	assert.Equal("m1", received[2].UUID)
+	assert.Equal(model.MessageEventEdit, received[2].Event)
+	assert.Equal("edited", received[2].Body)
+	assert.Equal(int64(3), received[2].Sequence)
+
+	// a message another node acknowledged but hadn't written to the store when this one resynced (i.e. it was still in its write-ahead log)
+	// is missed, and nothing queues it once it's flushed.
+	unflushed := model.Message{UUID: "m3", CreatedUTC: time.Now().UTC(), SenderID: u1.ID, ReceiverID: u2.ID, SenderSequence: 4, ReceiverSequence: 4, Body: "unflushed"}
+	assert.Nil(node.applyNotification(cluster.Notification{Kind: cluster.KindReconnect}))
+	assert.Nil(memory.CreateMessage(unflushed))
+	assert.Len(node.getCachedMessagesAfterSequence(u2.ID, 0), 3)
+	assert.Equal(int64(3), node.getSequence(u2.ID))
+}
+
+func TestChatClusterScheduledMessage(t *testing.T) {
+	assert := assert.New(t)
+
+	memory := store.NewMemory()
+	local := cluster.NewLocal()
+	u1 := &model.User{UUID: "test_user1"}
+	u2 := &model.User{UUID: "test_user2"}
+	assert.Nil(memory.CreateUser(u1))
+	assert.Nil(memory.CreateUser(u2))
+	session := &model.Session{UUID: "test_session1", UserID: u1.ID, LastActiveUTC: time.Now().UTC()}
+	assert.Nil(memory.CreateSession(session))
+	assert.Nil(memory.CreateSession(&model.Session{UUID: "test_session2", UserID: u2.ID, LastActiveUTC: time.Now().UTC()}))
+
+	soon := time.Now().UTC().Add(time.Minute)
+	node1 := &Chat{Store: memory, Cluster: local.Join()}
+	assert.Nil(node1.Restore())
+	scheduled, err := node1.scheduleMessage(session, &model.Message{ReceiverID: u2.ID, Body: "later", DeliverAt: &soon})
+	assert.Nil(err)
+	node2 := &Chat{Store: memory, Cluster: local.Join()}
+	assert.Nil(node2.Restore())
+	assert.Len(node2.getCachedScheduledMessages(session.UUID), 1)
+
+	// a message that couldn't be written isn't published, and stays scheduled.
+	assert.Nil(memory.CreateMessage(model.Message{UUID: scheduled.UUID, CreatedUTC: time.Now().UTC(), SenderID: u1.ID, ReceiverID: u2.ID}))
+	sent, err := node1.deliverScheduledMessage(scheduled)
+	assert.NotNil(err)
+	assert.False(sent)
+	assert.Empty(node1.Cluster.Notifications())
+	assert.Nil(memory.DeleteMessages([]string{scheduled.UUID}))
+	stored, err := memory.GetScheduledMessages()
+	assert.Nil(err)
+	assert.Len(stored, 1)
+
+	// both nodes have it due, but only the one that claims it publishes it.
+	delivered, err := node1.deliverScheduledMessages(soon)
+	assert.Nil(err)
+	assert.Equal(1, delivered)
+	delivered, err = node2.deliverScheduledMessages(soon)
+	assert.Nil(err)
+	assert.Zero(delivered)
+	applyClusterNotifications(assert, node1, node2)
+
+	for _, node := range []*Chat{node1, node2} {
+		received := node.getCachedMessagesAfterSequence(u2.ID, 0)
+		assert.Len(received, 1)
+		assert.Equal(scheduled.UUID, received[0].UUID)
+		assert.Equal(int64(1), received[0].Sequence)
+	}
+}
@@ -20,6 +20,9 @@ func (cs CullSessions) Name() string {
 func (cs CullSessions) Execute(ct *chronometer.CancellationToken) error {
 	ct.CheckCancellation()
 
+	// share this node's session activity first, so the other nodes don't cull sessions that are only active here.
+	cs.Controller.publishSessionActivity()
+
 	cutoff := time.Now().UTC().Add(-5 * time.Minute)
 	var err error
 	for _, session := range cs.Controller.Sessions {
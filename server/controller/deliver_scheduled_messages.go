@@ -0,0 +1,29 @@
+package controller
+
+import (
+	"time"
+
+	chronometer "github.com/blendlabs/go-chronometer"
+)
+
+// DeliverScheduledMessages is the job that sends scheduled messages once they're due.
+type DeliverScheduledMessages struct {
+	Controller *Chat
+}
+
+// Name is the job name
+func (dsm DeliverScheduledMessages) Name() string {
+	return "deliver_scheduled_messages"
+}
+
+// Execute is the job body.
+func (dsm DeliverScheduledMessages) Execute(ct *chronometer.CancellationToken) error {
+	ct.CheckCancellation()
+	_, err := dsm.Controller.deliverScheduledMessages(time.Now().UTC())
+	return err
+}
+
+// Schedule returns the job schedule.
+func (dsm DeliverScheduledMessages) Schedule() chronometer.Schedule {
+	return chronometer.Every(time.Second)
+}
@@ -0,0 +1,86 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/blendlabs/chatbus/server/store"
+	"github.com/gorilla/websocket"
+)
+
+var (
+	// ErrShuttingDown is returned for streams opened after the controller started draining.
+	ErrShuttingDown = errors.New("Shutting down!")
+)
+
+// getDrainSignal returns a channel that is closed once the controller starts draining for shutdown.
+func (c *Chat) getDrainSignal() <-chan struct{} {
+	c.drainLock.Lock()
+	defer c.drainLock.Unlock()
+	return c.drainSignalLocked()
+}
+
+// drainSignalLocked returns the drain signal, making it if needed; callers must hold the drain lock.
+func (c *Chat) drainSignalLocked() chan struct{} {
+	if c.drainSignal == nil {
+		c.drainSignal = make(chan struct{})
+	}
+	return c.drainSignal
+}
+
+// trackWebsocket counts a websocket that Drain should wait for; it returns false once draining has started.
+func (c *Chat) trackWebsocket() bool {
+	c.drainLock.Lock()
+	defer c.drainLock.Unlock()
+
+	if c.isDraining {
+		return false
+	}
+	c.websockets.Add(1)
+	return true
+}
+
+// Drain wakes every parked long poll, event stream and websocket so they finish up, then waits for the websockets to close.
+// The http server doesn't track hijacked connections, so this is the only thing that waits on them.
+func (c *Chat) Drain(ctx context.Context) error {
+	c.drainLock.Lock()
+	if !c.isDraining {
+		close(c.drainSignalLocked())
+		c.isDraining = true
+	}
+	c.drainLock.Unlock()
+
+	closed := make(chan struct{})
+	go func() {
+		c.websockets.Wait()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Flush writes every sent message and receipt that is still waiting to the store; it keeps going past a failure and returns the first error.
+func (c *Chat) Flush(ctx context.Context) error {
+	var err error
+	if c.Batcher != nil {
+		err = c.Batcher.Stop()
+	}
+	if flushErr := c.flushMessageLog(); flushErr != nil && err == nil {
+		err = flushErr
+	}
+	if waitErr := store.WaitForQueued(ctx); waitErr != nil && err == nil {
+		err = waitErr
+	}
+	return err
+}
+
+// closeWebsocket tells the other side of a socket that we're going away.
+func closeWebsocket(conn *websocket.Conn) error {
+	return conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "shutting down"), time.Now().Add(WebsocketWriteTimeout))
+}
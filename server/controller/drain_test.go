@@ -0,0 +1,55 @@
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/blendlabs/chatbus/server/model"
+	"github.com/blendlabs/chatbus/server/store"
+	assert "github.com/blendlabs/go-assert"
+)
+
+func TestChatDrain(t *testing.T) {
+	assert := assert.New(t)
+	chat := new(Chat)
+	chat.addMessageQueue(&model.Session{UUID: "test_session", UserID: 1})
+
+	assert.True(chat.trackWebsocket())
+
+	returned := make(chan []model.Message)
+	go func() {
+		returned <- chat.waitForCachedMessagesAfter(1, time.Now().UTC(), time.Minute)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	// the tracked websocket never closes, so the drain times out.
+	assert.Equal(context.DeadlineExceeded, chat.Drain(ctx))
+
+	select {
+	case messages := <-returned:
+		assert.Empty(messages)
+	case <-time.After(time.Second):
+		assert.FailNow("the long poll wasn't woken by the drain")
+	}
+
+	assert.False(chat.trackWebsocket())
+	chat.websockets.Done()
+	assert.Nil(chat.Drain(context.Background()))
+}
+
+func TestChatFlush(t *testing.T) {
+	assert := assert.New(t)
+	memory := store.NewMemory()
+	chat := &Chat{Store: memory, Batcher: store.NewBatcher(memory, 10, time.Hour)}
+	chat.Batcher.Start()
+
+	message := &model.Message{UUID: "m1", CreatedUTC: time.Now().UTC(), SenderID: 1, ReceiverID: 2, Body: "Test"}
+	assert.Nil(chat.persistMessage(message))
+	assert.Nil(chat.Flush(context.Background()))
+
+	verify, err := memory.GetMessage("m1")
+	assert.Nil(err)
+	assert.Equal("m1", verify.UUID)
+}
@@ -0,0 +1,156 @@
+package controller
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/blendlabs/chatbus/server/model"
+	"github.com/blendlabs/chatbus/server/store"
+)
+
+const (
+	// EphemeralBatchSize is how many expired messages the ephemeral job reads from the store at a time.
+	EphemeralBatchSize = 500
+)
+
+var (
+	// ErrInvalidTTL is returned for a message sent with a negative ttl.
+	ErrInvalidTTL = errors.New("Message ttl can't be negative!")
+)
+
+// setMessageExpiry sets when a message being sent vanishes, from its ttl.
+func setMessageExpiry(message *model.Message) error {
+	if message.TTLSeconds < 0 {
+		return ErrInvalidTTL
+	}
+	message.ExpiresUTC = nil
+	if message.TTLSeconds > 0 {
+		expires := message.CreatedUTC.Add(time.Duration(message.TTLSeconds) * time.Second)
+		message.ExpiresUTC = &expires
+	}
+	return nil
+}
+
+// isCachedExpired returns if a cached copy of a message is past its expiry; change events don't count.
+func isCachedExpired(message *model.Message, now time.Time) bool {
+	return len(message.Event) == 0 && message.ExpiresUTC != nil && !message.ExpiresUTC.After(now)
+}
+
+// getCachedExpiredMessages returns a copy of each message in any queue that is past its expiry.
+func (c *Chat) getCachedExpiredMessages(now time.Time) []model.Message {
+	c.messageQueueLock.RLock()
+	defer c.messageQueueLock.RUnlock()
+
+	seen := map[string]bool{}
+	var messages []model.Message
+	for _, queue := range c.MessageQueues {
+		queue.SyncRoot().Lock()
+		queue.Each(func(v interface{}) {
+			message := model.TryCastMessage(v)
+			if message != nil && isCachedExpired(message, now) && !seen[message.UUID] {
+				seen[message.UUID] = true
+				messages = append(messages, *message)
+			}
+		})
+		queue.SyncRoot().Unlock()
+	}
+	return messages
+}
+
+// hasCachedTombstone returns if a user's queue already has the tombstone for a message.
+func (c *Chat) hasCachedTombstone(userID int, uuid string) bool {
+	var found bool
+	c.reverseEachCachedMessageUntil(userID, func(message *model.Message) bool {
+		found = message.UUID == uuid && message.Event == model.MessageEventExpire
+		return !found
+	})
+	return found
+}
+
+// expireMessage evicts every cached copy of an ephemeral message, and the change events that carry its body,
+// then queues a tombstone for each recipient that doesn't have one yet.
+func (c *Chat) expireMessage(message *model.Message, now time.Time) []model.MessageEvent {
+	c.evictCachedMessages(func(cached *model.Message) bool {
+		return cached.UUID == message.UUID && cached.Event != model.MessageEventExpire
+	})
+
+	var events []model.MessageEvent
+	for _, userID := range c.getMessageRecipients(message) {
+		if c.hasCachedTombstone(userID, message.UUID) {
+			continue
+		}
+		tombstone := model.Message{
+			UUID:       message.UUID,
+			CreatedUTC: message.CreatedUTC,
+			SenderID:   message.SenderID,
+			ReceiverID: message.ReceiverID,
+			RoomID:     message.RoomID,
+			ExpiresUTC: message.ExpiresUTC,
+			ReadOnce:   message.ReadOnce,
+			DeletedUTC: &now,
+			Event:      model.MessageEventExpire,
+		}
+		events = append(events, model.MessageEvent{
+			MessageUUID: message.UUID,
+			UserID:      userID,
+			Sequence:    c.queueMessageEvent(userID, &tombstone),
+			Event:       model.MessageEventExpire,
+			CreatedUTC:  now,
+		})
+	}
+	return events
+}
+
+// expireEphemeralMessages tombstones the ephemeral messages that are past their expiry, or read once and read,
+// and deletes them from the store. It returns how many messages were expired.
+func (c *Chat) expireEphemeralMessages(now time.Time, txs ...*sql.Tx) (int, error) {
+	expired := c.getCachedExpiredMessages(now)
+	seen := map[string]bool{}
+	for _, message := range expired {
+		seen[message.UUID] = true
+	}
+
+	for {
+		stored, err := c.store().GetExpiredMessages(now, EphemeralBatchSize, txs...)
+		if err != nil {
+			return 0, err
+		}
+
+		var uuids []string
+		var events []model.MessageEvent
+		for _, message := range stored {
+			uuids = append(uuids, message.UUID)
+			if !seen[message.UUID] {
+				seen[message.UUID] = true
+				expired = append(expired, message)
+			}
+		}
+		for index := range expired {
+			events = append(events, c.expireMessage(&expired[index], now)...)
+		}
+		expired = nil
+
+		// the tombstone events are written after the delete, which would take them along with the message's other events.
+		if err = c.store().DeleteMessages(uuids, txs...); err != nil {
+			return 0, err
+		}
+		for _, event := range events {
+			if err = c.store().CreateMessageEvent(event, txs...); err != nil {
+				return 0, err
+			}
+		}
+
+		if len(stored) < EphemeralBatchSize {
+			return len(seen), nil
+		}
+	}
+}
+
+// expireReadOnceMessage tombstones a read once message as soon as it is read; the ephemeral job deletes it from the store.
+func (c *Chat) expireReadOnceMessage(message *model.Message, receipt model.MessageReceipt) {
+	store.QueueSaveMessageReceipt(c.store(), receipt)
+	for _, event := range c.expireMessage(message, receipt.ReadUTC.UTC()) {
+		store.QueueCreateMessageEvent(c.store(), event)
+	}
+}
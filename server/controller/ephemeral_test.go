@@ -0,0 +1,124 @@
+package controller
+
+import (
+	"testing"
+	"time"
+
+	"github.com/blendlabs/chatbus/server/model"
+	assert "github.com/blendlabs/go-assert"
+	util "github.com/blendlabs/go-util"
+)
+
+func TestChatExpireEphemeralMessages(t *testing.T) {
+	assert := assert.New(t)
+	ts, err := newTestStore()
+	assert.Nil(err)
+	defer ts.Close()
+	tx := ts.Tx
+
+	u1 := &model.User{UUID: util.UUIDv4().ToShortString(), DisplayName: "Test User"}
+	u2 := &model.User{UUID: util.UUIDv4().ToShortString(), DisplayName: "Test User2"}
+	assert.Nil(ts.CreateUser(u1, tx))
+	assert.Nil(ts.CreateUser(u2, tx))
+	session1 := &model.Session{UUID: util.UUIDv4().ToShortString(), CreatedUTC: time.Now().UTC(), LastActiveUTC: time.Now().UTC(), UserID: u1.ID}
+	session2 := &model.Session{UUID: util.UUIDv4().ToShortString(), CreatedUTC: time.Now().UTC(), LastActiveUTC: time.Now().UTC(), UserID: u2.ID}
+	assert.Nil(ts.CreateSession(session1, tx))
+	assert.Nil(ts.CreateSession(session2, tx))
+
+	chat := &Chat{Store: ts}
+	assert.Nil(chat.Restore(tx))
+
+	session, _ := chat.getCachedSession(session1.UUID)
+	assert.Equal(ErrInvalidTTL, chat.sendMessage(session, &model.Message{ReceiverID: u2.ID, Body: "never", TTLSeconds: -1}))
+
+	ephemeral := model.Message{ReceiverID: u2.ID, Body: "ephemeral", TTLSeconds: 60}
+	assert.Nil(chat.sendMessage(session, &ephemeral))
+	assert.NotNil(ephemeral.ExpiresUTC)
+	assert.True(ephemeral.ExpiresUTC.Equal(ephemeral.CreatedUTC.Add(time.Minute)))
+	lasting := model.Message{ReceiverID: u2.ID, Body: "lasting"}
+	assert.Nil(chat.sendMessage(session, &lasting))
+	assert.Nil(lasting.ExpiresUTC)
+	assert.Nil(ts.CreateMessages([]model.Message{ephemeral, lasting}, tx))
+
+	expired, err := chat.expireEphemeralMessages(ephemeral.CreatedUTC.Add(time.Second), tx)
+	assert.Nil(err)
+	assert.Zero(expired)
+	assert.Len(chat.getCachedMessagesAfterSequence(u2.ID, 0), 2)
+
+	now := ephemeral.ExpiresUTC.Add(time.Second)
+	expired, err = chat.expireEphemeralMessages(now, tx)
+	assert.Nil(err)
+	assert.Equal(1, expired)
+
+	// both users see the lasting message, then a tombstone without the body.
+	for _, userID := range []int{u1.ID, u2.ID} {
+		messages := chat.getCachedMessagesAfterSequence(userID, 0)
+		assert.Len(messages, 2)
+		assert.Equal(lasting.UUID, messages[0].UUID)
+		assert.Equal(ephemeral.UUID, messages[1].UUID)
+		assert.Equal(model.MessageEventExpire, messages[1].Event)
+		assert.Empty(messages[1].Body)
+		assert.True(messages[1].DeletedUTC.Equal(now))
+	}
+
+	verify, err := ts.GetMessage(ephemeral.UUID, tx)
+	assert.Nil(err)
+	assert.True(verify.IsZero())
+	verify, err = ts.GetMessage(lasting.UUID, tx)
+	assert.Nil(err)
+	assert.False(verify.IsZero())
+
+	// the tombstones' sequences survive the delete.
+	sequences, err := ts.GetMessageSequences(tx)
+	assert.Nil(err)
+	assert.Equal(int64(3), sequences[u2.ID])
+
+	// sweeping again doesn't tombstone twice.
+	expired, err = chat.expireEphemeralMessages(now, tx)
+	assert.Nil(err)
+	assert.Zero(expired)
+	assert.Len(chat.getCachedMessagesAfterSequence(u2.ID, 0), 2)
+}
+
+func TestChatReadOnceMessage(t *testing.T) {
+	assert := assert.New(t)
+
+	session1 := &model.Session{
+		UUID:       "test_session",
+		CreatedUTC: time.Now().UTC(),
+		UserID:     1,
+		User:       &model.User{ID: 1, UUID: "test_user1"},
+	}
+	session2 := &model.Session{
+		UUID:       "test_session2",
+		CreatedUTC: time.Now().UTC(),
+		UserID:     2,
+		User:       &model.User{ID: 2, UUID: "test_user2"},
+	}
+
+	chat := new(Chat)
+	chat.cacheSession(session1)
+	chat.addMessageQueue(session1)
+	chat.cacheSession(session2)
+	chat.addMessageQueue(session2)
+
+	now := time.Now().UTC()
+	chat.queueMessage(&model.Message{UUID: "m1", CreatedUTC: now, SenderID: 1, ReceiverID: 2, Body: "once", ReadOnce: true})
+
+	// delivery alone doesn't expire it.
+	chat.markDelivered(2, chat.getCachedMessagesAfterSequence(2, 0))
+	assert.Len(chat.getCachedMessagesAfterSequence(1, 0), 2)
+
+	chat.saveReceipt(2, "m1", true)
+	for _, userID := range []int{1, 2} {
+		messages := chat.getCachedMessagesAfterSequence(userID, 0)
+		assert.Len(messages, 1)
+		assert.Equal("m1", messages[0].UUID)
+		assert.Equal(model.MessageEventExpire, messages[0].Event)
+		assert.Empty(messages[0].Body)
+	}
+
+	// reading it again does nothing.
+	chat.saveReceipt(2, "m1", true)
+	assert.Len(chat.getCachedMessagesAfterSequence(2, 0), 1)
+}
@@ -0,0 +1,117 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/blendlabs/chatbus/server/model"
+	"github.com/blendlabs/chatbus/server/viewmodel"
+	web "github.com/wcharczuk/go-web"
+)
+
+const (
+	// EventsKeepAliveInterval is how often we write a comment to an idle event stream.
+	EventsKeepAliveInterval = 30 * time.Second
+)
+
+var (
+	// ErrStreamingUnsupported is returned when the response can't be flushed incrementally.
+	ErrStreamingUnsupported = errors.New("Streaming is not supported by the response writer.")
+)
+
+// GET /api/events/:session_id
+func (c *Chat) eventsAction(rc *web.RequestContext) web.ControllerResult {
+	session, result := c.getRequestSession(rc)
+	if result != nil {
+		return result
+	}
+
+	rw := innerResponseWriter(rc.Response)
+	if _, isFlusher := rw.(http.Flusher); !isFlusher {
+		return rc.API().InternalError(ErrStreamingUnsupported)
+	}
+
+	lastEventID := rc.Request.Header.Get("Last-Event-ID")
+	if len(lastEventID) == 0 {
+		lastEventID = rc.Request.URL.Query().Get("last_event_id")
+	}
+
+	c.streamEvents(session, lastEventID, rw, rc.Request.Context().Done())
+	return nil
+}
+
+// streamEvents writes the messages queued for a session's user as server sent events until done is closed, the controller starts draining or a write fails.
+// The event id is the message uuid (see `model.Message.EventID`), so a client reconnecting with `Last-Event-ID` resumes after the last message it saw.
+func (c *Chat) streamEvents(session *model.Session, lastEventID string, rw http.ResponseWriter, done <-chan struct{}) error {
+	flusher := rw.(http.Flusher)
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.Header().Set("Connection", "keep-alive")
+	rw.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	if len(lastEventID) == 0 {
+		lastEventID = c.getLastCachedEventID(session.UserID)
+	}
+
+	keepAlive := time.NewTicker(EventsKeepAliveInterval)
+	defer keepAlive.Stop()
+	drain := c.getDrainSignal()
+
+	typing := []int{}
+	for {
+		signal := c.getMessageSignal(session.UserID)
+		messages := c.getCachedMessagesAfterEventID(session.UserID, lastEventID)
+		for x := 0; x < len(messages); x++ {
+			message := messages[x]
+			err := writeServerSentEvent(rw, message.EventID(), viewmodel.Event{Type: viewmodel.EventTypeMessage, Message: &message})
+			if err != nil {
+				return err
+			}
+			lastEventID = message.EventID()
+		}
+		currentTyping := c.getCachedTypingTo(session.UserID)
+		isTypingChanged := typingChanged(typing, currentTyping)
+		if isTypingChanged {
+			// typing events reuse the last message id so a reconnect still resumes from the right message.
+			err := writeServerSentEvent(rw, lastEventID, viewmodel.Event{Type: viewmodel.EventTypeTyping, Typing: currentTyping})
+			if err != nil {
+				return err
+			}
+			typing = currentTyping
+		}
+		c.markDelivered(session.UserID, messages)
+		if len(messages) > 0 || isTypingChanged {
+			flusher.Flush()
+			c.setCachedSessionLastActive(session.UUID)
+		}
+
+		select {
+		case <-signal:
+		case <-keepAlive.C:
+			if _, err := io.WriteString(rw, ": keep-alive\n\n"); err != nil {
+				return err
+			}
+			flusher.Flush()
+			c.setCachedSessionLastActive(session.UUID)
+		case <-done:
+			return nil
+		case <-drain:
+			return nil
+		}
+	}
+}
+
+func writeServerSentEvent(w io.Writer, id string, event viewmodel.Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", id, event.Type, data)
+	return err
+}
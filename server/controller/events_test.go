@@ -0,0 +1,76 @@
+package controller
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blendlabs/chatbus/server/model"
+	"github.com/blendlabs/chatbus/server/viewmodel"
+	assert "github.com/blendlabs/go-assert"
+)
+
+func TestChatStreamEvents(t *testing.T) {
+	assert := assert.New(t)
+
+	session1 := &model.Session{
+		UUID:       "test_session",
+		CreatedUTC: time.Now().UTC(),
+		UserID:     1,
+		User:       &model.User{ID: 1, UUID: "test_user1"},
+	}
+	session2 := &model.Session{
+		UUID:       "test_session2",
+		CreatedUTC: time.Now().UTC(),
+		UserID:     2,
+		User:       &model.User{ID: 2, UUID: "test_user2"},
+	}
+
+	chat := new(Chat)
+	chat.cacheSession(session1)
+	chat.addMessageQueue(session1)
+	chat.cacheSession(session2)
+	chat.addMessageQueue(session2)
+
+	chat.queueMessage(&model.Message{UUID: "m1", CreatedUTC: time.Now().UTC(), SenderID: 1, ReceiverID: 2, Body: "one"})
+	chat.queueMessage(&model.Message{UUID: "m2", CreatedUTC: time.Now().UTC(), SenderID: 1, ReceiverID: 2, Body: "two"})
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		chat.streamEvents(session2, req.Header.Get("Last-Event-ID"), rw, req.Context().Done())
+	}))
+	defer server.Close()
+
+	req, err := http.NewRequest("GET", server.URL, nil)
+	assert.Nil(err)
+	req.Header.Set("Last-Event-ID", "m1")
+	res, err := http.DefaultClient.Do(req)
+	assert.Nil(err)
+	defer res.Body.Close()
+	assert.Equal("text/event-stream", res.Header.Get("Content-Type"))
+
+	chat.queueMessage(&model.Message{UUID: "m3", CreatedUTC: time.Now().UTC(), SenderID: 1, ReceiverID: 2, Body: "three"})
+
+	var ids []string
+	var events []viewmodel.Event
+	scanner := bufio.NewScanner(res.Body)
+	for len(events) < 2 && scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "id: ") {
+			ids = append(ids, strings.TrimPrefix(line, "id: "))
+		}
+		if strings.HasPrefix(line, "data: ") {
+			var event viewmodel.Event
+			assert.Nil(json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event))
+			events = append(events, event)
+		}
+	}
+
+	assert.Len(events, 2)
+	assert.Equal([]string{"m2", "m3"}, ids)
+	assert.Equal("two", events[0].Message.Body)
+	assert.Equal("three", events[1].Message.Body)
+}
@@ -0,0 +1,29 @@
+package controller
+
+import (
+	"time"
+
+	chronometer "github.com/blendlabs/go-chronometer"
+)
+
+// ExpireEphemeralMessages is the job that tombstones and deletes ephemeral messages once they expire or are read.
+type ExpireEphemeralMessages struct {
+	Controller *Chat
+}
+
+// Name is the job name
+func (eem ExpireEphemeralMessages) Name() string {
+	return "expire_ephemeral_messages"
+}
+
+// Execute is the job body.
+func (eem ExpireEphemeralMessages) Execute(ct *chronometer.CancellationToken) error {
+	ct.CheckCancellation()
+	_, err := eem.Controller.expireEphemeralMessages(time.Now().UTC())
+	return err
+}
+
+// Schedule returns the job schedule.
+func (eem ExpireEphemeralMessages) Schedule() chronometer.Schedule {
+	return chronometer.Every(time.Second)
+}
@@ -0,0 +1,29 @@
+package controller
+
+import (
+	"time"
+
+	chronometer "github.com/blendlabs/go-chronometer"
+)
+
+// ExpireMessages is the job that deletes the messages that are past their retention.
+type ExpireMessages struct {
+	Controller *Chat
+}
+
+// Name is the job name
+func (em ExpireMessages) Name() string {
+	return "expire_messages"
+}
+
+// Execute is the job body.
+func (em ExpireMessages) Execute(ct *chronometer.CancellationToken) error {
+	ct.CheckCancellation()
+	_, err := em.Controller.expireMessages(time.Now().UTC())
+	return err
+}
+
+// Schedule returns the job schedule.
+func (em ExpireMessages) Schedule() chronometer.Schedule {
+	return chronometer.EveryMinute()
+}
@@ -0,0 +1,29 @@
+package controller
+
+import (
+	"time"
+
+	chronometer "github.com/blendlabs/go-chronometer"
+)
+
+// ExpireTyping is the job that clears stale typing indicators.
+type ExpireTyping struct {
+	Controller *Chat
+}
+
+// Name is the job name
+func (et ExpireTyping) Name() string {
+	return "expire_typing"
+}
+
+// Execute is the job body.
+func (et ExpireTyping) Execute(ct *chronometer.CancellationToken) error {
+	ct.CheckCancellation()
+	et.Controller.expireCachedTyping(time.Now().UTC())
+	return nil
+}
+
+// Schedule returns the job schedule.
+func (et ExpireTyping) Schedule() chronometer.Schedule {
+	return chronometer.Every(time.Second)
+}
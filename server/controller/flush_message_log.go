@@ -0,0 +1,37 @@
+package controller
+
+import (
+	"time"
+
+	chronometer "github.com/blendlabs/go-chronometer"
+)
+
+const (
+	// MessageLogFlushInterval is how often the write-ahead log is flushed to the store if the job isn't given an interval.
+	MessageLogFlushInterval = 500 * time.Millisecond
+)
+
+// FlushMessageLog is the job that writes the messages in the write-ahead log to the store.
+type FlushMessageLog struct {
+	Controller *Chat
+	Interval   time.Duration
+}
+
+// Name is the job name
+func (fm FlushMessageLog) Name() string {
+	return "flush_message_log"
+}
+
+// Execute is the job body.
+func (fm FlushMessageLog) Execute(ct *chronometer.CancellationToken) error {
+	ct.CheckCancellation()
+	return fm.Controller.flushMessageLog()
+}
+
+// Schedule returns the job schedule.
+func (fm FlushMessageLog) Schedule() chronometer.Schedule {
+	if fm.Interval > 0 {
+		return chronometer.Every(fm.Interval)
+	}
+	return chronometer.Every(MessageLogFlushInterval)
+}
@@ -0,0 +1,98 @@
+package controller
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/blendlabs/chatbus/server/model"
+	"github.com/blendlabs/chatbus/server/viewmodel"
+	web "github.com/wcharczuk/go-web"
+)
+
+const (
+	// HistoryDefaultLimit is the page size for history when a limit isn't given.
+	HistoryDefaultLimit = 50
+
+	// HistoryMaxLimit is the largest page size for history.
+	HistoryMaxLimit = 500
+)
+
+// historyEndOfTime is the cursor used for the first (newest) page of history.
+var historyEndOfTime = time.Date(9999, time.December, 31, 0, 0, 0, 0, time.UTC)
+
+// GET /api/history/:session_id/:user_id?before=<uuid|unix|rfc3339>&limit=N
+func (c *Chat) getHistoryAction(rc *web.RequestContext) web.ControllerResult {
+	session, result := c.getRequestSession(rc)
+	if result != nil {
+		return result
+	}
+
+	userID, err := rc.RouteParameterInt("user_id")
+	if err != nil {
+		return rc.API().BadRequest(err.Error())
+	}
+	if !c.hasCachedUser(userID) {
+		return rc.API().NotFound()
+	}
+
+	limit := HistoryDefaultLimit
+	limitStr := rc.Request.URL.Query().Get("limit")
+	if len(limitStr) > 0 {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil {
+			return rc.API().BadRequest(err.Error())
+		}
+		if limit < 1 {
+			limit = 1
+		}
+		if limit > HistoryMaxLimit {
+			limit = HistoryMaxLimit
+		}
+	}
+
+	before := historyEndOfTime
+	var beforeUUID string
+	beforeStr := rc.Request.URL.Query().Get("before")
+	if len(beforeStr) > 0 {
+		if unix, parseErr := strconv.ParseInt(beforeStr, 10, 64); parseErr == nil {
+			before = time.Unix(unix, 0).UTC()
+		} else if timestamp, parseErr := time.Parse(time.RFC3339Nano, beforeStr); parseErr == nil {
+			before = timestamp.UTC()
+		} else {
+			message, err := c.store().GetMessage(beforeStr, rc.Tx())
+			if err != nil {
+				return rc.API().InternalError(err)
+			}
+			if message.IsZero() {
+				return rc.API().NotFound()
+			}
+			before = message.CreatedUTC
+			beforeUUID = message.UUID
+		}
+	}
+
+	messages, err := c.store().GetConversationBefore(session.UserID, userID, before, beforeUUID, limit, rc.Tx())
+	if err != nil {
+		return rc.API().InternalError(err)
+	}
+	c.setCachedSessionLastActive(session.UUID)
+	return rc.API().JSON(newHistory(session.UserID, messages, limit))
+}
+
+// newHistory builds a page of history from messages fetched newest first.
+func newHistory(userID int, messages []model.Message, limit int) viewmodel.History {
+	history := viewmodel.History{Messages: []model.Message{}}
+	for x := len(messages) - 1; x >= 0; x-- {
+		message := messages[x]
+		if message.SenderID == userID {
+			message.Sequence = message.SenderSequence
+		} else {
+			message.Sequence = message.ReceiverSequence
+		}
+		history.Messages = append(history.Messages, message)
+	}
+	if len(messages) == limit && limit > 0 {
+		history.Before = history.Messages[0].UUID
+	}
+	return history
+}
@@ -0,0 +1,74 @@
+package controller
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/blendlabs/chatbus/server/model"
+	"github.com/blendlabs/chatbus/server/viewmodel"
+	assert "github.com/blendlabs/go-assert"
+	util "github.com/blendlabs/go-util"
+	web "github.com/wcharczuk/go-web"
+)
+
+type serviceResponseOfHistory struct {
+	Meta     map[string]interface{} `json:"meta"`
+	Response viewmodel.History      `json:"response"`
+}
+
+func TestGetHistory(t *testing.T) {
+	assert := assert.New(t)
+	ts, err := newTestStore()
+	assert.Nil(err)
+	defer ts.Close()
+	tx := ts.Tx
+
+	u1 := &model.User{UUID: util.UUIDv4().ToShortString(), DisplayName: "Test User"}
+	assert.Nil(ts.CreateUser(u1, tx))
+
+	u2 := &model.User{UUID: util.UUIDv4().ToShortString(), DisplayName: "Test User"}
+	assert.Nil(ts.CreateUser(u2, tx))
+
+	s1 := &model.Session{
+		UUID:          util.UUIDv4().ToShortString(),
+		CreatedUTC:    time.Now().UTC(),
+		LastActiveUTC: time.Now().UTC(),
+		UserID:        u1.ID,
+		User:          u1,
+	}
+	assert.Nil(ts.CreateSession(s1, tx))
+
+	now := time.Now().UTC()
+	for x := 5; x > 0; x-- {
+		message := model.Message{
+			UUID:       util.UUIDv4().ToShortString(),
+			CreatedUTC: now.Add(time.Duration(-x) * time.Minute),
+			SenderID:   u1.ID,
+			ReceiverID: u2.ID,
+			Body:       "this is a test",
+		}
+		assert.Nil(ts.CreateMessage(message, tx))
+	}
+
+	app := web.New()
+	app.IsolateTo(tx)
+	chat := &Chat{Store: ts}
+	assert.Nil(chat.Restore(tx))
+	app.Register(chat)
+
+	var response serviceResponseOfHistory
+	err = app.Mock().WithVerb("GET").WithPathf("/api/history/%s/%d?limit=3", s1.UUID, u2.ID).JSON(&response)
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, response.Meta["http_code"])
+	assert.Len(response.Response.Messages, 3)
+	assert.True(response.Response.Messages[0].CreatedUTC.Before(response.Response.Messages[2].CreatedUTC))
+	assert.Equal(response.Response.Messages[0].UUID, response.Response.Before)
+
+	var older serviceResponseOfHistory
+	err = app.Mock().WithVerb("GET").WithPathf("/api/history/%s/%d?limit=3&before=%s", s1.UUID, u2.ID, response.Response.Before).JSON(&older)
+	assert.Nil(err)
+	assert.Len(older.Response.Messages, 2)
+	assert.Empty(older.Response.Before)
+	assert.True(older.Response.Messages[1].CreatedUTC.Before(response.Response.Messages[0].CreatedUTC))
+}
@@ -0,0 +1,300 @@
+package controller
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256" // registers the hashes the signing algorithms use.
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+)
+
+const (
+	// IdentityDefaultLeeway is how much clock skew is allowed on an identity token's expiry and not before times if the verifier doesn't say.
+	IdentityDefaultLeeway = time.Minute
+)
+
+var (
+	// ErrInvalidIdentityToken is returned for an identity token that is malformed, or whose signature doesn't match.
+	ErrInvalidIdentityToken = errors.New("Invalid identity token!")
+
+	// ErrUnknownIdentityKey is returned for an identity token signed with a key that isn't in the key set.
+	ErrUnknownIdentityKey = errors.New("Identity token was signed with an unknown key!")
+
+	// ErrIdentityTokenExpired is returned for an identity token that is past its expiry, or not valid yet.
+	ErrIdentityTokenExpired = errors.New("Identity token has expired or is not valid yet!")
+
+	// ErrIdentityClaimMismatch is returned for an identity token without a subject, or for another issuer or audience.
+	ErrIdentityClaimMismatch = errors.New("Identity token claims don't match!")
+
+	// ErrNoIdentityKeys is returned for a key set without any keys we can use.
+	ErrNoIdentityKeys = errors.New("Identity key set has no usable keys!")
+)
+
+// identityAlgorithms are the signing algorithms identity tokens can use, by name, with their hash.
+// Symmetric and unsigned tokens are never accepted.
+var identityAlgorithms = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+	"ES512": crypto.SHA512,
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+type identityKey struct {
+	alg    string
+	public crypto.PublicKey
+}
+
+type identityHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type identityClaims struct {
+	Subject   string          `json:"sub"`
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt float64         `json:"exp"`
+	NotBefore float64         `json:"nbf"`
+}
+
+// NewIdentityVerifier returns a verifier for the identity tokens signed by the keys in a json web key set.
+// RSA and EC signing keys are used; other keys in the set are skipped.
+func NewIdentityVerifier(jwks []byte) (*IdentityVerifier, error) {
+	var set jsonWebKeySet
+	if err := json.Unmarshal(jwks, &set); err != nil {
+		return nil, err
+	}
+	verifier := &IdentityVerifier{keys: map[string]identityKey{}}
+	for _, key := range set.Keys {
+		if len(key.Use) > 0 && key.Use != "sig" {
+			continue
+		}
+		public, err := parseJSONWebKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if public != nil {
+			verifier.keys[key.Kid] = identityKey{alg: key.Alg, public: public}
+		}
+	}
+	if len(verifier.keys) == 0 {
+		return nil, ErrNoIdentityKeys
+	}
+	return verifier, nil
+}
+
+// ReadIdentityVerifier returns a verifier for the key set in a json web key set file.
+func ReadIdentityVerifier(path string) (*IdentityVerifier, error) {
+	jwks, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewIdentityVerifier(jwks)
+}
+
+// IdentityVerifier checks the json web tokens our identity provider issues, so sessions are only created for the user a token is for.
+// The token's subject is the user's uuid.
+type IdentityVerifier struct {
+	keys map[string]identityKey
+
+	// Issuer is the `iss` tokens must have; empty accepts any.
+	Issuer string
+	// Audience is an `aud` tokens must have; empty accepts any.
+	Audience string
+	// Leeway is the clock skew allowed on `exp` and `nbf`; zero uses the default.
+	Leeway time.Duration
+}
+
+func (iv *IdentityVerifier) leeway() time.Duration {
+	if iv.Leeway > 0 {
+		return iv.Leeway
+	}
+	return IdentityDefaultLeeway
+}
+
+// Verify checks an identity token's signature and claims as of a given time and returns its subject.
+func (iv *IdentityVerifier) Verify(token string, now time.Time) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", ErrInvalidIdentityToken
+	}
+
+	var header identityHeader
+	if err := decodeJSONWebSegment(parts[0], &header); err != nil {
+		return "", ErrInvalidIdentityToken
+	}
+	hash, isAllowed := identityAlgorithms[header.Alg]
+	if !isAllowed {
+		return "", ErrInvalidIdentityToken
+	}
+	key, err := iv.getKey(header)
+	if err != nil {
+		return "", err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", ErrInvalidIdentityToken
+	}
+	digest := hash.New()
+	digest.Write([]byte(parts[0] + "." + parts[1]))
+	if !verifyIdentitySignature(key.public, digest.Sum(nil), hash, signature) {
+		return "", ErrInvalidIdentityToken
+	}
+
+	var claims identityClaims
+	if err = decodeJSONWebSegment(parts[1], &claims); err != nil {
+		return "", ErrInvalidIdentityToken
+	}
+	if claims.ExpiresAt == 0 || !now.Before(unixFloat(claims.ExpiresAt).Add(iv.leeway())) {
+		return "", ErrIdentityTokenExpired
+	}
+	if claims.NotBefore != 0 && now.Add(iv.leeway()).Before(unixFloat(claims.NotBefore)) {
+		return "", ErrIdentityTokenExpired
+	}
+	if len(claims.Subject) == 0 || (len(iv.Issuer) > 0 && claims.Issuer != iv.Issuer) {
+		return "", ErrIdentityClaimMismatch
+	}
+	if len(iv.Audience) > 0 && !hasAudience(claims.Audience, iv.Audience) {
+		return "", ErrIdentityClaimMismatch
+	}
+	return claims.Subject, nil
+}
+
+// getKey finds the key a token was signed with, by its key id; a token without one can only use a key set with a single key.
+func (iv *IdentityVerifier) getKey(header identityHeader) (identityKey, error) {
+	key, hasKey := iv.keys[header.Kid]
+	if !hasKey && len(header.Kid) == 0 && len(iv.keys) == 1 {
+		for _, only := range iv.keys {
+			key, hasKey = only, true
+		}
+	}
+	if !hasKey {
+		return key, ErrUnknownIdentityKey
+	}
+	if len(key.alg) > 0 && key.alg != header.Alg {
+		return key, ErrInvalidIdentityToken
+	}
+	// the algorithm has to be for the kind of key, i.e. an RSA key can't verify an ES256 token.
+	switch key.public.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(header.Alg, "RS") {
+			return key, ErrInvalidIdentityToken
+		}
+	case *ecdsa.PublicKey:
+		if !strings.HasPrefix(header.Alg, "ES") {
+			return key, ErrInvalidIdentityToken
+		}
+	}
+	return key, nil
+}
+
+func verifyIdentitySignature(public crypto.PublicKey, digest []byte, hash crypto.Hash, signature []byte) bool {
+	switch typed := public.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(typed, hash, digest, signature) == nil
+	case *ecdsa.PublicKey:
+		// EC signatures are r and s back to back, each the size of the curve.
+		size := (typed.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(typed, digest, r, s)
+	}
+	return false
+}
+
+// parseJSONWebKey returns the public key for a json web key, or nil if it isn't a kind we use.
+func parseJSONWebKey(key jsonWebKey) (crypto.PublicKey, error) {
+	switch key.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(key.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(key.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch key.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, nil
+		}
+		x, err := base64.RawURLEncoding.DecodeString(key.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(key.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, nil
+}
+
+func decodeJSONWebSegment(segment string, v interface{}) error {
+	contents, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(contents, v)
+}
+
+// hasAudience returns if an `aud` claim, which is either a string or a list of them, includes an audience.
+func hasAudience(claim json.RawMessage, audience string) bool {
+	var single string
+	if json.Unmarshal(claim, &single) == nil {
+		return single == audience
+	}
+	var list []string
+	if json.Unmarshal(claim, &list) != nil {
+		return false
+	}
+	for _, value := range list {
+		if value == audience {
+			return true
+		}
+	}
+	return false
+}
+
+func unixFloat(seconds float64) time.Time {
+	return time.Unix(0, int64(seconds*float64(time.Second)))
+}
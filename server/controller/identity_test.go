@@ -0,0 +1,166 @@
+package controller
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blendlabs/chatbus/server/model"
+	assert "github.com/blendlabs/go-assert"
+	util "github.com/blendlabs/go-util"
+	web "github.com/wcharczuk/go-web"
+)
+
+func encodeJSONWebSegment(v interface{}) string {
+	contents, _ := json.Marshal(v)
+	return base64.RawURLEncoding.EncodeToString(contents)
+}
+
+func signIdentityToken(key crypto.Signer, alg, kid string, claims map[string]interface{}) string {
+	payload := encodeJSONWebSegment(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"}) + "." + encodeJSONWebSegment(claims)
+	hash := identityAlgorithms[alg]
+	digest := hash.New()
+	digest.Write([]byte(payload))
+
+	var signature []byte
+	switch typed := key.(type) {
+	case *rsa.PrivateKey:
+		signature, _ = rsa.SignPKCS1v15(rand.Reader, typed, hash, digest.Sum(nil))
+	case *ecdsa.PrivateKey:
+		r, s, _ := ecdsa.Sign(rand.Reader, typed, digest.Sum(nil))
+		size := (typed.Curve.Params().BitSize + 7) / 8
+		signature = make([]byte, 2*size)
+		rBytes, sBytes := r.Bytes(), s.Bytes()
+		copy(signature[size-len(rBytes):size], rBytes)
+		copy(signature[2*size-len(sBytes):], sBytes)
+	}
+	return payload + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func testJWKS(rsaKey *rsa.PrivateKey, ecKey *ecdsa.PrivateKey) []byte {
+	return []byte(fmt.Sprintf(`{"keys":[
+		{"kty":"RSA","kid":"rsa","alg":"RS256","use":"sig","n":"%s","e":"%s"},
+		{"kty":"EC","kid":"ec","crv":"P-256","x":"%s","y":"%s"},
+		{"kty":"oct","kid":"hmac","k":"c2VjcmV0"}
+	]}`,
+		base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes()),
+		base64.RawURLEncoding.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes()),
+		base64.RawURLEncoding.EncodeToString(ecKey.X.Bytes()),
+		base64.RawURLEncoding.EncodeToString(ecKey.Y.Bytes()),
+	))
+}
+
+func TestIdentityVerifier(t *testing.T) {
+	assert := assert.New(t)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(err)
+
+	verifier, err := NewIdentityVerifier(testJWKS(rsaKey, ecKey))
+	assert.Nil(err)
+	assert.Len(verifier.keys, 2)
+	verifier.Issuer = "https://id.example.com"
+	verifier.Audience = "chatbus"
+
+	now := time.Now()
+	claims := map[string]interface{}{
+		"sub": "test_user",
+		"iss": "https://id.example.com",
+		"aud": []string{"chatbus", "other"},
+		"exp": now.Add(time.Hour).Unix(),
+	}
+
+	subject, err := verifier.Verify(signIdentityToken(rsaKey, "RS256", "rsa", claims), now)
+	assert.Nil(err)
+	assert.Equal("test_user", subject)
+	subject, err = verifier.Verify(signIdentityToken(ecKey, "ES256", "ec", claims), now)
+	assert.Nil(err)
+	assert.Equal("test_user", subject)
+
+	// the key has to sign with the algorithm it's for, and be in the set.
+	_, err = verifier.Verify(signIdentityToken(rsaKey, "RS512", "rsa", claims), now)
+	assert.Equal(ErrInvalidIdentityToken, err)
+	_, err = verifier.Verify(signIdentityToken(rsaKey, "RS256", "ec", claims), now)
+	assert.Equal(ErrInvalidIdentityToken, err)
+	_, err = verifier.Verify(signIdentityToken(rsaKey, "RS256", "missing", claims), now)
+	assert.Equal(ErrUnknownIdentityKey, err)
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(err)
+	_, err = verifier.Verify(signIdentityToken(otherKey, "ES256", "ec", claims), now)
+	assert.Equal(ErrInvalidIdentityToken, err)
+
+	// unsigned tokens are never accepted.
+	token := signIdentityToken(rsaKey, "RS256", "rsa", claims)
+	parts := strings.Split(token, ".")
+	_, err = verifier.Verify(encodeJSONWebSegment(map[string]string{"alg": "none", "kid": "rsa"})+"."+parts[1]+".", now)
+	assert.Equal(ErrInvalidIdentityToken, err)
+	_, err = verifier.Verify(parts[0]+"."+encodeJSONWebSegment(map[string]interface{}{"sub": "someone_else", "exp": claims["exp"]})+"."+parts[2], now)
+	assert.Equal(ErrInvalidIdentityToken, err)
+
+	_, err = verifier.Verify(token, now.Add(2*time.Hour))
+	assert.Equal(ErrIdentityTokenExpired, err)
+	claims["aud"] = "other"
+	_, err = verifier.Verify(signIdentityToken(rsaKey, "RS256", "rsa", claims), now)
+	assert.Equal(ErrIdentityClaimMismatch, err)
+	claims["aud"] = "chatbus"
+	claims["iss"] = "https://elsewhere.example.com"
+	_, err = verifier.Verify(signIdentityToken(rsaKey, "RS256", "rsa", claims), now)
+	assert.Equal(ErrIdentityClaimMismatch, err)
+
+	_, err = NewIdentityVerifier([]byte(`{"keys":[{"kty":"oct","k":"c2VjcmV0"}]}`))
+	assert.Equal(ErrNoIdentityKeys, err)
+}
+
+func TestChatNewSessionWithIdentity(t *testing.T) {
+	assert := assert.New(t)
+	ts, err := newTestStore()
+	assert.Nil(err)
+	defer ts.Close()
+	tx := ts.Tx
+
+	u1 := &model.User{UUID: util.UUIDv4().ToShortString(), DisplayName: "Test User"}
+	u2 := &model.User{UUID: util.UUIDv4().ToShortString(), DisplayName: "Test User2"}
+	assert.Nil(ts.CreateUser(u1, tx))
+	assert.Nil(ts.CreateUser(u2, tx))
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(err)
+	verifier, err := NewIdentityVerifier(testJWKS(rsaKey, ecKey))
+	assert.Nil(err)
+
+	app := web.New()
+	app.IsolateTo(tx)
+	chat := &Chat{Store: ts, Identity: verifier}
+	app.Register(chat)
+
+	token := signIdentityToken(rsaKey, "RS256", "rsa", map[string]interface{}{"sub": u1.UUID, "exp": time.Now().Add(time.Hour).Unix()})
+
+	meta, err := app.Mock().WithVerb("POST").WithPathf("/api/session/%d", u1.ID).ExecuteWithMeta()
+	assert.Nil(err)
+	assert.Equal(http.StatusForbidden, meta.StatusCode)
+
+	// a token for one user can't start a session for another.
+	meta, err = app.Mock().WithVerb("POST").WithPathf("/api/session/%d", u2.ID).WithHeader("Authorization", "Bearer "+token).ExecuteWithMeta()
+	assert.Nil(err)
+	assert.Equal(http.StatusForbidden, meta.StatusCode)
+
+	var response serviceResponseOfSession
+	err = app.Mock().WithVerb("POST").WithPathf("/api/session/%d", u1.ID).WithHeader("Authorization", "Bearer "+token).JSON(&response)
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, response.Meta["http_code"])
+	assert.Equal(u1.ID, response.Response.UserID)
+}
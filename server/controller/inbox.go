@@ -0,0 +1,104 @@
+package controller
+
+import (
+	"database/sql"
+
+	"github.com/blendlabs/chatbus/server/model"
+	"github.com/blendlabs/go-util/collections"
+)
+
+// getInbox returns a user's inbox, making it if need be.
+func (c *Chat) getInbox(userID int) *collections.RingBuffer {
+	c.inboxLock.Lock()
+	defer c.inboxLock.Unlock()
+
+	if c.Inboxes == nil {
+		c.Inboxes = map[int]*collections.RingBuffer{}
+	}
+	inbox, hasInbox := c.Inboxes[userID]
+	if !hasInbox {
+		inbox = collections.NewRingBufferWithCapacity(1024)
+		c.Inboxes[userID] = inbox
+	}
+	return inbox
+}
+
+// takeInbox removes and returns a user's inbox, or nil if they don't have one.
+func (c *Chat) takeInbox(userID int) *collections.RingBuffer {
+	c.inboxLock.Lock()
+	defer c.inboxLock.Unlock()
+
+	inbox, hasInbox := c.Inboxes[userID]
+	if !hasInbox {
+		return nil
+	}
+	delete(c.Inboxes, userID)
+	return inbox
+}
+
+// getCachedUnreadCount returns how many of the messages in a user's queue they haven't read.
+func (c *Chat) getCachedUnreadCount(userID int) int {
+	return len(c.getCachedUnreadThroughSequence(userID, c.getSequence(userID)))
+}
+
+// restoreInboxes refills the inboxes of users without a session from the store.
+// Entries for users that have a session, or that were already delivered to them, are stale and skipped.
+func (c *Chat) restoreInboxes(txs ...*sql.Tx) error {
+	entries, err := c.store().GetInboxMessages(txs...)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	var uuids []string
+	for _, entry := range entries {
+		uuids = append(uuids, entry.MessageUUID)
+	}
+	stored, err := c.store().GetMessagesByUUID(uuids, txs...)
+	if err != nil {
+		return err
+	}
+	receipts, err := c.store().GetMessageReceipts(uuids, txs...)
+	if err != nil {
+		return err
+	}
+	messages := map[string]model.Message{}
+	for _, message := range stored {
+		message.Receipts = receipts[message.UUID]
+		messages[message.UUID] = message
+	}
+
+	c.messageQueueLock.RLock()
+	defer c.messageQueueLock.RUnlock()
+	for _, entry := range entries {
+		if _, hasQueue := c.MessageQueues[entry.UserID]; hasQueue || !c.hasCachedUser(entry.UserID) {
+			continue
+		}
+		message, hasMessage := messages[entry.MessageUUID]
+		if !hasMessage {
+			continue
+		}
+		if receipt, hasReceipt := message.GetReceipt(entry.UserID); hasReceipt && receipt.DeliveredUTC != nil {
+			continue
+		}
+		c.restoreInboxMessage(entry.UserID, entry.Sequence, message)
+	}
+	return nil
+}
+
+// restoreInboxMessage puts a stored message back into a user's inbox with the sequence it was given.
+func (c *Chat) restoreInboxMessage(userID int, sequence int64, message model.Message) {
+	inbox := c.getInbox(userID)
+	inbox.SyncRoot().Lock()
+	defer inbox.SyncRoot().Unlock()
+
+	c.nextSequence(userID, sequence)
+	message.Sequence = sequence
+	message.RoomSequences = nil
+	if inbox.Len() >= MessageQueueMaxLength {
+		inbox.Dequeue()
+	}
+	inbox.Enqueue(&message)
+}
@@ -0,0 +1,97 @@
+package controller
+
+import (
+	"testing"
+	"time"
+
+	"github.com/blendlabs/chatbus/server/model"
+	assert "github.com/blendlabs/go-assert"
+	util "github.com/blendlabs/go-util"
+)
+
+func TestChatInbox(t *testing.T) {
+	assert := assert.New(t)
+
+	session1 := &model.Session{UUID: "test_session", CreatedUTC: time.Now().UTC(), UserID: 1, User: &model.User{ID: 1, UUID: "test_user1"}}
+	session2 := &model.Session{UUID: "test_session2", CreatedUTC: time.Now().UTC(), UserID: 2, User: &model.User{ID: 2, UUID: "test_user2"}}
+
+	chat := new(Chat)
+	chat.cacheUser(session1.User)
+	chat.cacheUser(session2.User)
+	chat.cacheSession(session1)
+	chat.cacheSessionByUser(session1)
+	chat.addMessageQueue(session1)
+
+	now := time.Now().UTC()
+	chat.queueMessage(&model.Message{UUID: "m1", CreatedUTC: now.Add(-time.Second), SenderID: 1, ReceiverID: 2, Body: "first"})
+	chat.queueMessage(&model.Message{UUID: "m2", CreatedUTC: now, SenderID: 1, ReceiverID: 2, Body: "second"})
+	// messages for users that don't exist don't get an inbox.
+	chat.queueMessage(&model.Message{UUID: "m3", CreatedUTC: now, SenderID: 1, ReceiverID: 3, Body: "nobody"})
+	assert.Len(chat.Inboxes, 1)
+	assert.Empty(chat.getCachedMessagesAfterSequence(2, 0))
+
+	// an edit while the user is away is waiting too.
+	edited := model.Message{UUID: "m1", CreatedUTC: now.Add(-time.Second), SenderID: 1, ReceiverID: 2, Body: "first, edited"}
+	chat.changeMessage(&edited, model.MessageEventEdit)
+
+	chat.cacheSession(session2)
+	chat.cacheSessionByUser(session2)
+	assert.True(chat.addMessageQueue(session2))
+	assert.Empty(chat.Inboxes)
+
+	messages := chat.getCachedMessagesAfterSequence(2, 0)
+	assert.Len(messages, 3)
+	assert.Equal("m1", messages[0].UUID)
+	assert.Equal(int64(1), messages[0].Sequence)
+	assert.Equal("m2", messages[1].UUID)
+	assert.Equal(int64(2), messages[1].Sequence)
+	assert.Equal(model.MessageEventEdit, messages[2].Event)
+	assert.Equal(2, chat.getCachedUnreadCount(2))
+
+	chat.saveReceipt(2, "m1", true)
+	assert.Equal(1, chat.getCachedUnreadCount(2))
+
+	// a second session for the user shares the queue.
+	assert.False(chat.addMessageQueue(&model.Session{UUID: "test_session3", UserID: 2}))
+}
+
+func TestChatRestoreInboxes(t *testing.T) {
+	assert := assert.New(t)
+	ts, err := newTestStore()
+	assert.Nil(err)
+	defer ts.Close()
+	tx := ts.Tx
+
+	u1 := &model.User{UUID: util.UUIDv4().ToShortString(), DisplayName: "Test User"}
+	u2 := &model.User{UUID: util.UUIDv4().ToShortString(), DisplayName: "Test User2"}
+	assert.Nil(ts.CreateUser(u1, tx))
+	assert.Nil(ts.CreateUser(u2, tx))
+	assert.Nil(ts.CreateSession(&model.Session{UUID: util.UUIDv4().ToShortString(), CreatedUTC: time.Now().UTC(), LastActiveUTC: time.Now().UTC(), UserID: u1.ID}, tx))
+
+	now := time.Now().UTC()
+	delivered := model.Message{UUID: util.UUIDv4().ToShortString(), CreatedUTC: now.Add(-time.Minute), SenderID: u1.ID, ReceiverID: u2.ID, Body: "delivered", SenderSequence: 1, ReceiverSequence: 1}
+	pending := model.Message{UUID: util.UUIDv4().ToShortString(), CreatedUTC: now, SenderID: u1.ID, ReceiverID: u2.ID, Body: "pending", SenderSequence: 2, ReceiverSequence: 2}
+	assert.Nil(ts.CreateMessages([]model.Message{delivered, pending}, tx))
+	assert.Nil(ts.SaveMessageReceipt(model.MessageReceipt{MessageUUID: delivered.UUID, UserID: u2.ID, DeliveredUTC: &now}, tx))
+	assert.Nil(ts.CreateInboxMessage(model.InboxMessage{UserID: u2.ID, MessageUUID: delivered.UUID, Sequence: 1, CreatedUTC: now}, tx))
+	assert.Nil(ts.CreateInboxMessage(model.InboxMessage{UserID: u2.ID, MessageUUID: pending.UUID, Sequence: 2, CreatedUTC: now}, tx))
+	// entries for users with a session are stale.
+	assert.Nil(ts.CreateInboxMessage(model.InboxMessage{UserID: u1.ID, MessageUUID: pending.UUID, Sequence: 2, CreatedUTC: now}, tx))
+
+	chat := &Chat{Store: ts}
+	assert.Nil(chat.Restore(tx))
+	assert.Len(chat.Inboxes, 1)
+
+	assert.True(chat.addMessageQueue(&model.Session{UUID: util.UUIDv4().ToShortString(), UserID: u2.ID}))
+	messages := chat.getCachedMessagesAfterSequence(u2.ID, 0)
+	assert.Len(messages, 1)
+	assert.Equal(pending.UUID, messages[0].UUID)
+	assert.Equal(int64(2), messages[0].Sequence)
+	assert.Equal(1, chat.getCachedUnreadCount(u2.ID))
+
+	assert.Nil(ts.DeleteInboxMessages(u2.ID, tx))
+	entries, err := ts.GetInboxMessages(tx)
+	assert.Nil(err)
+	assert.Len(entries, 1)
+	assert.Equal(u1.ID, entries[0].UserID)
+}
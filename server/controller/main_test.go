@@ -1,13 +1,21 @@
 package controller
 
 import (
+	"database/sql"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/blendlabs/chatbus/server/model"
+	"github.com/blendlabs/chatbus/server/store"
 	"github.com/blendlabs/spiffy"
 )
 
+// testStoreKind is the kind of store the tests run against; set `STORE=memory` or `STORE=sqlite` to run them without postgres.
+var testStoreKind = os.Getenv("STORE")
+
 func connectDB() error {
 	spiffy.CreateDbAlias("main", spiffy.NewDbConnectionFromEnvironment())
 	spiffy.SetDefaultAlias("main")
@@ -21,7 +29,54 @@ func connectDB() error {
 	return nil
 }
 
+// testStore is the store a test runs against.
+// For postgres it is isolated to a transaction that is rolled back on close; otherwise it is a fresh store per test.
+type testStore struct {
+	store.Store
+	Tx  *sql.Tx
+	Dir string
+}
+
+// Close rolls back the test's changes.
+func (ts *testStore) Close() error {
+	if sqlite, isSqlite := ts.Store.(*store.Sqlite); isSqlite {
+		sqlite.DB.Close()
+		return os.RemoveAll(ts.Dir)
+	}
+	if ts.Tx != nil {
+		return ts.Tx.Rollback()
+	}
+	return nil
+}
+
+func newTestStore() (*testStore, error) {
+	switch testStoreKind {
+	case store.KindMemory:
+		return &testStore{Store: store.NewMemory()}, nil
+	case store.KindSqlite:
+		dir, err := ioutil.TempDir("", "chatbus")
+		if err != nil {
+			return nil, err
+		}
+		sqlite, err := store.OpenSqlite(filepath.Join(dir, "chatbus.db"))
+		if err != nil {
+			return nil, err
+		}
+		return &testStore{Store: sqlite, Dir: dir}, nil
+	}
+	tx, err := model.DB().Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &testStore{Store: store.Postgres{}, Tx: tx}, nil
+}
+
 func TestMain(m *testing.M) {
+	if testStoreKind == store.KindMemory || testStoreKind == store.KindSqlite {
+		store.SetDefault(store.NewMemory())
+		os.Exit(m.Run())
+	}
+
 	err := connectDB()
 	if err != nil {
 		log.Fatal(err)
@@ -0,0 +1,224 @@
+package controller
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/blendlabs/chatbus/server/model"
+	"github.com/blendlabs/chatbus/server/store"
+	"github.com/blendlabs/go-util/collections"
+	web "github.com/wcharczuk/go-web"
+)
+
+const (
+	// MessageInsertWaitMaxDuration is the longest a change to a message waits for the message's own insert to be written.
+	MessageInsertWaitMaxDuration = 10 * time.Second
+)
+
+var (
+	// ErrNotMessageSender is returned when a session tries to change a message its user didn't send.
+	ErrNotMessageSender = errors.New("Only the sender can change a message!")
+
+	// ErrMessageDeleted is returned when a session tries to change a message that has been retracted.
+	ErrMessageDeleted = errors.New("Message has been deleted!")
+
+	// ErrMessageNotStored is returned when a message still isn't in the store after this node wrote out what it had waiting,
+	// i.e. it was sent through another node in the cluster that hasn't written it yet.
+	ErrMessageNotStored = errors.New("Message hasn't been stored yet!")
+)
+
+// getMessageRecipients returns the users whose queues a message was routed to.
+func (c *Chat) getMessageRecipients(message *model.Message) []int {
+	recipients := collections.NewSetOfInt()
+	recipients.Add(message.SenderID)
+	if message.RoomID != 0 {
+		for _, userID := range c.getCachedRoomMembers(message.RoomID) {
+			recipients.Add(userID)
+		}
+	} else {
+		recipients.Add(message.ReceiverID)
+	}
+	return recipients.AsSlice()
+}
+
+// getSenderMessage finds a message sent by a session's user, preferring the cached copy over the database.
+func (c *Chat) getSenderMessage(session *model.Session, uuid string, tx *sql.Tx) (*model.Message, error) {
+	message, found := c.getCachedMessage(session.UserID, uuid)
+	if !found {
+		stored, err := c.store().GetMessage(uuid, tx)
+		if err != nil {
+			return nil, err
+		}
+		if stored.IsZero() {
+			return nil, nil
+		}
+		message = *stored
+	}
+	if message.SenderID != session.UserID {
+		return nil, ErrNotMessageSender
+	}
+	if message.DeletedUTC != nil {
+		return nil, ErrMessageDeleted
+	}
+	return &message, nil
+}
+
+// changeMessage replaces the cached copies of a changed message in every recipient's queue and queues a change event for each of them.
+func (c *Chat) changeMessage(message *model.Message, event string) []model.MessageEvent {
+	now := time.Now().UTC()
+	var events []model.MessageEvent
+	for _, userID := range c.getMessageRecipients(message) {
+		c.updateCachedMessage(userID, message.UUID, func(cached *model.Message) {
+			cached.Body = message.Body
+			cached.Attachments = message.Attachments
+			cached.EditedUTC = message.EditedUTC
+			cached.DeletedUTC = message.DeletedUTC
+		})
+
+		changed := *message
+		changed.Event = event
+		events = append(events, model.MessageEvent{
+			MessageUUID: message.UUID,
+			UserID:      userID,
+			Sequence:    c.queueMessageEvent(userID, &changed),
+			Event:       event,
+			CreatedUTC:  now,
+		})
+	}
+	return events
+}
+
+// awaitMessageInsert makes sure a sent message is in the store, writing out the log, batch or work queue it may still be waiting in.
+// Otherwise a change would update nothing, and the insert would write the original back afterwards.
+// If the message still isn't stored it returns ErrMessageNotStored.
+func (c *Chat) awaitMessageInsert(ctx context.Context, uuid string, tx *sql.Tx) error {
+	stored, err := c.store().GetMessage(uuid, tx)
+	if err != nil {
+		return err
+	}
+	if !stored.IsZero() {
+		return nil
+	}
+
+	// the message is waiting wherever persistMessage put it.
+	if c.WAL != nil {
+		err = c.flushMessageLog()
+	} else if c.Batcher != nil {
+		err = c.Batcher.Flush()
+	} else {
+		waitCtx, cancel := context.WithTimeout(ctx, MessageInsertWaitMaxDuration)
+		err = store.WaitForQueued(waitCtx)
+		cancel()
+	}
+	if err != nil {
+		return err
+	}
+
+	stored, err = c.store().GetMessage(uuid, tx)
+	if err != nil {
+		return err
+	}
+	if stored.IsZero() {
+		return ErrMessageNotStored
+	}
+	return nil
+}
+
+// saveMessageChange persists a changed message, then updates its cached copies and queues and persists a change event for each recipient.
+// The caches are only changed once the store has the change.
+func (c *Chat) saveMessageChange(ctx context.Context, message *model.Message, event string, tx *sql.Tx) error {
+	err := c.awaitMessageInsert(ctx, message.UUID, tx)
+	if err != nil {
+		return err
+	}
+	err = c.store().UpdateMessageContent(*message, tx)
+	if err != nil {
+		return err
+	}
+	for _, messageEvent := range c.changeMessage(message, event) {
+		err = c.store().CreateMessageEvent(messageEvent, tx)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getMessageChangeTarget resolves the session and the sender's message from the route.
+func (c *Chat) getMessageChangeTarget(rc *web.RequestContext) (*model.Session, *model.Message, web.ControllerResult) {
+	session, result := c.getRequestSession(rc)
+	if result != nil {
+		return nil, nil, result
+	}
+
+	uuid, err := rc.RouteParameter("uuid")
+	if err != nil {
+		return nil, nil, rc.API().BadRequest(err.Error())
+	}
+
+	message, err := c.getSenderMessage(session, uuid, rc.Tx())
+	if err == ErrNotMessageSender || err == ErrMessageDeleted {
+		return nil, nil, rc.API().BadRequest(err.Error())
+	}
+	if err != nil {
+		return nil, nil, rc.API().InternalError(err)
+	}
+	if message == nil {
+		return nil, nil, rc.API().NotFound()
+	}
+	return session, message, nil
+}
+
+// PUT /api/message/:session_id/:uuid
+func (c *Chat) editMessageAction(rc *web.RequestContext) web.ControllerResult {
+	session, message, result := c.getMessageChangeTarget(rc)
+	if result != nil {
+		return result
+	}
+
+	var edit model.Message
+	err := rc.PostBodyAsJSON(&edit)
+	if err != nil {
+		return rc.API().BadRequest(err.Error())
+	}
+
+	now := time.Now().UTC()
+	message.Body = edit.Body
+	message.Attachments = edit.Attachments
+	message.EditedUTC = &now
+
+	err = c.saveMessageChange(rc.Request.Context(), message, model.MessageEventEdit, rc.Tx())
+	if err == ErrMessageNotStored {
+		return rc.API().NotFound()
+	}
+	if err != nil {
+		return rc.API().InternalError(err)
+	}
+	c.setCachedSessionLastActive(session.UUID)
+	return rc.API().JSON(message)
+}
+
+// DELETE /api/message/:session_id/:uuid
+func (c *Chat) deleteMessageAction(rc *web.RequestContext) web.ControllerResult {
+	session, message, result := c.getMessageChangeTarget(rc)
+	if result != nil {
+		return result
+	}
+
+	now := time.Now().UTC()
+	message.Body = ""
+	message.Attachments = nil
+	message.DeletedUTC = &now
+
+	err := c.saveMessageChange(rc.Request.Context(), message, model.MessageEventDelete, rc.Tx())
+	if err == ErrMessageNotStored {
+		return rc.API().NotFound()
+	}
+	if err != nil {
+		return rc.API().InternalError(err)
+	}
+	c.setCachedSessionLastActive(session.UUID)
+	return rc.API().OK()
+}
@@ -0,0 +1,169 @@
+package controller
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/blendlabs/chatbus/server/model"
+	"github.com/blendlabs/chatbus/server/store"
+	assert "github.com/blendlabs/go-assert"
+	util "github.com/blendlabs/go-util"
+	web "github.com/wcharczuk/go-web"
+)
+
+func TestChatChangeMessage(t *testing.T) {
+	assert := assert.New(t)
+
+	session1 := &model.Session{
+		UUID:       "test_session",
+		CreatedUTC: time.Now().UTC(),
+		UserID:     1,
+		User:       &model.User{ID: 1, UUID: "test_user1"},
+	}
+	session2 := &model.Session{
+		UUID:       "test_session2",
+		CreatedUTC: time.Now().UTC(),
+		UserID:     2,
+		User:       &model.User{ID: 2, UUID: "test_user2"},
+	}
+
+	chat := new(Chat)
+	chat.cacheSession(session1)
+	chat.addMessageQueue(session1)
+	chat.cacheSession(session2)
+	chat.addMessageQueue(session2)
+
+	chat.queueMessage(&model.Message{UUID: "m1", CreatedUTC: time.Now().UTC(), SenderID: 1, ReceiverID: 2, Body: "before"})
+
+	message, err := chat.getSenderMessage(session1, "m1", nil)
+	assert.Nil(err)
+	assert.NotNil(message)
+
+	_, err = chat.getSenderMessage(session2, "m1", nil)
+	assert.Equal(ErrNotMessageSender, err)
+
+	now := time.Now().UTC()
+	message.Body = "after"
+	message.EditedUTC = &now
+	events := chat.changeMessage(message, model.MessageEventEdit)
+	assert.Len(events, 2)
+
+	for _, userID := range []int{1, 2} {
+		messages := chat.getCachedMessagesAfterSequence(userID, 0)
+		assert.Len(messages, 2)
+		assert.Equal("after", messages[0].Body)
+		assert.Empty(messages[0].Event)
+		assert.NotNil(messages[0].EditedUTC)
+		assert.Equal(model.MessageEventEdit, messages[1].Event)
+		assert.Equal("after", messages[1].Body)
+	}
+}
+
+func TestChatSaveMessageChangeBeforeInsert(t *testing.T) {
+	assert := assert.New(t)
+
+	memory := store.NewMemory()
+	chat := &Chat{Store: memory, Batcher: store.NewBatcher(memory, 0, 0)}
+	session := &model.Session{UUID: "test_session", UserID: 1, User: &model.User{ID: 1, UUID: "test_user1"}}
+	chat.cacheSession(session)
+	chat.addMessageQueue(session)
+
+	// the insert is still waiting in the batcher when the message is edited.
+	message := &model.Message{UUID: "m1", CreatedUTC: time.Now().UTC(), SenderID: 1, ReceiverID: 2, Body: "before"}
+	chat.queueMessage(message)
+	assert.Nil(chat.persistMessage(message))
+	assert.Equal(1, chat.Batcher.Len())
+
+	message.Body = "after"
+	assert.Nil(chat.saveMessageChange(context.Background(), message, model.MessageEventEdit, nil))
+	assert.Zero(chat.Batcher.Len())
+
+	stored, err := memory.GetMessage("m1")
+	assert.Nil(err)
+	assert.Equal("after", stored.Body)
+	assert.Equal("after", chat.getCachedMessagesAfterSequence(1, 0)[0].Body)
+
+	// a message another node hasn't written yet isn't changed, and its caches are left alone.
+	elsewhere := &model.Message{UUID: "m2", CreatedUTC: time.Now().UTC(), SenderID: 1, ReceiverID: 2, Body: "before"}
+	chat.queueMessage(elsewhere)
+	elsewhere.Body = "after"
+	assert.Equal(ErrMessageNotStored, chat.saveMessageChange(context.Background(), elsewhere, model.MessageEventEdit, nil))
+	cached := chat.getCachedMessagesAfterSequence(1, 0)
+	assert.Equal("m2", cached[len(cached)-1].UUID)
+	assert.Equal("before", cached[len(cached)-1].Body)
+}
+
+func TestEditAndDeleteMessage(t *testing.T) {
+	assert := assert.New(t)
+	ts, err := newTestStore()
+	assert.Nil(err)
+	defer ts.Close()
+	tx := ts.Tx
+
+	u1 := &model.User{UUID: util.UUIDv4().ToShortString(), DisplayName: "Test User"}
+	assert.Nil(ts.CreateUser(u1, tx))
+
+	u2 := &model.User{UUID: util.UUIDv4().ToShortString(), DisplayName: "Test User"}
+	assert.Nil(ts.CreateUser(u2, tx))
+
+	s1 := &model.Session{
+		UUID:          util.UUIDv4().ToShortString(),
+		CreatedUTC:    time.Now().UTC(),
+		LastActiveUTC: time.Now().UTC(),
+		UserID:        u1.ID,
+		User:          u1,
+	}
+	s2 := &model.Session{
+		UUID:          util.UUIDv4().ToShortString(),
+		CreatedUTC:    time.Now().UTC(),
+		LastActiveUTC: time.Now().UTC(),
+		UserID:        u2.ID,
+		User:          u2,
+	}
+	assert.Nil(ts.CreateSession(s1, tx))
+	assert.Nil(ts.CreateSession(s2, tx))
+
+	message := model.Message{
+		UUID:       util.UUIDv4().ToShortString(),
+		CreatedUTC: time.Now().UTC(),
+		SenderID:   u1.ID,
+		ReceiverID: u2.ID,
+		Body:       "this is a test",
+	}
+	assert.Nil(ts.CreateMessage(message, tx))
+
+	app := web.New()
+	app.IsolateTo(tx)
+	chat := &Chat{Store: ts}
+	assert.Nil(chat.Restore(tx))
+	app.Register(chat)
+
+	meta, err := app.Mock().WithVerb("PUT").WithPathf("/api/message/%s/%s", s2.UUID, message.UUID).WithPostBodyAsJSON(model.Message{Body: "not mine"}).ExecuteWithMeta()
+	assert.Nil(err)
+	assert.Equal(http.StatusBadRequest, meta.StatusCode)
+
+	var response serviceResponseOfMessage
+	err = app.Mock().WithVerb("PUT").WithPathf("/api/message/%s/%s", s1.UUID, message.UUID).WithPostBodyAsJSON(model.Message{Body: "edited"}).JSON(&response)
+	assert.Nil(err)
+	assert.Equal("edited", response.Response.Body)
+
+	verify, err := ts.GetMessage(message.UUID, tx)
+	assert.Nil(err)
+	assert.Equal("edited", verify.Body)
+	assert.NotNil(verify.EditedUTC)
+
+	meta, err = app.Mock().WithVerb("DELETE").WithPathf("/api/message/%s/%s", s1.UUID, message.UUID).ExecuteWithMeta()
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, meta.StatusCode)
+
+	verify, err = ts.GetMessage(message.UUID, tx)
+	assert.Nil(err)
+	assert.Empty(verify.Body)
+	assert.NotNil(verify.DeletedUTC)
+
+	messages := chat.getCachedMessagesAfterSequence(u2.ID, 0)
+	assert.Len(messages, 3)
+	assert.Equal(model.MessageEventDelete, messages[2].Event)
+}
@@ -0,0 +1,29 @@
+package controller
+
+import (
+	"time"
+
+	chronometer "github.com/blendlabs/go-chronometer"
+)
+
+// PruneRateLimits is the job that forgets the rate limit buckets that have refilled, so idle sessions don't pile up.
+type PruneRateLimits struct {
+	Controller *Chat
+}
+
+// Name is the job name
+func (prl PruneRateLimits) Name() string {
+	return "prune_rate_limits"
+}
+
+// Execute is the job body.
+func (prl PruneRateLimits) Execute(ct *chronometer.CancellationToken) error {
+	ct.CheckCancellation()
+	prl.Controller.RateLimits.Prune(time.Now())
+	return nil
+}
+
+// Schedule returns the job schedule.
+func (prl PruneRateLimits) Schedule() chronometer.Schedule {
+	return chronometer.EveryMinute()
+}
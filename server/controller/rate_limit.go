@@ -0,0 +1,285 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/blendlabs/chatbus/server/model"
+	"github.com/blendlabs/chatbus/server/viewmodel"
+	web "github.com/wcharczuk/go-web"
+)
+
+const (
+	// RateLimitSends is the kind of rate limit on sending messages.
+	RateLimitSends = "sends"
+	// RateLimitPolls is the kind of rate limit on polling for messages.
+	RateLimitPolls = "polls"
+	// RateLimitContacts is the kind of rate limit on adding and removing contacts.
+	RateLimitContacts = "contacts"
+
+	// RateLimitScopeSession is the scope of a rate limit kept per session.
+	RateLimitScopeSession = "session"
+	// RateLimitScopeUser is the scope of a rate limit kept per user, across all of their sessions.
+	RateLimitScopeUser = "user"
+)
+
+var (
+	// ErrInvalidRateLimit is returned for a rate limit that isn't `count/duration` with an optional `:burst`.
+	ErrInvalidRateLimit = errors.New("Invalid rate limit, expected `count/duration[:burst]`!")
+
+	// ErrRateLimited is returned when a request is over its rate limit.
+	ErrRateLimited = errors.New("Rate limit exceeded!")
+)
+
+// ParseRateLimiter parses a rate limit of `count/duration`, i.e. `5/s` or `300/1m`, with an optional `:burst` (which defaults to the count).
+// An empty limit returns nil, which doesn't limit anything.
+func ParseRateLimiter(limit string) (*RateLimiter, error) {
+	if len(limit) == 0 {
+		return nil, nil
+	}
+
+	rate := limit
+	burst := ""
+	if colon := strings.Index(limit, ":"); colon >= 0 {
+		rate, burst = limit[:colon], limit[colon+1:]
+	}
+	parts := strings.Split(rate, "/")
+	if len(parts) != 2 {
+		return nil, ErrInvalidRateLimit
+	}
+	count, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil || count <= 0 {
+		return nil, ErrInvalidRateLimit
+	}
+	// allow `5/s` as well as `5/1s`.
+	per := parts[1]
+	if len(per) > 0 && (per[0] < '0' || per[0] > '9') {
+		per = "1" + per
+	}
+	duration, err := time.ParseDuration(per)
+	if err != nil || duration <= 0 {
+		return nil, ErrInvalidRateLimit
+	}
+
+	limiter := &RateLimiter{Rate: count / duration.Seconds(), Burst: math.Ceil(count)}
+	if len(burst) > 0 {
+		limiter.Burst, err = strconv.ParseFloat(burst, 64)
+		if err != nil || limiter.Burst < 1 {
+			return nil, ErrInvalidRateLimit
+		}
+	}
+	return limiter, nil
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// RateLimiter is a set of token buckets, one per key, that refill at a steady rate up to a burst.
+// A nil rate limiter allows everything.
+type RateLimiter struct {
+	bucketsLock sync.Mutex
+	buckets     map[string]*tokenBucket
+
+	allowed  uint64
+	rejected uint64
+
+	// Rate is how many tokens a bucket gets back a second.
+	Rate float64
+	// Burst is the most tokens a bucket holds, and what a new bucket starts with.
+	Burst float64
+}
+
+// refill tops a bucket up for the time since it was last used.
+func (rl *RateLimiter) refill(bucket *tokenBucket, now time.Time) {
+	if elapsed := now.Sub(bucket.updated).Seconds(); elapsed > 0 {
+		bucket.tokens = math.Min(rl.Burst, bucket.tokens+elapsed*rl.Rate)
+		bucket.updated = now
+	}
+}
+
+// Take takes a token from a key's bucket. If the bucket is empty it returns false along with how long until there's a token.
+func (rl *RateLimiter) Take(key string, now time.Time) (time.Duration, bool) {
+	if rl == nil {
+		return 0, true
+	}
+
+	rl.bucketsLock.Lock()
+	defer rl.bucketsLock.Unlock()
+
+	if rl.buckets == nil {
+		rl.buckets = map[string]*tokenBucket{}
+	}
+	bucket, hasBucket := rl.buckets[key]
+	if !hasBucket {
+		bucket = &tokenBucket{tokens: rl.Burst, updated: now}
+		rl.buckets[key] = bucket
+	}
+	rl.refill(bucket, now)
+
+	if bucket.tokens < 1 {
+		atomic.AddUint64(&rl.rejected, 1)
+		return time.Duration((1 - bucket.tokens) / rl.Rate * float64(time.Second)), false
+	}
+	bucket.tokens--
+	atomic.AddUint64(&rl.allowed, 1)
+	return 0, true
+}
+
+// giveBack returns a token taken from a key's bucket, for a request that was turned away by another limit after all.
+func (rl *RateLimiter) giveBack(key string) {
+	if rl == nil {
+		return
+	}
+
+	rl.bucketsLock.Lock()
+	defer rl.bucketsLock.Unlock()
+
+	if bucket, hasBucket := rl.buckets[key]; hasBucket {
+		bucket.tokens = math.Min(rl.Burst, bucket.tokens+1)
+		atomic.AddUint64(&rl.allowed, ^uint64(0))
+	}
+}
+
+// Prune forgets the buckets that have refilled, since a new bucket would be the same; it returns how many are left.
+func (rl *RateLimiter) Prune(now time.Time) int {
+	if rl == nil {
+		return 0
+	}
+
+	rl.bucketsLock.Lock()
+	defer rl.bucketsLock.Unlock()
+
+	for key, bucket := range rl.buckets {
+		rl.refill(bucket, now)
+		if bucket.tokens >= rl.Burst {
+			delete(rl.buckets, key)
+		}
+	}
+	return len(rl.buckets)
+}
+
+// Counters returns how many requests the limiter has allowed and rejected, and how many keys it is tracking.
+func (rl *RateLimiter) Counters() (allowed, rejected uint64, keys int) {
+	if rl == nil {
+		return 0, 0, 0
+	}
+	rl.bucketsLock.Lock()
+	keys = len(rl.buckets)
+	rl.bucketsLock.Unlock()
+	return atomic.LoadUint64(&rl.allowed), atomic.LoadUint64(&rl.rejected), keys
+}
+
+// RateLimitScopes are the limits on one kind of request, per session and per user.
+type RateLimitScopes struct {
+	Session *RateLimiter
+	User    *RateLimiter
+}
+
+// Take takes a token for a session from both scopes, user first. If either is out it returns false along with how long to wait,
+// and the other scope keeps its token.
+func (rls RateLimitScopes) Take(session *model.Session, now time.Time) (time.Duration, bool) {
+	userKey := strconv.Itoa(session.UserID)
+	if wait, allowed := rls.User.Take(userKey, now); !allowed {
+		return wait, false
+	}
+	if wait, allowed := rls.Session.Take(session.UUID, now); !allowed {
+		rls.User.giveBack(userKey)
+		return wait, false
+	}
+	return 0, true
+}
+
+// RateLimits are the limits on sending messages, polling for them and changing contacts; limits that aren't set don't apply.
+type RateLimits struct {
+	Sends    RateLimitScopes
+	Polls    RateLimitScopes
+	Contacts RateLimitScopes
+}
+
+// each calls a function for every limiter that is set, with its kind and scope.
+func (rl RateLimits) each(action func(kind, scope string, limiter *RateLimiter)) {
+	for _, kind := range []string{RateLimitSends, RateLimitPolls, RateLimitContacts} {
+		scopes := rl.get(kind)
+		if scopes.Session != nil {
+			action(kind, RateLimitScopeSession, scopes.Session)
+		}
+		if scopes.User != nil {
+			action(kind, RateLimitScopeUser, scopes.User)
+		}
+	}
+}
+
+func (rl RateLimits) get(kind string) RateLimitScopes {
+	switch kind {
+	case RateLimitSends:
+		return rl.Sends
+	case RateLimitPolls:
+		return rl.Polls
+	case RateLimitContacts:
+		return rl.Contacts
+	}
+	return RateLimitScopes{}
+}
+
+// Prune forgets the buckets that have refilled in every limiter.
+func (rl RateLimits) Prune(now time.Time) {
+	rl.each(func(_, _ string, limiter *RateLimiter) {
+		limiter.Prune(now)
+	})
+}
+
+// Counters returns the counters for every limiter that is set.
+func (rl RateLimits) Counters() []viewmodel.RateLimitCounters {
+	output := []viewmodel.RateLimitCounters{}
+	rl.each(func(kind, scope string, limiter *RateLimiter) {
+		allowed, rejected, keys := limiter.Counters()
+		output = append(output, viewmodel.RateLimitCounters{
+			Kind:     kind,
+			Scope:    scope,
+			Allowed:  allowed,
+			Rejected: rejected,
+			Keys:     keys,
+		})
+	})
+	return output
+}
+
+// rateLimitedResult is a 429 with a `Retry-After` header, in the same shape as the other api results.
+type rateLimitedResult struct {
+	RetryAfter time.Duration
+}
+
+// Render writes the result.
+func (rlr rateLimitedResult) Render(rc *web.RequestContext) error {
+	rc.Response.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rc.Response.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(rlr.RetryAfter.Seconds()))))
+	rc.Response.WriteHeader(http.StatusTooManyRequests)
+	return json.NewEncoder(rc.Response).Encode(map[string]interface{}{
+		"meta": map[string]interface{}{
+			"http_code": http.StatusTooManyRequests,
+			"message":   ErrRateLimited.Error(),
+		},
+	})
+}
+
+// checkRateLimit takes a token for a request from a session against one kind of limit, returning a 429 if it is out.
+func (c *Chat) checkRateLimit(rc *web.RequestContext, kind string, session *model.Session) web.ControllerResult {
+	if wait, allowed := c.RateLimits.get(kind).Take(session, time.Now()); !allowed {
+		return rateLimitedResult{RetryAfter: wait}
+	}
+	return nil
+}
+
+// GET /api/rate_limits
+func (c *Chat) getRateLimitsAction(rc *web.RequestContext) web.ControllerResult {
+	return rc.API().JSON(c.RateLimits.Counters())
+}
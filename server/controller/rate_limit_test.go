@@ -0,0 +1,133 @@
+package controller
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/blendlabs/chatbus/server/model"
+	assert "github.com/blendlabs/go-assert"
+	util "github.com/blendlabs/go-util"
+	web "github.com/wcharczuk/go-web"
+)
+
+func TestParseRateLimiter(t *testing.T) {
+	assert := assert.New(t)
+
+	limiter, err := ParseRateLimiter("")
+	assert.Nil(err)
+	assert.Nil(limiter)
+
+	limiter, err = ParseRateLimiter("5/s")
+	assert.Nil(err)
+	assert.Equal(5.0, limiter.Rate)
+	assert.Equal(5.0, limiter.Burst)
+
+	limiter, err = ParseRateLimiter("300/1m:20")
+	assert.Nil(err)
+	assert.Equal(5.0, limiter.Rate)
+	assert.Equal(20.0, limiter.Burst)
+
+	for _, invalid := range []string{"5", "5/", "0/s", "x/s", "5/fortnight", "5/s:0", "5/s:x"} {
+		_, err = ParseRateLimiter(invalid)
+		assert.Equal(ErrInvalidRateLimit, err, invalid)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	assert := assert.New(t)
+
+	limiter := &RateLimiter{Rate: 2, Burst: 2}
+	now := time.Now()
+	for x := 0; x < 2; x++ {
+		_, allowed := limiter.Take("a", now)
+		assert.True(allowed)
+	}
+	wait, allowed := limiter.Take("a", now)
+	assert.False(allowed)
+	assert.Equal(500*time.Millisecond, wait)
+
+	// other keys have their own bucket.
+	_, allowed = limiter.Take("b", now)
+	assert.True(allowed)
+
+	_, allowed = limiter.Take("a", now.Add(500*time.Millisecond))
+	assert.True(allowed)
+
+	allowedCount, rejectedCount, keys := limiter.Counters()
+	assert.Equal(uint64(4), allowedCount)
+	assert.Equal(uint64(1), rejectedCount)
+	assert.Equal(2, keys)
+
+	// buckets that have refilled are forgotten.
+	assert.Equal(1, limiter.Prune(now.Add(time.Second)))
+	assert.Zero(limiter.Prune(now.Add(2 * time.Second)))
+
+	var unlimited *RateLimiter
+	_, allowed = unlimited.Take("a", now)
+	assert.True(allowed)
+}
+
+func TestRateLimits(t *testing.T) {
+	assert := assert.New(t)
+
+	limits := RateLimits{
+		Sends: RateLimitScopes{Session: &RateLimiter{Rate: 1, Burst: 1}, User: &RateLimiter{Rate: 1, Burst: 2}},
+	}
+	session1 := &model.Session{UUID: "test_session", UserID: 1}
+	session2 := &model.Session{UUID: "test_session2", UserID: 1}
+	session3 := &model.Session{UUID: "test_session3", UserID: 1}
+
+	now := time.Now()
+	_, allowed := limits.Sends.Take(session1, now)
+	assert.True(allowed)
+	_, allowed = limits.Sends.Take(session1, now)
+	assert.False(allowed)
+	_, allowed = limits.Sends.Take(session2, now)
+	assert.True(allowed, "a request the session limit turned away doesn't use up the user's limit")
+	_, allowed = limits.Sends.Take(session3, now)
+	assert.False(allowed, "the user's other sessions share the user's limit")
+
+	_, allowed = limits.Polls.Take(session1, now)
+	assert.True(allowed)
+
+	counters := limits.Counters()
+	assert.Len(counters, 2)
+	assert.Equal(RateLimitSends, counters[0].Kind)
+	assert.Equal(RateLimitScopeSession, counters[0].Scope)
+	assert.Equal(uint64(1), counters[0].Rejected)
+	assert.Equal(RateLimitScopeUser, counters[1].Scope)
+	assert.Equal(uint64(2), counters[1].Allowed)
+	assert.Equal(uint64(1), counters[1].Rejected)
+}
+
+func TestChatRateLimitedSend(t *testing.T) {
+	assert := assert.New(t)
+	ts, err := newTestStore()
+	assert.Nil(err)
+	defer ts.Close()
+	tx := ts.Tx
+
+	u1 := &model.User{UUID: util.UUIDv4().ToShortString(), DisplayName: "Test User"}
+	u2 := &model.User{UUID: util.UUIDv4().ToShortString(), DisplayName: "Test User2"}
+	assert.Nil(ts.CreateUser(u1, tx))
+	assert.Nil(ts.CreateUser(u2, tx))
+	s1 := &model.Session{UUID: util.UUIDv4().ToShortString(), CreatedUTC: time.Now().UTC(), LastActiveUTC: time.Now().UTC(), UserID: u1.ID}
+	assert.Nil(ts.CreateSession(s1, tx))
+
+	app := web.New()
+	app.IsolateTo(tx)
+	chat := &Chat{Store: ts, RateLimits: RateLimits{Sends: RateLimitScopes{Session: &RateLimiter{Rate: 0.1, Burst: 1}}}}
+	assert.Nil(chat.Restore(tx))
+	app.Register(chat)
+
+	message := model.Message{ReceiverID: u2.ID, Body: "this is a test"}
+	meta, err := app.Mock().WithVerb("POST").WithPathf("/api/message/%s", s1.UUID).WithPostBodyAsJSON(&message).ExecuteWithMeta()
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, meta.StatusCode)
+
+	meta, err = app.Mock().WithVerb("POST").WithPathf("/api/message/%s", s1.UUID).WithPostBodyAsJSON(&message).ExecuteWithMeta()
+	assert.Nil(err)
+	assert.Equal(http.StatusTooManyRequests, meta.StatusCode)
+	assert.Equal("10", meta.Headers.Get("Retry-After"))
+}
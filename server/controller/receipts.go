@@ -0,0 +1,150 @@
+package controller
+
+import (
+	"time"
+
+	"github.com/blendlabs/chatbus/server/model"
+	"github.com/blendlabs/chatbus/server/store"
+	"github.com/blendlabs/chatbus/server/viewmodel"
+	web "github.com/wcharczuk/go-web"
+)
+
+// updateCachedMessage applies an update to a message in a user's queue; change events for the message are left alone.
+func (c *Chat) updateCachedMessage(userID int, uuid string, update func(*model.Message)) bool {
+	var found bool
+	c.reverseEachCachedMessageUntil(userID, func(message *model.Message) bool {
+		if message.UUID == uuid && len(message.Event) == 0 {
+			update(message)
+			found = true
+			return false
+		}
+		return true
+	})
+	return found
+}
+
+// getCachedMessage returns a copy of a message in a user's queue.
+func (c *Chat) getCachedMessage(userID int, uuid string) (model.Message, bool) {
+	var message model.Message
+	found := c.updateCachedMessage(userID, uuid, func(cached *model.Message) {
+		message = *cached
+	})
+	return message, found
+}
+
+// queueMessageEvent puts a change event for a message onto a user's queue, returning its sequence number.
+// In a cluster the event is published instead; if that fails the error is reported and the sequence is zero.
+func (c *Chat) queueMessageEvent(userID int, message *model.Message) int64 {
+	if c.Cluster != nil {
+		sequences, err := c.publishMessage(clusterMessageEvent, message, []int{userID}, nil)
+		if err != nil {
+			c.reportClusterError(err)
+			return 0
+		}
+		return sequences[userID]
+	}
+
+	c.messageQueueLock.RLock()
+	defer c.messageQueueLock.RUnlock()
+	return c.enqueueMessage(userID, 0, message, true)
+}
+
+// saveReceipt marks a message in a recipient's queue as delivered (and read, if set).
+// If that changes the receipt, the sender's copy is updated, a receipt event is queued for the sender, and the receipt is persisted.
+// Reading a read once message expires it instead.
+func (c *Chat) saveReceipt(userID int, uuid string, read bool) {
+	now := time.Now().UTC()
+
+	var message model.Message
+	var receipt model.MessageReceipt
+	var changed bool
+	c.updateCachedMessage(userID, uuid, func(cached *model.Message) {
+		if cached.SenderID == userID {
+			return
+		}
+		receipt, _ = cached.GetReceipt(userID)
+		receipt.MessageUUID = cached.UUID
+		receipt.UserID = userID
+		if receipt.DeliveredUTC == nil {
+			receipt.DeliveredUTC = &now
+			changed = true
+		}
+		if read && receipt.ReadUTC == nil {
+			receipt.ReadUTC = &now
+			changed = true
+		}
+		if changed {
+			cached.Receipts = cached.WithReceipt(receipt)
+			message = *cached
+		}
+	})
+	if !changed {
+		return
+	}
+	if message.ReadOnce && receipt.ReadUTC != nil {
+		c.expireReadOnceMessage(&message, receipt)
+		return
+	}
+
+	c.updateCachedMessage(message.SenderID, message.UUID, func(cached *model.Message) {
+		cached.Receipts = cached.WithReceipt(receipt)
+		message.Receipts = cached.Receipts
+	})
+
+	message.Event = model.MessageEventReceipt
+	receipt.Sequence = c.queueMessageEvent(message.SenderID, &message)
+	store.QueueSaveMessageReceipt(c.store(), receipt)
+}
+
+// markDelivered records that messages were handed to one of a user's sessions.
+func (c *Chat) markDelivered(userID int, messages []model.Message) {
+	for _, message := range messages {
+		if message.SenderID == userID || len(message.Event) > 0 {
+			continue
+		}
+		if receipt, hasReceipt := message.GetReceipt(userID); hasReceipt && receipt.DeliveredUTC != nil {
+			continue
+		}
+		c.saveReceipt(userID, message.UUID, false)
+	}
+}
+
+// getCachedUnreadThroughSequence returns the uuids of the messages in a user's queue, up to a sequence number, that the user hasn't read.
+func (c *Chat) getCachedUnreadThroughSequence(userID int, sequence int64) []string {
+	var uuids []string
+	c.reverseEachCachedMessageUntil(userID, func(message *model.Message) bool {
+		if message.Sequence > sequence || message.SenderID == userID || len(message.Event) > 0 {
+			return true
+		}
+		if receipt, hasReceipt := message.GetReceipt(userID); !hasReceipt || receipt.ReadUTC == nil {
+			uuids = append(uuids, message.UUID)
+		}
+		return true
+	})
+	return uuids
+}
+
+// POST /api/read/:session_id
+func (c *Chat) markReadAction(rc *web.RequestContext) web.ControllerResult {
+	session, result := c.getRequestSession(rc)
+	if result != nil {
+		return result
+	}
+
+	var markRead viewmodel.MarkRead
+	err := rc.PostBodyAsJSON(&markRead)
+	if err != nil {
+		return rc.API().BadRequest(err.Error())
+	}
+
+	if len(markRead.UUID) > 0 {
+		c.saveReceipt(session.UserID, markRead.UUID, true)
+	}
+	if markRead.Sequence > 0 {
+		for _, uuid := range c.getCachedUnreadThroughSequence(session.UserID, markRead.Sequence) {
+			c.saveReceipt(session.UserID, uuid, true)
+		}
+	}
+	c.setCachedSessionLastActive(session.UUID)
+	return rc.API().OK()
+}
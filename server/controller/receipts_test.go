@@ -0,0 +1,73 @@
+package controller
+
+import (
+	"testing"
+	"time"
+
+	"github.com/blendlabs/chatbus/server/model"
+	assert "github.com/blendlabs/go-assert"
+)
+
+func TestChatSaveReceipt(t *testing.T) {
+	assert := assert.New(t)
+
+	session1 := &model.Session{
+		UUID:       "test_session",
+		CreatedUTC: time.Now().UTC(),
+		UserID:     1,
+		User:       &model.User{ID: 1, UUID: "test_user1"},
+	}
+	session2 := &model.Session{
+		UUID:       "test_session2",
+		CreatedUTC: time.Now().UTC(),
+		UserID:     2,
+		User:       &model.User{ID: 2, UUID: "test_user2"},
+	}
+
+	chat := new(Chat)
+	chat.cacheSession(session1)
+	chat.addMessageQueue(session1)
+	chat.cacheSession(session2)
+	chat.addMessageQueue(session2)
+
+	now := time.Now().UTC()
+	chat.queueMessage(&model.Message{UUID: "m1", CreatedUTC: now.Add(-time.Second), SenderID: 1, ReceiverID: 2})
+	chat.queueMessage(&model.Message{UUID: "m2", CreatedUTC: now, SenderID: 1, ReceiverID: 2})
+
+	messages := chat.getCachedMessagesAfterSequence(2, 0)
+	assert.Len(messages, 2)
+	chat.markDelivered(2, messages)
+	chat.markDelivered(2, chat.getCachedMessagesAfterSequence(2, 0))
+
+	// the sender gets one receipt event per message, and sees the receipts on its own copies.
+	sent := chat.getCachedMessagesAfterSequence(1, 2)
+	assert.Len(sent, 2)
+	assert.Equal(model.MessageEventReceipt, sent[0].Event)
+	assert.Equal("m1", sent[0].UUID)
+	assert.Equal("m1.3", sent[0].EventID())
+	receipt, hasReceipt := sent[0].GetReceipt(2)
+	assert.True(hasReceipt)
+	assert.NotNil(receipt.DeliveredUTC)
+	assert.Nil(receipt.ReadUTC)
+
+	original := chat.getCachedMessagesAfterSequence(1, 0)[0]
+	assert.Equal("m1", original.UUID)
+	_, hasReceipt = original.GetReceipt(2)
+	assert.True(hasReceipt)
+
+	// timestamp polling doesn't see receipt events.
+	assert.Len(chat.getCachedMessagesAfter(1, now.Add(-2*time.Second)), 2)
+
+	assert.Len(chat.getCachedUnreadThroughSequence(2, 2), 2)
+	chat.saveReceipt(2, "m1", true)
+	assert.Equal([]string{"m2"}, chat.getCachedUnreadThroughSequence(2, 2))
+
+	sent = chat.getCachedMessagesAfterSequence(1, 4)
+	assert.Len(sent, 1)
+	receipt, _ = sent[0].GetReceipt(2)
+	assert.NotNil(receipt.ReadUTC)
+
+	// the sender can't receipt their own message.
+	chat.saveReceipt(1, "m2", true)
+	assert.Len(chat.getCachedMessagesAfterSequence(1, 5), 0)
+}
@@ -0,0 +1,168 @@
+package controller
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	web "github.com/wcharczuk/go-web"
+)
+
+const (
+	// SignatureHeader is the header a signed request carries its signature in, as hex.
+	SignatureHeader = "X-Chatbus-Signature"
+
+	// SignatureTimestampHeader is the header a signed request carries the unix time it was signed at in.
+	SignatureTimestampHeader = "X-Chatbus-Timestamp"
+
+	// SignatureDefaultWindow is how far a signed request's timestamp can be from now if the signer doesn't say.
+	SignatureDefaultWindow = 5 * time.Minute
+
+	// SignatureMaxBodySize is the most of a signed request's body that is read to check its hash; a bigger body is rejected.
+	SignatureMaxBodySize = 1 << 20
+)
+
+var (
+	// ErrMissingSignature is returned for a request to a signed route without a signature or timestamp.
+	ErrMissingSignature = errors.New("Request is not signed!")
+
+	// ErrInvalidSignature is returned for a request whose signature doesn't match.
+	ErrInvalidSignature = errors.New("Invalid request signature!")
+
+	// ErrSignatureExpired is returned for a signed request whose timestamp is outside the replay window.
+	ErrSignatureExpired = errors.New("Request signature is outside the replay window!")
+
+	// ErrSignatureReplayed is returned for a signed request that was already seen.
+	ErrSignatureReplayed = errors.New("Request signature was already used!")
+)
+
+// NewRequestSigner returns a request signer with a shared secret and a replay window as a go duration, i.e. `5m`;
+// an empty window uses the default.
+func NewRequestSigner(secret, window string) (*RequestSigner, error) {
+	signer := &RequestSigner{Secret: []byte(secret)}
+	if len(window) > 0 {
+		parsed, err := time.ParseDuration(window)
+		if err != nil {
+			return nil, err
+		}
+		signer.Window = parsed
+	}
+	return signer, nil
+}
+
+// RequestSigner checks the signatures on the admin routes, so only a caller with the shared secret (i.e. the gateway) can use them.
+// The signature is a hex HMAC-SHA256 of the method, the request uri, the unix timestamp and a hex SHA-256 of the body, joined with newlines.
+// A timestamp more than the window from now is rejected, and so is a signature that was already used within the window.
+// Used signatures are only remembered by this process, so in a cluster a signed request can be replayed once against each node within the window.
+type RequestSigner struct {
+	seenLock sync.Mutex
+	seen     map[string]time.Time
+
+	Secret []byte
+	// Window is how far a request's timestamp can be from now; zero uses the default.
+	Window time.Duration
+}
+
+func (rs *RequestSigner) window() time.Duration {
+	if rs.Window > 0 {
+		return rs.Window
+	}
+	return SignatureDefaultWindow
+}
+
+// Sign returns the signature for a request.
+func (rs *RequestSigner) Sign(method, uri string, body []byte, timestamp time.Time) string {
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, rs.Secret)
+	mac.Write([]byte(method + "\n" + uri + "\n" + strconv.FormatInt(timestamp.Unix(), 10) + "\n" + hex.EncodeToString(bodyHash[:])))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// CheckHeaders returns a request's signature and timestamp, checking the timestamp is within the window as of a given time.
+// It doesn't need the body, so a request can be turned away before its body is read.
+func (rs *RequestSigner) CheckHeaders(req *http.Request, now time.Time) (string, time.Time, error) {
+	signature := req.Header.Get(SignatureHeader)
+	timestampStr := req.Header.Get(SignatureTimestampHeader)
+	if len(signature) == 0 || len(timestampStr) == 0 {
+		return "", time.Time{}, ErrMissingSignature
+	}
+	unix, err := strconv.ParseInt(timestampStr, 10, 64)
+	if err != nil {
+		return "", time.Time{}, ErrInvalidSignature
+	}
+	timestamp := time.Unix(unix, 0)
+	if skew := now.Sub(timestamp); skew > rs.window() || skew < -rs.window() {
+		return "", time.Time{}, ErrSignatureExpired
+	}
+	return signature, timestamp, nil
+}
+
+// Verify checks the signature on a request with its body, as of a given time.
+func (rs *RequestSigner) Verify(req *http.Request, body []byte, now time.Time) error {
+	signature, timestamp, err := rs.CheckHeaders(req, now)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(signature), []byte(rs.Sign(req.Method, req.URL.RequestURI(), body, timestamp))) {
+		return ErrInvalidSignature
+	}
+	if !rs.markSeen(signature, timestamp, now) {
+		return ErrSignatureReplayed
+	}
+	return nil
+}
+
+// markSeen records a signature, returning false if it was already seen; signatures outside the window are forgotten,
+// since their timestamps would be rejected anyway.
+func (rs *RequestSigner) markSeen(signature string, timestamp, now time.Time) bool {
+	rs.seenLock.Lock()
+	defer rs.seenLock.Unlock()
+
+	if rs.seen == nil {
+		rs.seen = map[string]time.Time{}
+	}
+	for seen, seenTimestamp := range rs.seen {
+		if now.Sub(seenTimestamp) > rs.window() {
+			delete(rs.seen, seen)
+		}
+	}
+	if _, hasSeen := rs.seen[signature]; hasSeen {
+		return false
+	}
+	rs.seen[signature] = timestamp
+	return true
+}
+
+// requireSignature is middleware that rejects requests that aren't signed by the signer; without a signer the route is open.
+// The headers are checked first; only then is the body read, up to SignatureMaxBodySize, to check its hash and put back for the action.
+func (c *Chat) requireSignature(action web.ControllerAction) web.ControllerAction {
+	return func(rc *web.RequestContext) web.ControllerResult {
+		if c.Signer == nil {
+			return action(rc)
+		}
+		if _, _, err := c.Signer.CheckHeaders(rc.Request, time.Now()); err != nil {
+			return rc.API().NotAuthorized()
+		}
+
+		var body []byte
+		if rc.Request.Body != nil {
+			var err error
+			body, err = ioutil.ReadAll(http.MaxBytesReader(rc.Response, rc.Request.Body, SignatureMaxBodySize))
+			if err != nil {
+				return rc.API().BadRequest(err.Error())
+			}
+			rc.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		if err := c.Signer.Verify(rc.Request, body, time.Now()); err != nil {
+			return rc.API().NotAuthorized()
+		}
+		return action(rc)
+	}
+}
@@ -0,0 +1,114 @@
+package controller
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/blendlabs/chatbus/server/model"
+	assert "github.com/blendlabs/go-assert"
+	util "github.com/blendlabs/go-util"
+	web "github.com/wcharczuk/go-web"
+)
+
+func signRequest(signer *RequestSigner, req *http.Request, body []byte, timestamp time.Time) {
+	req.Header.Set(SignatureTimestampHeader, strconv.FormatInt(timestamp.Unix(), 10))
+	req.Header.Set(SignatureHeader, signer.Sign(req.Method, req.URL.RequestURI(), body, timestamp))
+}
+
+func TestRequestSigner(t *testing.T) {
+	assert := assert.New(t)
+
+	signer, err := NewRequestSigner("test_secret", "1m")
+	assert.Nil(err)
+	assert.Equal(time.Minute, signer.Window)
+
+	now := time.Now()
+	body := []byte(`{"display_name":"test"}`)
+	req, err := http.NewRequest("DELETE", "/api/user/1?force=true", nil)
+	assert.Nil(err)
+	assert.Equal(ErrMissingSignature, signer.Verify(req, body, now))
+
+	signRequest(signer, req, body, now)
+	assert.Nil(signer.Verify(req, body, now))
+	assert.Equal(ErrSignatureReplayed, signer.Verify(req, body, now))
+
+	// the signature covers the body, the uri and the timestamp.
+	signRequest(signer, req, body, now.Add(-time.Second))
+	assert.Equal(ErrInvalidSignature, signer.Verify(req, []byte(`{}`), now))
+	other, err := http.NewRequest("DELETE", "/api/user/2?force=true", nil)
+	assert.Nil(err)
+	other.Header = req.Header
+	assert.Equal(ErrInvalidSignature, signer.Verify(other, body, now))
+	req.Header.Set(SignatureTimestampHeader, strconv.FormatInt(now.Unix(), 10))
+	assert.Equal(ErrInvalidSignature, signer.Verify(req, body, now))
+
+	signRequest(signer, req, body, now.Add(-2*time.Minute))
+	assert.Equal(ErrSignatureExpired, signer.Verify(req, body, now))
+	signRequest(signer, req, body, now.Add(2*time.Minute))
+	assert.Equal(ErrSignatureExpired, signer.Verify(req, body, now))
+	// the timestamp is checked without the body, so a stale request isn't read.
+	_, _, err = signer.CheckHeaders(req, now)
+	assert.Equal(ErrSignatureExpired, err)
+
+	// signatures are forgotten once they're out of the window.
+	signRequest(signer, req, body, now.Add(-time.Second))
+	assert.Nil(signer.Verify(req, body, now))
+	assert.Len(signer.seen, 2)
+	signRequest(signer, req, body, now.Add(time.Minute))
+	assert.Nil(signer.Verify(req, body, now.Add(90*time.Second)))
+	assert.Len(signer.seen, 1)
+
+	wrong, err := NewRequestSigner("other_secret", "")
+	assert.Nil(err)
+	signRequest(wrong, req, body, now)
+	assert.Equal(ErrInvalidSignature, signer.Verify(req, body, now))
+
+	_, err = NewRequestSigner("test_secret", "not a duration")
+	assert.NotNil(err)
+}
+
+func TestChatSignedAdminRoutes(t *testing.T) {
+	assert := assert.New(t)
+	ts, err := newTestStore()
+	assert.Nil(err)
+	defer ts.Close()
+	tx := ts.Tx
+
+	u1 := &model.User{UUID: util.UUIDv4().ToShortString(), DisplayName: "Test User"}
+	assert.Nil(ts.CreateUser(u1, tx))
+
+	signer, err := NewRequestSigner("test_secret", "")
+	assert.Nil(err)
+
+	app := web.New()
+	app.IsolateTo(tx)
+	chat := &Chat{Store: ts, Signer: signer}
+	app.Register(chat)
+
+	meta, err := app.Mock().WithPathf("/api/users").ExecuteWithMeta()
+	assert.Nil(err)
+	assert.Equal(http.StatusForbidden, meta.StatusCode)
+
+	now := time.Now()
+	meta, err = app.Mock().WithPathf("/api/users").
+		WithHeader(SignatureTimestampHeader, strconv.FormatInt(now.Unix(), 10)).
+		WithHeader(SignatureHeader, signer.Sign("GET", "/api/users", nil, now)).
+		ExecuteWithMeta()
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, meta.StatusCode)
+
+	// creating and renaming users are admin routes too.
+	meta, err = app.Mock().WithPathf("/api/user").WithVerb("POST").WithPostBodyAsJSON(&model.User{UUID: util.UUIDv4().ToShortString()}).ExecuteWithMeta()
+	assert.Nil(err)
+	assert.Equal(http.StatusForbidden, meta.StatusCode)
+	meta, err = app.Mock().WithPathf("/api/user/%d", u1.ID).WithVerb("PUT").WithPostBodyAsJSON(u1).ExecuteWithMeta()
+	assert.Nil(err)
+	assert.Equal(http.StatusForbidden, meta.StatusCode)
+
+	// routes that aren't for admins don't need a signature.
+	meta, err = app.Mock().WithPathf("/api/user/%d", u1.ID).ExecuteWithMeta()
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, meta.StatusCode)
+}
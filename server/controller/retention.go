@@ -0,0 +1,244 @@
+package controller
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blendlabs/chatbus/server/model"
+	"github.com/blendlabs/go-util/collections"
+)
+
+const (
+	// RetentionDefaultBatchSize is how many messages the expiry job looks at per query if the retention doesn't say.
+	RetentionDefaultBatchSize = 500
+)
+
+var (
+	// ErrInvalidRetentionOverride is returned for a retention override that isn't `key=duration`.
+	ErrInvalidRetentionOverride = errors.New("Invalid retention override, expected `key=duration`!")
+)
+
+// Conversation identifies the direct messages between two users, whichever way round they were sent.
+type Conversation struct {
+	UserID      int
+	OtherUserID int
+}
+
+// NewConversation returns the conversation between two users.
+func NewConversation(userID, otherUserID int) Conversation {
+	if otherUserID < userID {
+		userID, otherUserID = otherUserID, userID
+	}
+	return Conversation{UserID: userID, OtherUserID: otherUserID}
+}
+
+// Retention is how long messages are kept before the expiry job deletes them.
+// A zero max age keeps messages forever; overrides replace the max age for a room or a conversation, and can be zero to keep those forever.
+type Retention struct {
+	MaxAge        time.Duration
+	Rooms         map[int]time.Duration
+	Conversations map[Conversation]time.Duration
+	// BatchSize is how many messages the expiry job reads (and deletes) at a time.
+	BatchSize int
+	// ArchivePath is a file expired messages are appended to, as json lines, before they're deleted; empty skips archiving.
+	ArchivePath string
+}
+
+// ParseRetention parses a max age and lists of room (`room_id=duration`) and conversation (`user_id:user_id=duration`) overrides.
+// Durations are go durations, i.e. `720h`; the lists are comma separated.
+func ParseRetention(maxAge, rooms, conversations string) (Retention, error) {
+	var retention Retention
+	var err error
+	if len(maxAge) > 0 {
+		retention.MaxAge, err = time.ParseDuration(maxAge)
+		if err != nil {
+			return retention, err
+		}
+	}
+
+	err = parseRetentionOverrides(rooms, func(key string, maxAge time.Duration) error {
+		roomID, err := strconv.Atoi(key)
+		if err != nil {
+			return err
+		}
+		if retention.Rooms == nil {
+			retention.Rooms = map[int]time.Duration{}
+		}
+		retention.Rooms[roomID] = maxAge
+		return nil
+	})
+	if err != nil {
+		return retention, err
+	}
+
+	err = parseRetentionOverrides(conversations, func(key string, maxAge time.Duration) error {
+		users := strings.Split(key, ":")
+		if len(users) != 2 {
+			return ErrInvalidRetentionOverride
+		}
+		userID, err := strconv.Atoi(users[0])
+		if err != nil {
+			return err
+		}
+		otherUserID, err := strconv.Atoi(users[1])
+		if err != nil {
+			return err
+		}
+		if retention.Conversations == nil {
+			retention.Conversations = map[Conversation]time.Duration{}
+		}
+		retention.Conversations[NewConversation(userID, otherUserID)] = maxAge
+		return nil
+	})
+	return retention, err
+}
+
+func parseRetentionOverrides(overrides string, add func(key string, maxAge time.Duration) error) error {
+	for _, override := range strings.Split(overrides, ",") {
+		override = strings.TrimSpace(override)
+		if len(override) == 0 {
+			continue
+		}
+		parts := strings.Split(override, "=")
+		if len(parts) != 2 {
+			return ErrInvalidRetentionOverride
+		}
+		maxAge, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return err
+		}
+		if err = add(strings.TrimSpace(parts[0]), maxAge); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maxAges returns the retention as the store's per message max ages.
+func (r Retention) maxAges() model.MessageMaxAges {
+	maxAges := model.MessageMaxAges{Default: r.MaxAge, Rooms: r.Rooms}
+	if len(r.Conversations) > 0 {
+		maxAges.Conversations = map[[2]int]time.Duration{}
+		for conversation, maxAge := range r.Conversations {
+			maxAges.Conversations[model.ConversationKey(conversation.UserID, conversation.OtherUserID)] = maxAge
+		}
+	}
+	return maxAges
+}
+
+// MaxAgeFor returns how long a message is kept; zero is forever.
+func (r Retention) MaxAgeFor(message model.Message) time.Duration {
+	return r.maxAges().For(message)
+}
+
+// IsExpired returns if a message is past its max age.
+func (r Retention) IsExpired(message model.Message, now time.Time) bool {
+	return r.maxAges().IsExpired(message, now)
+}
+
+// cutoff returns the newest a message can be and still have expired, under the shortest max age; it returns false if nothing ever expires.
+func (r Retention) cutoff(now time.Time) (time.Time, bool) {
+	return r.maxAges().Cutoff(now)
+}
+
+// expireMessages evicts the expired messages from the cached queues, then deletes (and archives) them from the store a batch at a time.
+// It returns how many messages were deleted from the store.
+func (c *Chat) expireMessages(now time.Time, txs ...*sql.Tx) (int, error) {
+	maxAges := c.Retention.maxAges()
+	if _, expires := maxAges.Cutoff(now); !expires {
+		return 0, nil
+	}
+	c.evictCachedMessages(func(message *model.Message) bool {
+		return maxAges.IsExpired(*message, now)
+	})
+
+	batchSize := c.Retention.BatchSize
+	if batchSize <= 0 {
+		batchSize = RetentionDefaultBatchSize
+	}
+
+	var deleted int
+	var after time.Time
+	var afterUUID string
+	for {
+		expired, err := c.store().GetMessagesPastMaxAge(maxAges, now, after, afterUUID, batchSize, txs...)
+		if err != nil {
+			return deleted, err
+		}
+		if len(expired) == 0 {
+			return deleted, nil
+		}
+		after, afterUUID = expired[len(expired)-1].CreatedUTC, expired[len(expired)-1].UUID
+
+		var expiredUUIDs []string
+		for _, message := range expired {
+			expiredUUIDs = append(expiredUUIDs, message.UUID)
+		}
+		if err = c.archiveMessages(expired); err != nil {
+			return deleted, err
+		}
+		if err = c.store().DeleteMessages(expiredUUIDs, txs...); err != nil {
+			return deleted, err
+		}
+		deleted += len(expired)
+
+		if len(expired) < batchSize {
+			return deleted, nil
+		}
+	}
+}
+
+// archiveMessages appends messages to the retention archive, if there is one.
+func (c *Chat) archiveMessages(messages []model.Message) error {
+	if len(c.Retention.ArchivePath) == 0 {
+		return nil
+	}
+	file, err := os.OpenFile(c.Retention.ArchivePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(file)
+	for _, message := range messages {
+		if err = encoder.Encode(message); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err = file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// evictCachedMessages removes the messages (and their change events) matching a predicate from every queue and inbox.
+func (c *Chat) evictCachedMessages(evict func(*model.Message) bool) {
+	c.messageQueueLock.RLock()
+	defer c.messageQueueLock.RUnlock()
+
+	for _, queue := range c.MessageQueues {
+		evictQueuedMessages(queue, evict)
+	}
+
+	c.inboxLock.Lock()
+	defer c.inboxLock.Unlock()
+	for _, inbox := range c.Inboxes {
+		evictQueuedMessages(inbox, evict)
+	}
+}
+
+func evictQueuedMessages(queue *collections.RingBuffer, evict func(*model.Message) bool) {
+	queue.SyncRoot().Lock()
+	defer queue.SyncRoot().Unlock()
+	for x := queue.Len(); x > 0; x-- {
+		message := model.TryCastMessage(queue.Dequeue())
+		if message != nil && !evict(message) {
+			queue.Enqueue(message)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package controller
+
+import (
+	"testing"
+	"time"
+
+	"github.com/blendlabs/chatbus/server/model"
+	assert "github.com/blendlabs/go-assert"
+	util "github.com/blendlabs/go-util"
+)
+
+func TestParseRetention(t *testing.T) {
+	assert := assert.New(t)
+
+	retention, err := ParseRetention("720h", "12=24h, 15=0s", "7:3=1h")
+	assert.Nil(err)
+	assert.Equal(720*time.Hour, retention.MaxAge)
+	assert.Equal(24*time.Hour, retention.Rooms[12])
+	assert.Equal(time.Hour, retention.Conversations[NewConversation(3, 7)])
+
+	assert.Equal(time.Hour, retention.MaxAgeFor(model.Message{SenderID: 3, ReceiverID: 7}))
+	assert.Equal(time.Duration(0), retention.MaxAgeFor(model.Message{RoomID: 15}))
+	assert.Equal(720*time.Hour, retention.MaxAgeFor(model.Message{RoomID: 2}))
+
+	cutoff, expires := retention.cutoff(time.Date(2017, 1, 2, 0, 0, 0, 0, time.UTC))
+	assert.True(expires)
+	assert.True(time.Date(2017, 1, 1, 23, 0, 0, 0, time.UTC).Equal(cutoff))
+
+	_, expires = Retention{}.cutoff(time.Now())
+	assert.False(expires)
+
+	_, err = ParseRetention("", "12", "")
+	assert.Equal(ErrInvalidRetentionOverride, err)
+	_, err = ParseRetention("", "", "3=1h")
+	assert.Equal(ErrInvalidRetentionOverride, err)
+	_, err = ParseRetention("forever", "", "")
+	assert.NotNil(err)
+}
+
+func TestChatExpireMessages(t *testing.T) {
+	assert := assert.New(t)
+	ts, err := newTestStore()
+	assert.Nil(err)
+	defer ts.Close()
+	tx := ts.Tx
+
+	u1 := &model.User{UUID: util.UUIDv4().ToShortString(), DisplayName: "Test User"}
+	u2 := &model.User{UUID: util.UUIDv4().ToShortString(), DisplayName: "Test User2"}
+	u3 := &model.User{UUID: util.UUIDv4().ToShortString(), DisplayName: "Test User3"}
+	assert.Nil(ts.CreateUser(u1, tx))
+	assert.Nil(ts.CreateUser(u2, tx))
+	assert.Nil(ts.CreateUser(u3, tx))
+	assert.Nil(ts.CreateSession(&model.Session{UUID: util.UUIDv4().ToShortString(), CreatedUTC: time.Now().UTC(), LastActiveUTC: time.Now().UTC(), UserID: u2.ID}, tx))
+
+	now := time.Now().UTC()
+	old := model.Message{UUID: util.UUIDv4().ToShortString(), CreatedUTC: now.Add(-2 * time.Hour), SenderID: u1.ID, ReceiverID: u2.ID, Body: "old", SenderSequence: 1, ReceiverSequence: 1}
+	recent := model.Message{UUID: util.UUIDv4().ToShortString(), CreatedUTC: now.Add(-time.Minute), SenderID: u1.ID, ReceiverID: u2.ID, Body: "recent", SenderSequence: 2, ReceiverSequence: 2}
+	kept := model.Message{UUID: util.UUIDv4().ToShortString(), CreatedUTC: now.Add(-2 * time.Hour), SenderID: u1.ID, ReceiverID: u3.ID, Body: "kept", SenderSequence: 3, ReceiverSequence: 1}
+	assert.Nil(ts.CreateMessage(old, tx))
+	assert.Nil(ts.CreateMessage(recent, tx))
+	assert.Nil(ts.CreateMessage(kept, tx))
+
+	chat := &Chat{Store: ts}
+	chat.Retention, err = ParseRetention("1h", "", "")
+	assert.Nil(err)
+	chat.Retention.Conversations = map[Conversation]time.Duration{NewConversation(u3.ID, u1.ID): 0}
+	chat.Retention.BatchSize = 1
+	assert.Nil(chat.Restore(tx))
+	assert.Len(chat.getCachedMessagesAfterSequence(u2.ID, 0), 2)
+
+	deleted, err := chat.expireMessages(now, tx)
+	assert.Nil(err)
+	assert.Equal(1, deleted)
+
+	messages := chat.getCachedMessagesAfterSequence(u2.ID, 0)
+	assert.Len(messages, 1)
+	assert.Equal(recent.UUID, messages[0].UUID)
+
+	verify, err := ts.GetMessage(old.UUID, tx)
+	assert.Nil(err)
+	assert.True(verify.IsZero())
+	verify, err = ts.GetMessage(kept.UUID, tx)
+	assert.Nil(err)
+	assert.False(verify.IsZero())
+
+	// the deleted message's sequences are still accounted for.
+	assert.Nil(ts.DeleteMessages([]string{recent.UUID}, tx))
+	sequences, err := ts.GetMessageSequences(tx)
+	assert.Nil(err)
+	assert.Equal(int64(2), sequences[u2.ID])
+}
@@ -0,0 +1,296 @@
+package controller
+
+import (
+	"errors"
+	"time"
+
+	"github.com/blendlabs/chatbus/server/model"
+	"github.com/blendlabs/chatbus/server/viewmodel"
+	"github.com/blendlabs/chatbus/server/wal"
+	util "github.com/blendlabs/go-util"
+	"github.com/blendlabs/go-util/collections"
+	web "github.com/wcharczuk/go-web"
+)
+
+var (
+	// ErrNotRoomMember is returned when a session acts on a room its user isn't a member of.
+	ErrNotRoomMember = errors.New("Not a member of the room!")
+
+	// ErrNotRoomCreator is returned when a session changes the members of a room its user didn't create.
+	ErrNotRoomCreator = errors.New("Only the room's creator can change its members!")
+)
+
+func (c *Chat) cacheRoom(room *model.Room) {
+	c.roomsLock.Lock()
+	defer c.roomsLock.Unlock()
+	if c.Rooms == nil {
+		c.Rooms = map[int]*model.Room{}
+	}
+	c.Rooms[room.ID] = room
+}
+
+func (c *Chat) getCachedRoom(roomID int) (*model.Room, bool) {
+	c.roomsLock.RLock()
+	defer c.roomsLock.RUnlock()
+	if room, hasRoom := c.Rooms[roomID]; hasRoom {
+		return room, true
+	}
+	return nil, false
+}
+
+func (c *Chat) cacheRoomMember(roomID, userID int) {
+	c.roomMembersLock.Lock()
+	defer c.roomMembersLock.Unlock()
+	if c.RoomMembers == nil {
+		c.RoomMembers = map[int]collections.SetOfInt{}
+	}
+	if _, hasMembers := c.RoomMembers[roomID]; !hasMembers {
+		c.RoomMembers[roomID] = collections.NewSetOfInt()
+	}
+	c.RoomMembers[roomID].Add(userID)
+}
+
+func (c *Chat) removeCachedRoomMember(roomID, userID int) {
+	c.roomMembersLock.Lock()
+	defer c.roomMembersLock.Unlock()
+	if members, hasMembers := c.RoomMembers[roomID]; hasMembers {
+		members.Remove(userID)
+		if members.Len() == 0 {
+			delete(c.RoomMembers, roomID)
+		}
+	}
+}
+
+func (c *Chat) getCachedRoomMembers(roomID int) []int {
+	c.roomMembersLock.RLock()
+	defer c.roomMembersLock.RUnlock()
+	if members, hasMembers := c.RoomMembers[roomID]; hasMembers {
+		return members.AsSlice()
+	}
+	return []int{}
+}
+
+func (c *Chat) isCachedRoomMember(roomID, userID int) bool {
+	c.roomMembersLock.RLock()
+	defer c.roomMembersLock.RUnlock()
+	if members, hasMembers := c.RoomMembers[roomID]; hasMembers {
+		return members.Contains(userID)
+	}
+	return false
+}
+
+// getCachedRoomsForUser returns the rooms a user is a member of.
+func (c *Chat) getCachedRoomsForUser(userID int) []viewmodel.Room {
+	c.roomMembersLock.RLock()
+	defer c.roomMembersLock.RUnlock()
+
+	output := []viewmodel.Room{}
+	for roomID, members := range c.RoomMembers {
+		if !members.Contains(userID) {
+			continue
+		}
+		if room, hasRoom := c.getCachedRoom(roomID); hasRoom {
+			output = append(output, viewmodel.Room{Room: room, MemberIDs: members.AsSlice()})
+		}
+	}
+	return output
+}
+
+// getSessionRoom resolves the session and the room from the route, and checks the session's user is a member.
+func (c *Chat) getSessionRoom(rc *web.RequestContext) (*model.Session, *model.Room, web.ControllerResult) {
+	session, result := c.getRequestSession(rc)
+	if result != nil {
+		return nil, nil, result
+	}
+
+	roomID, err := rc.RouteParameterInt("room_id")
+	if err != nil {
+		return nil, nil, rc.API().BadRequest(err.Error())
+	}
+	room, hasRoom := c.getCachedRoom(roomID)
+	if !hasRoom {
+		return nil, nil, rc.API().NotFound()
+	}
+	if !c.isCachedRoomMember(room.ID, session.UserID) {
+		return nil, nil, rc.API().BadRequest(ErrNotRoomMember.Error())
+	}
+	return session, room, nil
+}
+
+// GET /api/rooms/:session_id
+func (c *Chat) getRoomsAction(rc *web.RequestContext) web.ControllerResult {
+	session, result := c.getRequestSession(rc)
+	if result != nil {
+		return result
+	}
+	return rc.API().JSON(c.getCachedRoomsForUser(session.UserID))
+}
+
+// POST /api/room/:session_id
+func (c *Chat) createRoomAction(rc *web.RequestContext) web.ControllerResult {
+	session, result := c.getRequestSession(rc)
+	if result != nil {
+		return result
+	}
+
+	var room model.Room
+	err := rc.PostBodyAsJSON(&room)
+	if err != nil {
+		return rc.API().BadRequest(err.Error())
+	}
+	room.ID = 0
+	room.UUID = util.UUIDv4().ToShortString()
+	room.CreatedUTC = time.Now().UTC()
+	room.CreatedBy = session.UserID
+
+	err = c.store().CreateRoom(&room, rc.Tx())
+	if err != nil {
+		return rc.API().InternalError(err)
+	}
+	err = c.store().CreateRoomMember(model.RoomMember{RoomID: room.ID, UserID: session.UserID}, rc.Tx())
+	if err != nil {
+		return rc.API().InternalError(err)
+	}
+
+	c.cacheRoom(&room)
+	c.cacheRoomMember(room.ID, session.UserID)
+	c.publish(clusterRoom, room)
+	c.publish(clusterRoomMember, model.RoomMember{RoomID: room.ID, UserID: session.UserID})
+	return rc.API().JSON(viewmodel.Room{Room: &room, MemberIDs: c.getCachedRoomMembers(room.ID)})
+}
+
+// GET /api/room/:session_id/:room_id
+func (c *Chat) getRoomAction(rc *web.RequestContext) web.ControllerResult {
+	_, room, result := c.getSessionRoom(rc)
+	if result != nil {
+		return result
+	}
+	return rc.API().JSON(viewmodel.Room{Room: room, MemberIDs: c.getCachedRoomMembers(room.ID)})
+}
+
+// POST /api/room.member/:session_id/:room_id/:user_id
+func (c *Chat) createRoomMemberAction(rc *web.RequestContext) web.ControllerResult {
+	session, room, result := c.getSessionRoom(rc)
+	if result != nil {
+		return result
+	}
+	if session.UserID != room.CreatedBy {
+		return rc.API().BadRequest(ErrNotRoomCreator.Error())
+	}
+
+	userID, err := rc.RouteParameterInt("user_id")
+	if err != nil {
+		return rc.API().BadRequest(err.Error())
+	}
+
+	user, err := c.store().GetUser(userID, rc.Tx())
+	if err != nil {
+		return rc.API().InternalError(err)
+	}
+	if user.IsZero() {
+		return rc.API().NotFound()
+	}
+
+	err = c.store().CreateRoomMember(model.RoomMember{RoomID: room.ID, UserID: user.ID}, rc.Tx())
+	if err != nil {
+		return rc.API().InternalError(err)
+	}
+
+	c.cacheUser(user)
+	c.cacheRoomMember(room.ID, user.ID)
+	c.publish(clusterRoomMember, model.RoomMember{RoomID: room.ID, UserID: user.ID})
+	return rc.API().OK()
+}
+
+// DELETE /api/room.member/:session_id/:room_id/:user_id
+func (c *Chat) deleteRoomMemberAction(rc *web.RequestContext) web.ControllerResult {
+	session, room, result := c.getSessionRoom(rc)
+	if result != nil {
+		return result
+	}
+
+	userID, err := rc.RouteParameterInt("user_id")
+	if err != nil {
+		return rc.API().BadRequest(err.Error())
+	}
+	// members can leave on their own, but only the creator can remove anyone else.
+	if session.UserID != room.CreatedBy && userID != session.UserID {
+		return rc.API().BadRequest(ErrNotRoomCreator.Error())
+	}
+	if !c.isCachedRoomMember(room.ID, userID) {
+		return rc.API().NotFound()
+	}
+
+	err = c.store().DeleteRoomMember(room.ID, userID, rc.Tx())
+	if err != nil {
+		return rc.API().InternalError(err)
+	}
+
+	c.removeCachedRoomMember(room.ID, userID)
+	c.publish(clusterRoomMemberDeleted, model.RoomMember{RoomID: room.ID, UserID: userID})
+	return rc.API().OK()
+}
+
+// POST /api/room.message/:session_id/:room_id
+func (c *Chat) sendRoomMessageAction(rc *web.RequestContext) web.ControllerResult {
+	session, room, result := c.getSessionRoom(rc)
+	if result != nil {
+		return result
+	}
+	if result = c.checkRateLimit(rc, RateLimitSends, session); result != nil {
+		return result
+	}
+
+	var message model.Message
+	err := rc.PostBodyAsJSON(&message)
+	if err != nil {
+		return rc.API().BadRequest(err.Error())
+	}
+
+	if isScheduled(&message, time.Now().UTC()) {
+		// room messages are addressed to their sender so the receiver foreign key holds.
+		message.ReceiverID = session.UserID
+		message.RoomID = room.ID
+		scheduled, err := c.scheduleMessage(session, &message, rc.Tx())
+		if err == ErrInvalidTTL || err == wal.ErrEntryTooLarge {
+			return rc.API().BadRequest(err.Error())
+		}
+		if err != nil {
+			return rc.API().InternalError(err)
+		}
+		return rc.API().JSON(scheduled)
+	}
+
+	err = c.sendRoomMessage(session, room, &message)
+	if err == ErrInvalidTTL || err == wal.ErrEntryTooLarge {
+		return rc.API().BadRequest(err.Error())
+	}
+	if err != nil {
+		return rc.API().InternalError(err)
+	}
+	return rc.API().JSON(message)
+}
+
+// sendRoomMessage stamps a message from a session, fans it out to the room members' cached queues and persists it.
+func (c *Chat) sendRoomMessage(session *model.Session, room *model.Room, message *model.Message) error {
+	message.CreatedUTC = time.Now().UTC()
+	message.SenderID = session.UserID
+	// room messages are addressed to their sender so the receiver foreign key holds.
+	message.ReceiverID = session.UserID
+	message.RoomID = room.ID
+	message.UUID = util.UUIDv4().ToShortString()
+	message.RoomSequences = nil
+	message.DeliverAt = nil
+	if err := setMessageExpiry(message); err != nil {
+		return err
+	}
+	if err := c.checkMessageLog(message); err != nil {
+		return err
+	}
+
+	if err := c.persistAndQueueMessage(message); err != nil {
+		return err
+	}
+	c.setCachedSessionLastActive(session.UUID)
+	return nil
+}
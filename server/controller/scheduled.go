@@ -0,0 +1,229 @@
+package controller
+
+import (
+	"database/sql"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/blendlabs/chatbus/server/model"
+	util "github.com/blendlabs/go-util"
+	web "github.com/wcharczuk/go-web"
+)
+
+var (
+	// ErrScheduledOverWebsocket is returned for a message sent over a websocket with a `deliver_at`; only `POST /api/send` schedules messages.
+	ErrScheduledOverWebsocket = errors.New("Messages can't be scheduled over a websocket!")
+
+	// errScheduledMessageClaimed rolls back the delivery of a scheduled message another server (or a cancel) got to first.
+	errScheduledMessageClaimed = errors.New("Scheduled message was already claimed!")
+)
+
+// isScheduled returns if a message being sent asks to be delivered later.
+func isScheduled(message *model.Message, now time.Time) bool {
+	return message.DeliverAt != nil && message.DeliverAt.After(now)
+}
+
+func (c *Chat) cacheScheduledMessage(scheduled model.ScheduledMessage) {
+	c.scheduledLock.Lock()
+	defer c.scheduledLock.Unlock()
+	if c.ScheduledMessages == nil {
+		c.ScheduledMessages = map[string]model.ScheduledMessage{}
+	}
+	c.ScheduledMessages[scheduled.UUID] = scheduled
+}
+
+// removeCachedScheduledMessage removes a scheduled message if it belongs to a session, returning it.
+func (c *Chat) removeCachedScheduledMessage(sessionID, uuid string) (model.ScheduledMessage, bool) {
+	c.scheduledLock.Lock()
+	defer c.scheduledLock.Unlock()
+	scheduled, hasScheduled := c.ScheduledMessages[uuid]
+	if !hasScheduled || scheduled.SessionUUID != sessionID {
+		return scheduled, false
+	}
+	delete(c.ScheduledMessages, uuid)
+	return scheduled, true
+}
+
+// getCachedScheduledMessages returns the messages a session has scheduled, soonest first.
+func (c *Chat) getCachedScheduledMessages(sessionID string) []model.ScheduledMessage {
+	c.scheduledLock.Lock()
+	defer c.scheduledLock.Unlock()
+
+	messages := []model.ScheduledMessage{}
+	for _, scheduled := range c.ScheduledMessages {
+		if scheduled.SessionUUID == sessionID {
+			messages = append(messages, scheduled)
+		}
+	}
+	sortScheduledMessages(messages)
+	return messages
+}
+
+// takeDueScheduledMessages removes and returns the scheduled messages that are due, soonest first.
+func (c *Chat) takeDueScheduledMessages(now time.Time) []model.ScheduledMessage {
+	c.scheduledLock.Lock()
+	defer c.scheduledLock.Unlock()
+
+	var messages []model.ScheduledMessage
+	for uuid, scheduled := range c.ScheduledMessages {
+		if !scheduled.DeliverUTC.After(now) {
+			messages = append(messages, scheduled)
+			delete(c.ScheduledMessages, uuid)
+		}
+	}
+	sortScheduledMessages(messages)
+	return messages
+}
+
+func sortScheduledMessages(messages []model.ScheduledMessage) {
+	sort.Slice(messages, func(i, j int) bool {
+		if messages[i].DeliverUTC.Equal(messages[j].DeliverUTC) {
+			return messages[i].UUID < messages[j].UUID
+		}
+		return messages[i].DeliverUTC.Before(messages[j].DeliverUTC)
+	})
+}
+
+// restoreScheduledMessages caches the messages waiting to be delivered; ones that were delivered just before a restart are cleaned up.
+func (c *Chat) restoreScheduledMessages(txs ...*sql.Tx) error {
+	messages, err := c.store().GetScheduledMessages(txs...)
+	if err != nil {
+		return err
+	}
+	for _, scheduled := range messages {
+		delivered, err := c.store().GetMessage(scheduled.UUID, txs...)
+		if err != nil {
+			return err
+		}
+		if !delivered.IsZero() {
+			if err = c.store().DeleteScheduledMessage(scheduled.UUID, txs...); err != nil {
+				return err
+			}
+			continue
+		}
+		c.cacheScheduledMessage(scheduled)
+	}
+	return nil
+}
+
+// scheduleMessage validates a message from a session and holds it until its delivery time.
+// Room messages should already be addressed to the room.
+func (c *Chat) scheduleMessage(session *model.Session, message *model.Message, txs ...*sql.Tx) (model.ScheduledMessage, error) {
+	if message.RoomID == 0 && !c.hasCachedUser(message.ReceiverID) {
+		return model.ScheduledMessage{}, ErrRecipientNotFound
+	}
+	if message.TTLSeconds < 0 {
+		return model.ScheduledMessage{}, ErrInvalidTTL
+	}
+	if err := c.checkMessageLog(message); err != nil {
+		return model.ScheduledMessage{}, err
+	}
+
+	message.CreatedUTC = time.Now().UTC()
+	message.SenderID = session.UserID
+	message.UUID = util.UUIDv4().ToShortString()
+
+	scheduled := model.NewScheduledMessage(session, *message, message.DeliverAt.UTC())
+	err := c.store().CreateScheduledMessage(scheduled, txs...)
+	if err != nil {
+		return scheduled, err
+	}
+	c.cacheScheduledMessage(scheduled)
+	c.setCachedSessionLastActive(session.UUID)
+	return scheduled, nil
+}
+
+// deliverScheduledMessages sends the scheduled messages that are due, returning how many were sent.
+// It keeps going past a failure and returns the first error; messages that failed stay in the store until the next restore.
+func (c *Chat) deliverScheduledMessages(now time.Time, txs ...*sql.Tx) (int, error) {
+	var delivered int
+	var firstErr error
+	for _, scheduled := range c.takeDueScheduledMessages(now) {
+		sent, err := c.deliverScheduledMessage(scheduled, txs...)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if sent {
+			delivered++
+		}
+	}
+	return delivered, firstErr
+}
+
+// deliverScheduledMessage stamps a scheduled message with the time it is actually sent, persists it and routes it.
+// The scheduled row is claimed and the message written in one transaction, so in a cluster only one server sends it and a restart
+// neither loses it nor sends it again; the message is only routed (or published) once that transaction commits.
+// It is dropped if the recipient is gone, or the sender has left the room.
+func (c *Chat) deliverScheduledMessage(scheduled model.ScheduledMessage, txs ...*sql.Tx) (bool, error) {
+	message := scheduled.Message()
+	message.CreatedUTC = time.Now().UTC()
+	deliverable := c.hasCachedUser(message.ReceiverID)
+	if message.RoomID != 0 {
+		message.ReceiverID = message.SenderID
+		deliverable = c.isCachedRoomMember(message.RoomID, message.SenderID)
+	}
+	if !deliverable {
+		_, err := c.store().DeliverScheduledMessage(scheduled.UUID, func() (*model.Message, error) { return nil, nil }, txs...)
+		return false, err
+	}
+	if err := setMessageExpiry(&message); err != nil {
+		return false, err
+	}
+
+	err := c.commitAndQueueMessage(&message, func(message *model.Message) error {
+		claimed, err := c.store().DeliverScheduledMessage(scheduled.UUID, func() (*model.Message, error) { return message, nil }, txs...)
+		if err == nil && !claimed {
+			return errScheduledMessageClaimed
+		}
+		return err
+	})
+	if err == errScheduledMessageClaimed {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if message.RoomID == 0 {
+		c.removeCachedTyping(message.SenderID, message.ReceiverID)
+	}
+	return true, nil
+}
+
+// GET /api/scheduled/:session_id
+func (c *Chat) getScheduledMessagesAction(rc *web.RequestContext) web.ControllerResult {
+	session, result := c.getRequestSession(rc)
+	if result != nil {
+		return result
+	}
+
+	c.setCachedSessionLastActive(session.UUID)
+	return rc.API().JSON(c.getCachedScheduledMessages(session.UUID))
+}
+
+// DELETE /api/scheduled/:session_id/:uuid
+func (c *Chat) cancelScheduledMessageAction(rc *web.RequestContext) web.ControllerResult {
+	session, result := c.getRequestSession(rc)
+	if result != nil {
+		return result
+	}
+	uuid, err := rc.RouteParameter("uuid")
+	if err != nil {
+		return rc.API().BadRequest(err.Error())
+	}
+
+	scheduled, cancelled := c.removeCachedScheduledMessage(session.UUID, uuid)
+	if !cancelled {
+		return rc.API().NotFound()
+	}
+	err = c.store().DeleteScheduledMessage(uuid, rc.Tx())
+	if err != nil {
+		c.cacheScheduledMessage(scheduled)
+		return rc.API().InternalError(err)
+	}
+	c.setCachedSessionLastActive(session.UUID)
+	return rc.API().OK()
+}
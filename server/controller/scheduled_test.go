@@ -0,0 +1,97 @@
+package controller
+
+import (
+	"testing"
+	"time"
+
+	"github.com/blendlabs/chatbus/server/model"
+	assert "github.com/blendlabs/go-assert"
+	util "github.com/blendlabs/go-util"
+)
+
+func TestChatScheduleMessage(t *testing.T) {
+	assert := assert.New(t)
+	ts, err := newTestStore()
+	assert.Nil(err)
+	defer ts.Close()
+	tx := ts.Tx
+
+	u1 := &model.User{UUID: util.UUIDv4().ToShortString(), DisplayName: "Test User"}
+	u2 := &model.User{UUID: util.UUIDv4().ToShortString(), DisplayName: "Test User2"}
+	assert.Nil(ts.CreateUser(u1, tx))
+	assert.Nil(ts.CreateUser(u2, tx))
+	session1 := &model.Session{UUID: util.UUIDv4().ToShortString(), CreatedUTC: time.Now().UTC(), LastActiveUTC: time.Now().UTC(), UserID: u1.ID}
+	session2 := &model.Session{UUID: util.UUIDv4().ToShortString(), CreatedUTC: time.Now().UTC(), LastActiveUTC: time.Now().UTC(), UserID: u2.ID}
+	assert.Nil(ts.CreateSession(session1, tx))
+	assert.Nil(ts.CreateSession(session2, tx))
+
+	chat := &Chat{Store: ts}
+	assert.Nil(chat.Restore(tx))
+	session, _ := chat.getCachedSession(session1.UUID)
+
+	now := time.Now().UTC()
+	soon, later := now.Add(time.Minute), now.Add(time.Hour)
+	assert.False(isScheduled(&model.Message{DeliverAt: &now}, now))
+	assert.True(isScheduled(&model.Message{DeliverAt: &soon}, now))
+
+	_, err = chat.scheduleMessage(session, &model.Message{ReceiverID: u2.ID + 100, DeliverAt: &soon}, tx)
+	assert.Equal(ErrRecipientNotFound, err)
+
+	first, err := chat.scheduleMessage(session, &model.Message{ReceiverID: u2.ID, Body: "first", DeliverAt: &soon}, tx)
+	assert.Nil(err)
+	second, err := chat.scheduleMessage(session, &model.Message{ReceiverID: u2.ID, Body: "second", DeliverAt: &later}, tx)
+	assert.Nil(err)
+	assert.True(soon.Equal(first.DeliverUTC))
+
+	scheduled := chat.getCachedScheduledMessages(session1.UUID)
+	assert.Len(scheduled, 2)
+	assert.Equal(first.UUID, scheduled[0].UUID)
+	assert.Equal(second.UUID, scheduled[1].UUID)
+	assert.Empty(chat.getCachedScheduledMessages(session2.UUID))
+	assert.Empty(chat.getCachedMessagesAfterSequence(u2.ID, 0))
+
+	// only the session that scheduled a message can cancel it.
+	_, cancelled := chat.removeCachedScheduledMessage(session2.UUID, second.UUID)
+	assert.False(cancelled)
+
+	delivered, err := chat.deliverScheduledMessages(now, tx)
+	assert.Nil(err)
+	assert.Zero(delivered)
+
+	delivered, err = chat.deliverScheduledMessages(soon, tx)
+	assert.Nil(err)
+	assert.Equal(1, delivered)
+
+	messages := chat.getCachedMessagesAfterSequence(u2.ID, 0)
+	assert.Len(messages, 1)
+	assert.Equal(first.UUID, messages[0].UUID)
+	assert.Equal("first", messages[0].Body)
+	assert.Equal(u1.ID, messages[0].SenderID)
+	assert.True(messages[0].CreatedUTC.After(first.ScheduledUTC))
+	assert.Len(chat.getCachedScheduledMessages(session1.UUID), 1)
+	verify, err := ts.GetMessage(first.UUID, tx)
+	assert.Nil(err)
+	assert.Equal("first", verify.Body)
+
+	// the message still waiting is reloaded on restore.
+	stored, err := ts.GetScheduledMessages(tx)
+	assert.Nil(err)
+	assert.Len(stored, 1)
+	assert.Equal(second.UUID, stored[0].UUID)
+
+	restored := &Chat{Store: ts}
+	assert.Nil(restored.Restore(tx))
+	scheduled = restored.getCachedScheduledMessages(session1.UUID)
+	assert.Len(scheduled, 1)
+	assert.Equal("second", scheduled[0].Body)
+
+	// a message claimed elsewhere (i.e. by another server) isn't routed.
+	assert.Nil(ts.DeleteScheduledMessage(second.UUID, tx))
+	delivered, err = chat.deliverScheduledMessages(later, tx)
+	assert.Nil(err)
+	assert.Zero(delivered)
+	assert.Len(chat.getCachedMessagesAfterSequence(u2.ID, 0), 1)
+	verify, err = ts.GetMessage(second.UUID, tx)
+	assert.Nil(err)
+	assert.True(verify.IsZero())
+}
@@ -0,0 +1,181 @@
+package controller
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blendlabs/chatbus/server/model"
+	"github.com/blendlabs/chatbus/server/viewmodel"
+	web "github.com/wcharczuk/go-web"
+)
+
+const (
+	// SessionTokenDefaultTTL is how long a session token is good for if the tokens don't say.
+	SessionTokenDefaultTTL = 24 * time.Hour
+
+	// SessionTokenSecretLength is the length in bytes of a generated token secret.
+	SessionTokenSecretLength = 32
+)
+
+var (
+	// ErrInvalidSessionToken is returned for a session token that is malformed, or wasn't signed with our secret.
+	ErrInvalidSessionToken = errors.New("Invalid session token!")
+
+	// ErrSessionTokenExpired is returned for a session token that is past its expiry.
+	ErrSessionTokenExpired = errors.New("Session token has expired!")
+)
+
+// SessionTokens sign and verify the bearer tokens that stand in for a session id, so the id doesn't have to be in the url.
+// A token is `<session_uuid>.<expires_unix>.<signature>`, where the signature is a base64url HMAC-SHA256 of the first two parts.
+// Tokens can't be issued or verified without a secret.
+type SessionTokens struct {
+	Secret []byte
+	// TTL is how long a token is good for; zero uses the default.
+	TTL time.Duration
+	// DisablePaths turns off the routes that take the session id in the path, leaving only the token routes under `/api/me`.
+	DisablePaths bool
+}
+
+// NewSessionTokens returns session tokens signed with a secret and good for a go duration, i.e. `24h`.
+// An empty secret generates a random one, which means tokens don't outlive the process; an empty ttl uses the default.
+func NewSessionTokens(secret, ttl string) (SessionTokens, error) {
+	var tokens SessionTokens
+	if len(ttl) > 0 {
+		parsed, err := time.ParseDuration(ttl)
+		if err != nil {
+			return tokens, err
+		}
+		tokens.TTL = parsed
+	}
+	if len(secret) > 0 {
+		tokens.Secret = []byte(secret)
+		return tokens, nil
+	}
+	tokens.Secret = make([]byte, SessionTokenSecretLength)
+	_, err := rand.Read(tokens.Secret)
+	return tokens, err
+}
+
+func (t SessionTokens) ttl() time.Duration {
+	if t.TTL > 0 {
+		return t.TTL
+	}
+	return SessionTokenDefaultTTL
+}
+
+func (t SessionTokens) sign(payload string) string {
+	mac := hmac.New(sha256.New, t.Secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Issue returns a token for a session along with when it expires.
+func (t SessionTokens) Issue(sessionID string, now time.Time) (string, time.Time) {
+	expires := now.Add(t.ttl()).UTC()
+	payload := sessionID + "." + strconv.FormatInt(expires.Unix(), 10)
+	return payload + "." + t.sign(payload), expires
+}
+
+// Verify checks a token's signature and expiry and returns the session id it was issued for.
+func (t SessionTokens) Verify(token string, now time.Time) (string, error) {
+	if len(t.Secret) == 0 {
+		return "", ErrInvalidSessionToken
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || len(parts[0]) == 0 {
+		return "", ErrInvalidSessionToken
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(t.sign(parts[0]+"."+parts[1]))) {
+		return "", ErrInvalidSessionToken
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", ErrInvalidSessionToken
+	}
+	if !now.Before(time.Unix(expires, 0)) {
+		return "", ErrSessionTokenExpired
+	}
+	return parts[0], nil
+}
+
+// newSessionViewModel returns a session with a fresh token and the user's unread count.
+func (c *Chat) newSessionViewModel(session *model.Session) viewmodel.Session {
+	output := viewmodel.Session{Session: session, Unread: c.getCachedUnreadCount(session.UserID)}
+	if len(c.Tokens.Secret) > 0 {
+		token, expires := c.Tokens.Issue(session.UUID, time.Now().UTC())
+		output.Token = token
+		output.TokenExpiresUTC = &expires
+	}
+	return output
+}
+
+// getBearerToken returns the bearer token from the `Authorization` header, if there is one.
+func getBearerToken(rc *web.RequestContext) string {
+	authorization := rc.Request.Header.Get("Authorization")
+	if len(authorization) > len("Bearer ") && strings.EqualFold(authorization[:len("Bearer ")], "Bearer ") {
+		return strings.TrimSpace(authorization[len("Bearer "):])
+	}
+	return ""
+}
+
+// queryTokenPaths are the routes that take the session token as the `access_token` query parameter;
+// websockets and event streams can't set headers from a browser. Anywhere else a token in the url would only end up in logs.
+var queryTokenPaths = map[string]bool{
+	"/api/me/ws":     true,
+	"/api/me/events": true,
+}
+
+// getRequestToken returns the session token for a request from the `Authorization` header,
+// or from the `access_token` query parameter on the websocket and event stream routes.
+func getRequestToken(rc *web.RequestContext) string {
+	if token := getBearerToken(rc); len(token) > 0 {
+		return token
+	}
+	if queryTokenPaths[rc.Request.URL.Path] {
+		return rc.Request.URL.Query().Get("access_token")
+	}
+	return ""
+}
+
+// getRequestSession resolves the session a request is for, from the `:session_id` route parameter on the path routes
+// or from the bearer token on the `/api/me` routes.
+func (c *Chat) getRequestSession(rc *web.RequestContext) (*model.Session, web.ControllerResult) {
+	if sessionID, err := rc.RouteParameter("session_id"); err == nil {
+		session, hasSession := c.getCachedSession(sessionID)
+		if !hasSession {
+			return nil, rc.API().NotFound()
+		}
+		return session, nil
+	}
+
+	token := getRequestToken(rc)
+	if len(token) == 0 {
+		return nil, rc.API().NotAuthorized()
+	}
+	sessionID, err := c.Tokens.Verify(token, time.Now().UTC())
+	if err != nil {
+		return nil, rc.API().NotAuthorized()
+	}
+	// the token outlived its session, i.e. it was culled or deleted.
+	session, hasSession := c.getCachedSession(sessionID)
+	if !hasSession {
+		return nil, rc.API().NotAuthorized()
+	}
+	return session, nil
+}
+
+// POST /api/me/token
+func (c *Chat) refreshSessionTokenAction(rc *web.RequestContext) web.ControllerResult {
+	session, result := c.getRequestSession(rc)
+	if result != nil {
+		return result
+	}
+	c.setCachedSessionLastActive(session.UUID)
+	return rc.API().JSON(c.newSessionViewModel(session))
+}
@@ -0,0 +1,124 @@
+package controller
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blendlabs/chatbus/server/model"
+	"github.com/blendlabs/chatbus/server/viewmodel"
+	assert "github.com/blendlabs/go-assert"
+	util "github.com/blendlabs/go-util"
+	web "github.com/wcharczuk/go-web"
+)
+
+type serviceResponseOfSessionViewModel struct {
+	Meta     map[string]interface{} `json:"meta"`
+	Response viewmodel.Session      `json:"response"`
+}
+
+func TestSessionTokens(t *testing.T) {
+	assert := assert.New(t)
+
+	tokens, err := NewSessionTokens("test_secret", "1h")
+	assert.Nil(err)
+	assert.Equal(time.Hour, tokens.TTL)
+
+	now := time.Now().UTC()
+	token, expires := tokens.Issue("test_session", now)
+	assert.Equal(now.Add(time.Hour).Unix(), expires.Unix())
+
+	sessionID, err := tokens.Verify(token, now)
+	assert.Nil(err)
+	assert.Equal("test_session", sessionID)
+
+	_, err = tokens.Verify(token, now.Add(time.Hour))
+	assert.Equal(ErrSessionTokenExpired, err)
+
+	// the session id and expiry can't be changed without the secret.
+	parts := strings.Split(token, ".")
+	_, err = tokens.Verify("other_session."+parts[1]+"."+parts[2], now)
+	assert.Equal(ErrInvalidSessionToken, err)
+	_, err = tokens.Verify(parts[0]+".9999999999."+parts[2], now)
+	assert.Equal(ErrInvalidSessionToken, err)
+	_, err = tokens.Verify("test_session", now)
+	assert.Equal(ErrInvalidSessionToken, err)
+
+	other, err := NewSessionTokens("other_secret", "")
+	assert.Nil(err)
+	assert.Equal(SessionTokenDefaultTTL, other.ttl())
+	_, err = other.Verify(token, now)
+	assert.Equal(ErrInvalidSessionToken, err)
+
+	_, err = SessionTokens{}.Verify(token, now)
+	assert.Equal(ErrInvalidSessionToken, err)
+
+	generated, err := NewSessionTokens("", "")
+	assert.Nil(err)
+	assert.Len(generated.Secret, SessionTokenSecretLength)
+
+	_, err = NewSessionTokens("test_secret", "not a duration")
+	assert.NotNil(err)
+}
+
+func TestChatSessionTokenRoutes(t *testing.T) {
+	assert := assert.New(t)
+	ts, err := newTestStore()
+	assert.Nil(err)
+	defer ts.Close()
+	tx := ts.Tx
+
+	u1 := &model.User{UUID: util.UUIDv4().ToShortString(), DisplayName: "Test User"}
+	assert.Nil(ts.CreateUser(u1, tx))
+
+	tokens, err := NewSessionTokens("test_secret", "")
+	assert.Nil(err)
+	tokens.DisablePaths = true
+
+	app := web.New()
+	app.IsolateTo(tx)
+	chat := &Chat{Store: ts, Tokens: tokens}
+	app.Register(chat)
+
+	var session serviceResponseOfSessionViewModel
+	err = app.Mock().WithVerb("POST").WithPathf("/api/session/%d", u1.ID).JSON(&session)
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, session.Meta["http_code"])
+	assert.NotEmpty(session.Response.Token)
+	assert.NotNil(session.Response.TokenExpiresUTC)
+
+	var messages serviceResponseOfMessages
+	err = app.Mock().WithVerb("GET").WithPathf("/api/me/messages").WithHeader("Authorization", "Bearer "+session.Response.Token).JSON(&messages)
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, messages.Meta["http_code"])
+
+	err = app.Mock().WithVerb("GET").WithPathf("/api/me/messages").WithHeader("Authorization", "Bearer nope").JSON(&messages)
+	assert.Nil(err)
+	assert.Equal(http.StatusForbidden, messages.Meta["http_code"])
+
+	// only websockets and event streams take the token in the query string.
+	err = app.Mock().WithVerb("GET").WithPathf("/api/me/messages").WithQueryString("access_token", session.Response.Token).JSON(&messages)
+	assert.Nil(err)
+	assert.Equal(http.StatusForbidden, messages.Meta["http_code"])
+
+	meta, err := app.Mock().WithVerb("GET").WithPathf("/api/messages/%s", session.Response.UUID).ExecuteWithMeta()
+	assert.Nil(err)
+	assert.Equal(http.StatusNotFound, meta.StatusCode)
+	meta, err = app.Mock().WithVerb("DELETE").WithPathf("/api/session/%s", session.Response.UUID).ExecuteWithMeta()
+	assert.Nil(err)
+	assert.Equal(http.StatusNotFound, meta.StatusCode)
+	assert.True(chat.userHasSession(u1.ID))
+
+	// ending the session takes its token with it.
+	meta, err = app.Mock().WithVerb("DELETE").WithPathf("/api/me/session").ExecuteWithMeta()
+	assert.Nil(err)
+	assert.Equal(http.StatusForbidden, meta.StatusCode)
+	meta, err = app.Mock().WithVerb("DELETE").WithPathf("/api/me/session").WithHeader("Authorization", "Bearer "+session.Response.Token).ExecuteWithMeta()
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, meta.StatusCode)
+	assert.False(chat.userHasSession(u1.ID))
+	err = app.Mock().WithVerb("GET").WithPathf("/api/me/messages").WithHeader("Authorization", "Bearer "+session.Response.Token).JSON(&messages)
+	assert.Nil(err)
+	assert.Equal(http.StatusForbidden, messages.Meta["http_code"])
+}
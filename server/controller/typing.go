@@ -0,0 +1,145 @@
+package controller
+
+import (
+	"sort"
+	"time"
+
+	web "github.com/wcharczuk/go-web"
+)
+
+const (
+	// TypingExpiry is how long a typing indicator lasts unless it is reported again.
+	TypingExpiry = 5 * time.Second
+)
+
+// setCachedTyping marks a user as typing to another user until the typing expiry elapses.
+func (c *Chat) setCachedTyping(typerID, targetID int) {
+	c.typingLock.Lock()
+	if c.Typing == nil {
+		c.Typing = map[int]map[int]time.Time{}
+	}
+	if _, hasTyping := c.Typing[targetID]; !hasTyping {
+		c.Typing[targetID] = map[int]time.Time{}
+	}
+	_, wasTyping := c.Typing[targetID][typerID]
+	c.Typing[targetID][typerID] = time.Now().UTC().Add(TypingExpiry)
+	c.typingLock.Unlock()
+
+	if !wasTyping {
+		c.signalMessage(targetID)
+	}
+}
+
+// removeCachedTyping clears a user typing to another user.
+func (c *Chat) removeCachedTyping(typerID, targetID int) {
+	c.typingLock.Lock()
+	var wasTyping bool
+	if typers, hasTyping := c.Typing[targetID]; hasTyping {
+		_, wasTyping = typers[typerID]
+		delete(typers, typerID)
+		if len(typers) == 0 {
+			delete(c.Typing, targetID)
+		}
+	}
+	c.typingLock.Unlock()
+
+	if wasTyping {
+		c.signalMessage(targetID)
+	}
+}
+
+// isCachedTyping returns if a user is typing to another user.
+func (c *Chat) isCachedTyping(typerID, targetID int) bool {
+	c.typingLock.Lock()
+	defer c.typingLock.Unlock()
+	if typers, hasTyping := c.Typing[targetID]; hasTyping {
+		if expires, isTyping := typers[typerID]; isTyping {
+			return time.Now().UTC().Before(expires)
+		}
+	}
+	return false
+}
+
+// getCachedTypingTo returns the ids of the users typing to a user, in order.
+func (c *Chat) getCachedTypingTo(targetID int) []int {
+	c.typingLock.Lock()
+	defer c.typingLock.Unlock()
+
+	now := time.Now().UTC()
+	typing := []int{}
+	for typerID, expires := range c.Typing[targetID] {
+		if now.Before(expires) {
+			typing = append(typing, typerID)
+		}
+	}
+	sort.Ints(typing)
+	return typing
+}
+
+// expireCachedTyping clears typing indicators that expired before a given time, and wakes up their targets.
+func (c *Chat) expireCachedTyping(now time.Time) {
+	c.typingLock.Lock()
+	var targets []int
+	for targetID, typers := range c.Typing {
+		for typerID, expires := range typers {
+			if !now.Before(expires) {
+				delete(typers, typerID)
+				targets = append(targets, targetID)
+			}
+		}
+		if len(typers) == 0 {
+			delete(c.Typing, targetID)
+		}
+	}
+	c.typingLock.Unlock()
+
+	for _, targetID := range targets {
+		c.signalMessage(targetID)
+	}
+}
+
+// typingChanged returns if two ordered lists of typing user ids differ.
+func typingChanged(previous, current []int) bool {
+	if len(previous) != len(current) {
+		return true
+	}
+	for x := 0; x < len(current); x++ {
+		if previous[x] != current[x] {
+			return true
+		}
+	}
+	return false
+}
+
+// POST /api/typing/:session_id/:user_id
+func (c *Chat) startTypingAction(rc *web.RequestContext) web.ControllerResult {
+	return c.typingAction(rc, true)
+}
+
+// DELETE /api/typing/:session_id/:user_id
+func (c *Chat) stopTypingAction(rc *web.RequestContext) web.ControllerResult {
+	return c.typingAction(rc, false)
+}
+
+func (c *Chat) typingAction(rc *web.RequestContext, isTyping bool) web.ControllerResult {
+	session, result := c.getRequestSession(rc)
+	if result != nil {
+		return result
+	}
+
+	userID, err := rc.RouteParameterInt("user_id")
+	if err != nil {
+		return rc.API().BadRequest(err.Error())
+	}
+	if !c.hasCachedUser(userID) {
+		return rc.API().BadRequest(ErrRecipientNotFound.Error())
+	}
+
+	if isTyping {
+		c.setCachedTyping(session.UserID, userID)
+	} else {
+		c.removeCachedTyping(session.UserID, userID)
+	}
+	c.setCachedSessionLastActive(session.UUID)
+	return rc.API().OK()
+}
@@ -0,0 +1,52 @@
+package controller
+
+import (
+	"testing"
+	"time"
+
+	assert "github.com/blendlabs/go-assert"
+)
+
+func TestChatCachedTyping(t *testing.T) {
+	assert := assert.New(t)
+
+	chat := new(Chat)
+	chat.setCachedTyping(2, 1)
+	chat.setCachedTyping(3, 1)
+	assert.True(chat.isCachedTyping(2, 1))
+	assert.False(chat.isCachedTyping(1, 2))
+	assert.Equal([]int{2, 3}, chat.getCachedTypingTo(1))
+	assert.Empty(chat.getCachedTypingTo(2))
+
+	chat.removeCachedTyping(3, 1)
+	assert.Equal([]int{2}, chat.getCachedTypingTo(1))
+
+	chat.expireCachedTyping(time.Now().UTC())
+	assert.True(chat.isCachedTyping(2, 1))
+
+	chat.expireCachedTyping(time.Now().UTC().Add(TypingExpiry))
+	assert.False(chat.isCachedTyping(2, 1))
+	assert.Empty(chat.Typing)
+}
+
+func TestChatSetCachedTypingSignals(t *testing.T) {
+	assert := assert.New(t)
+
+	chat := new(Chat)
+	signal := chat.getMessageSignal(1)
+	chat.setCachedTyping(2, 1)
+
+	select {
+	case <-signal:
+	case <-time.After(time.Second):
+		assert.FailNow("typing should wake up the target")
+	}
+}
+
+func TestTypingChanged(t *testing.T) {
+	assert := assert.New(t)
+	assert.False(typingChanged([]int{}, []int{}))
+	assert.False(typingChanged([]int{1, 2}, []int{1, 2}))
+	assert.True(typingChanged([]int{1}, []int{1, 2}))
+	assert.True(typingChanged([]int{1, 3}, []int{1, 2}))
+}
@@ -0,0 +1,178 @@
+package controller
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/blendlabs/chatbus/server/model"
+	"github.com/blendlabs/chatbus/server/viewmodel"
+	"github.com/gorilla/websocket"
+	web "github.com/wcharczuk/go-web"
+)
+
+const (
+	// WebsocketWriteTimeout is the time allowed to write a frame to a socket.
+	WebsocketWriteTimeout = 10 * time.Second
+
+	// WebsocketPongWait is the time allowed between pongs before a socket is considered dead.
+	WebsocketPongWait = 60 * time.Second
+
+	// WebsocketPingInterval is how often we ping sockets; it must be less than the pong wait.
+	WebsocketPingInterval = (WebsocketPongWait * 9) / 10
+
+	// WebsocketMaxMessageSize is the largest frame we will accept from a socket.
+	WebsocketMaxMessageSize = 1 << 12
+)
+
+// websocketUpgrader upgrades session connections; origin checks are left to upstream like the rest of CORS.
+var websocketUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+}
+
+// innerResponseWriter unwraps the go-web response writer so we can hijack or flush the connection.
+func innerResponseWriter(w http.ResponseWriter) http.ResponseWriter {
+	if typed, isTyped := w.(interface {
+		InnerWriter() http.ResponseWriter
+	}); isTyped {
+		return typed.InnerWriter()
+	}
+	return w
+}
+
+// GET /api/ws/:session_id
+func (c *Chat) websocketAction(rc *web.RequestContext) web.ControllerResult {
+	session, result := c.getRequestSession(rc)
+	if result != nil {
+		return result
+	}
+
+	if !c.trackWebsocket() {
+		return rc.API().InternalError(ErrShuttingDown)
+	}
+	defer c.websockets.Done()
+
+	conn, err := websocketUpgrader.Upgrade(innerResponseWriter(rc.Response), rc.Request, nil)
+	if err != nil {
+		// the upgrader has already written an error response.
+		return nil
+	}
+	c.serveWebsocket(session, conn)
+	return nil
+}
+
+// serveWebsocket runs a socket for a session until either side hangs up.
+func (c *Chat) serveWebsocket(session *model.Session, conn *websocket.Conn) {
+	defer conn.Close()
+
+	events := make(chan viewmodel.Event)
+	readerDone := make(chan struct{})
+	writerDone := make(chan struct{})
+
+	go func() {
+		defer close(writerDone)
+		c.pushWebsocket(session, conn, events, readerDone)
+	}()
+
+	c.readWebsocket(session, conn, events, writerDone)
+	close(readerDone)
+	<-writerDone
+}
+
+// readWebsocket reads messages sent over a socket and sends them as the session.
+func (c *Chat) readWebsocket(session *model.Session, conn *websocket.Conn, events chan<- viewmodel.Event, writerDone <-chan struct{}) {
+	conn.SetReadLimit(WebsocketMaxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(WebsocketPongWait))
+	conn.SetPongHandler(func(string) error {
+		c.setCachedSessionLastActive(session.UUID)
+		return conn.SetReadDeadline(time.Now().Add(WebsocketPongWait))
+	})
+
+	for {
+		_, body, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		var message model.Message
+		err = json.Unmarshal(body, &message)
+		if err == nil && message.DeliverAt != nil {
+			err = ErrScheduledOverWebsocket
+		}
+		if err == nil {
+			if _, allowed := c.RateLimits.Sends.Take(session, time.Now()); !allowed {
+				err = ErrRateLimited
+			}
+		}
+		if err == nil {
+			err = c.sendMessage(session, &message)
+		}
+		if err == nil {
+			continue
+		}
+
+		select {
+		case events <- viewmodel.Event{Type: viewmodel.EventTypeError, Error: err.Error()}:
+		case <-writerDone:
+			return
+		}
+	}
+}
+
+// pushWebsocket writes every message queued for the session's user to the socket, along with pings and any events from the reader.
+func (c *Chat) pushWebsocket(session *model.Session, conn *websocket.Conn, events <-chan viewmodel.Event, readerDone <-chan struct{}) {
+	// make sure the reader wakes up if we bail on a write.
+	defer conn.Close()
+
+	ping := time.NewTicker(WebsocketPingInterval)
+	defer ping.Stop()
+	drain := c.getDrainSignal()
+
+	sequence := c.getSequence(session.UserID)
+	typing := []int{}
+	for {
+		signal := c.getMessageSignal(session.UserID)
+		messages := c.getCachedMessagesAfterSequence(session.UserID, sequence)
+		for x := 0; x < len(messages); x++ {
+			message := messages[x]
+			if err := writeWebsocketEvent(conn, viewmodel.Event{Type: viewmodel.EventTypeMessage, Message: &message}); err != nil {
+				return
+			}
+			sequence = message.Sequence
+		}
+		c.markDelivered(session.UserID, messages)
+		if currentTyping := c.getCachedTypingTo(session.UserID); typingChanged(typing, currentTyping) {
+			if err := writeWebsocketEvent(conn, viewmodel.Event{Type: viewmodel.EventTypeTyping, Typing: currentTyping}); err != nil {
+				return
+			}
+			typing = currentTyping
+		}
+
+		select {
+		case <-signal:
+		case event := <-events:
+			if err := writeWebsocketEvent(conn, event); err != nil {
+				return
+			}
+		case <-ping.C:
+			conn.SetWriteDeadline(time.Now().Add(WebsocketWriteTimeout))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case <-readerDone:
+			return
+		case <-drain:
+			closeWebsocket(conn)
+			return
+		}
+	}
+}
+
+func writeWebsocketEvent(conn *websocket.Conn, event viewmodel.Event) error {
+	conn.SetWriteDeadline(time.Now().Add(WebsocketWriteTimeout))
+	return conn.WriteJSON(event)
+}
@@ -0,0 +1,79 @@
+package controller
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blendlabs/chatbus/server/model"
+	"github.com/blendlabs/chatbus/server/viewmodel"
+	assert "github.com/blendlabs/go-assert"
+	"github.com/gorilla/websocket"
+)
+
+func TestChatServeWebsocket(t *testing.T) {
+	assert := assert.New(t)
+
+	session1 := &model.Session{
+		UUID:       "test_session",
+		CreatedUTC: time.Now().UTC(),
+		UserID:     1,
+		User:       &model.User{ID: 1, UUID: "test_user1"},
+	}
+	session2 := &model.Session{
+		UUID:       "test_session2",
+		CreatedUTC: time.Now().UTC(),
+		UserID:     2,
+		User:       &model.User{ID: 2, UUID: "test_user2"},
+	}
+
+	chat := new(Chat)
+	chat.cacheSession(session1)
+	chat.addMessageQueue(session1)
+	chat.cacheSession(session2)
+	chat.addMessageQueue(session2)
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		conn, err := websocketUpgrader.Upgrade(rw, req, nil)
+		if err != nil {
+			return
+		}
+		chat.serveWebsocket(session2, conn)
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	assert.Nil(err)
+	defer conn.Close()
+
+	// the error comes back through the writer, so once it's read the writer has settled on its sequence.
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	assert.Nil(conn.WriteMessage(websocket.TextMessage, []byte(`{"receiver_id":99,"body":"nobody"}`)))
+	var event viewmodel.Event
+	assert.Nil(conn.ReadJSON(&event))
+	assert.Equal(viewmodel.EventTypeError, event.Type)
+	assert.Equal(ErrRecipientNotFound.Error(), event.Error)
+
+	// messages can only be scheduled with `POST /api/send`.
+	assert.Nil(conn.WriteMessage(websocket.TextMessage, []byte(`{"receiver_id":2,"body":"later","deliver_at":"2030-01-01T00:00:00Z"}`)))
+	event = viewmodel.Event{}
+	assert.Nil(conn.ReadJSON(&event))
+	assert.Equal(viewmodel.EventTypeError, event.Type)
+	assert.Equal(ErrScheduledOverWebsocket.Error(), event.Error)
+
+	chat.queueMessage(&model.Message{
+		UUID:       "test_message",
+		CreatedUTC: time.Now().UTC(),
+		SenderID:   1,
+		ReceiverID: 2,
+		Body:       "This is a test message.",
+	})
+
+	event = viewmodel.Event{}
+	assert.Nil(conn.ReadJSON(&event))
+	assert.Equal(viewmodel.EventTypeMessage, event.Type)
+	assert.NotNil(event.Message)
+	assert.Equal("test_message", event.Message.UUID)
+}
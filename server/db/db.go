@@ -59,6 +59,188 @@ func Migrate() error {
 				"messages",
 			),
 		),
+		migration.New(
+			"messages sequences",
+			migration.Step(
+				migration.CreateColumn,
+				migration.Body(
+					"ALTER TABLE messages ADD COLUMN sender_seq bigint not null default 0;",
+					"ALTER TABLE messages ADD COLUMN receiver_seq bigint not null default 0;",
+					`WITH ranked AS (
+						SELECT uuid, user_id, ROW_NUMBER() OVER (PARTITION BY user_id ORDER BY created_utc, uuid) as seq
+						FROM (SELECT uuid, created_utc, sender as user_id FROM messages UNION ALL SELECT uuid, created_utc, receiver as user_id FROM messages) as datums
+					)
+					UPDATE messages m SET sender_seq = ranked.seq FROM ranked WHERE ranked.uuid = m.uuid AND ranked.user_id = m.sender;`,
+					`WITH ranked AS (
+						SELECT uuid, user_id, ROW_NUMBER() OVER (PARTITION BY user_id ORDER BY created_utc, uuid) as seq
+						FROM (SELECT uuid, created_utc, sender as user_id FROM messages UNION ALL SELECT uuid, created_utc, receiver as user_id FROM messages) as datums
+					)
+					UPDATE messages m SET receiver_seq = ranked.seq FROM ranked WHERE ranked.uuid = m.uuid AND ranked.user_id = m.receiver;`,
+				),
+				"messages",
+				"sender_seq",
+			),
+		),
+		migration.New(
+			"rooms",
+			migration.Step(
+				migration.CreateTable,
+				migration.Body(
+					"CREATE TABLE rooms (id serial not null, uuid varchar(64) not null, name varchar(256), created_utc timestamp not null, created_by int not null);",
+					"ALTER TABLE rooms ADD CONSTRAINT pk_rooms_id PRIMARY KEY (id);",
+					"ALTER TABLE rooms ADD CONSTRAINT uk_rooms_uuid UNIQUE (uuid);",
+					"ALTER TABLE rooms ADD CONSTRAINT fk_rooms_created_by FOREIGN KEY (created_by) REFERENCES users(id);",
+				),
+				"rooms",
+			),
+		),
+		migration.New(
+			"room_members",
+			migration.Step(
+				migration.CreateTable,
+				migration.Body(
+					"CREATE TABLE room_members (room_id int not null, user_id int not null);",
+					"ALTER TABLE room_members ADD CONSTRAINT pk_room_members_room_id_user_id PRIMARY KEY (room_id, user_id);",
+					"ALTER TABLE room_members ADD CONSTRAINT fk_room_members_room_id FOREIGN KEY (room_id) REFERENCES rooms(id) ON DELETE CASCADE;",
+					"ALTER TABLE room_members ADD CONSTRAINT fk_room_members_user_id FOREIGN KEY (user_id) REFERENCES users(id);",
+				),
+				"room_members",
+			),
+		),
+		migration.New(
+			"messages room",
+			migration.Step(
+				migration.CreateColumn,
+				migration.Body(
+					"ALTER TABLE messages ADD COLUMN room_id int not null default 0;",
+					"CREATE INDEX ix_messages_room_id ON messages (room_id);",
+				),
+				"messages",
+				"room_id",
+			),
+		),
+		migration.New(
+			"message_sequences",
+			migration.Step(
+				migration.CreateTable,
+				migration.Body(
+					"CREATE TABLE message_sequences (message_uuid varchar(64) not null, user_id int not null, seq bigint not null);",
+					"ALTER TABLE message_sequences ADD CONSTRAINT pk_message_sequences_message_uuid_user_id PRIMARY KEY (message_uuid, user_id);",
+					"ALTER TABLE message_sequences ADD CONSTRAINT fk_message_sequences_message_uuid FOREIGN KEY (message_uuid) REFERENCES messages(uuid) ON DELETE CASCADE;",
+				),
+				"message_sequences",
+			),
+		),
+		migration.New(
+			"messages conversation index",
+			migration.Step(
+				migration.CreateIndex,
+				migration.Body(
+					"CREATE INDEX ix_messages_sender_receiver_created_utc ON messages (sender, receiver, created_utc desc, uuid desc);",
+				),
+				"messages",
+				"ix_messages_sender_receiver_created_utc",
+			),
+		),
+		migration.New(
+			"message_receipts",
+			migration.Step(
+				migration.CreateTable,
+				migration.Body(
+					"CREATE TABLE message_receipts (message_uuid varchar(64) not null, user_id int not null, delivered_utc timestamp, read_utc timestamp, seq bigint not null default 0);",
+					"ALTER TABLE message_receipts ADD CONSTRAINT pk_message_receipts_message_uuid_user_id PRIMARY KEY (message_uuid, user_id);",
+					"ALTER TABLE message_receipts ADD CONSTRAINT fk_message_receipts_user_id FOREIGN KEY (user_id) REFERENCES users(id);",
+				),
+				"message_receipts",
+			),
+		),
+		migration.New(
+			"messages edits",
+			migration.Step(
+				migration.CreateColumn,
+				migration.Body(
+					"ALTER TABLE messages ADD COLUMN edited_utc timestamp;",
+					"ALTER TABLE messages ADD COLUMN deleted_utc timestamp;",
+				),
+				"messages",
+				"edited_utc",
+			),
+		),
+		migration.New(
+			"message_events",
+			migration.Step(
+				migration.CreateTable,
+				migration.Body(
+					"CREATE TABLE message_events (message_uuid varchar(64) not null, user_id int not null, seq bigint not null, event varchar(32) not null, created_utc timestamp not null);",
+					"ALTER TABLE message_events ADD CONSTRAINT pk_message_events_message_uuid_user_id_seq PRIMARY KEY (message_uuid, user_id, seq);",
+					"ALTER TABLE message_events ADD CONSTRAINT fk_message_events_user_id FOREIGN KEY (user_id) REFERENCES users(id);",
+				),
+				"message_events",
+			),
+		),
+		migration.New(
+			"user_sequences",
+			migration.Step(
+				migration.CreateTable,
+				migration.Body(
+					"CREATE TABLE user_sequences (user_id int not null, seq bigint not null);",
+					"ALTER TABLE user_sequences ADD CONSTRAINT pk_user_sequences_user_id PRIMARY KEY (user_id);",
+				),
+				"user_sequences",
+			),
+		),
+		migration.New(
+			"messages ephemeral",
+			migration.Step(
+				migration.CreateColumn,
+				migration.Body(
+					"ALTER TABLE messages ADD COLUMN expires_utc timestamp;",
+					"ALTER TABLE messages ADD COLUMN read_once boolean not null default false;",
+					"CREATE INDEX ix_messages_expires_utc ON messages (expires_utc) WHERE expires_utc is not null;",
+					"CREATE INDEX ix_messages_read_once ON messages (uuid) WHERE read_once;",
+				),
+				"messages",
+				"expires_utc",
+			),
+		),
+		migration.New(
+			"scheduled_messages",
+			migration.Step(
+				migration.CreateTable,
+				migration.Body(
+					"CREATE TABLE scheduled_messages (uuid varchar(64) not null, session_uuid varchar(64) not null, scheduled_utc timestamp not null, deliver_utc timestamp not null, sender int not null, receiver int not null, room_id int not null default 0, body varchar(1024) not null, attachments json, ttl_seconds int not null default 0, read_once boolean not null default false);",
+					"ALTER TABLE scheduled_messages ADD CONSTRAINT pk_scheduled_messages_uuid PRIMARY KEY (uuid);",
+					"ALTER TABLE scheduled_messages ADD CONSTRAINT fk_scheduled_messages_sender FOREIGN KEY (sender) REFERENCES users(id);",
+					"ALTER TABLE scheduled_messages ADD CONSTRAINT fk_scheduled_messages_receiver FOREIGN KEY (receiver) REFERENCES users(id);",
+					"CREATE INDEX ix_scheduled_messages_deliver_utc ON scheduled_messages (deliver_utc);",
+				),
+				"scheduled_messages",
+			),
+		),
+		migration.New(
+			"inbox_messages",
+			migration.Step(
+				migration.CreateTable,
+				migration.Body(
+					"CREATE TABLE inbox_messages (user_id int not null, message_uuid varchar(64) not null, seq bigint not null, created_utc timestamp not null);",
+					"ALTER TABLE inbox_messages ADD CONSTRAINT pk_inbox_messages_user_id_message_uuid PRIMARY KEY (user_id, message_uuid);",
+					"ALTER TABLE inbox_messages ADD CONSTRAINT fk_inbox_messages_user_id FOREIGN KEY (user_id) REFERENCES users(id);",
+					"CREATE INDEX ix_inbox_messages_message_uuid ON inbox_messages (message_uuid);",
+				),
+				"inbox_messages",
+			),
+		),
+		migration.New(
+			"messages created index",
+			migration.Step(
+				migration.CreateIndex,
+				migration.Body(
+					"CREATE INDEX ix_messages_created_utc ON messages (created_utc, uuid);",
+				),
+				"messages",
+				"ix_messages_created_utc",
+			),
+		),
 	)
 	schema.Logged(migration.NewLogger())
 	return schema.Apply(spiffy.DefaultDb())
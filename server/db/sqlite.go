@@ -0,0 +1,132 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// sqliteSchema is the sqlite equivalent of the migrations in `Migrate`, in order.
+// The database's `user_version` records how many steps have been applied, so only add steps to the end.
+var sqliteSchema = [][]string{
+	// users
+	{
+		"CREATE TABLE users (id integer primary key autoincrement, uuid varchar(64) not null, display_name varchar(256));",
+		"CREATE UNIQUE INDEX uk_users_uuid ON users (uuid);",
+	},
+	// sessions
+	{
+		"CREATE TABLE sessions (uuid varchar(64) not null primary key, created_utc timestamp not null, last_active_utc timestamp not null, user_id int not null references users(id));",
+	},
+	// contacts
+	{
+		"CREATE TABLE contacts (sender int not null references users(id), receiver int not null references users(id), primary key (sender, receiver));",
+	},
+	// messages, with the sequence, room and edit columns added to the postgres table since.
+	{
+		`CREATE TABLE messages (
+			uuid varchar(64) not null primary key
+			, created_utc timestamp not null
+			, sender int not null references users(id)
+			, receiver int not null references users(id)
+			, body varchar(1024) not null
+			, attachments text
+			, sender_seq bigint not null default 0
+			, receiver_seq bigint not null default 0
+			, room_id int not null default 0
+			, edited_utc timestamp
+			, deleted_utc timestamp
+		);`,
+		"CREATE INDEX ix_messages_room_id ON messages (room_id);",
+		"CREATE INDEX ix_messages_receiver_created_utc ON messages (receiver, created_utc desc);",
+		"CREATE INDEX ix_messages_sender_receiver_created_utc ON messages (sender, receiver, created_utc desc, uuid desc);",
+	},
+	// rooms
+	{
+		"CREATE TABLE rooms (id integer primary key autoincrement, uuid varchar(64) not null, name varchar(256), created_utc timestamp not null, created_by int not null references users(id));",
+		"CREATE UNIQUE INDEX uk_rooms_uuid ON rooms (uuid);",
+	},
+	// room_members
+	{
+		"CREATE TABLE room_members (room_id int not null references rooms(id) on delete cascade, user_id int not null references users(id), primary key (room_id, user_id));",
+	},
+	// message_sequences
+	{
+		"CREATE TABLE message_sequences (message_uuid varchar(64) not null references messages(uuid) on delete cascade, user_id int not null, seq bigint not null, primary key (message_uuid, user_id));",
+	},
+	// message_receipts
+	{
+		"CREATE TABLE message_receipts (message_uuid varchar(64) not null, user_id int not null references users(id), delivered_utc timestamp, read_utc timestamp, seq bigint not null default 0, primary key (message_uuid, user_id));",
+	},
+	// message_events
+	{
+		"CREATE TABLE message_events (message_uuid varchar(64) not null, user_id int not null references users(id), seq bigint not null, event varchar(32) not null, created_utc timestamp not null, primary key (message_uuid, user_id, seq));",
+	},
+	// user_sequences
+	{
+		"CREATE TABLE user_sequences (user_id int not null primary key, seq bigint not null);",
+	},
+	// messages ephemeral
+	{
+		"ALTER TABLE messages ADD COLUMN expires_utc timestamp;",
+		"ALTER TABLE messages ADD COLUMN read_once boolean not null default false;",
+		"CREATE INDEX ix_messages_expires_utc ON messages (expires_utc) WHERE expires_utc is not null;",
+		"CREATE INDEX ix_messages_read_once ON messages (uuid) WHERE read_once;",
+	},
+	// scheduled_messages
+	{
+		`CREATE TABLE scheduled_messages (
+			uuid varchar(64) not null primary key
+			, session_uuid varchar(64) not null
+			, scheduled_utc timestamp not null
+			, deliver_utc timestamp not null
+			, sender int not null references users(id)
+			, receiver int not null references users(id)
+			, room_id int not null default 0
+			, body varchar(1024) not null
+			, attachments text
+			, ttl_seconds int not null default 0
+			, read_once boolean not null default false
+		);`,
+		"CREATE INDEX ix_scheduled_messages_deliver_utc ON scheduled_messages (deliver_utc);",
+	},
+	// inbox_messages
+	{
+		"CREATE TABLE inbox_messages (user_id int not null references users(id), message_uuid varchar(64) not null, seq bigint not null, created_utc timestamp not null, primary key (user_id, message_uuid));",
+		"CREATE INDEX ix_inbox_messages_message_uuid ON inbox_messages (message_uuid);",
+	},
+	// messages created index
+	{
+		"CREATE INDEX ix_messages_created_utc ON messages (created_utc, uuid);",
+	},
+}
+
+// MigrateSqlite migrates a sqlite database.
+func MigrateSqlite(conn *sql.DB) error {
+	var version int
+	err := conn.QueryRow("PRAGMA user_version;").Scan(&version)
+	if err != nil {
+		return err
+	}
+
+	for ; version < len(sqliteSchema); version++ {
+		tx, err := conn.Begin()
+		if err != nil {
+			return err
+		}
+		for _, statement := range sqliteSchema[version] {
+			if _, err = tx.Exec(statement); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		// pragmas can't take parameters.
+		if _, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d;", version+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package model
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/blendlabs/spiffy"
+)
+
+// InboxMessage records a message that was routed to a user while they had no session, so it is still pending after a restart.
+type InboxMessage struct {
+	UserID      int    `json:"user_id" db:"user_id,pk"`
+	MessageUUID string `json:"message_uuid" db:"message_uuid,pk"`
+	// Sequence is the message's position in the user's stream.
+	Sequence   int64     `json:"seq" db:"seq"`
+	CreatedUTC time.Time `json:"created_utc" db:"created_utc"`
+}
+
+// TableName returns the table name for the object.
+func (im InboxMessage) TableName() string {
+	return "inbox_messages"
+}
+
+// GetInboxMessages gets every pending inbox entry, by user and then sequence.
+func GetInboxMessages(txs ...*sql.Tx) ([]InboxMessage, error) {
+	var tx *sql.Tx
+	if len(txs) > 0 {
+		tx = txs[0]
+	}
+	entries := []InboxMessage{}
+	queryBody := fmt.Sprintf("SELECT %s FROM %s ORDER BY user_id, seq", spiffy.ColumnNames(InboxMessage{}), InboxMessage{}.TableName())
+	err := DB().QueryInTransaction(queryBody, tx).OutMany(&entries)
+	return entries, err
+}
+
+// CreateInboxMessage records a pending inbox entry, if it isn't already.
+func CreateInboxMessage(entry InboxMessage, txs ...*sql.Tx) error {
+	var tx *sql.Tx
+	if len(txs) > 0 {
+		tx = txs[0]
+	}
+	queryBody := `INSERT INTO inbox_messages (user_id, message_uuid, seq, created_utc) VALUES ($1, $2, $3, $4) ON CONFLICT (user_id, message_uuid) DO NOTHING`
+	return DB().ExecInTransaction(queryBody, tx, entry.UserID, entry.MessageUUID, entry.Sequence, entry.CreatedUTC)
+}
+
+// DeleteInboxMessages deletes a user's pending inbox entries once they've been handed to a session.
+func DeleteInboxMessages(userID int, txs ...*sql.Tx) error {
+	var tx *sql.Tx
+	if len(txs) > 0 {
+		tx = txs[0]
+	}
+	return DB().ExecInTransaction("DELETE FROM inbox_messages WHERE user_id = $1", tx, userID)
+}
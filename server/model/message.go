@@ -1,12 +1,28 @@
 package model
 
 import (
+	"bytes"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"time"
 
-	"github.com/blendlabs/go-workqueue"
 	"github.com/blendlabs/spiffy"
+	"github.com/lib/pq"
+)
+
+const (
+	// MessageEventReceipt marks a queued copy of a message announcing a change to its receipts.
+	MessageEventReceipt = "receipt"
+	// MessageEventEdit marks a queued copy of a message announcing that it was edited.
+	MessageEventEdit = "edit"
+	// MessageEventDelete marks a queued copy of a message announcing that it was retracted.
+	MessageEventDelete = "delete"
+	// MessageEventExpire marks a tombstone for an ephemeral message that has vanished.
+	MessageEventExpire = "expire"
+
+	// MessageInsertMaxRows is the most rows CreateMessages puts in one insert; postgres allows 65535 parameters per statement.
+	MessageInsertMaxRows = 1000
 )
 
 // TryCastMessage tries to cast an interface as a *Message
@@ -30,6 +46,33 @@ type Message struct {
 	Receiver    *User                  `json:"receiver,omitempty" db:"-"`
 	Body        string                 `json:"body" db:"body"` // REQUIRED (MAYBE??)
 	Attachments map[string]interface{} `json:"attachments" db:"attachments,json"`
+	// RoomID is set for messages sent to a room; room messages are addressed to their sender.
+	RoomID int `json:"room_id,omitempty" db:"room_id"`
+	// EditedUTC is when the message was last edited by its sender.
+	EditedUTC *time.Time `json:"edited_utc,omitempty" db:"edited_utc"`
+	// DeletedUTC is when the message was retracted by its sender; retracted messages keep their row with the body cleared.
+	DeletedUTC *time.Time `json:"deleted_utc,omitempty" db:"deleted_utc"`
+	// ExpiresUTC is when an ephemeral message vanishes; it is set from TTLSeconds when the message is sent.
+	ExpiresUTC *time.Time `json:"expires_utc,omitempty" db:"expires_utc"`
+	// ReadOnce messages vanish as soon as a recipient reads them.
+	ReadOnce bool `json:"read_once,omitempty" db:"read_once"`
+	// TTLSeconds is how long an ephemeral message should last, as sent; it isn't stored.
+	TTLSeconds int `json:"ttl_seconds,omitempty" db:"-"`
+	// DeliverAt holds a message being sent until a later time, see ScheduledMessage; it isn't stored.
+	DeliverAt *time.Time `json:"deliver_at,omitempty" db:"-"`
+
+	// SenderSequence and ReceiverSequence are the message's position in the sender's and receiver's streams.
+	SenderSequence   int64 `json:"-" db:"sender_seq"`
+	ReceiverSequence int64 `json:"-" db:"receiver_seq"`
+	// Sequence is the message's position in the stream of the user whose queue it was read from.
+	Sequence int64 `json:"seq,omitempty" db:"-"`
+	// RoomSequences are the message's position in each room member's stream, by user id.
+	RoomSequences map[int]int64 `json:"-" db:"-"`
+
+	// Receipts are the delivery and read receipts for the message's recipients.
+	Receipts []MessageReceipt `json:"receipts,omitempty" db:"-"`
+	// Event is set on queued copies of a message that announce a change to it, rather than the message itself.
+	Event string `json:"event,omitempty" db:"-"`
 }
 
 // IsZero returns if the object is set or not.
@@ -37,6 +80,35 @@ func (m Message) IsZero() bool {
 	return len(m.UUID) == 0
 }
 
+// EventID returns an id for the message's place in a stream; change events get their own id.
+func (m Message) EventID() string {
+	if len(m.Event) == 0 {
+		return m.UUID
+	}
+	return fmt.Sprintf("%s.%d", m.UUID, m.Sequence)
+}
+
+// GetReceipt returns the message's receipt for a recipient.
+func (m Message) GetReceipt(userID int) (MessageReceipt, bool) {
+	for _, receipt := range m.Receipts {
+		if receipt.UserID == userID {
+			return receipt, true
+		}
+	}
+	return MessageReceipt{}, false
+}
+
+// WithReceipt returns a copy of the message's receipts with a recipient's receipt replaced.
+func (m Message) WithReceipt(receipt MessageReceipt) []MessageReceipt {
+	receipts := []MessageReceipt{}
+	for _, existing := range m.Receipts {
+		if existing.UserID != receipt.UserID {
+			receipts = append(receipts, existing)
+		}
+	}
+	return append(receipts, receipt)
+}
+
 // LessThan returns if an object
 func (m Message) LessThan(other interface{}) bool {
 	if typed, isTyped := other.(Message); isTyped {
@@ -53,20 +125,127 @@ func (m Message) TableName() string {
 	return "messages"
 }
 
-// QueueCreate queue's a message create.
-func (m Message) QueueCreate() {
-	workQueue.Enqueue(func(v ...interface{}) error {
-		if len(v) == 0 {
-			return nil
-		}
-		if typed, isTyped := v[0].(spiffy.DatabaseMapped); isTyped {
-			return DB().Create(typed)
+// Create creates the message along with any room sequences.
+func (m Message) Create(txs ...*sql.Tx) error {
+	var tx *sql.Tx
+	if len(txs) > 0 {
+		tx = txs[0]
+	}
+	err := DB().CreateInTransaction(m, tx)
+	if err != nil {
+		return err
+	}
+	for userID, sequence := range m.RoomSequences {
+		err = DB().CreateInTransaction(MessageSequence{MessageUUID: m.UUID, UserID: userID, Sequence: sequence}, tx)
+		if err != nil {
+			return err
 		}
+	}
+	return nil
+}
+
+// CreateMessages creates messages along with their room sequences using multi-row inserts, in one transaction.
+func CreateMessages(messages []Message, txs ...*sql.Tx) error {
+	if len(messages) == 0 {
 		return nil
-	}, m)
+	}
+	if len(txs) > 0 && txs[0] != nil {
+		return createMessages(messages, txs[0])
+	}
+
+	tx, err := DB().Begin()
+	if err != nil {
+		return err
+	}
+	err = createMessages(messages, tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// createMessages inserts messages and then their room sequences, MessageInsertMaxRows at a time.
+func createMessages(messages []Message, tx *sql.Tx) error {
+	var sequences []MessageSequence
+	for start := 0; start < len(messages); start += MessageInsertMaxRows {
+		end := start + MessageInsertMaxRows
+		if end > len(messages) {
+			end = len(messages)
+		}
+
+		var args []interface{}
+		for _, m := range messages[start:end] {
+			attachments, err := json.Marshal(m.Attachments)
+			if err != nil {
+				return err
+			}
+			args = append(args, m.UUID, m.CreatedUTC, m.SenderID, m.ReceiverID, m.Body, string(attachments), m.RoomID, m.EditedUTC, m.DeletedUTC, m.SenderSequence, m.ReceiverSequence, m.ExpiresUTC, m.ReadOnce)
+			for userID, sequence := range m.RoomSequences {
+				sequences = append(sequences, MessageSequence{MessageUUID: m.UUID, UserID: userID, Sequence: sequence})
+			}
+		}
+
+		queryBody := `INSERT INTO messages (uuid, created_utc, sender, receiver, body, attachments, room_id, edited_utc, deleted_utc, sender_seq, receiver_seq, expires_utc, read_once) VALUES ` + valuesPlaceholders(end-start, 13)
+		err := DB().ExecInTransaction(queryBody, tx, args...)
+		if err != nil {
+			return err
+		}
+	}
+
+	for start := 0; start < len(sequences); start += MessageInsertMaxRows {
+		end := start + MessageInsertMaxRows
+		if end > len(sequences) {
+			end = len(sequences)
+		}
+
+		var args []interface{}
+		for _, sequence := range sequences[start:end] {
+			args = append(args, sequence.MessageUUID, sequence.UserID, sequence.Sequence)
+		}
+		queryBody := `INSERT INTO message_sequences (message_uuid, user_id, seq) VALUES ` + valuesPlaceholders(end-start, 3)
+		err := DB().ExecInTransaction(queryBody, tx, args...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// valuesPlaceholders returns the numbered placeholders for a multi-row insert, i.e. `($1,$2),($3,$4)`.
+func valuesPlaceholders(rows, columns int) string {
+	buffer := bytes.NewBuffer(nil)
+	for row := 0; row < rows; row++ {
+		if row > 0 {
+			buffer.WriteString(",")
+		}
+		buffer.WriteString("(")
+		for column := 0; column < columns; column++ {
+			if column > 0 {
+				buffer.WriteString(",")
+			}
+			fmt.Fprintf(buffer, "$%d", row*columns+column+1)
+		}
+		buffer.WriteString(")")
+	}
+	return buffer.String()
+}
+
+// UpdateContent persists the message's body, attachments and edit / retraction timestamps.
+func (m Message) UpdateContent(txs ...*sql.Tx) error {
+	var tx *sql.Tx
+	if len(txs) > 0 {
+		tx = txs[0]
+	}
+	attachments, err := json.Marshal(m.Attachments)
+	if err != nil {
+		return err
+	}
+	queryBody := `UPDATE messages SET body = $2, attachments = $3, edited_utc = $4, deleted_utc = $5 WHERE uuid = $1`
+	return DB().ExecInTransaction(queryBody, tx, m.UUID, m.Body, string(attachments), m.EditedUTC, m.DeletedUTC)
 }
 
-// GetAllMessagesWithLimit gets all the messages within a given limit (per recipient).
+// GetAllMessagesWithLimit gets all the messages within a given limit (per recipient, or per room for room messages).
 func GetAllMessagesWithLimit(limit int, txs ...*sql.Tx) ([]Message, error) {
 	var tx *sql.Tx
 	if len(txs) > 0 {
@@ -82,11 +261,335 @@ func GetAllMessagesWithLimit(limit int, txs ...*sql.Tx) ([]Message, error) {
 			, m.*
 		FROM 
 			%s m
+		WHERE m.room_id = 0
+		UNION ALL
+		SELECT
+			ROW_NUMBER() over (PARTITION BY m.room_id ORDER BY m.created_utc desc) as rank
+			, m.*
+		FROM 
+			%s m
+		WHERE m.room_id <> 0
 	) as datums
 	where datums.rank <= $1
 	order by datums.created_utc asc
 	`
-	queryBody := fmt.Sprintf(queryFormat, spiffy.ColumnNames(Message{}), Message{}.TableName())
+	queryBody := fmt.Sprintf(queryFormat, spiffy.ColumnNames(Message{}), Message{}.TableName(), Message{}.TableName())
 	err := DB().QueryInTransaction(queryBody, tx, limit).OutMany(&messages)
+	if err != nil {
+		return messages, err
+	}
+
+	roomSequences, err := getRoomMessageSequencesWithLimit(limit, tx)
+	if err != nil {
+		return messages, err
+	}
+	for x := 0; x < len(messages); x++ {
+		if sequences, hasSequences := roomSequences[messages[x].UUID]; hasSequences {
+			messages[x].RoomSequences = sequences
+		}
+	}
+	return messages, nil
+}
+
+// getRoomMessageSequencesWithLimit gets the member sequences for the room messages within a given limit (per room), by message uuid.
+func getRoomMessageSequencesWithLimit(limit int, tx *sql.Tx) (map[string]map[int]int64, error) {
+	sequences := map[string]map[int]int64{}
+
+	queryBody := `
+	SELECT ms.message_uuid, ms.user_id, ms.seq FROM
+	(
+		SELECT
+			ROW_NUMBER() over (PARTITION BY m.room_id ORDER BY m.created_utc desc) as rank
+			, m.uuid
+		FROM 
+			messages m
+		WHERE m.room_id <> 0
+	) as datums
+	JOIN message_sequences ms on ms.message_uuid = datums.uuid
+	where datums.rank <= $1
+	`
+	err := DB().QueryInTransaction(queryBody, tx, limit).Each(func(r *sql.Rows) error {
+		var messageUUID string
+		var userID int
+		var sequence int64
+		err := r.Scan(&messageUUID, &userID, &sequence)
+		if err != nil {
+			return err
+		}
+		if _, hasSequences := sequences[messageUUID]; !hasSequences {
+			sequences[messageUUID] = map[int]int64{}
+		}
+		sequences[messageUUID][userID] = sequence
+		return nil
+	})
+	return sequences, err
+}
+
+// GetConversationBefore gets up to limit messages between two users that were sent before a cursor, newest first.
+// The cursor is either a timestamp, or a timestamp and the uuid of the message at that timestamp to page past.
+func GetConversationBefore(userID, otherUserID int, before time.Time, beforeUUID string, limit int, txs ...*sql.Tx) ([]Message, error) {
+	var tx *sql.Tx
+	if len(txs) > 0 {
+		tx = txs[0]
+	}
+	var messages []Message
+
+	queryFormat := `
+	SELECT %s FROM %s m
+	WHERE
+		((m.sender = $1 and m.receiver = $2) or (m.sender = $2 and m.receiver = $1))
+		and m.room_id = 0
+		and (m.created_utc < $3 or (m.created_utc = $3 and m.uuid < $4))
+	ORDER BY m.created_utc desc, m.uuid desc
+	LIMIT $5
+	`
+	queryBody := fmt.Sprintf(queryFormat, spiffy.ColumnNames(Message{}), Message{}.TableName())
+	err := DB().QueryInTransaction(queryBody, tx, userID, otherUserID, before, beforeUUID, limit).OutMany(&messages)
+	return messages, err
+}
+
+// MessageMaxAges are how long messages are kept before they expire; a zero max age keeps them forever.
+// Room and conversation overrides replace the default max age; conversations are keyed by the lower user id first.
+type MessageMaxAges struct {
+	Default       time.Duration
+	Rooms         map[int]time.Duration
+	Conversations map[[2]int]time.Duration
+}
+
+// For returns how long a message is kept; zero is forever.
+func (ma MessageMaxAges) For(message Message) time.Duration {
+	if message.RoomID != 0 {
+		if maxAge, hasOverride := ma.Rooms[message.RoomID]; hasOverride {
+			return maxAge
+		}
+		return ma.Default
+	}
+	if maxAge, hasOverride := ma.Conversations[ConversationKey(message.SenderID, message.ReceiverID)]; hasOverride {
+		return maxAge
+	}
+	return ma.Default
+}
+
+// IsExpired returns if a message is past its max age.
+func (ma MessageMaxAges) IsExpired(message Message, now time.Time) bool {
+	maxAge := ma.For(message)
+	return maxAge > 0 && message.CreatedUTC.Before(now.Add(-maxAge))
+}
+
+// Cutoff returns the newest a message can be and still have expired, under the shortest max age; it returns false if nothing ever expires.
+func (ma MessageMaxAges) Cutoff(now time.Time) (time.Time, bool) {
+	var shortest time.Duration
+	consider := func(maxAge time.Duration) {
+		if maxAge > 0 && (shortest == 0 || maxAge < shortest) {
+			shortest = maxAge
+		}
+	}
+	consider(ma.Default)
+	for _, maxAge := range ma.Rooms {
+		consider(maxAge)
+	}
+	for _, maxAge := range ma.Conversations {
+		consider(maxAge)
+	}
+	if shortest == 0 {
+		return time.Time{}, false
+	}
+	return now.Add(-shortest), true
+}
+
+// ConversationKey returns the key of the direct messages between two users in `MessageMaxAges.Conversations`.
+func ConversationKey(userID, otherUserID int) [2]int {
+	if otherUserID < userID {
+		return [2]int{otherUserID, userID}
+	}
+	return [2]int{userID, otherUserID}
+}
+
+// GetMessagesPastMaxAge gets up to limit messages past their max age as of now, oldest first, starting after a cursor.
+// The cursor is the timestamp and uuid of the last message of the previous page; start with a zero time and an empty uuid.
+func GetMessagesPastMaxAge(maxAges MessageMaxAges, now, after time.Time, afterUUID string, limit int, txs ...*sql.Tx) ([]Message, error) {
+	var tx *sql.Tx
+	if len(txs) > 0 {
+		tx = txs[0]
+	}
+	var messages []Message
+	cutoff, expires := maxAges.Cutoff(now)
+	if !expires {
+		return messages, nil
+	}
+
+	var roomIDs []int64
+	var roomMaxAges []int64
+	for roomID, maxAge := range maxAges.Rooms {
+		roomIDs = append(roomIDs, int64(roomID))
+		roomMaxAges = append(roomMaxAges, int64(maxAge/time.Millisecond))
+	}
+	var userIDs, otherUserIDs []int64
+	var conversationMaxAges []int64
+	for conversation, maxAge := range maxAges.Conversations {
+		userIDs = append(userIDs, int64(conversation[0]))
+		otherUserIDs = append(otherUserIDs, int64(conversation[1]))
+		conversationMaxAges = append(conversationMaxAges, int64(maxAge/time.Millisecond))
+	}
+
+	// the shortest cutoff bounds the scan of ix_messages_created_utc; each message's own max age (in milliseconds) then decides.
+	queryFormat := `
+	SELECT %s FROM %s m
+	CROSS JOIN LATERAL (
+		SELECT COALESCE(
+			CASE WHEN m.room_id <> 0
+				THEN (SELECT r.max_age FROM unnest($5::int[], $6::bigint[]) r(room_id, max_age) WHERE r.room_id = m.room_id)
+				ELSE (SELECT c.max_age FROM unnest($7::int[], $8::int[], $9::bigint[]) c(user_id, other_user_id, max_age) WHERE c.user_id = least(m.sender, m.receiver) and c.other_user_id = greatest(m.sender, m.receiver))
+			END
+		, $10) as max_age
+	) ma
+	WHERE
+		m.created_utc < $1
+		and (m.created_utc > $2 or (m.created_utc = $2 and m.uuid > $3))
+		and ma.max_age > 0
+		and m.created_utc < $4::timestamp - interval '1 millisecond' * ma.max_age
+	ORDER BY m.created_utc asc, m.uuid asc
+	LIMIT $11
+	`
+	queryBody := fmt.Sprintf(queryFormat, spiffy.ColumnNames(Message{}), Message{}.TableName())
+	err := DB().QueryInTransaction(queryBody, tx,
+		cutoff, after, afterUUID, now,
+		pq.Array(roomIDs), pq.Array(roomMaxAges),
+		pq.Array(userIDs), pq.Array(otherUserIDs), pq.Array(conversationMaxAges),
+		int64(maxAges.Default/time.Millisecond), limit,
+	).OutMany(&messages)
 	return messages, err
 }
+
+// GetMessagesByUUID gets a set of messages by uuid, in no particular order; missing ones are skipped.
+func GetMessagesByUUID(uuids []string, txs ...*sql.Tx) ([]Message, error) {
+	var tx *sql.Tx
+	if len(txs) > 0 {
+		tx = txs[0]
+	}
+	messages := []Message{}
+	if len(uuids) == 0 {
+		return messages, nil
+	}
+	queryBody := fmt.Sprintf("SELECT %s FROM %s WHERE uuid = ANY($1)", spiffy.ColumnNames(Message{}), Message{}.TableName())
+	err := DB().QueryInTransaction(queryBody, tx, pq.Array(uuids)).OutMany(&messages)
+	return messages, err
+}
+
+// GetExpiredMessages gets up to limit ephemeral messages that should have vanished by now, either because they're past their expiry or because they're read once and have been read.
+func GetExpiredMessages(now time.Time, limit int, txs ...*sql.Tx) ([]Message, error) {
+	var tx *sql.Tx
+	if len(txs) > 0 {
+		tx = txs[0]
+	}
+	var messages []Message
+
+	queryFormat := `
+	SELECT %s FROM %s m
+	WHERE
+		m.expires_utc <= $1
+		or (m.read_once and exists (SELECT 1 FROM message_receipts mr WHERE mr.message_uuid = m.uuid and mr.read_utc is not null))
+	LIMIT $2
+	`
+	queryBody := fmt.Sprintf(queryFormat, spiffy.ColumnNames(Message{}), Message{}.TableName())
+	err := DB().QueryInTransaction(queryBody, tx, now, limit).OutMany(&messages)
+	return messages, err
+}
+
+// DeleteMessages deletes messages along with their sequences, receipts and change events, in one transaction.
+// The highest sequence each user had among them is kept in `user_sequences`, so sequences don't go backwards on restore.
+func DeleteMessages(messageUUIDs []string, txs ...*sql.Tx) error {
+	if len(messageUUIDs) == 0 {
+		return nil
+	}
+	if len(txs) > 0 && txs[0] != nil {
+		return deleteMessages(messageUUIDs, txs[0])
+	}
+
+	tx, err := DB().Begin()
+	if err != nil {
+		return err
+	}
+	err = deleteMessages(messageUUIDs, tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func deleteMessages(messageUUIDs []string, tx *sql.Tx) error {
+	uuids := pq.Array(messageUUIDs)
+	queryBody := `
+	INSERT INTO user_sequences (user_id, seq)
+	SELECT user_id, MAX(seq) FROM
+	(
+		SELECT sender as user_id, sender_seq as seq FROM messages WHERE uuid = ANY($1)
+		UNION ALL
+		SELECT receiver as user_id, receiver_seq as seq FROM messages WHERE uuid = ANY($1)
+		UNION ALL
+		SELECT user_id, seq FROM message_sequences WHERE message_uuid = ANY($1)
+		UNION ALL
+		SELECT m.sender as user_id, mr.seq FROM message_receipts mr JOIN messages m on m.uuid = mr.message_uuid WHERE mr.message_uuid = ANY($1)
+		UNION ALL
+		SELECT user_id, seq FROM message_events WHERE message_uuid = ANY($1)
+	) as datums
+	group by user_id
+	ON CONFLICT (user_id) DO UPDATE SET seq = GREATEST(user_sequences.seq, excluded.seq)
+	`
+	err := DB().ExecInTransaction(queryBody, tx, uuids)
+	if err != nil {
+		return err
+	}
+	for _, statement := range []string{
+		"DELETE FROM message_events WHERE message_uuid = ANY($1)",
+		"DELETE FROM message_receipts WHERE message_uuid = ANY($1)",
+		"DELETE FROM message_sequences WHERE message_uuid = ANY($1)",
+		"DELETE FROM inbox_messages WHERE message_uuid = ANY($1)",
+		"DELETE FROM messages WHERE uuid = ANY($1)",
+	} {
+		err = DB().ExecInTransaction(statement, tx, uuids)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetMessageSequences gets the highest message sequence number for each user, including the ones kept in `user_sequences` for deleted messages.
+func GetMessageSequences(txs ...*sql.Tx) (map[int]int64, error) {
+	var tx *sql.Tx
+	if len(txs) > 0 {
+		tx = txs[0]
+	}
+	sequences := map[int]int64{}
+
+	queryBody := `
+	SELECT user_id, MAX(seq) FROM
+	(
+		SELECT sender as user_id, sender_seq as seq FROM messages
+		UNION ALL
+		SELECT receiver as user_id, receiver_seq as seq FROM messages
+		UNION ALL
+		SELECT user_id, seq FROM message_sequences
+		UNION ALL
+		SELECT m.sender as user_id, mr.seq FROM message_receipts mr JOIN messages m on m.uuid = mr.message_uuid
+		UNION ALL
+		SELECT user_id, seq FROM message_events
+		UNION ALL
+		SELECT user_id, seq FROM user_sequences
+	) as datums
+	group by user_id
+	`
+	err := DB().QueryInTransaction(queryBody, tx).Each(func(r *sql.Rows) error {
+		var userID int
+		var sequence int64
+		err := r.Scan(&userID, &sequence)
+		if err != nil {
+			return err
+		}
+		sequences[userID] = sequence
+		return nil
+	})
+	return sequences, err
+}
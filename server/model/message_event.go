@@ -0,0 +1,52 @@
+package model
+
+import (
+	"database/sql"
+	"time"
+)
+
+// MessageEvent records a change event queued for a message (an edit or retraction) and its position in a user's stream.
+type MessageEvent struct {
+	MessageUUID string    `json:"message_uuid" db:"message_uuid,pk"`
+	UserID      int       `json:"user_id" db:"user_id,pk"`
+	Sequence    int64     `json:"seq" db:"seq,pk"`
+	Event       string    `json:"event" db:"event"`
+	CreatedUTC  time.Time `json:"created_utc" db:"created_utc"`
+}
+
+// TableName returns the table name for the object.
+func (me MessageEvent) TableName() string {
+	return "message_events"
+}
+
+// GetUserStreamAfterSequence gets the newest limit entries of a user's stream after a sequence, oldest first.
+// Messages come back with no event, change events with theirs and receipt changes as receipt events.
+func GetUserStreamAfterSequence(userID int, after int64, limit int, txs ...*sql.Tx) ([]MessageEvent, error) {
+	var tx *sql.Tx
+	if len(txs) > 0 {
+		tx = txs[0]
+	}
+	var entries []MessageEvent
+
+	queryBody := `
+	SELECT message_uuid, user_id, seq, event, created_utc FROM
+	(
+		SELECT uuid as message_uuid, sender as user_id, sender_seq as seq, '' as event, created_utc FROM messages WHERE sender = $1 and sender_seq > $2
+		UNION ALL
+		SELECT uuid as message_uuid, receiver as user_id, receiver_seq as seq, '' as event, created_utc FROM messages WHERE receiver = $1 and receiver_seq > $2
+		UNION ALL
+		SELECT ms.message_uuid, ms.user_id, ms.seq, '' as event, m.created_utc FROM message_sequences ms JOIN messages m on m.uuid = ms.message_uuid WHERE ms.user_id = $1 and ms.seq > $2
+		UNION ALL
+		SELECT message_uuid, user_id, seq, event, created_utc FROM message_events WHERE user_id = $1 and seq > $2
+		UNION ALL
+		SELECT mr.message_uuid, m.sender as user_id, mr.seq, $4 as event, m.created_utc FROM message_receipts mr JOIN messages m on m.uuid = mr.message_uuid WHERE m.sender = $1 and mr.seq > $2
+	) as datums
+	ORDER BY seq desc
+	LIMIT $3
+	`
+	err := DB().QueryInTransaction(queryBody, tx, userID, after, limit, MessageEventReceipt).OutMany(&entries)
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, err
+}
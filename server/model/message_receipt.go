@@ -0,0 +1,71 @@
+package model
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/blendlabs/spiffy"
+	"github.com/lib/pq"
+)
+
+// MessageReceipt records when a message was delivered to and read by a recipient.
+type MessageReceipt struct {
+	MessageUUID  string     `json:"message_uuid" db:"message_uuid,pk"`
+	UserID       int        `json:"user_id" db:"user_id,pk"`
+	DeliveredUTC *time.Time `json:"delivered_utc,omitempty" db:"delivered_utc"`
+	ReadUTC      *time.Time `json:"read_utc,omitempty" db:"read_utc"`
+	// Sequence is the position of the latest change to the receipt in the message sender's stream.
+	Sequence int64 `json:"-" db:"seq"`
+}
+
+// IsZero returns if the object is set or not.
+func (mr MessageReceipt) IsZero() bool {
+	return len(mr.MessageUUID) == 0 || mr.UserID == 0
+}
+
+// TableName returns the table name for the object.
+func (mr MessageReceipt) TableName() string {
+	return "message_receipts"
+}
+
+// Save creates the receipt or fills in any timestamps that aren't already set.
+func (mr MessageReceipt) Save(txs ...*sql.Tx) error {
+	var tx *sql.Tx
+	if len(txs) > 0 {
+		tx = txs[0]
+	}
+
+	queryBody := `
+	INSERT INTO message_receipts (message_uuid, user_id, delivered_utc, read_utc, seq)
+	VALUES ($1, $2, $3, $4, $5)
+	ON CONFLICT (message_uuid, user_id) DO UPDATE SET
+		delivered_utc = COALESCE(message_receipts.delivered_utc, excluded.delivered_utc)
+		, read_utc = COALESCE(message_receipts.read_utc, excluded.read_utc)
+		, seq = GREATEST(message_receipts.seq, excluded.seq)
+	`
+	return DB().ExecInTransaction(queryBody, tx, mr.MessageUUID, mr.UserID, mr.DeliveredUTC, mr.ReadUTC, mr.Sequence)
+}
+
+// GetMessageReceipts gets the receipts for a set of messages, by message uuid.
+func GetMessageReceipts(messageUUIDs []string, txs ...*sql.Tx) (map[string][]MessageReceipt, error) {
+	var tx *sql.Tx
+	if len(txs) > 0 {
+		tx = txs[0]
+	}
+	receipts := map[string][]MessageReceipt{}
+	if len(messageUUIDs) == 0 {
+		return receipts, nil
+	}
+
+	var all []MessageReceipt
+	queryBody := fmt.Sprintf("select %s from %s where message_uuid = ANY($1)", spiffy.ColumnNames(MessageReceipt{}), MessageReceipt{}.TableName())
+	err := DB().QueryInTransaction(queryBody, tx, pq.Array(messageUUIDs)).OutMany(&all)
+	if err != nil {
+		return receipts, err
+	}
+	for _, receipt := range all {
+		receipts[receipt.MessageUUID] = append(receipts[receipt.MessageUUID], receipt)
+	}
+	return receipts, nil
+}
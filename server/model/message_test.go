@@ -48,3 +48,146 @@ func TestGetAllMessagesWithLimit(t *testing.T) {
 
 	assert.Len(filtered, 8)
 }
+
+func TestGetMessageSequences(t *testing.T) {
+	assert := assert.New(t)
+	tx, err := DB().Begin()
+	assert.Nil(err)
+	defer tx.Rollback()
+
+	u1 := &User{UUID: util.UUIDv4().ToShortString(), DisplayName: "Test User"}
+	assert.Nil(DB().CreateInTransaction(u1, tx))
+
+	u2 := &User{UUID: util.UUIDv4().ToShortString(), DisplayName: "Test User 2"}
+	assert.Nil(DB().CreateInTransaction(u2, tx))
+
+	assert.Nil(DB().CreateInTransaction(&Message{UUID: util.UUIDv4().ToShortString(), CreatedUTC: time.Now().UTC(), SenderID: u1.ID, ReceiverID: u2.ID, Body: "Test", SenderSequence: 1, ReceiverSequence: 1}, tx))
+	assert.Nil(DB().CreateInTransaction(&Message{UUID: util.UUIDv4().ToShortString(), CreatedUTC: time.Now().UTC(), SenderID: u2.ID, ReceiverID: u1.ID, Body: "Test", SenderSequence: 2, ReceiverSequence: 2}, tx))
+	assert.Nil(DB().CreateInTransaction(&Message{UUID: util.UUIDv4().ToShortString(), CreatedUTC: time.Now().UTC(), SenderID: u1.ID, ReceiverID: u2.ID, Body: "Test", SenderSequence: 3, ReceiverSequence: 3}, tx))
+
+	sequences, err := GetMessageSequences(tx)
+	assert.Nil(err)
+	assert.Equal(int64(3), sequences[u1.ID])
+	assert.Equal(int64(3), sequences[u2.ID])
+}
+
+func TestGetUserStreamAfterSequence(t *testing.T) {
+	assert := assert.New(t)
+	tx, err := DB().Begin()
+	assert.Nil(err)
+	defer tx.Rollback()
+
+	u1 := &User{UUID: util.UUIDv4().ToShortString(), DisplayName: "Test User"}
+	assert.Nil(DB().CreateInTransaction(u1, tx))
+
+	u2 := &User{UUID: util.UUIDv4().ToShortString(), DisplayName: "Test User 2"}
+	assert.Nil(DB().CreateInTransaction(u2, tx))
+
+	now := time.Now().UTC()
+	m1 := Message{UUID: util.UUIDv4().ToShortString(), CreatedUTC: now, SenderID: u1.ID, ReceiverID: u2.ID, Body: "Test", SenderSequence: 1, ReceiverSequence: 1}
+	m2 := Message{UUID: util.UUIDv4().ToShortString(), CreatedUTC: now, SenderID: u2.ID, ReceiverID: u1.ID, Body: "Test", SenderSequence: 2, ReceiverSequence: 2}
+	assert.Nil(CreateMessages([]Message{m1, m2}, tx))
+	assert.Nil(MessageReceipt{MessageUUID: m1.UUID, UserID: u2.ID, DeliveredUTC: &now, Sequence: 3}.Save(tx))
+	assert.Nil(DB().CreateInTransaction(MessageEvent{MessageUUID: m2.UUID, UserID: u1.ID, Sequence: 4, Event: MessageEventEdit, CreatedUTC: now}, tx))
+
+	stream, err := GetUserStreamAfterSequence(u1.ID, 1, 10, tx)
+	assert.Nil(err)
+	assert.Len(stream, 3)
+	assert.Equal(m2.UUID, stream[0].MessageUUID)
+	assert.Empty(stream[0].Event)
+	assert.Equal(MessageEventReceipt, stream[1].Event)
+	assert.Equal(int64(3), stream[1].Sequence)
+	assert.Equal(MessageEventEdit, stream[2].Event)
+
+	stream, err = GetUserStreamAfterSequence(u1.ID, 0, 1, tx)
+	assert.Nil(err)
+	assert.Len(stream, 1)
+	assert.Equal(int64(4), stream[0].Sequence)
+}
+
+func TestCreateMessages(t *testing.T) {
+	assert := assert.New(t)
+	tx, err := DB().Begin()
+	assert.Nil(err)
+	defer tx.Rollback()
+
+	u1 := &User{UUID: util.UUIDv4().ToShortString(), DisplayName: "Test User"}
+	assert.Nil(DB().CreateInTransaction(u1, tx))
+
+	u2 := &User{UUID: util.UUIDv4().ToShortString(), DisplayName: "Test User 2"}
+	assert.Nil(DB().CreateInTransaction(u2, tx))
+
+	room := &Room{UUID: util.UUIDv4().ToShortString(), Name: "Test Room", CreatedUTC: time.Now().UTC(), CreatedBy: u1.ID}
+	assert.Nil(DB().CreateInTransaction(room, tx))
+
+	messages := []Message{
+		{UUID: util.UUIDv4().ToShortString(), CreatedUTC: time.Now().UTC(), SenderID: u1.ID, ReceiverID: u2.ID, Body: "Test", SenderSequence: 1, ReceiverSequence: 1},
+		{UUID: util.UUIDv4().ToShortString(), CreatedUTC: time.Now().UTC(), SenderID: u2.ID, ReceiverID: u1.ID, Body: "Test", Attachments: map[string]interface{}{"foo": "bar"}, SenderSequence: 2, ReceiverSequence: 2},
+		{UUID: util.UUIDv4().ToShortString(), CreatedUTC: time.Now().UTC(), SenderID: u1.ID, ReceiverID: u1.ID, RoomID: room.ID, Body: "Test", RoomSequences: map[int]int64{u1.ID: 3, u2.ID: 3}},
+	}
+	assert.Nil(CreateMessages(messages, tx))
+
+	for _, message := range messages {
+		var verify Message
+		assert.Nil(DB().GetByIDInTransaction(&verify, tx, message.UUID))
+		assert.Equal(message.Body, verify.Body)
+		assert.Equal(message.ReceiverSequence, verify.ReceiverSequence)
+	}
+
+	sequences, err := GetMessageSequences(tx)
+	assert.Nil(err)
+	assert.Equal(int64(3), sequences[u2.ID])
+}
+
+func TestValuesPlaceholders(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("($1,$2),($3,$4),($5,$6)", valuesPlaceholders(3, 2))
+	assert.Equal("($1)", valuesPlaceholders(1, 1))
+}
+
+func TestDeleteMessages(t *testing.T) {
+	assert := assert.New(t)
+	tx, err := DB().Begin()
+	assert.Nil(err)
+	defer tx.Rollback()
+
+	u1 := &User{UUID: util.UUIDv4().ToShortString(), DisplayName: "Test User"}
+	assert.Nil(DB().CreateInTransaction(u1, tx))
+
+	u2 := &User{UUID: util.UUIDv4().ToShortString(), DisplayName: "Test User 2"}
+	assert.Nil(DB().CreateInTransaction(u2, tx))
+
+	cutoff := time.Now().UTC().Add(-time.Hour)
+	m1 := Message{UUID: util.UUIDv4().ToShortString(), CreatedUTC: cutoff.Add(-time.Hour), SenderID: u1.ID, ReceiverID: u2.ID, Body: "Test", SenderSequence: 1, ReceiverSequence: 1}
+	m2 := Message{UUID: util.UUIDv4().ToShortString(), CreatedUTC: cutoff.Add(-time.Minute), SenderID: u2.ID, ReceiverID: u1.ID, Body: "Test", SenderSequence: 2, ReceiverSequence: 2}
+	m3 := Message{UUID: util.UUIDv4().ToShortString(), CreatedUTC: time.Now().UTC(), SenderID: u1.ID, ReceiverID: u2.ID, Body: "Test", SenderSequence: 3, ReceiverSequence: 3}
+	assert.Nil(CreateMessages([]Message{m1, m2, m3}, tx))
+
+	maxAges := MessageMaxAges{Default: time.Hour, Conversations: map[[2]int]time.Duration{ConversationKey(u2.ID, u1.ID): 0}}
+	messages, err := GetMessagesPastMaxAge(maxAges, time.Now().UTC(), time.Time{}, "", 100, tx)
+	assert.Nil(err)
+	for _, message := range messages {
+		assert.NotEqual(m1.UUID, message.UUID)
+	}
+
+	maxAges.Conversations = nil
+	messages, err = GetMessagesPastMaxAge(maxAges, time.Now().UTC(), time.Time{}, "", 100, tx)
+	assert.Nil(err)
+	var uuids []string
+	for _, message := range messages {
+		if message.UUID == m1.UUID || message.UUID == m2.UUID || message.UUID == m3.UUID {
+			uuids = append(uuids, message.UUID)
+		}
+	}
+	assert.Equal([]string{m1.UUID, m2.UUID}, uuids)
+
+	assert.Nil(DeleteMessages([]string{m1.UUID, m2.UUID, m3.UUID}, tx))
+	var verify Message
+	assert.Nil(DB().GetByIDInTransaction(&verify, tx, m3.UUID))
+	assert.True(verify.IsZero())
+
+	sequences, err := GetMessageSequences(tx)
+	assert.Nil(err)
+	assert.Equal(int64(3), sequences[u1.ID])
+	assert.Equal(int64(3), sequences[u2.ID])
+}
@@ -0,0 +1,62 @@
+package model
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Room is a group conversation.
+type Room struct {
+	ID         int       `json:"id" db:"id,pk,serial"`
+	UUID       string    `json:"uuid" db:"uuid"`
+	Name       string    `json:"name" db:"name"`
+	CreatedUTC time.Time `json:"created_utc" db:"created_utc"`
+	CreatedBy  int       `json:"created_by" db:"created_by"`
+}
+
+// IsZero returns if the room is set or not.
+func (r *Room) IsZero() bool {
+	return r.ID == 0
+}
+
+// TableName returns the table name for the object.
+func (r Room) TableName() string {
+	return "rooms"
+}
+
+// RoomMember is a room membership entry.
+type RoomMember struct {
+	RoomID int `json:"room_id" db:"room_id,pk"`
+	UserID int `json:"user_id" db:"user_id,pk"`
+}
+
+// IsZero returns if the object is set or not.
+func (rm RoomMember) IsZero() bool {
+	return rm.RoomID == 0 || rm.UserID == 0
+}
+
+// TableName returns the table name for the object.
+func (rm RoomMember) TableName() string {
+	return "room_members"
+}
+
+// DeleteRoomMember removes a user from a room.
+func DeleteRoomMember(roomID, userID int, txs ...*sql.Tx) error {
+	var tx *sql.Tx
+	if len(txs) > 0 {
+		tx = txs[0]
+	}
+	return DB().ExecInTransaction("DELETE FROM room_members where room_id = $1 and user_id = $2", tx, roomID, userID)
+}
+
+// MessageSequence is a room member's sequence number for a room message.
+type MessageSequence struct {
+	MessageUUID string `json:"message_uuid" db:"message_uuid,pk"`
+	UserID      int    `json:"user_id" db:"user_id,pk"`
+	Sequence    int64  `json:"seq" db:"seq"`
+}
+
+// TableName returns the table name for the object.
+func (ms MessageSequence) TableName() string {
+	return "message_sequences"
+}
@@ -0,0 +1,50 @@
+package model
+
+import (
+	"testing"
+	"time"
+
+	assert "github.com/blendlabs/go-assert"
+	util "github.com/blendlabs/go-util"
+)
+
+func TestRoomMembers(t *testing.T) {
+	assert := assert.New(t)
+	tx, err := DB().Begin()
+	assert.Nil(err)
+	defer tx.Rollback()
+
+	u1 := &User{UUID: util.UUIDv4().ToShortString(), DisplayName: "Test User"}
+	assert.Nil(DB().CreateInTransaction(u1, tx))
+
+	u2 := &User{UUID: util.UUIDv4().ToShortString(), DisplayName: "Test User 2"}
+	assert.Nil(DB().CreateInTransaction(u2, tx))
+
+	room := &Room{UUID: util.UUIDv4().ToShortString(), Name: "Test Room", CreatedUTC: time.Now().UTC(), CreatedBy: u1.ID}
+	assert.Nil(DB().CreateInTransaction(room, tx))
+	assert.False(room.IsZero())
+
+	assert.Nil(DB().CreateInTransaction(&RoomMember{RoomID: room.ID, UserID: u1.ID}, tx))
+	assert.Nil(DB().CreateInTransaction(&RoomMember{RoomID: room.ID, UserID: u2.ID}, tx))
+	assert.Nil(DeleteRoomMember(room.ID, u2.ID, tx))
+
+	var members []RoomMember
+	assert.Nil(DB().QueryInTransaction("select * from room_members where room_id = $1", tx, room.ID).OutMany(&members))
+	assert.Len(members, 1)
+	assert.Equal(u1.ID, members[0].UserID)
+
+	message := Message{UUID: util.UUIDv4().ToShortString(), CreatedUTC: time.Now().UTC(), SenderID: u1.ID, ReceiverID: u1.ID, RoomID: room.ID, Body: "Test", RoomSequences: map[int]int64{u1.ID: 7}}
+	assert.Nil(message.Create(tx))
+
+	messages, err := GetAllMessagesWithLimit(5, tx)
+	assert.Nil(err)
+	var found *Message
+	for x := 0; x < len(messages); x++ {
+		if messages[x].UUID == message.UUID {
+			found = &messages[x]
+		}
+	}
+	assert.NotNil(found)
+	assert.Equal(room.ID, found.RoomID)
+	assert.Equal(int64(7), found.RoomSequences[u1.ID])
+}
@@ -0,0 +1,126 @@
+package model
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/blendlabs/spiffy"
+)
+
+// ScheduledMessage is a message held back until its delivery time.
+type ScheduledMessage struct {
+	UUID string `json:"uuid" db:"uuid,pk"`
+	// SessionUUID is the session that scheduled the message; only it can list or cancel the message.
+	SessionUUID string `json:"session_id" db:"session_uuid"`
+	// ScheduledUTC is when the message was scheduled.
+	ScheduledUTC time.Time `json:"scheduled_utc" db:"scheduled_utc"`
+	// DeliverUTC is when the message is sent.
+	DeliverUTC  time.Time              `json:"deliver_at" db:"deliver_utc"`
+	SenderID    int                    `json:"sender_id" db:"sender"`
+	ReceiverID  int                    `json:"receiver_id" db:"receiver"`
+	RoomID      int                    `json:"room_id,omitempty" db:"room_id"`
+	Body        string                 `json:"body" db:"body"`
+	Attachments map[string]interface{} `json:"attachments" db:"attachments,json"`
+	TTLSeconds  int                    `json:"ttl_seconds,omitempty" db:"ttl_seconds"`
+	ReadOnce    bool                   `json:"read_once,omitempty" db:"read_once"`
+}
+
+// NewScheduledMessage returns a scheduled message holding a message's content until a delivery time.
+func NewScheduledMessage(session *Session, message Message, deliverUTC time.Time) ScheduledMessage {
+	return ScheduledMessage{
+		UUID:         message.UUID,
+		SessionUUID:  session.UUID,
+		ScheduledUTC: message.CreatedUTC,
+		DeliverUTC:   deliverUTC,
+		SenderID:     message.SenderID,
+		ReceiverID:   message.ReceiverID,
+		RoomID:       message.RoomID,
+		Body:         message.Body,
+		Attachments:  message.Attachments,
+		TTLSeconds:   message.TTLSeconds,
+		ReadOnce:     message.ReadOnce,
+	}
+}
+
+// IsZero returns if the object is set or not.
+func (sm ScheduledMessage) IsZero() bool {
+	return len(sm.UUID) == 0
+}
+
+// TableName returns the table name for the object.
+func (sm ScheduledMessage) TableName() string {
+	return "scheduled_messages"
+}
+
+// Message returns the message to send; it still needs its created time and sequences.
+func (sm ScheduledMessage) Message() Message {
+	return Message{
+		UUID:        sm.UUID,
+		SenderID:    sm.SenderID,
+		ReceiverID:  sm.ReceiverID,
+		RoomID:      sm.RoomID,
+		Body:        sm.Body,
+		Attachments: sm.Attachments,
+		TTLSeconds:  sm.TTLSeconds,
+		ReadOnce:    sm.ReadOnce,
+	}
+}
+
+// GetScheduledMessages gets the messages waiting to be delivered, soonest first.
+func GetScheduledMessages(txs ...*sql.Tx) ([]ScheduledMessage, error) {
+	var tx *sql.Tx
+	if len(txs) > 0 {
+		tx = txs[0]
+	}
+	messages := []ScheduledMessage{}
+	queryBody := fmt.Sprintf("SELECT %s FROM %s ORDER BY deliver_utc, uuid", spiffy.ColumnNames(ScheduledMessage{}), ScheduledMessage{}.TableName())
+	err := DB().QueryInTransaction(queryBody, tx).OutMany(&messages)
+	return messages, err
+}
+
+// DeleteScheduledMessage deletes a message waiting to be delivered.
+func DeleteScheduledMessage(uuid string, txs ...*sql.Tx) error {
+	var tx *sql.Tx
+	if len(txs) > 0 {
+		tx = txs[0]
+	}
+	return DB().ExecInTransaction("DELETE FROM scheduled_messages WHERE uuid = $1", tx, uuid)
+}
+
+// DeliverScheduledMessage claims a scheduled message by deleting it, sends it with `send` and creates the message send returns (if any),
+// in one transaction. The delete holds the row, so when several servers try to deliver the same message only the first one sends it;
+// it returns false without calling send for the rest.
+func DeliverScheduledMessage(uuid string, send func() (*Message, error), txs ...*sql.Tx) (bool, error) {
+	if len(txs) > 0 && txs[0] != nil {
+		return deliverScheduledMessage(uuid, send, txs[0])
+	}
+
+	tx, err := DB().Begin()
+	if err != nil {
+		return false, err
+	}
+	claimed, err := deliverScheduledMessage(uuid, send, tx)
+	if err != nil || !claimed {
+		tx.Rollback()
+		return claimed, err
+	}
+	return true, tx.Commit()
+}
+
+func deliverScheduledMessage(uuid string, send func() (*Message, error), tx *sql.Tx) (bool, error) {
+	result, err := tx.Exec("DELETE FROM scheduled_messages WHERE uuid = $1", uuid)
+	if err != nil {
+		return false, err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil || deleted == 0 {
+		return false, err
+	}
+
+	message, err := send()
+	if err != nil || message == nil {
+		return true, err
+	}
+	return true, message.Create(tx)
+}
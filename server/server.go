@@ -1,14 +1,30 @@
 package server
 
 import (
+	"context"
+	"errors"
+	"net/http"
 	"strings"
+	"time"
 
+	"github.com/blendlabs/chatbus/server/cluster"
 	"github.com/blendlabs/chatbus/server/controller"
+	"github.com/blendlabs/chatbus/server/store"
+	"github.com/blendlabs/chatbus/server/wal"
 	chronometer "github.com/blendlabs/go-chronometer"
 	workQueue "github.com/blendlabs/go-workqueue"
 	web "github.com/wcharczuk/go-web"
 )
 
+var (
+	// ErrClusterNeedsPostgres is returned when cluster mode is asked for with a store other than postgres.
+	ErrClusterNeedsPostgres = errors.New("Cluster mode needs the postgres store!")
+	// ErrClusterNeedsDatabaseURL is returned when cluster mode is asked for without a DATABASE_URL to listen with.
+	ErrClusterNeedsDatabaseURL = errors.New("Cluster mode needs a DATABASE_URL!")
+	// ErrClusterNeedsSessionTokenSecret is returned when cluster mode is asked for without a SESSION_TOKEN_SECRET; a generated one would differ on each node.
+	ErrClusterNeedsSessionTokenSecret = errors.New("Cluster mode needs a SESSION_TOKEN_SECRET!")
+)
+
 // optionsHandler totally defeats CORS.
 func optionsHandler(rc *web.RequestContext) web.ControllerResult {
 	rc.Response.Header().Set("Access-Control-Allow-Origin", rc.Request.Header.Get("Origin"))
@@ -18,8 +34,152 @@ func optionsHandler(rc *web.RequestContext) web.ControllerResult {
 	return rc.NoContent()
 }
 
+// newStore returns the store the config asks for.
+func newStore(config *AppConfig) (store.Store, error) {
+	switch config.Store {
+	case store.KindPostgres:
+		return store.Postgres{}, nil
+	case store.KindMemory:
+		return store.NewMemory(), nil
+	case store.KindSqlite:
+		sqlite, err := store.OpenSqlite(config.SqlitePath)
+		if err != nil {
+			return nil, err
+		}
+		return sqlite, nil
+	}
+	return nil, store.ErrUnknownKind
+}
+
+// newWAL opens the write-ahead log the config asks for, if any.
+func newWAL(config *AppConfig) (*wal.Log, error) {
+	if config.Store == store.KindMemory || len(config.WALPath) == 0 {
+		return nil, nil
+	}
+	messageLog, err := wal.Open(config.WALPath)
+	if err != nil {
+		return nil, err
+	}
+	messageLog.BatchSize = config.MessageBatchSize
+	return messageLog, nil
+}
+
+// newBatcher returns the batcher that writes sent messages when there isn't a write-ahead log.
+func newBatcher(config *AppConfig, chatStore store.Store) *store.Batcher {
+	batcher := store.NewBatcher(chatStore, config.MessageBatchSize, time.Duration(config.MessageBatchIntervalMillis)*time.Millisecond)
+	batcher.OnError = func(err store.BatchError) {
+		web.NewStandardOutputLogger().Log(err.Error())
+	}
+	return batcher
+}
+
+// newRetention returns the message retention the config asks for.
+func newRetention(config *AppConfig) (controller.Retention, error) {
+	retention, err := controller.ParseRetention(config.RetentionMaxAge, config.RetentionRooms, config.RetentionConversations)
+	if err != nil {
+		return retention, err
+	}
+	retention.BatchSize = config.RetentionBatchSize
+	retention.ArchivePath = config.RetentionArchivePath
+	return retention, nil
+}
+
+// newSessionTokens returns the session tokens the config asks for.
+func newSessionTokens(config *AppConfig) (controller.SessionTokens, error) {
+	tokens, err := controller.NewSessionTokens(config.SessionTokenSecret, config.SessionTokenTTL)
+	if err != nil {
+		return tokens, err
+	}
+	tokens.DisablePaths = !config.SessionPathsEnabled
+	return tokens, nil
+}
+
+// newRequestSigner returns the signer for the admin routes the config asks for, if any.
+func newRequestSigner(config *AppConfig) (*controller.RequestSigner, error) {
+	if len(config.AdminSigningSecret) == 0 {
+		return nil, nil
+	}
+	return controller.NewRequestSigner(config.AdminSigningSecret, config.AdminSigningWindow)
+}
+
+// newIdentityVerifier returns the verifier for identity tokens the config asks for, if any.
+func newIdentityVerifier(config *AppConfig) (*controller.IdentityVerifier, error) {
+	var verifier *controller.IdentityVerifier
+	var err error
+	if len(config.IdentityJWKSPath) > 0 {
+		verifier, err = controller.ReadIdentityVerifier(config.IdentityJWKSPath)
+	} else if len(config.IdentityJWKS) > 0 {
+		verifier, err = controller.NewIdentityVerifier([]byte(config.IdentityJWKS))
+	}
+	if verifier == nil || err != nil {
+		return nil, err
+	}
+	verifier.Issuer = config.IdentityIssuer
+	verifier.Audience = config.IdentityAudience
+	return verifier, nil
+}
+
+// newRateLimitScopes parses the session and user rate limits for one kind of request.
+func newRateLimitScopes(session, user string) (controller.RateLimitScopes, error) {
+	var scopes controller.RateLimitScopes
+	var err error
+	scopes.Session, err = controller.ParseRateLimiter(session)
+	if err != nil {
+		return scopes, err
+	}
+	scopes.User, err = controller.ParseRateLimiter(user)
+	return scopes, err
+}
+
+// newRateLimits returns the rate limits the config asks for.
+func newRateLimits(config *AppConfig) (controller.RateLimits, error) {
+	var limits controller.RateLimits
+	var err error
+	limits.Sends, err = newRateLimitScopes(config.RateLimitSessionSends, config.RateLimitUserSends)
+	if err != nil {
+		return limits, err
+	}
+	limits.Polls, err = newRateLimitScopes(config.RateLimitSessionPolls, config.RateLimitUserPolls)
+	if err != nil {
+		return limits, err
+	}
+	limits.Contacts, err = newRateLimitScopes(config.RateLimitSessionContacts, config.RateLimitUserContacts)
+	return limits, err
+}
+
+// newCluster joins the cluster the config asks for, if any.
+func newCluster(config *AppConfig) (cluster.Bus, error) {
+	if !config.Cluster {
+		return nil, nil
+	}
+	if config.Store != store.KindPostgres {
+		return nil, ErrClusterNeedsPostgres
+	}
+	if len(config.DatabaseURL) == 0 {
+		return nil, ErrClusterNeedsDatabaseURL
+	}
+	if len(config.SessionTokenSecret) == 0 {
+		return nil, ErrClusterNeedsSessionTokenSecret
+	}
+	bus, err := cluster.OpenPostgres(config.DatabaseURL, config.ClusterChannel)
+	if err != nil {
+		return nil, err
+	}
+	bus.OnError = func(err error) {
+		web.NewStandardOutputLogger().Log(err.Error())
+	}
+	return bus, nil
+}
+
+// Server is the app along with the chat controller and the background work it owns.
+type Server struct {
+	App  *web.App
+	Chat *controller.Chat
+	HTTP *http.Server
+}
+
 // New inits the http server.
-func New() (*web.App, error) {
+func New() (*Server, error) {
 	app := web.New()
 	app.SetName(DefaultConfig().AppName)
 	app.SetPort(DefaultConfig().Port)
@@ -37,19 +197,138 @@ func New() (*web.App, error) {
 		rc.Response.Header().Set("Access-Control-Allow-Origin", "*")
 	})
 
-	chatController := new(controller.Chat)
-	err := chatController.Restore()
+	chatStore, err := newStore(DefaultConfig())
+	if err != nil {
+		return nil, err
+	}
+	messageLog, err := newWAL(DefaultConfig())
+	if err != nil {
+		return nil, err
+	}
+	retention, err := newRetention(DefaultConfig())
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := newSessionTokens(DefaultConfig())
+	if err != nil {
+		return nil, err
+	}
+	signer, err := newRequestSigner(DefaultConfig())
+	if err != nil {
+		return nil, err
+	}
+	identity, err := newIdentityVerifier(DefaultConfig())
+	if err != nil {
+		return nil, err
+	}
+	rateLimits, err := newRateLimits(DefaultConfig())
+	if err != nil {
+		return nil, err
+	}
+	// the cluster is joined before restoring, so nothing published meanwhile is missed.
+	bus, err := newCluster(DefaultConfig())
 	if err != nil {
 		return nil, err
 	}
+	chatController := &controller.Chat{
+		Store:      chatStore,
+		WAL:        messageLog,
+		Retention:  retention,
+		Tokens:     tokens,
+		Signer:     signer,
+		Identity:   identity,
+		RateLimits: rateLimits,
+		Cluster:    bus,
+	}
+	if messageLog == nil {
+		chatController.Batcher = newBatcher(DefaultConfig(), chatStore)
+	}
+	if bus != nil {
+		chatController.OnClusterError = func(err error) {
+			web.NewStandardOutputLogger().Log(err.Error())
+		}
+	}
+	err = chatController.Restore()
+	if err != nil {
+		if bus != nil {
+			bus.Close()
+		}
+		return nil, err
+	}
 	app.Register(chatController)
 
-	app.OnStart(func(app *web.App) error {
-		chronometer.Default().LoadJob(&controller.CullSessions{Controller: chatController})
-		chronometer.Default().Start()
-		workQueue.Start(2)
-		web.NewStandardOutputLogger().Log("Server started.")
-		return nil
+	return &Server{
+		App:  app,
+		Chat: chatController,
+		HTTP: &http.Server{Addr: ":" + DefaultConfig().Port, Handler: app},
+	}, nil
+}
+
+// Start starts the background jobs and serves requests until the server is shut down.
+func (s *Server) Start() error {
+	chronometer.Default().LoadJob(&controller.CullSessions{Controller: s.Chat})
+	chronometer.Default().LoadJob(&controller.ExpireTyping{Controller: s.Chat})
+	chronometer.Default().LoadJob(&controller.ExpireMessages{Controller: s.Chat})
+	chronometer.Default().LoadJob(&controller.ExpireEphemeralMessages{Controller: s.Chat})
+	chronometer.Default().LoadJob(&controller.DeliverScheduledMessages{Controller: s.Chat})
+	chronometer.Default().LoadJob(&controller.PruneRateLimits{Controller: s.Chat})
+	chronometer.Default().LoadJob(&controller.FlushMessageLog{
+		Controller: s.Chat,
+		Interval:   time.Duration(DefaultConfig().WALFlushIntervalMillis) * time.Millisecond,
 	})
-	return app, nil
+	chronometer.Default().Start()
+	if s.Chat.Batcher != nil {
+		s.Chat.Batcher.Start()
+	}
+	workQueue.Start(2)
+	if s.Chat.Cluster != nil {
+		go s.Chat.ListenCluster()
+	}
+	web.NewStandardOutputLogger().Log("Server started.")
+
+	err := s.HTTP.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// Shutdown stops the server in order: it stops accepting requests, lets in-flight long polls and streams finish,
+// writes everything still queued to the store, stops the background jobs, leaves the cluster and closes the write-ahead log.
+// It gives up waiting once the context is done, but still stops the jobs and closes the log.
+func (s *Server) Shutdown(ctx context.Context) error {
+	logger := web.NewStandardOutputLogger()
+
+	// the server closes its listeners straight away, then waits on the requests in flight; draining wakes the ones that are parked.
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- s.HTTP.Shutdown(ctx)
+	}()
+	err := s.Chat.Drain(ctx)
+	if shutdownErr := <-shutdown; shutdownErr != nil && err == nil {
+		err = shutdownErr
+	}
+	logger.Log("Stopped serving requests.")
+
+	// the jobs queue writes of their own (scheduled deliveries, expiries, culled sessions), so they stop before the last flush.
+	if stopErr := chronometer.Default().Stop(); stopErr != nil && err == nil {
+		err = stopErr
+	}
+	if flushErr := s.Chat.Flush(ctx); flushErr != nil && err == nil {
+		err = flushErr
+	}
+	logger.Log("Flushed pending writes.")
+
+	if s.Chat.Cluster != nil {
+		if closeErr := s.Chat.Cluster.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	if s.Chat.WAL != nil {
+		if closeErr := s.Chat.WAL.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	logger.Log("Server stopped.")
+	return err
 }
@@ -0,0 +1,199 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/blendlabs/chatbus/server/model"
+)
+
+const (
+	// DefaultBatchSize is how many messages a batcher writes at once if it isn't given a size.
+	DefaultBatchSize = 100
+	// DefaultBatchInterval is how long a batcher lets messages wait if it isn't given an interval.
+	DefaultBatchInterval = 50 * time.Millisecond
+)
+
+// ErrBatcherStopped is returned when a message is added to a batcher that has been stopped; nothing would write it.
+var ErrBatcherStopped = errors.New("The batcher is stopped, the message won't be written!")
+
+// BatchError is returned (and reported) for a batch of messages that couldn't be written.
+type BatchError struct {
+	Messages []model.Message
+	Err      error
+}
+
+// Error implements error.
+func (be BatchError) Error() string {
+	return fmt.Sprintf("Couldn't write a batch of %d messages: %v", len(be.Messages), be.Err)
+}
+
+// Batcher groups messages waiting to be written to a store and writes each group with `CreateMessages`.
+// A group is written once it reaches the batch size, or once the flush interval comes around, whichever is first.
+type Batcher struct {
+	Store     Store
+	BatchSize int
+	Interval  time.Duration
+	// OnError is called with the messages of each batch that couldn't be written; those messages are dropped.
+	OnError func(BatchError)
+
+	lock      sync.Mutex
+	flushLock sync.Mutex
+	pending   []model.Message
+	isStopped bool
+	full      chan struct{}
+	stop      chan struct{}
+	stopped   chan struct{}
+}
+
+// NewBatcher returns a batcher for a store; a zero batch size or interval uses the defaults.
+func NewBatcher(store Store, batchSize int, interval time.Duration) *Batcher {
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+	if interval <= 0 {
+		interval = DefaultBatchInterval
+	}
+	return &Batcher{
+		Store:     store,
+		BatchSize: batchSize,
+		Interval:  interval,
+		full:      make(chan struct{}, 1),
+	}
+}
+
+// Add queues a message to be written with the next batch; once the batcher is stopped it returns `ErrBatcherStopped`.
+func (b *Batcher) Add(message model.Message) error {
+	b.lock.Lock()
+	if b.isStopped {
+		b.lock.Unlock()
+		return ErrBatcherStopped
+	}
+	b.pending = append(b.pending, message)
+	isFull := len(b.pending) >= b.BatchSize
+	b.lock.Unlock()
+
+	if isFull {
+		select {
+		case b.full <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Len returns how many messages are waiting to be written.
+func (b *Batcher) Len() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return len(b.pending)
+}
+
+// Start starts writing batches in the background.
+func (b *Batcher) Start() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.stop != nil {
+		return
+	}
+	b.stop = make(chan struct{})
+	b.stopped = make(chan struct{})
+	go b.run(b.stop, b.stopped)
+}
+
+// Stop stops the background writes and writes whatever is still pending; after that the batcher doesn't take any more messages.
+func (b *Batcher) Stop() error {
+	b.lock.Lock()
+	b.isStopped = true
+	stop, stopped := b.stop, b.stopped
+	b.stop, b.stopped = nil, nil
+	b.lock.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-stopped
+	}
+	return b.Flush()
+}
+
+// Flush writes everything that is pending, a batch at a time, and returns the first batch's error.
+func (b *Batcher) Flush() error {
+	return b.flush(true)
+}
+
+func (b *Batcher) run(stop, stopped chan struct{}) {
+	defer close(stopped)
+	ticker := time.NewTicker(b.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-b.full:
+			b.flush(false)
+		case <-ticker.C:
+			b.flush(true)
+		}
+	}
+}
+
+// flush writes the pending messages a batch at a time; unless `partial` is set it leaves a short last batch for later.
+func (b *Batcher) flush(partial bool) error {
+	b.flushLock.Lock()
+	defer b.flushLock.Unlock()
+
+	var firstErr error
+	for {
+		batch := b.take(partial)
+		if len(batch) == 0 {
+			return firstErr
+		}
+		if batchErr := b.createMessages(batch); len(batchErr.Messages) > 0 {
+			if b.OnError != nil {
+				b.OnError(batchErr)
+			}
+			if firstErr == nil {
+				firstErr = batchErr
+			}
+		}
+	}
+}
+
+// createMessages writes a batch. If it fails it is retried a message at a time, so one bad message doesn't take the rest with it;
+// it returns the messages that still failed.
+func (b *Batcher) createMessages(batch []model.Message) BatchError {
+	var failed BatchError
+	if err := b.Store.CreateMessages(batch); err == nil {
+		return failed
+	}
+
+	for _, message := range batch {
+		if err := b.Store.CreateMessage(message); err != nil {
+			failed.Messages = append(failed.Messages, message)
+			if failed.Err == nil {
+				failed.Err = err
+			}
+		}
+	}
+	return failed
+}
+
+// take removes the next batch from the pending messages.
+func (b *Batcher) take(partial bool) []model.Message {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	size := b.BatchSize
+	if len(b.pending) < size {
+		if !partial {
+			return nil
+		}
+		size = len(b.pending)
+	}
+	batch := b.pending[:size:size]
+	b.pending = b.pending[size:]
+	return batch
+}
@@ -0,0 +1,101 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/blendlabs/chatbus/server/model"
+	assert "github.com/blendlabs/go-assert"
+	util "github.com/blendlabs/go-util"
+)
+
+// countingStore counts the batches written to a memory store, failing the ones that contain a poisoned message.
+type countingStore struct {
+	*Memory
+	batches chan int
+}
+
+func (cs countingStore) CreateMessages(messages []model.Message, txs ...*sql.Tx) error {
+	cs.batches <- len(messages)
+	for _, message := range messages {
+		if message.Body == "poison" {
+			return errors.New("Poisoned!")
+		}
+	}
+	return cs.Memory.CreateMessages(messages, txs...)
+}
+
+func (cs countingStore) CreateMessage(message model.Message, txs ...*sql.Tx) error {
+	if message.Body == "poison" {
+		return errors.New("Poisoned!")
+	}
+	return cs.Memory.CreateMessage(message, txs...)
+}
+
+func newTestMessage(body string) model.Message {
+	return model.Message{UUID: util.UUIDv4().ToShortString(), CreatedUTC: time.Now().UTC(), SenderID: 1, ReceiverID: 2, Body: body}
+}
+
+func TestBatcher(t *testing.T) {
+	assert := assert.New(t)
+	store := countingStore{Memory: NewMemory(), batches: make(chan int, 16)}
+
+	// a long interval, so only full batches are written until the batcher is stopped.
+	batcher := NewBatcher(store, 3, time.Hour)
+	var reported []BatchError
+	batcher.OnError = func(err BatchError) {
+		reported = append(reported, err)
+	}
+	batcher.Start()
+	defer batcher.Stop()
+
+	for x := 0; x < 4; x++ {
+		batcher.Add(newTestMessage("Test"))
+	}
+	select {
+	case size := <-store.batches:
+		assert.Equal(3, size)
+	case <-time.After(time.Second):
+		assert.FailNow("timed out waiting for a full batch")
+	}
+
+	batcher.Add(newTestMessage("poison"))
+	assert.NotNil(batcher.Stop())
+	assert.Equal(2, <-store.batches)
+	assert.Zero(batcher.Len())
+	// the batch is retried a message at a time, so only the poisoned message is dropped.
+	assert.Len(reported, 1)
+	assert.Len(reported[0].Messages, 1)
+	assert.Equal("poison", reported[0].Messages[0].Body)
+	assert.Equal(ErrBatcherStopped, batcher.Add(newTestMessage("Late")))
+
+	messages, err := store.GetAllMessagesWithLimit(10)
+	assert.Nil(err)
+	assert.Len(messages, 4)
+}
+
+func TestBatcherInterval(t *testing.T) {
+	assert := assert.New(t)
+	store := NewMemory()
+	batcher := NewBatcher(store, 100, 10*time.Millisecond)
+	batcher.Start()
+	defer batcher.Stop()
+
+	message := newTestMessage("Test")
+	batcher.Add(message)
+
+	var verify *model.Message
+	var err error
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		verify, err = store.GetMessage(message.UUID)
+		if err != nil || !verify.IsZero() {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.Nil(err)
+	assert.Equal(message.UUID, verify.UUID)
+}
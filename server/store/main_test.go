@@ -0,0 +1,38 @@
+package store
+
+import (
+	"log"
+	"os"
+	"testing"
+
+	"github.com/blendlabs/spiffy"
+)
+
+// hasDB is false when the tests are run with `STORE=memory`, in which case the postgres tests are skipped.
+var hasDB = os.Getenv("STORE") != KindMemory
+
+func connectDB() error {
+	spiffy.CreateDbAlias("main", spiffy.NewDbConnectionFromEnvironment())
+	spiffy.SetDefaultAlias("main")
+
+	_, err := spiffy.DefaultDb().Open()
+	if err != nil {
+		return err
+	}
+
+	spiffy.DefaultDb().Connection.SetMaxIdleConns(50)
+	return nil
+}
+
+func TestMain(m *testing.M) {
+	if !hasDB {
+		os.Exit(m.Run())
+	}
+
+	err := connectDB()
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
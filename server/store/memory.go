@@ -0,0 +1,792 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/blendlabs/chatbus/server/model"
+)
+
+var (
+	// ErrAlreadyExists is returned when creating something with a key (id or uuid) that is already taken.
+	ErrAlreadyExists = errors.New("Already exists!")
+)
+
+var _ Store = &Memory{}
+
+// NewMemory returns a new, empty in-memory store.
+func NewMemory() *Memory {
+	return &Memory{
+		users:          map[int]model.User{},
+		sessions:       map[string]model.Session{},
+		contacts:       map[model.Contacts]bool{},
+		rooms:          map[int]model.Room{},
+		roomMembers:    map[model.RoomMember]bool{},
+		messages:       map[string]model.Message{},
+		roomSequences:  map[string]map[int]int64{},
+		messageEvents:  map[int]map[int64]model.MessageEvent{},
+		receipts:       map[string]map[int]model.MessageReceipt{},
+		userSequences:  map[int]int64{},
+		scheduled:      map[string]model.ScheduledMessage{},
+		inbox:          map[int]map[string]model.InboxMessage{},
+		userUUIDs:      map[string]int{},
+		roomUUIDs:      map[string]int{},
+		messageHistory: []string{},
+	}
+}
+
+// Memory is a store that keeps everything in memory.
+// It is meant for tests and local development; transactions are ignored, foreign keys aren't enforced and nothing survives a restart.
+type Memory struct {
+	lock sync.RWMutex
+
+	lastUserID int
+	lastRoomID int
+
+	users         map[int]model.User
+	sessions      map[string]model.Session
+	contacts      map[model.Contacts]bool
+	rooms         map[int]model.Room
+	roomMembers   map[model.RoomMember]bool
+	messages      map[string]model.Message
+	roomSequences map[string]map[int]int64
+	messageEvents map[int]map[int64]model.MessageEvent
+	receipts      map[string]map[int]model.MessageReceipt
+	// userSequences are the highest sequences users had among deleted messages.
+	userSequences map[int]int64
+	scheduled     map[string]model.ScheduledMessage
+	inbox         map[int]map[string]model.InboxMessage
+
+	userUUIDs map[string]int
+	roomUUIDs map[string]int
+	// messageHistory is the message uuids in the order they were created.
+	messageHistory []string
+}
+
+// GetUsers implements Store.
+func (m *Memory) GetUsers(txs ...*sql.Tx) ([]model.User, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	users := []model.User{}
+	for _, user := range m.users {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users, nil
+}
+
+// GetUser implements Store.
+func (m *Memory) GetUser(id int, txs ...*sql.Tx) (*model.User, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	user := m.users[id]
+	return &user, nil
+}
+
+// GetUserByUUID implements Store.
+func (m *Memory) GetUserByUUID(uuid string, txs ...*sql.Tx) (*model.User, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	var user model.User
+	if id, hasUser := m.userUUIDs[uuid]; hasUser {
+		user = m.users[id]
+	}
+	return &user, nil
+}
+
+// CreateUser implements Store.
+func (m *Memory) CreateUser(user *model.User, txs ...*sql.Tx) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, hasUser := m.userUUIDs[user.UUID]; hasUser {
+		return ErrAlreadyExists
+	}
+	m.lastUserID++
+	user.ID = m.lastUserID
+	m.users[user.ID] = *user
+	m.userUUIDs[user.UUID] = user.ID
+	return nil
+}
+
+// UpdateUser implements Store.
+func (m *Memory) UpdateUser(user *model.User, txs ...*sql.Tx) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	existing, hasUser := m.users[user.ID]
+	if !hasUser {
+		return nil
+	}
+	if existing.UUID != user.UUID {
+		if _, hasUUID := m.userUUIDs[user.UUID]; hasUUID {
+			return ErrAlreadyExists
+		}
+		delete(m.userUUIDs, existing.UUID)
+		m.userUUIDs[user.UUID] = user.ID
+	}
+	m.users[user.ID] = *user
+	return nil
+}
+
+// DeleteUser implements Store.
+func (m *Memory) DeleteUser(user *model.User, txs ...*sql.Tx) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if existing, hasUser := m.users[user.ID]; hasUser {
+		delete(m.userUUIDs, existing.UUID)
+		delete(m.users, user.ID)
+	}
+	return nil
+}
+
+// GetSessions implements Store.
+func (m *Memory) GetSessions(txs ...*sql.Tx) ([]model.Session, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	sessions := []model.Session{}
+	for _, session := range m.sessions {
+		sessions = append(sessions, session)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].CreatedUTC.Before(sessions[j].CreatedUTC) })
+	return sessions, nil
+}
+
+// GetSession implements Store.
+func (m *Memory) GetSession(uuid string, txs ...*sql.Tx) (*model.Session, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	session := m.sessions[uuid]
+	return &session, nil
+}
+
+// CreateSession implements Store.
+func (m *Memory) CreateSession(session *model.Session, txs ...*sql.Tx) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, hasSession := m.sessions[session.UUID]; hasSession {
+		return ErrAlreadyExists
+	}
+	stored := *session
+	stored.User = nil
+	m.sessions[session.UUID] = stored
+	return nil
+}
+
+// DeleteSession implements Store.
+func (m *Memory) DeleteSession(session *model.Session, txs ...*sql.Tx) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.sessions, session.UUID)
+	return nil
+}
+
+// GetContacts implements Store.
+func (m *Memory) GetContacts(txs ...*sql.Tx) ([]model.Contacts, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	contacts := []model.Contacts{}
+	for contact := range m.contacts {
+		contacts = append(contacts, contact)
+	}
+	sort.Slice(contacts, func(i, j int) bool {
+		if contacts[i].Sender == contacts[j].Sender {
+			return contacts[i].Receiver < contacts[j].Receiver
+		}
+		return contacts[i].Sender < contacts[j].Sender
+	})
+	return contacts, nil
+}
+
+// CreateContacts implements Store.
+func (m *Memory) CreateContacts(sender, receiver int, txs ...*sql.Tx) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.contacts[model.Contacts{Sender: sender, Receiver: receiver}] = true
+	m.contacts[model.Contacts{Sender: receiver, Receiver: sender}] = true
+	return nil
+}
+
+// DeleteContacts implements Store.
+func (m *Memory) DeleteContacts(sender, receiver int, txs ...*sql.Tx) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.contacts, model.Contacts{Sender: sender, Receiver: receiver})
+	delete(m.contacts, model.Contacts{Sender: receiver, Receiver: sender})
+	return nil
+}
+
+// GetRooms implements Store.
+func (m *Memory) GetRooms(txs ...*sql.Tx) ([]model.Room, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	rooms := []model.Room{}
+	for _, room := range m.rooms {
+		rooms = append(rooms, room)
+	}
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].ID < rooms[j].ID })
+	return rooms, nil
+}
+
+// CreateRoom implements Store.
+func (m *Memory) CreateRoom(room *model.Room, txs ...*sql.Tx) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, hasRoom := m.roomUUIDs[room.UUID]; hasRoom {
+		return ErrAlreadyExists
+	}
+	m.lastRoomID++
+	room.ID = m.lastRoomID
+	m.rooms[room.ID] = *room
+	m.roomUUIDs[room.UUID] = room.ID
+	return nil
+}
+
+// GetRoomMembers implements Store.
+func (m *Memory) GetRoomMembers(txs ...*sql.Tx) ([]model.RoomMember, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	members := []model.RoomMember{}
+	for member := range m.roomMembers {
+		members = append(members, member)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		if members[i].RoomID == members[j].RoomID {
+			return members[i].UserID < members[j].UserID
+		}
+		return members[i].RoomID < members[j].RoomID
+	})
+	return members, nil
+}
+
+// CreateRoomMember implements Store.
+func (m *Memory) CreateRoomMember(member model.RoomMember, txs ...*sql.Tx) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.roomMembers[member] = true
+	return nil
+}
+
+// DeleteRoomMember implements Store.
+func (m *Memory) DeleteRoomMember(roomID, userID int, txs ...*sql.Tx) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.roomMembers, model.RoomMember{RoomID: roomID, UserID: userID})
+	return nil
+}
+
+// GetMessage implements Store.
+func (m *Memory) GetMessage(uuid string, txs ...*sql.Tx) (*model.Message, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	message := m.messages[uuid]
+	return &message, nil
+}
+
+// sortedMessages returns the messages newest first, the way the ranking queries order them.
+// Callers must hold the lock.
+func (m *Memory) sortedMessages() []model.Message {
+	messages := make([]model.Message, 0, len(m.messageHistory))
+	for _, uuid := range m.messageHistory {
+		messages = append(messages, m.messages[uuid])
+	}
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].CreatedUTC.After(messages[j].CreatedUTC)
+	})
+	return messages
+}
+
+// GetMessagesByUUID implements Store.
+func (m *Memory) GetMessagesByUUID(uuids []string, txs ...*sql.Tx) ([]model.Message, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	messages := []model.Message{}
+	for _, uuid := range uuids {
+		if message, hasMessage := m.messages[uuid]; hasMessage {
+			messages = append(messages, message)
+		}
+	}
+	return messages, nil
+}
+
+// GetAllMessagesWithLimit implements Store.
+// Like the postgres query, direct messages are ranked per receiver and room messages per room.
+func (m *Memory) GetAllMessagesWithLimit(limit int, txs ...*sql.Tx) ([]model.Message, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	receiverRanks := map[int]int{}
+	roomRanks := map[int]int{}
+	var messages []model.Message
+	for _, message := range m.sortedMessages() {
+		var rank int
+		if message.RoomID == 0 {
+			receiverRanks[message.ReceiverID]++
+			rank = receiverRanks[message.ReceiverID]
+		} else {
+			roomRanks[message.RoomID]++
+			rank = roomRanks[message.RoomID]
+		}
+		if rank > limit {
+			continue
+		}
+		if sequences, hasSequences := m.roomSequences[message.UUID]; hasSequences {
+			message.RoomSequences = copySequences(sequences)
+		}
+		messages = append(messages, message)
+	}
+
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, nil
+}
+
+// GetMessagesPastMaxAge implements Store.
+func (m *Memory) GetMessagesPastMaxAge(maxAges model.MessageMaxAges, now, after time.Time, afterUUID string, limit int, txs ...*sql.Tx) ([]model.Message, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	var messages []model.Message
+	for _, message := range m.messages {
+		if !maxAges.IsExpired(message, now) {
+			continue
+		}
+		if message.CreatedUTC.Before(after) || (message.CreatedUTC.Equal(after) && message.UUID <= afterUUID) {
+			continue
+		}
+		messages = append(messages, message)
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		if messages[i].CreatedUTC.Equal(messages[j].CreatedUTC) {
+			return messages[i].UUID < messages[j].UUID
+		}
+		return messages[i].CreatedUTC.Before(messages[j].CreatedUTC)
+	})
+	if len(messages) > limit {
+		messages = messages[:limit]
+	}
+	return messages, nil
+}
+
+// GetExpiredMessages implements Store.
+func (m *Memory) GetExpiredMessages(now time.Time, limit int, txs ...*sql.Tx) ([]model.Message, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	var messages []model.Message
+	for _, message := range m.messages {
+		if len(messages) >= limit {
+			break
+		}
+		if message.ExpiresUTC != nil && !message.ExpiresUTC.After(now) {
+			messages = append(messages, message)
+			continue
+		}
+		if message.ReadOnce {
+			for _, receipt := range m.receipts[message.UUID] {
+				if receipt.ReadUTC != nil {
+					messages = append(messages, message)
+					break
+				}
+			}
+		}
+	}
+	return messages, nil
+}
+
+// GetConversationBefore implements Store.
+func (m *Memory) GetConversationBefore(userID, otherUserID int, before time.Time, beforeUUID string, limit int, txs ...*sql.Tx) ([]model.Message, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	var messages []model.Message
+	for _, message := range m.messages {
+		if message.RoomID != 0 {
+			continue
+		}
+		isConversation := (message.SenderID == userID && message.ReceiverID == otherUserID) ||
+			(message.SenderID == otherUserID && message.ReceiverID == userID)
+		if !isConversation {
+			continue
+		}
+		if message.CreatedUTC.Before(before) || (message.CreatedUTC.Equal(before) && message.UUID < beforeUUID) {
+			messages = append(messages, message)
+		}
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		if messages[i].CreatedUTC.Equal(messages[j].CreatedUTC) {
+			return messages[i].UUID > messages[j].UUID
+		}
+		return messages[i].CreatedUTC.After(messages[j].CreatedUTC)
+	})
+	if len(messages) > limit {
+		messages = messages[:limit]
+	}
+	return messages, nil
+}
+
+// GetMessageSequences implements Store.
+func (m *Memory) GetMessageSequences(txs ...*sql.Tx) (map[int]int64, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	sequences := copySequences(m.userSequences)
+	advance := func(userID int, sequence int64) {
+		if sequence > sequences[userID] {
+			sequences[userID] = sequence
+		}
+	}
+	for _, message := range m.messages {
+		advance(message.SenderID, message.SenderSequence)
+		advance(message.ReceiverID, message.ReceiverSequence)
+	}
+	for _, roomSequences := range m.roomSequences {
+		for userID, sequence := range roomSequences {
+			advance(userID, sequence)
+		}
+	}
+	for messageUUID, receipts := range m.receipts {
+		if message, hasMessage := m.messages[messageUUID]; hasMessage {
+			for _, receipt := range receipts {
+				advance(message.SenderID, receipt.Sequence)
+			}
+		}
+	}
+	for userID, events := range m.messageEvents {
+		for sequence := range events {
+			advance(userID, sequence)
+		}
+	}
+	return sequences, nil
+}
+
+// CreateMessage implements Store.
+func (m *Memory) CreateMessage(message model.Message, txs ...*sql.Tx) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, hasMessage := m.messages[message.UUID]; hasMessage {
+		return ErrAlreadyExists
+	}
+	if len(message.RoomSequences) > 0 {
+		m.roomSequences[message.UUID] = copySequences(message.RoomSequences)
+	}
+	m.messages[message.UUID] = storedMessage(message)
+	m.messageHistory = append(m.messageHistory, message.UUID)
+	return nil
+}
+
+// CreateMessages implements Store.
+func (m *Memory) CreateMessages(messages []model.Message, txs ...*sql.Tx) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	batch := map[string]bool{}
+	for _, message := range messages {
+		if _, hasMessage := m.messages[message.UUID]; hasMessage || batch[message.UUID] {
+			return ErrAlreadyExists
+		}
+		batch[message.UUID] = true
+	}
+	for _, message := range messages {
+		if len(message.RoomSequences) > 0 {
+			m.roomSequences[message.UUID] = copySequences(message.RoomSequences)
+		}
+		m.messages[message.UUID] = storedMessage(message)
+		m.messageHistory = append(m.messageHistory, message.UUID)
+	}
+	return nil
+}
+
+// UpdateMessageContent implements Store.
+func (m *Memory) UpdateMessageContent(message model.Message, txs ...*sql.Tx) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	existing, hasMessage := m.messages[message.UUID]
+	if !hasMessage {
+		return nil
+	}
+	existing.Body = message.Body
+	existing.Attachments = message.Attachments
+	existing.EditedUTC = message.EditedUTC
+	existing.DeletedUTC = message.DeletedUTC
+	m.messages[message.UUID] = existing
+	return nil
+}
+
+// DeleteMessages implements Store.
+func (m *Memory) DeleteMessages(messageUUIDs []string, txs ...*sql.Tx) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	advance := func(userID int, sequence int64) {
+		if sequence > m.userSequences[userID] {
+			m.userSequences[userID] = sequence
+		}
+	}
+
+	deleted := map[string]bool{}
+	for _, uuid := range messageUUIDs {
+		for _, inbox := range m.inbox {
+			delete(inbox, uuid)
+		}
+		message, hasMessage := m.messages[uuid]
+		if !hasMessage {
+			continue
+		}
+		deleted[uuid] = true
+		advance(message.SenderID, message.SenderSequence)
+		advance(message.ReceiverID, message.ReceiverSequence)
+		for userID, sequence := range m.roomSequences[uuid] {
+			advance(userID, sequence)
+		}
+		for _, receipt := range m.receipts[uuid] {
+			advance(message.SenderID, receipt.Sequence)
+		}
+		delete(m.messages, uuid)
+		delete(m.roomSequences, uuid)
+		delete(m.receipts, uuid)
+	}
+	if len(deleted) == 0 {
+		return nil
+	}
+
+	for userID, events := range m.messageEvents {
+		for sequence, event := range events {
+			if deleted[event.MessageUUID] {
+				advance(userID, sequence)
+				delete(events, sequence)
+			}
+		}
+	}
+
+	history := make([]string, 0, len(m.messageHistory)-len(deleted))
+	for _, uuid := range m.messageHistory {
+		if !deleted[uuid] {
+			history = append(history, uuid)
+		}
+	}
+	m.messageHistory = history
+	return nil
+}
+
+// CreateMessageEvent implements Store.
+func (m *Memory) CreateMessageEvent(event model.MessageEvent, txs ...*sql.Tx) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, hasEvents := m.messageEvents[event.UserID]; !hasEvents {
+		m.messageEvents[event.UserID] = map[int64]model.MessageEvent{}
+	}
+	if _, hasEvent := m.messageEvents[event.UserID][event.Sequence]; hasEvent {
+		return ErrAlreadyExists
+	}
+	m.messageEvents[event.UserID][event.Sequence] = event
+	return nil
+}
+
+// GetUserStreamAfterSequence implements Store.
+func (m *Memory) GetUserStreamAfterSequence(userID int, after int64, limit int, txs ...*sql.Tx) ([]model.MessageEvent, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	var entries []model.MessageEvent
+	add := func(message model.Message, sequence int64, event string) {
+		if sequence > after {
+			entries = append(entries, model.MessageEvent{MessageUUID: message.UUID, UserID: userID, Sequence: sequence, Event: event, CreatedUTC: message.CreatedUTC})
+		}
+	}
+	for _, message := range m.messages {
+		if message.SenderID == userID {
+			add(message, message.SenderSequence, "")
+			for _, receipt := range m.receipts[message.UUID] {
+				add(message, receipt.Sequence, model.MessageEventReceipt)
+			}
+		}
+		if message.ReceiverID == userID {
+			add(message, message.ReceiverSequence, "")
+		}
+		if sequence, hasSequence := m.roomSequences[message.UUID][userID]; hasSequence {
+			add(message, sequence, "")
+		}
+	}
+	for sequence, event := range m.messageEvents[userID] {
+		if sequence > after {
+			entries = append(entries, event)
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Sequence < entries[j].Sequence
+	})
+	if len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+	return entries, nil
+}
+
+// GetScheduledMessages implements Store.
+func (m *Memory) GetScheduledMessages(txs ...*sql.Tx) ([]model.ScheduledMessage, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	messages := []model.ScheduledMessage{}
+	for _, scheduled := range m.scheduled {
+		messages = append(messages, scheduled)
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		if messages[i].DeliverUTC.Equal(messages[j].DeliverUTC) {
+			return messages[i].UUID < messages[j].UUID
+		}
+		return messages[i].DeliverUTC.Before(messages[j].DeliverUTC)
+	})
+	return messages, nil
+}
+
+// CreateScheduledMessage implements Store.
+func (m *Memory) CreateScheduledMessage(scheduled model.ScheduledMessage, txs ...*sql.Tx) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, hasScheduled := m.scheduled[scheduled.UUID]; hasScheduled {
+		return ErrAlreadyExists
+	}
+	m.scheduled[scheduled.UUID] = scheduled
+	return nil
+}
+
+// DeleteScheduledMessage implements Store.
+func (m *Memory) DeleteScheduledMessage(uuid string, txs ...*sql.Tx) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.scheduled, uuid)
+	return nil
+}
+
+// DeliverScheduledMessage implements Store.
+// The scheduled message is put back if it can't be sent or stored.
+func (m *Memory) DeliverScheduledMessage(uuid string, send func() (*model.Message, error), txs ...*sql.Tx) (bool, error) {
+	m.lock.Lock()
+	scheduled, hasScheduled := m.scheduled[uuid]
+	delete(m.scheduled, uuid)
+	m.lock.Unlock()
+	if !hasScheduled {
+		return false, nil
+	}
+
+	message, err := send()
+	if err == nil && message != nil {
+		err = m.CreateMessage(*message)
+	}
+	if err != nil {
+		m.lock.Lock()
+		m.scheduled[uuid] = scheduled
+		m.lock.Unlock()
+	}
+	return true, err
+}
+
+// GetInboxMessages implements Store.
+func (m *Memory) GetInboxMessages(txs ...*sql.Tx) ([]model.InboxMessage, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	entries := []model.InboxMessage{}
+	for _, inbox := range m.inbox {
+		for _, entry := range inbox {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].UserID == entries[j].UserID {
+			return entries[i].Sequence < entries[j].Sequence
+		}
+		return entries[i].UserID < entries[j].UserID
+	})
+	return entries, nil
+}
+
+// CreateInboxMessage implements Store.
+func (m *Memory) CreateInboxMessage(entry model.InboxMessage, txs ...*sql.Tx) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, hasInbox := m.inbox[entry.UserID]; !hasInbox {
+		m.inbox[entry.UserID] = map[string]model.InboxMessage{}
+	}
+	if _, hasEntry := m.inbox[entry.UserID][entry.MessageUUID]; !hasEntry {
+		m.inbox[entry.UserID][entry.MessageUUID] = entry
+	}
+	return nil
+}
+
+// DeleteInboxMessages implements Store.
+func (m *Memory) DeleteInboxMessages(userID int, txs ...*sql.Tx) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.inbox, userID)
+	return nil
+}
+
+// GetMessageReceipts implements Store.
+func (m *Memory) GetMessageReceipts(messageUUIDs []string, txs ...*sql.Tx) (map[string][]model.MessageReceipt, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	receipts := map[string][]model.MessageReceipt{}
+	for _, messageUUID := range messageUUIDs {
+		for _, receipt := range m.receipts[messageUUID] {
+			receipts[messageUUID] = append(receipts[messageUUID], receipt)
+		}
+	}
+	return receipts, nil
+}
+
+// SaveMessageReceipt implements Store.
+func (m *Memory) SaveMessageReceipt(receipt model.MessageReceipt, txs ...*sql.Tx) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, hasReceipts := m.receipts[receipt.MessageUUID]; !hasReceipts {
+		m.receipts[receipt.MessageUUID] = map[int]model.MessageReceipt{}
+	}
+	existing, hasReceipt := m.receipts[receipt.MessageUUID][receipt.UserID]
+	if !hasReceipt {
+		m.receipts[receipt.MessageUUID][receipt.UserID] = receipt
+		return nil
+	}
+	if existing.DeliveredUTC == nil {
+		existing.DeliveredUTC = receipt.DeliveredUTC
+	}
+	if existing.ReadUTC == nil {
+		existing.ReadUTC = receipt.ReadUTC
+	}
+	if receipt.Sequence > existing.Sequence {
+		existing.Sequence = receipt.Sequence
+	}
+	m.receipts[receipt.MessageUUID][receipt.UserID] = existing
+	return nil
+}
+
+// storedMessage strips the fields of a message that aren't persisted.
+func storedMessage(message model.Message) model.Message {
+	message.Sender = nil
+	message.Receiver = nil
+	message.Sequence = 0
+	message.RoomSequences = nil
+	message.Receipts = nil
+	message.Event = ""
+	message.TTLSeconds = 0
+	message.DeliverAt = nil
+	return message
+}
+
+func copySequences(sequences map[int]int64) map[int]int64 {
+	copied := make(map[int]int64, len(sequences))
+	for userID, sequence := range sequences {
+		copied[userID] = sequence
+	}
+	return copied
+}
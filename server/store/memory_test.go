@@ -0,0 +1,213 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/blendlabs/chatbus/server/model"
+	assert "github.com/blendlabs/go-assert"
+	util "github.com/blendlabs/go-util"
+)
+
+func TestMemoryUsers(t *testing.T) {
+	assert := assert.New(t)
+	store := NewMemory()
+
+	u1 := &model.User{UUID: "test_user", DisplayName: "Test User"}
+	assert.Nil(store.CreateUser(u1))
+	u2 := &model.User{UUID: "test_user2", DisplayName: "Test User 2"}
+	assert.Nil(store.CreateUser(u2))
+	assert.Equal(1, u1.ID)
+	assert.Equal(2, u2.ID)
+
+	assert.Equal(ErrAlreadyExists, store.CreateUser(&model.User{UUID: "test_user"}))
+
+	verify, err := store.GetUserByUUID("test_user2")
+	assert.Nil(err)
+	assert.Equal(u2.ID, verify.ID)
+
+	assert.Nil(store.DeleteUser(u1))
+	verify, err = store.GetUserByUUID("test_user")
+	assert.Nil(err)
+	assert.True(verify.IsZero())
+
+	u3 := &model.User{UUID: "test_user", DisplayName: "Test User 3"}
+	assert.Nil(store.CreateUser(u3))
+	assert.Equal(3, u3.ID)
+}
+
+func TestMemoryGetAllMessagesWithLimit(t *testing.T) {
+	assert := assert.New(t)
+	store := NewMemory()
+
+	now := time.Now().UTC()
+	for x := 0; x < 7; x++ {
+		assert.Nil(store.CreateMessage(model.Message{UUID: util.UUIDv4().ToShortString(), CreatedUTC: now.Add(time.Duration(x) * time.Second), SenderID: 1, ReceiverID: 2, SenderSequence: int64(x + 1), ReceiverSequence: int64(x + 1)}))
+	}
+	for x := 0; x < 3; x++ {
+		assert.Nil(store.CreateMessage(model.Message{UUID: util.UUIDv4().ToShortString(), CreatedUTC: now.Add(time.Duration(x) * time.Second), SenderID: 1, ReceiverID: 3}))
+	}
+	assert.Nil(store.CreateMessage(model.Message{UUID: util.UUIDv4().ToShortString(), CreatedUTC: now, SenderID: 1, ReceiverID: 1, RoomID: 1, RoomSequences: map[int]int64{1: 20, 4: 3}}))
+
+	messages, err := store.GetAllMessagesWithLimit(5)
+	assert.Nil(err)
+	assert.Len(messages, 9)
+	for x := 1; x < len(messages); x++ {
+		assert.False(messages[x].CreatedUTC.Before(messages[x-1].CreatedUTC))
+	}
+
+	var toUser2 int
+	var roomSequences map[int]int64
+	for _, message := range messages {
+		if message.ReceiverID == 2 {
+			toUser2++
+			assert.True(message.CreatedUTC.After(now.Add(time.Second)))
+		}
+		if message.RoomID == 1 {
+			roomSequences = message.RoomSequences
+		}
+	}
+	assert.Equal(5, toUser2)
+	assert.Equal(int64(3), roomSequences[4])
+
+	sequences, err := store.GetMessageSequences()
+	assert.Nil(err)
+	assert.Equal(int64(20), sequences[1])
+	assert.Equal(int64(7), sequences[2])
+}
+
+func TestMemoryDeleteMessages(t *testing.T) {
+	assert := assert.New(t)
+	store := NewMemory()
+
+	now := time.Now().UTC()
+	m1 := model.Message{UUID: "m1", CreatedUTC: now.Add(-2 * time.Hour), SenderID: 1, ReceiverID: 2, SenderSequence: 1, ReceiverSequence: 1}
+	m2 := model.Message{UUID: "m2", CreatedUTC: now.Add(-2 * time.Hour), SenderID: 2, ReceiverID: 1, SenderSequence: 2, ReceiverSequence: 2}
+	m3 := model.Message{UUID: "m3", CreatedUTC: now, SenderID: 1, ReceiverID: 2, SenderSequence: 3, ReceiverSequence: 3}
+	assert.Nil(store.CreateMessages([]model.Message{m1, m2, m3}))
+	assert.Nil(store.CreateMessageEvent(model.MessageEvent{MessageUUID: "m2", UserID: 1, Sequence: 9, Event: model.MessageEventEdit, CreatedUTC: now}))
+
+	maxAges := model.MessageMaxAges{Default: time.Hour, Conversations: map[[2]int]time.Duration{model.ConversationKey(2, 1): 3 * time.Hour}}
+	messages, err := store.GetMessagesPastMaxAge(maxAges, now, time.Time{}, "", 10)
+	assert.Nil(err)
+	assert.Empty(messages)
+	maxAges.Conversations = nil
+	messages, err = store.GetMessagesPastMaxAge(maxAges, now, time.Time{}, "", 1)
+	assert.Nil(err)
+	assert.Len(messages, 1)
+	assert.Equal("m1", messages[0].UUID)
+	messages, err = store.GetMessagesPastMaxAge(maxAges, now, messages[0].CreatedUTC, messages[0].UUID, 10)
+	assert.Nil(err)
+	assert.Len(messages, 1)
+	assert.Equal("m2", messages[0].UUID)
+
+	assert.Nil(store.DeleteMessages([]string{"m1", "m2"}))
+	messages, err = store.GetAllMessagesWithLimit(10)
+	assert.Nil(err)
+	assert.Len(messages, 1)
+
+	assert.Nil(store.DeleteMessages([]string{"m3"}))
+	sequences, err := store.GetMessageSequences()
+	assert.Nil(err)
+	assert.Equal(int64(9), sequences[1])
+	assert.Equal(int64(3), sequences[2])
+}
+
+func TestMemoryGetUserStreamAfterSequence(t *testing.T) {
+	assert := assert.New(t)
+	store := NewMemory()
+
+	now := time.Now().UTC()
+	assert.Nil(store.CreateMessages([]model.Message{
+		{UUID: "m1", CreatedUTC: now, SenderID: 1, ReceiverID: 2, SenderSequence: 1, ReceiverSequence: 1},
+		{UUID: "m2", CreatedUTC: now, SenderID: 2, ReceiverID: 1, SenderSequence: 2, ReceiverSequence: 2},
+		{UUID: "m3", CreatedUTC: now, SenderID: 2, ReceiverID: 2, RoomID: 1, RoomSequences: map[int]int64{1: 3, 2: 3}},
+	}))
+	assert.Nil(store.SaveMessageReceipt(model.MessageReceipt{MessageUUID: "m1", UserID: 2, DeliveredUTC: &now, Sequence: 4}))
+	assert.Nil(store.CreateMessageEvent(model.MessageEvent{MessageUUID: "m2", UserID: 1, Sequence: 5, Event: model.MessageEventEdit, CreatedUTC: now}))
+
+	stream, err := store.GetUserStreamAfterSequence(1, 1, 10)
+	assert.Nil(err)
+	assert.Len(stream, 4)
+	assert.Equal("m2", stream[0].MessageUUID)
+	assert.Empty(stream[0].Event)
+	assert.Equal("m3", stream[1].MessageUUID)
+	assert.Equal(model.MessageEventReceipt, stream[2].Event)
+	assert.Equal(int64(4), stream[2].Sequence)
+	assert.Equal(model.MessageEventEdit, stream[3].Event)
+
+	// the limit keeps the newest entries.
+	stream, err = store.GetUserStreamAfterSequence(1, 0, 2)
+	assert.Nil(err)
+	assert.Len(stream, 2)
+	assert.Equal(int64(4), stream[0].Sequence)
+	assert.Equal(int64(5), stream[1].Sequence)
+}
+
+func TestMemoryGetExpiredMessages(t *testing.T) {
+	assert := assert.New(t)
+	store := NewMemory()
+
+	now := time.Now().UTC()
+	expires := now.Add(time.Minute)
+	m1 := model.Message{UUID: "m1", CreatedUTC: now, SenderID: 1, ReceiverID: 2, SenderSequence: 1, ReceiverSequence: 1, ExpiresUTC: &expires}
+	m2 := model.Message{UUID: "m2", CreatedUTC: now, SenderID: 1, ReceiverID: 2, SenderSequence: 2, ReceiverSequence: 2, ReadOnce: true}
+	m3 := model.Message{UUID: "m3", CreatedUTC: now, SenderID: 1, ReceiverID: 2, SenderSequence: 3, ReceiverSequence: 3}
+	assert.Nil(store.CreateMessages([]model.Message{m1, m2, m3}))
+	assert.Nil(store.SaveMessageReceipt(model.MessageReceipt{MessageUUID: "m2", UserID: 2, DeliveredUTC: &now}))
+
+	messages, err := store.GetExpiredMessages(now, 10)
+	assert.Nil(err)
+	assert.Empty(messages)
+
+	assert.Nil(store.SaveMessageReceipt(model.MessageReceipt{MessageUUID: "m2", UserID: 2, ReadUTC: &now}))
+	messages, err = store.GetExpiredMessages(now, 10)
+	assert.Nil(err)
+	assert.Len(messages, 1)
+	assert.Equal("m2", messages[0].UUID)
+
+	messages, err = store.GetExpiredMessages(expires, 10)
+	assert.Nil(err)
+	assert.Len(messages, 2)
+}
+
+func TestMemoryDeliverScheduledMessage(t *testing.T) {
+	assert := assert.New(t)
+	store := NewMemory()
+
+	now := time.Now().UTC()
+	scheduled := model.ScheduledMessage{UUID: "s1", SessionUUID: "test_session", ScheduledUTC: now, DeliverUTC: now, SenderID: 1, ReceiverID: 2, Body: "later"}
+	assert.Nil(store.CreateScheduledMessage(scheduled))
+
+	// a message that couldn't be sent is put back for the next try.
+	claimed, err := store.DeliverScheduledMessage("s1", func() (*model.Message, error) {
+		return nil, ErrAlreadyExists
+	})
+	assert.True(claimed)
+	assert.Equal(ErrAlreadyExists, err)
+	waiting, err := store.GetScheduledMessages()
+	assert.Nil(err)
+	assert.Len(waiting, 1)
+
+	message := scheduled.Message()
+	message.CreatedUTC = now
+	var sends int
+	send := func() (*model.Message, error) {
+		sends++
+		return &message, nil
+	}
+	claimed, err = store.DeliverScheduledMessage("s1", send)
+	assert.Nil(err)
+	assert.True(claimed)
+	claimed, err = store.DeliverScheduledMessage("s1", send)
+	assert.Nil(err)
+	assert.False(claimed)
+	assert.Equal(1, sends)
+
+	verify, err := store.GetMessage("s1")
+	assert.Nil(err)
+	assert.Equal("later", verify.Body)
+	waiting, err = store.GetScheduledMessages()
+	assert.Nil(err)
+	assert.Empty(waiting)
+}
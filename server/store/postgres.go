@@ -0,0 +1,249 @@
+package store
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/blendlabs/chatbus/server/model"
+)
+
+var _ Store = Postgres{}
+
+// Postgres is the store backed by the spiffy default db.
+type Postgres struct{}
+
+func firstTx(txs []*sql.Tx) *sql.Tx {
+	if len(txs) > 0 {
+		return txs[0]
+	}
+	return nil
+}
+
+// GetUsers implements Store.
+func (p Postgres) GetUsers(txs ...*sql.Tx) ([]model.User, error) {
+	users := []model.User{}
+	err := model.DB().GetAllInTransaction(&users, firstTx(txs))
+	return users, err
+}
+
+// GetUser implements Store.
+func (p Postgres) GetUser(id int, txs ...*sql.Tx) (*model.User, error) {
+	var user model.User
+	err := model.DB().GetByIDInTransaction(&user, firstTx(txs), id)
+	return &user, err
+}
+
+// GetUserByUUID implements Store.
+func (p Postgres) GetUserByUUID(uuid string, txs ...*sql.Tx) (*model.User, error) {
+	return model.GetUserByUUID(uuid, txs...)
+}
+
+// CreateUser implements Store.
+func (p Postgres) CreateUser(user *model.User, txs ...*sql.Tx) error {
+	return model.DB().CreateInTransaction(user, firstTx(txs))
+}
+
+// UpdateUser implements Store.
+func (p Postgres) UpdateUser(user *model.User, txs ...*sql.Tx) error {
+	return model.DB().UpdateInTransaction(user, firstTx(txs))
+}
+
+// DeleteUser implements Store.
+func (p Postgres) DeleteUser(user *model.User, txs ...*sql.Tx) error {
+	return model.DB().DeleteInTransaction(user, firstTx(txs))
+}
+
+// GetSessions implements Store.
+func (p Postgres) GetSessions(txs ...*sql.Tx) ([]model.Session, error) {
+	sessions := []model.Session{}
+	err := model.DB().GetAllInTransaction(&sessions, firstTx(txs))
+	return sessions, err
+}
+
+// GetSession implements Store.
+func (p Postgres) GetSession(uuid string, txs ...*sql.Tx) (*model.Session, error) {
+	var session model.Session
+	err := model.DB().GetByIDInTransaction(&session, firstTx(txs), uuid)
+	return &session, err
+}
+
+// CreateSession implements Store.
+func (p Postgres) CreateSession(session *model.Session, txs ...*sql.Tx) error {
+	return model.DB().CreateInTransaction(session, firstTx(txs))
+}
+
+// DeleteSession implements Store.
+func (p Postgres) DeleteSession(session *model.Session, txs ...*sql.Tx) error {
+	return model.DB().DeleteInTransaction(session, firstTx(txs))
+}
+
+// GetContacts implements Store.
+func (p Postgres) GetContacts(txs ...*sql.Tx) ([]model.Contacts, error) {
+	contacts := []model.Contacts{}
+	err := model.DB().GetAllInTransaction(&contacts, firstTx(txs))
+	return contacts, err
+}
+
+// CreateContacts implements Store.
+func (p Postgres) CreateContacts(sender, receiver int, txs ...*sql.Tx) error {
+	tx := firstTx(txs)
+	for _, contact := range []model.Contacts{{Sender: sender, Receiver: receiver}, {Sender: receiver, Receiver: sender}} {
+		if exists, _ := model.DB().ExistsInTransaction(contact, tx); !exists {
+			err := model.DB().CreateInTransaction(contact, tx)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// DeleteContacts implements Store.
+func (p Postgres) DeleteContacts(sender, receiver int, txs ...*sql.Tx) error {
+	return model.DeleteContacts(sender, receiver, txs...)
+}
+
+// GetRooms implements Store.
+func (p Postgres) GetRooms(txs ...*sql.Tx) ([]model.Room, error) {
+	rooms := []model.Room{}
+	err := model.DB().GetAllInTransaction(&rooms, firstTx(txs))
+	return rooms, err
+}
+
+// CreateRoom implements Store.
+func (p Postgres) CreateRoom(room *model.Room, txs ...*sql.Tx) error {
+	return model.DB().CreateInTransaction(room, firstTx(txs))
+}
+
+// GetRoomMembers implements Store.
+func (p Postgres) GetRoomMembers(txs ...*sql.Tx) ([]model.RoomMember, error) {
+	members := []model.RoomMember{}
+	err := model.DB().GetAllInTransaction(&members, firstTx(txs))
+	return members, err
+}
+
+// CreateRoomMember implements Store.
+func (p Postgres) CreateRoomMember(member model.RoomMember, txs ...*sql.Tx) error {
+	tx := firstTx(txs)
+	if exists, _ := model.DB().ExistsInTransaction(member, tx); exists {
+		return nil
+	}
+	return model.DB().CreateInTransaction(member, tx)
+}
+
+// DeleteRoomMember implements Store.
+func (p Postgres) DeleteRoomMember(roomID, userID int, txs ...*sql.Tx) error {
+	return model.DeleteRoomMember(roomID, userID, txs...)
+}
+
+// GetMessage implements Store.
+func (p Postgres) GetMessage(uuid string, txs ...*sql.Tx) (*model.Message, error) {
+	var message model.Message
+	err := model.DB().GetByIDInTransaction(&message, firstTx(txs), uuid)
+	return &message, err
+}
+
+// GetMessagesByUUID implements Store.
+func (p Postgres) GetMessagesByUUID(uuids []string, txs ...*sql.Tx) ([]model.Message, error) {
+	return model.GetMessagesByUUID(uuids, txs...)
+}
+
+// GetAllMessagesWithLimit implements Store.
+func (p Postgres) GetAllMessagesWithLimit(limit int, txs ...*sql.Tx) ([]model.Message, error) {
+	return model.GetAllMessagesWithLimit(limit, txs...)
+}
+
+// GetConversationBefore implements Store.
+func (p Postgres) GetConversationBefore(userID, otherUserID int, before time.Time, beforeUUID string, limit int, txs ...*sql.Tx) ([]model.Message, error) {
+	return model.GetConversationBefore(userID, otherUserID, before, beforeUUID, limit, txs...)
+}
+
+// GetMessagesPastMaxAge implements Store.
+func (p Postgres) GetMessagesPastMaxAge(maxAges model.MessageMaxAges, now, after time.Time, afterUUID string, limit int, txs ...*sql.Tx) ([]model.Message, error) {
+	return model.GetMessagesPastMaxAge(maxAges, now, after, afterUUID, limit, txs...)
+}
+
+// GetExpiredMessages implements Store.
+func (p Postgres) GetExpiredMessages(now time.Time, limit int, txs ...*sql.Tx) ([]model.Message, error) {
+	return model.GetExpiredMessages(now, limit, txs...)
+}
+
+// GetMessageSequences implements Store.
+func (p Postgres) GetMessageSequences(txs ...*sql.Tx) (map[int]int64, error) {
+	return model.GetMessageSequences(txs...)
+}
+
+// CreateMessage implements Store.
+func (p Postgres) CreateMessage(message model.Message, txs ...*sql.Tx) error {
+	return message.Create(txs...)
+}
+
+// CreateMessages implements Store.
+func (p Postgres) CreateMessages(messages []model.Message, txs ...*sql.Tx) error {
+	return model.CreateMessages(messages, txs...)
+}
+
+// UpdateMessageContent implements Store.
+func (p Postgres) UpdateMessageContent(message model.Message, txs ...*sql.Tx) error {
+	return message.UpdateContent(txs...)
+}
+
+// DeleteMessages implements Store.
+func (p Postgres) DeleteMessages(messageUUIDs []string, txs ...*sql.Tx) error {
+	return model.DeleteMessages(messageUUIDs, txs...)
+}
+
+// CreateMessageEvent implements Store.
+func (p Postgres) CreateMessageEvent(event model.MessageEvent, txs ...*sql.Tx) error {
+	return model.DB().CreateInTransaction(event, firstTx(txs))
+}
+
+// GetUserStreamAfterSequence implements Store.
+func (p Postgres) GetUserStreamAfterSequence(userID int, after int64, limit int, txs ...*sql.Tx) ([]model.MessageEvent, error) {
+	return model.GetUserStreamAfterSequence(userID, after, limit, txs...)
+}
+
+// GetScheduledMessages implements Store.
+func (p Postgres) GetScheduledMessages(txs ...*sql.Tx) ([]model.ScheduledMessage, error) {
+	return model.GetScheduledMessages(txs...)
+}
+
+// CreateScheduledMessage implements Store.
+func (p Postgres) CreateScheduledMessage(scheduled model.ScheduledMessage, txs ...*sql.Tx) error {
+	return model.DB().CreateInTransaction(scheduled, firstTx(txs))
+}
+
+// DeleteScheduledMessage implements Store.
+func (p Postgres) DeleteScheduledMessage(uuid string, txs ...*sql.Tx) error {
+	return model.DeleteScheduledMessage(uuid, txs...)
+}
+
+// DeliverScheduledMessage implements Store.
+func (p Postgres) DeliverScheduledMessage(uuid string, send func() (*model.Message, error), txs ...*sql.Tx) (bool, error) {
+	return model.DeliverScheduledMessage(uuid, send, txs...)
+}
+
+// GetInboxMessages implements Store.
+func (p Postgres) GetInboxMessages(txs ...*sql.Tx) ([]model.InboxMessage, error) {
+	return model.GetInboxMessages(txs...)
+}
+
+// CreateInboxMessage implements Store.
+func (p Postgres) CreateInboxMessage(entry model.InboxMessage, txs ...*sql.Tx) error {
+	return model.CreateInboxMessage(entry, txs...)
+}
+
+// DeleteInboxMessages implements Store.
+func (p Postgres) DeleteInboxMessages(userID int, txs ...*sql.Tx) error {
+	return model.DeleteInboxMessages(userID, txs...)
+}
+
+// GetMessageReceipts implements Store.
+func (p Postgres) GetMessageReceipts(messageUUIDs []string, txs ...*sql.Tx) (map[string][]model.MessageReceipt, error) {
+	return model.GetMessageReceipts(messageUUIDs, txs...)
+}
+
+// SaveMessageReceipt implements Store.
+func (p Postgres) SaveMessageReceipt(receipt model.MessageReceipt, txs ...*sql.Tx) error {
+	return receipt.Save(txs...)
+}
@@ -0,0 +1,70 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/blendlabs/chatbus/server/model"
+	assert "github.com/blendlabs/go-assert"
+	util "github.com/blendlabs/go-util"
+)
+
+func TestPostgresUsers(t *testing.T) {
+	if !hasDB {
+		t.Skip("no database")
+	}
+	assert := assert.New(t)
+	tx, err := model.DB().Begin()
+	assert.Nil(err)
+	defer tx.Rollback()
+
+	store := Postgres{}
+	u1 := &model.User{UUID: util.UUIDv4().ToShortString(), DisplayName: "Test User"}
+	assert.Nil(store.CreateUser(u1, tx))
+	assert.NotZero(u1.ID)
+
+	verify, err := store.GetUser(u1.ID, tx)
+	assert.Nil(err)
+	assert.Equal(u1.UUID, verify.UUID)
+
+	verify, err = store.GetUserByUUID(u1.UUID, tx)
+	assert.Nil(err)
+	assert.Equal(u1.ID, verify.ID)
+
+	assert.Nil(store.DeleteUser(u1, tx))
+	verify, err = store.GetUser(u1.ID, tx)
+	assert.Nil(err)
+	assert.True(verify.IsZero())
+}
+
+func TestPostgresCreateIsIdempotent(t *testing.T) {
+	if !hasDB {
+		t.Skip("no database")
+	}
+	assert := assert.New(t)
+	tx, err := model.DB().Begin()
+	assert.Nil(err)
+	defer tx.Rollback()
+
+	store := Postgres{}
+	u1 := &model.User{UUID: util.UUIDv4().ToShortString(), DisplayName: "Test User"}
+	assert.Nil(store.CreateUser(u1, tx))
+	u2 := &model.User{UUID: util.UUIDv4().ToShortString(), DisplayName: "Test User 2"}
+	assert.Nil(store.CreateUser(u2, tx))
+
+	assert.Nil(store.CreateContacts(u1.ID, u2.ID, tx))
+	assert.Nil(store.CreateContacts(u2.ID, u1.ID, tx))
+
+	var contacts []model.Contacts
+	assert.Nil(model.DB().QueryInTransaction("select * from contacts where sender = $1 or sender = $2", tx, u1.ID, u2.ID).OutMany(&contacts))
+	assert.Len(contacts, 2)
+
+	room := &model.Room{UUID: util.UUIDv4().ToShortString(), Name: "Test Room", CreatedUTC: time.Now().UTC(), CreatedBy: u1.ID}
+	assert.Nil(store.CreateRoom(room, tx))
+	assert.Nil(store.CreateRoomMember(model.RoomMember{RoomID: room.ID, UserID: u1.ID}, tx))
+	assert.Nil(store.CreateRoomMember(model.RoomMember{RoomID: room.ID, UserID: u1.ID}, tx))
+
+	var members []model.RoomMember
+	assert.Nil(model.DB().QueryInTransaction("select * from room_members where room_id = $1", tx, room.ID).OutMany(&members))
+	assert.Len(members, 1)
+}
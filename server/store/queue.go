@@ -0,0 +1,88 @@
+package store
+
+import (
+	"context"
+	"sync"
+
+	"github.com/blendlabs/chatbus/server/model"
+	"github.com/blendlabs/go-workqueue"
+)
+
+// queued counts the writes that have been queued but haven't run yet.
+var queued sync.WaitGroup
+
+// WaitForQueued blocks until every queued write has run, or the context is done.
+func WaitForQueued(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		queued.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// QueueCreateMessage queue's a message create against a store.
+func QueueCreateMessage(store Store, message model.Message) {
+	queued.Add(1)
+	workQueue.Enqueue(func(v ...interface{}) error {
+		defer queued.Done()
+		if len(v) == 0 {
+			return nil
+		}
+		if typed, isTyped := v[0].(model.Message); isTyped {
+			return store.CreateMessage(typed)
+		}
+		return nil
+	}, message)
+}
+
+// QueueSaveMessageReceipt queue's a receipt save against a store.
+func QueueSaveMessageReceipt(store Store, receipt model.MessageReceipt) {
+	queued.Add(1)
+	workQueue.Enqueue(func(v ...interface{}) error {
+		defer queued.Done()
+		if len(v) == 0 {
+			return nil
+		}
+		if typed, isTyped := v[0].(model.MessageReceipt); isTyped {
+			return store.SaveMessageReceipt(typed)
+		}
+		return nil
+	}, receipt)
+}
+
+// QueueCreateMessageEvent queue's a message event create against a store.
+func QueueCreateMessageEvent(store Store, event model.MessageEvent) {
+	queued.Add(1)
+	workQueue.Enqueue(func(v ...interface{}) error {
+		defer queued.Done()
+		if len(v) == 0 {
+			return nil
+		}
+		if typed, isTyped := v[0].(model.MessageEvent); isTyped {
+			return store.CreateMessageEvent(typed)
+		}
+		return nil
+	}, event)
+}
+
+// QueueCreateInboxMessage queue's an inbox entry create against a store.
+func QueueCreateInboxMessage(store Store, entry model.InboxMessage) {
+	queued.Add(1)
+	workQueue.Enqueue(func(v ...interface{}) error {
+		defer queued.Done()
+		if len(v) == 0 {
+			return nil
+		}
+		if typed, isTyped := v[0].(model.InboxMessage); isTyped {
+			return store.CreateInboxMessage(typed)
+		}
+		return nil
+	}, entry)
+}
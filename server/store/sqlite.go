@@ -0,0 +1,918 @@
+package store
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/blendlabs/chatbus/server/db"
+	"github.com/blendlabs/chatbus/server/model"
+	// registers the sqlite3 driver.
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	sqliteMessageColumns = "uuid, created_utc, sender, receiver, body, attachments, room_id, edited_utc, deleted_utc, sender_seq, receiver_seq, expires_utc, read_once"
+
+	sqliteScheduledMessageColumns = "uuid, session_uuid, scheduled_utc, deliver_utc, sender, receiver, room_id, body, attachments, ttl_seconds, read_once"
+
+	// sqliteMaxVariables is how many values we bind to one statement; sqlite's default limit is 999.
+	sqliteMaxVariables = 500
+)
+
+var _ Store = &Sqlite{}
+
+// OpenSqlite opens (creating it if need be) and migrates a sqlite database file.
+func OpenSqlite(path string) (*Sqlite, error) {
+	conn, err := sql.Open("sqlite3", path+"?_foreign_keys=1&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	// sqlite only allows one writer; serializing on one connection avoids `database is locked` errors.
+	conn.SetMaxOpenConns(1)
+
+	err = db.MigrateSqlite(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &Sqlite{DB: conn}, nil
+}
+
+// Sqlite is the store backed by an embedded sqlite database, for single node installs.
+type Sqlite struct {
+	DB *sql.DB
+}
+
+type sqliteRunner interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// runner returns the transaction if one is given, otherwise the db.
+func (s *Sqlite) runner(txs []*sql.Tx) sqliteRunner {
+	if tx := firstTx(txs); tx != nil {
+		return tx
+	}
+	return s.DB
+}
+
+// inTx runs an action in the given transaction, or in a new one that is committed if the action succeeds.
+func (s *Sqlite) inTx(txs []*sql.Tx, action func(tx *sql.Tx) error) error {
+	if tx := firstTx(txs); tx != nil {
+		return action(tx)
+	}
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	err = action(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetUsers implements Store.
+func (s *Sqlite) GetUsers(txs ...*sql.Tx) ([]model.User, error) {
+	users := []model.User{}
+	rows, err := s.runner(txs).Query("SELECT id, uuid, display_name FROM users ORDER BY id")
+	if err != nil {
+		return users, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var user model.User
+		err = rows.Scan(&user.ID, &user.UUID, &user.DisplayName)
+		if err != nil {
+			return users, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+func (s *Sqlite) getUserWhere(where string, arg interface{}, txs []*sql.Tx) (*model.User, error) {
+	var user model.User
+	err := s.runner(txs).QueryRow("SELECT id, uuid, display_name FROM users WHERE "+where, arg).Scan(&user.ID, &user.UUID, &user.DisplayName)
+	if err == sql.ErrNoRows {
+		return &model.User{}, nil
+	}
+	return &user, err
+}
+
+// GetUser implements Store.
+func (s *Sqlite) GetUser(id int, txs ...*sql.Tx) (*model.User, error) {
+	return s.getUserWhere("id = ?", id, txs)
+}
+
+// GetUserByUUID implements Store.
+func (s *Sqlite) GetUserByUUID(uuid string, txs ...*sql.Tx) (*model.User, error) {
+	return s.getUserWhere("uuid = ?", uuid, txs)
+}
+
+// CreateUser implements Store.
+func (s *Sqlite) CreateUser(user *model.User, txs ...*sql.Tx) error {
+	result, err := s.runner(txs).Exec("INSERT INTO users (uuid, display_name) VALUES (?, ?)", user.UUID, user.DisplayName)
+	if err != nil {
+		return err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	user.ID = int(id)
+	return nil
+}
+
+// UpdateUser implements Store.
+func (s *Sqlite) UpdateUser(user *model.User, txs ...*sql.Tx) error {
+	_, err := s.runner(txs).Exec("UPDATE users SET uuid = ?, display_name = ? WHERE id = ?", user.UUID, user.DisplayName, user.ID)
+	return err
+}
+
+// DeleteUser implements Store.
+func (s *Sqlite) DeleteUser(user *model.User, txs ...*sql.Tx) error {
+	_, err := s.runner(txs).Exec("DELETE FROM users WHERE id = ?", user.ID)
+	return err
+}
+
+// GetSessions implements Store.
+func (s *Sqlite) GetSessions(txs ...*sql.Tx) ([]model.Session, error) {
+	sessions := []model.Session{}
+	rows, err := s.runner(txs).Query("SELECT uuid, created_utc, last_active_utc, user_id FROM sessions ORDER BY created_utc")
+	if err != nil {
+		return sessions, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var session model.Session
+		err = rows.Scan(&session.UUID, &session.CreatedUTC, &session.LastActiveUTC, &session.UserID)
+		if err != nil {
+			return sessions, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+// GetSession implements Store.
+func (s *Sqlite) GetSession(uuid string, txs ...*sql.Tx) (*model.Session, error) {
+	var session model.Session
+	err := s.runner(txs).QueryRow("SELECT uuid, created_utc, last_active_utc, user_id FROM sessions WHERE uuid = ?", uuid).Scan(&session.UUID, &session.CreatedUTC, &session.LastActiveUTC, &session.UserID)
+	if err == sql.ErrNoRows {
+		return &model.Session{}, nil
+	}
+	return &session, err
+}
+
+// CreateSession implements Store.
+func (s *Sqlite) CreateSession(session *model.Session, txs ...*sql.Tx) error {
+	_, err := s.runner(txs).Exec("INSERT INTO sessions (uuid, created_utc, last_active_utc, user_id) VALUES (?, ?, ?, ?)", session.UUID, session.CreatedUTC.UTC(), session.LastActiveUTC.UTC(), session.UserID)
+	return err
+}
+
+// DeleteSession implements Store.
+func (s *Sqlite) DeleteSession(session *model.Session, txs ...*sql.Tx) error {
+	_, err := s.runner(txs).Exec("DELETE FROM sessions WHERE uuid = ?", session.UUID)
+	return err
+}
+
+// GetContacts implements Store.
+func (s *Sqlite) GetContacts(txs ...*sql.Tx) ([]model.Contacts, error) {
+	contacts := []model.Contacts{}
+	rows, err := s.runner(txs).Query("SELECT sender, receiver FROM contacts ORDER BY sender, receiver")
+	if err != nil {
+		return contacts, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var contact model.Contacts
+		err = rows.Scan(&contact.Sender, &contact.Receiver)
+		if err != nil {
+			return contacts, err
+		}
+		contacts = append(contacts, contact)
+	}
+	return contacts, rows.Err()
+}
+
+// CreateContacts implements Store.
+func (s *Sqlite) CreateContacts(sender, receiver int, txs ...*sql.Tx) error {
+	_, err := s.runner(txs).Exec("INSERT OR IGNORE INTO contacts (sender, receiver) VALUES (?, ?), (?, ?)", sender, receiver, receiver, sender)
+	return err
+}
+
+// DeleteContacts implements Store.
+func (s *Sqlite) DeleteContacts(sender, receiver int, txs ...*sql.Tx) error {
+	_, err := s.runner(txs).Exec("DELETE FROM contacts WHERE (sender = ? and receiver = ?) or (sender = ? and receiver = ?)", sender, receiver, receiver, sender)
+	return err
+}
+
+// GetRooms implements Store.
+func (s *Sqlite) GetRooms(txs ...*sql.Tx) ([]model.Room, error) {
+	rooms := []model.Room{}
+	rows, err := s.runner(txs).Query("SELECT id, uuid, name, created_utc, created_by FROM rooms ORDER BY id")
+	if err != nil {
+		return rooms, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var room model.Room
+		err = rows.Scan(&room.ID, &room.UUID, &room.Name, &room.CreatedUTC, &room.CreatedBy)
+		if err != nil {
+			return rooms, err
+		}
+		rooms = append(rooms, room)
+	}
+	return rooms, rows.Err()
+}
+
+// CreateRoom implements Store.
+func (s *Sqlite) CreateRoom(room *model.Room, txs ...*sql.Tx) error {
+	result, err := s.runner(txs).Exec("INSERT INTO rooms (uuid, name, created_utc, created_by) VALUES (?, ?, ?, ?)", room.UUID, room.Name, room.CreatedUTC.UTC(), room.CreatedBy)
+	if err != nil {
+		return err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	room.ID = int(id)
+	return nil
+}
+
+// GetRoomMembers implements Store.
+func (s *Sqlite) GetRoomMembers(txs ...*sql.Tx) ([]model.RoomMember, error) {
+	members := []model.RoomMember{}
+	rows, err := s.runner(txs).Query("SELECT room_id, user_id FROM room_members ORDER BY room_id, user_id")
+	if err != nil {
+		return members, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var member model.RoomMember
+		err = rows.Scan(&member.RoomID, &member.UserID)
+		if err != nil {
+			return members, err
+		}
+		members = append(members, member)
+	}
+	return members, rows.Err()
+}
+
+// CreateRoomMember implements Store.
+func (s *Sqlite) CreateRoomMember(member model.RoomMember, txs ...*sql.Tx) error {
+	_, err := s.runner(txs).Exec("INSERT OR IGNORE INTO room_members (room_id, user_id) VALUES (?, ?)", member.RoomID, member.UserID)
+	return err
+}
+
+// DeleteRoomMember implements Store.
+func (s *Sqlite) DeleteRoomMember(roomID, userID int, txs ...*sql.Tx) error {
+	_, err := s.runner(txs).Exec("DELETE FROM room_members WHERE room_id = ? and user_id = ?", roomID, userID)
+	return err
+}
+
+type sqliteScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanSqliteMessage reads a row of `sqliteMessageColumns`, decoding the attachments json.
+func scanSqliteMessage(row sqliteScanner) (model.Message, error) {
+	var message model.Message
+	var attachments sql.NullString
+	err := row.Scan(
+		&message.UUID,
+		&message.CreatedUTC,
+		&message.SenderID,
+		&message.ReceiverID,
+		&message.Body,
+		&attachments,
+		&message.RoomID,
+		&message.EditedUTC,
+		&message.DeletedUTC,
+		&message.SenderSequence,
+		&message.ReceiverSequence,
+		&message.ExpiresUTC,
+		&message.ReadOnce,
+	)
+	if err != nil {
+		return message, err
+	}
+	if attachments.Valid && len(attachments.String) > 0 {
+		err = json.Unmarshal([]byte(attachments.String), &message.Attachments)
+	}
+	return message, err
+}
+
+func (s *Sqlite) queryMessages(runner sqliteRunner, query string, args ...interface{}) ([]model.Message, error) {
+	var messages []model.Message
+	rows, err := runner.Query(query, args...)
+	if err != nil {
+		return messages, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		message, err := scanSqliteMessage(rows)
+		if err != nil {
+			return messages, err
+		}
+		messages = append(messages, message)
+	}
+	return messages, rows.Err()
+}
+
+// GetMessage implements Store.
+func (s *Sqlite) GetMessage(uuid string, txs ...*sql.Tx) (*model.Message, error) {
+	message, err := scanSqliteMessage(s.runner(txs).QueryRow("SELECT "+sqliteMessageColumns+" FROM messages WHERE uuid = ?", uuid))
+	if err == sql.ErrNoRows {
+		return &model.Message{}, nil
+	}
+	return &message, err
+}
+
+// GetMessagesByUUID implements Store.
+func (s *Sqlite) GetMessagesByUUID(uuids []string, txs ...*sql.Tx) ([]model.Message, error) {
+	messages := []model.Message{}
+	runner := s.runner(txs)
+	for start := 0; start < len(uuids); start += sqliteMaxVariables {
+		end := start + sqliteMaxVariables
+		if end > len(uuids) {
+			end = len(uuids)
+		}
+		args := make([]interface{}, end-start)
+		for x := start; x < end; x++ {
+			args[x-start] = uuids[x]
+		}
+		placeholders := strings.TrimSuffix(strings.Repeat("?,", len(args)), ",")
+
+		batch, err := s.queryMessages(runner, "SELECT "+sqliteMessageColumns+" FROM messages WHERE uuid IN ("+placeholders+")", args...)
+		if err != nil {
+			return messages, err
+		}
+		messages = append(messages, batch...)
+	}
+	return messages, nil
+}
+
+// GetAllMessagesWithLimit implements Store.
+// Like the postgres query, direct messages are ranked per receiver and room messages per room; it needs sqlite 3.25+ for window functions.
+func (s *Sqlite) GetAllMessagesWithLimit(limit int, txs ...*sql.Tx) ([]model.Message, error) {
+	runner := s.runner(txs)
+	queryBody := `
+	SELECT ` + sqliteMessageColumns + ` FROM
+	(
+		SELECT
+			ROW_NUMBER() over (PARTITION BY m.receiver ORDER BY m.created_utc desc) as rank
+			, m.*
+		FROM
+			messages m
+		WHERE m.room_id = 0
+		UNION ALL
+		SELECT
+			ROW_NUMBER() over (PARTITION BY m.room_id ORDER BY m.created_utc desc) as rank
+			, m.*
+		FROM
+			messages m
+		WHERE m.room_id <> 0
+	) as datums
+	where datums.rank <= ?
+	order by datums.created_utc asc
+	`
+	messages, err := s.queryMessages(runner, queryBody, limit)
+	if err != nil {
+		return messages, err
+	}
+
+	sequences := map[string]map[int]int64{}
+	rows, err := runner.Query(`
+	SELECT ms.message_uuid, ms.user_id, ms.seq FROM
+	(
+		SELECT
+			ROW_NUMBER() over (PARTITION BY m.room_id ORDER BY m.created_utc desc) as rank
+			, m.uuid
+		FROM
+			messages m
+		WHERE m.room_id <> 0
+	) as datums
+	JOIN message_sequences ms on ms.message_uuid = datums.uuid
+	where datums.rank <= ?
+	`, limit)
+	if err != nil {
+		return messages, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var messageUUID string
+		var userID int
+		var sequence int64
+		err = rows.Scan(&messageUUID, &userID, &sequence)
+		if err != nil {
+			return messages, err
+		}
+		if _, hasSequences := sequences[messageUUID]; !hasSequences {
+			sequences[messageUUID] = map[int]int64{}
+		}
+		sequences[messageUUID][userID] = sequence
+	}
+	if err = rows.Err(); err != nil {
+		return messages, err
+	}
+
+	for x := 0; x < len(messages); x++ {
+		if roomSequences, hasSequences := sequences[messages[x].UUID]; hasSequences {
+			messages[x].RoomSequences = roomSequences
+		}
+	}
+	return messages, nil
+}
+
+// GetConversationBefore implements Store.
+func (s *Sqlite) GetConversationBefore(userID, otherUserID int, before time.Time, beforeUUID string, limit int, txs ...*sql.Tx) ([]model.Message, error) {
+	queryBody := `
+	SELECT ` + sqliteMessageColumns + ` FROM messages m
+	WHERE
+		((m.sender = ?1 and m.receiver = ?2) or (m.sender = ?2 and m.receiver = ?1))
+		and m.room_id = 0
+		and (m.created_utc < ?3 or (m.created_utc = ?3 and m.uuid < ?4))
+	ORDER BY m.created_utc desc, m.uuid desc
+	LIMIT ?5
+	`
+	return s.queryMessages(s.runner(txs), queryBody, userID, otherUserID, before.UTC(), beforeUUID, limit)
+}
+
+// GetMessagesPastMaxAge implements Store.
+// Sqlite has no arrays to join the overrides against, so each one is a branch of the cutoff's case; there are only ever a few.
+func (s *Sqlite) GetMessagesPastMaxAge(maxAges model.MessageMaxAges, now, after time.Time, afterUUID string, limit int, txs ...*sql.Tx) ([]model.Message, error) {
+	bound, expires := maxAges.Cutoff(now)
+	if !expires {
+		return nil, nil
+	}
+	// a message kept forever gets a zero cutoff, which nothing was created before.
+	cutoff := func(maxAge time.Duration) time.Time {
+		if maxAge <= 0 {
+			return time.Time{}
+		}
+		return now.Add(-maxAge).UTC()
+	}
+
+	args := []interface{}{bound.UTC(), after.UTC(), afterUUID, limit, cutoff(maxAges.Default)}
+	var cases bytes.Buffer
+	for roomID, maxAge := range maxAges.Rooms {
+		args = append(args, roomID, cutoff(maxAge))
+		fmt.Fprintf(&cases, " WHEN m.room_id = ?%d THEN ?%d", len(args)-1, len(args))
+	}
+	cases.WriteString(" WHEN m.room_id <> 0 THEN ?5")
+	for conversation, maxAge := range maxAges.Conversations {
+		args = append(args, conversation[0], conversation[1], cutoff(maxAge))
+		fmt.Fprintf(&cases, " WHEN min(m.sender, m.receiver) = ?%d and max(m.sender, m.receiver) = ?%d THEN ?%d", len(args)-2, len(args)-1, len(args))
+	}
+
+	queryBody := `
+	SELECT ` + sqliteMessageColumns + ` FROM messages m
+	WHERE
+		m.created_utc < ?1
+		and (m.created_utc > ?2 or (m.created_utc = ?2 and m.uuid > ?3))
+		and m.created_utc < CASE` + cases.String() + ` ELSE ?5 END
+	ORDER BY m.created_utc asc, m.uuid asc
+	LIMIT ?4
+	`
+	return s.queryMessages(s.runner(txs), queryBody, args...)
+}
+
+// GetExpiredMessages implements Store.
+func (s *Sqlite) GetExpiredMessages(now time.Time, limit int, txs ...*sql.Tx) ([]model.Message, error) {
+	queryBody := `
+	SELECT ` + sqliteMessageColumns + ` FROM messages m
+	WHERE
+		m.expires_utc <= ?1
+		or (m.read_once and exists (SELECT 1 FROM message_receipts mr WHERE mr.message_uuid = m.uuid and mr.read_utc is not null))
+	LIMIT ?2
+	`
+	return s.queryMessages(s.runner(txs), queryBody, now.UTC(), limit)
+}
+
+// GetMessageSequences implements Store.
+func (s *Sqlite) GetMessageSequences(txs ...*sql.Tx) (map[int]int64, error) {
+	sequences := map[int]int64{}
+	rows, err := s.runner(txs).Query(`
+	SELECT user_id, MAX(seq) FROM
+	(
+		SELECT sender as user_id, sender_seq as seq FROM messages
+		UNION ALL
+		SELECT receiver as user_id, receiver_seq as seq FROM messages
+		UNION ALL
+		SELECT user_id, seq FROM message_sequences
+		UNION ALL
+		SELECT m.sender as user_id, mr.seq FROM message_receipts mr JOIN messages m on m.uuid = mr.message_uuid
+		UNION ALL
+		SELECT user_id, seq FROM message_events
+		UNION ALL
+		SELECT user_id, seq FROM user_sequences
+	) as datums
+	group by user_id
+	`)
+	if err != nil {
+		return sequences, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var userID int
+		var sequence int64
+		err = rows.Scan(&userID, &sequence)
+		if err != nil {
+			return sequences, err
+		}
+		sequences[userID] = sequence
+	}
+	return sequences, rows.Err()
+}
+
+// CreateMessage implements Store.
+func (s *Sqlite) CreateMessage(message model.Message, txs ...*sql.Tx) error {
+	attachments, err := json.Marshal(message.Attachments)
+	if err != nil {
+		return err
+	}
+	return s.inTx(txs, func(tx *sql.Tx) error {
+		_, err := tx.Exec(
+			"INSERT INTO messages ("+sqliteMessageColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			message.UUID,
+			message.CreatedUTC.UTC(),
+			message.SenderID,
+			message.ReceiverID,
+			message.Body,
+			string(attachments),
+			message.RoomID,
+			message.EditedUTC,
+			message.DeletedUTC,
+			message.SenderSequence,
+			message.ReceiverSequence,
+			message.ExpiresUTC,
+			message.ReadOnce,
+		)
+		if err != nil {
+			return err
+		}
+		for userID, sequence := range message.RoomSequences {
+			_, err = tx.Exec("INSERT INTO message_sequences (message_uuid, user_id, seq) VALUES (?, ?, ?)", message.UUID, userID, sequence)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// CreateMessages implements Store.
+// Rows are inserted as many at a time as fit under sqliteMaxVariables.
+func (s *Sqlite) CreateMessages(messages []model.Message, txs ...*sql.Tx) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	var messageArgs [][]interface{}
+	var sequenceArgs [][]interface{}
+	for _, message := range messages {
+		attachments, err := json.Marshal(message.Attachments)
+		if err != nil {
+			return err
+		}
+		messageArgs = append(messageArgs, []interface{}{
+			message.UUID,
+			message.CreatedUTC.UTC(),
+			message.SenderID,
+			message.ReceiverID,
+			message.Body,
+			string(attachments),
+			message.RoomID,
+			message.EditedUTC,
+			message.DeletedUTC,
+			message.SenderSequence,
+			message.ReceiverSequence,
+			message.ExpiresUTC,
+			message.ReadOnce,
+		})
+		for userID, sequence := range message.RoomSequences {
+			sequenceArgs = append(sequenceArgs, []interface{}{message.UUID, userID, sequence})
+		}
+	}
+
+	return s.inTx(txs, func(tx *sql.Tx) error {
+		err := sqliteInsertRows(tx, "INSERT INTO messages ("+sqliteMessageColumns+") VALUES ", messageArgs)
+		if err != nil {
+			return err
+		}
+		return sqliteInsertRows(tx, "INSERT INTO message_sequences (message_uuid, user_id, seq) VALUES ", sequenceArgs)
+	})
+}
+
+// sqliteInsertRows runs a multi-row insert for rows of the same width, splitting it to stay under sqliteMaxVariables.
+func sqliteInsertRows(tx *sql.Tx, statement string, rows [][]interface{}) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	columns := len(rows[0])
+	row := "(?" + strings.Repeat(", ?", columns-1) + ")"
+	perStatement := sqliteMaxVariables / columns
+
+	for start := 0; start < len(rows); start += perStatement {
+		end := start + perStatement
+		if end > len(rows) {
+			end = len(rows)
+		}
+
+		var args []interface{}
+		placeholders := make([]string, 0, end-start)
+		for _, values := range rows[start:end] {
+			args = append(args, values...)
+			placeholders = append(placeholders, row)
+		}
+		if _, err := tx.Exec(statement+strings.Join(placeholders, ", "), args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteMessages implements Store.
+func (s *Sqlite) DeleteMessages(messageUUIDs []string, txs ...*sql.Tx) error {
+	return s.inTx(txs, func(tx *sql.Tx) error {
+		for start := 0; start < len(messageUUIDs); start += sqliteMaxVariables {
+			end := start + sqliteMaxVariables
+			if end > len(messageUUIDs) {
+				end = len(messageUUIDs)
+			}
+			args := make([]interface{}, end-start)
+			placeholders := make([]string, end-start)
+			for x := start; x < end; x++ {
+				args[x-start] = messageUUIDs[x]
+				placeholders[x-start] = fmt.Sprintf("?%d", x-start+1)
+			}
+			in := "(" + strings.Join(placeholders, ",") + ")"
+
+			// the placeholders are numbered, so each IN list reuses the same arguments.
+			_, err := tx.Exec(`
+			INSERT INTO user_sequences (user_id, seq)
+			SELECT user_id, MAX(seq) FROM
+			(
+				SELECT sender as user_id, sender_seq as seq FROM messages WHERE uuid IN `+in+`
+				UNION ALL
+				SELECT receiver as user_id, receiver_seq as seq FROM messages WHERE uuid IN `+in+`
+				UNION ALL
+				SELECT user_id, seq FROM message_sequences WHERE message_uuid IN `+in+`
+				UNION ALL
+				SELECT m.sender as user_id, mr.seq FROM message_receipts mr JOIN messages m on m.uuid = mr.message_uuid WHERE mr.message_uuid IN `+in+`
+				UNION ALL
+				SELECT user_id, seq FROM message_events WHERE message_uuid IN `+in+`
+			) as datums
+			WHERE true
+			group by user_id
+			ON CONFLICT (user_id) DO UPDATE SET seq = MAX(user_sequences.seq, excluded.seq)
+			`, args...)
+			if err != nil {
+				return err
+			}
+			for _, statement := range []string{
+				"DELETE FROM message_events WHERE message_uuid IN ",
+				"DELETE FROM message_receipts WHERE message_uuid IN ",
+				"DELETE FROM message_sequences WHERE message_uuid IN ",
+				"DELETE FROM inbox_messages WHERE message_uuid IN ",
+				"DELETE FROM messages WHERE uuid IN ",
+			} {
+				if _, err = tx.Exec(statement+in, args...); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// UpdateMessageContent implements Store.
+func (s *Sqlite) UpdateMessageContent(message model.Message, txs ...*sql.Tx) error {
+	attachments, err := json.Marshal(message.Attachments)
+	if err != nil {
+		return err
+	}
+	_, err = s.runner(txs).Exec("UPDATE messages SET body = ?, attachments = ?, edited_utc = ?, deleted_utc = ? WHERE uuid = ?", message.Body, string(attachments), message.EditedUTC, message.DeletedUTC, message.UUID)
+	return err
+}
+
+// CreateMessageEvent implements Store.
+func (s *Sqlite) CreateMessageEvent(event model.MessageEvent, txs ...*sql.Tx) error {
+	_, err := s.runner(txs).Exec("INSERT INTO message_events (message_uuid, user_id, seq, event, created_utc) VALUES (?, ?, ?, ?, ?)", event.MessageUUID, event.UserID, event.Sequence, event.Event, event.CreatedUTC.UTC())
+	return err
+}
+
+// GetUserStreamAfterSequence implements Store.
+func (s *Sqlite) GetUserStreamAfterSequence(userID int, after int64, limit int, txs ...*sql.Tx) ([]model.MessageEvent, error) {
+	rows, err := s.runner(txs).Query(`
+	SELECT message_uuid, user_id, seq, event, created_utc FROM
+	(
+		SELECT uuid as message_uuid, sender as user_id, sender_seq as seq, '' as event, created_utc FROM messages WHERE sender = ?1 and sender_seq > ?2
+		UNION ALL
+		SELECT uuid as message_uuid, receiver as user_id, receiver_seq as seq, '' as event, created_utc FROM messages WHERE receiver = ?1 and receiver_seq > ?2
+		UNION ALL
+		SELECT ms.message_uuid, ms.user_id, ms.seq, '' as event, m.created_utc FROM message_sequences ms JOIN messages m on m.uuid = ms.message_uuid WHERE ms.user_id = ?1 and ms.seq > ?2
+		UNION ALL
+		SELECT message_uuid, user_id, seq, event, created_utc FROM message_events WHERE user_id = ?1 and seq > ?2
+		UNION ALL
+		SELECT mr.message_uuid, m.sender as user_id, mr.seq, ?4 as event, m.created_utc FROM message_receipts mr JOIN messages m on m.uuid = mr.message_uuid WHERE m.sender = ?1 and mr.seq > ?2
+	) as datums
+	ORDER BY seq desc
+	LIMIT ?3
+	`, userID, after, limit, model.MessageEventReceipt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []model.MessageEvent
+	for rows.Next() {
+		var entry model.MessageEvent
+		if err = rows.Scan(&entry.MessageUUID, &entry.UserID, &entry.Sequence, &entry.Event, &entry.CreatedUTC); err != nil {
+			return entries, err
+		}
+		entries = append(entries, entry)
+	}
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, rows.Err()
+}
+
+// GetScheduledMessages implements Store.
+func (s *Sqlite) GetScheduledMessages(txs ...*sql.Tx) ([]model.ScheduledMessage, error) {
+	messages := []model.ScheduledMessage{}
+	rows, err := s.runner(txs).Query("SELECT " + sqliteScheduledMessageColumns + " FROM scheduled_messages ORDER BY deliver_utc, uuid")
+	if err != nil {
+		return messages, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var scheduled model.ScheduledMessage
+		var attachments sql.NullString
+		err = rows.Scan(
+			&scheduled.UUID,
+			&scheduled.SessionUUID,
+			&scheduled.ScheduledUTC,
+			&scheduled.DeliverUTC,
+			&scheduled.SenderID,
+			&scheduled.ReceiverID,
+			&scheduled.RoomID,
+			&scheduled.Body,
+			&attachments,
+			&scheduled.TTLSeconds,
+			&scheduled.ReadOnce,
+		)
+		if err != nil {
+			return messages, err
+		}
+		if attachments.Valid && len(attachments.String) > 0 {
+			if err = json.Unmarshal([]byte(attachments.String), &scheduled.Attachments); err != nil {
+				return messages, err
+			}
+		}
+		messages = append(messages, scheduled)
+	}
+	return messages, rows.Err()
+}
+
+// CreateScheduledMessage implements Store.
+func (s *Sqlite) CreateScheduledMessage(scheduled model.ScheduledMessage, txs ...*sql.Tx) error {
+	attachments, err := json.Marshal(scheduled.Attachments)
+	if err != nil {
+		return err
+	}
+	_, err = s.runner(txs).Exec(
+		"INSERT INTO scheduled_messages ("+sqliteScheduledMessageColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		scheduled.UUID,
+		scheduled.SessionUUID,
+		scheduled.ScheduledUTC.UTC(),
+		scheduled.DeliverUTC.UTC(),
+		scheduled.SenderID,
+		scheduled.ReceiverID,
+		scheduled.RoomID,
+		scheduled.Body,
+		string(attachments),
+		scheduled.TTLSeconds,
+		scheduled.ReadOnce,
+	)
+	return err
+}
+
+// DeleteScheduledMessage implements Store.
+func (s *Sqlite) DeleteScheduledMessage(uuid string, txs ...*sql.Tx) error {
+	_, err := s.runner(txs).Exec("DELETE FROM scheduled_messages WHERE uuid = ?", uuid)
+	return err
+}
+
+// DeliverScheduledMessage implements Store.
+func (s *Sqlite) DeliverScheduledMessage(uuid string, send func() (*model.Message, error), txs ...*sql.Tx) (bool, error) {
+	var claimed bool
+	err := s.inTx(txs, func(tx *sql.Tx) error {
+		result, err := tx.Exec("DELETE FROM scheduled_messages WHERE uuid = ?", uuid)
+		if err != nil {
+			return err
+		}
+		deleted, err := result.RowsAffected()
+		if err != nil || deleted == 0 {
+			return err
+		}
+		claimed = true
+
+		message, err := send()
+		if err != nil || message == nil {
+			return err
+		}
+		return s.CreateMessage(*message, tx)
+	})
+	return claimed, err
+}
+
+// GetInboxMessages implements Store.
+func (s *Sqlite) GetInboxMessages(txs ...*sql.Tx) ([]model.InboxMessage, error) {
+	entries := []model.InboxMessage{}
+	rows, err := s.runner(txs).Query("SELECT user_id, message_uuid, seq, created_utc FROM inbox_messages ORDER BY user_id, seq")
+	if err != nil {
+		return entries, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var entry model.InboxMessage
+		err = rows.Scan(&entry.UserID, &entry.MessageUUID, &entry.Sequence, &entry.CreatedUTC)
+		if err != nil {
+			return entries, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// CreateInboxMessage implements Store.
+func (s *Sqlite) CreateInboxMessage(entry model.InboxMessage, txs ...*sql.Tx) error {
+	_, err := s.runner(txs).Exec("INSERT OR IGNORE INTO inbox_messages (user_id, message_uuid, seq, created_utc) VALUES (?, ?, ?, ?)", entry.UserID, entry.MessageUUID, entry.Sequence, entry.CreatedUTC.UTC())
+	return err
+}
+
+// DeleteInboxMessages implements Store.
+func (s *Sqlite) DeleteInboxMessages(userID int, txs ...*sql.Tx) error {
+	_, err := s.runner(txs).Exec("DELETE FROM inbox_messages WHERE user_id = ?", userID)
+	return err
+}
+
+// GetMessageReceipts implements Store.
+func (s *Sqlite) GetMessageReceipts(messageUUIDs []string, txs ...*sql.Tx) (map[string][]model.MessageReceipt, error) {
+	receipts := map[string][]model.MessageReceipt{}
+	runner := s.runner(txs)
+	for start := 0; start < len(messageUUIDs); start += sqliteMaxVariables {
+		end := start + sqliteMaxVariables
+		if end > len(messageUUIDs) {
+			end = len(messageUUIDs)
+		}
+		args := make([]interface{}, end-start)
+		for x := start; x < end; x++ {
+			args[x-start] = messageUUIDs[x]
+		}
+		placeholders := strings.TrimSuffix(strings.Repeat("?,", len(args)), ",")
+
+		rows, err := runner.Query("SELECT message_uuid, user_id, delivered_utc, read_utc, seq FROM message_receipts WHERE message_uuid IN ("+placeholders+")", args...)
+		if err != nil {
+			return receipts, err
+		}
+		for rows.Next() {
+			var receipt model.MessageReceipt
+			err = rows.Scan(&receipt.MessageUUID, &receipt.UserID, &receipt.DeliveredUTC, &receipt.ReadUTC, &receipt.Sequence)
+			if err != nil {
+				rows.Close()
+				return receipts, err
+			}
+			receipts[receipt.MessageUUID] = append(receipts[receipt.MessageUUID], receipt)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return receipts, err
+		}
+	}
+	return receipts, nil
+}
+
+// SaveMessageReceipt implements Store.
+func (s *Sqlite) SaveMessageReceipt(receipt model.MessageReceipt, txs ...*sql.Tx) error {
+	_, err := s.runner(txs).Exec(`
+	INSERT INTO message_receipts (message_uuid, user_id, delivered_utc, read_utc, seq)
+	VALUES (?, ?, ?, ?, ?)
+	ON CONFLICT (message_uuid, user_id) DO UPDATE SET
+		delivered_utc = COALESCE(message_receipts.delivered_utc, excluded.delivered_utc)
+		, read_utc = COALESCE(message_receipts.read_utc, excluded.read_utc)
+		, seq = MAX(message_receipts.seq, excluded.seq)
+	`, receipt.MessageUUID, receipt.UserID, receipt.DeliveredUTC, receipt.ReadUTC, receipt.Sequence)
+	return err
+}
@@ -0,0 +1,197 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/blendlabs/chatbus/server/model"
+	assert "github.com/blendlabs/go-assert"
+	util "github.com/blendlabs/go-util"
+)
+
+func TestSqlite(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "chatbus")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	store, err := OpenSqlite(filepath.Join(dir, "chatbus.db"))
+	assert.Nil(err)
+	defer store.DB.Close()
+
+	u1 := &model.User{UUID: util.UUIDv4().ToShortString(), DisplayName: "Test User"}
+	assert.Nil(store.CreateUser(u1))
+	u2 := &model.User{UUID: util.UUIDv4().ToShortString(), DisplayName: "Test User 2"}
+	assert.Nil(store.CreateUser(u2))
+	assert.NotNil(store.CreateUser(&model.User{UUID: u1.UUID}))
+
+	verify, err := store.GetUserByUUID(u2.UUID)
+	assert.Nil(err)
+	assert.Equal(u2.ID, verify.ID)
+
+	assert.Nil(store.CreateContacts(u1.ID, u2.ID))
+	assert.Nil(store.CreateContacts(u2.ID, u1.ID))
+	contacts, err := store.GetContacts()
+	assert.Nil(err)
+	assert.Len(contacts, 2)
+
+	now := time.Now().UTC()
+	for x := 0; x < 4; x++ {
+		message := model.Message{UUID: util.UUIDv4().ToShortString(), CreatedUTC: now.Add(time.Duration(x) * time.Second), SenderID: u1.ID, ReceiverID: u2.ID, Body: "Test", SenderSequence: int64(x + 1), ReceiverSequence: int64(x + 1)}
+		if x == 3 {
+			message.Attachments = map[string]interface{}{"url": "http://example.com/cat.png"}
+		}
+		assert.Nil(store.CreateMessage(message))
+	}
+
+	messages, err := store.GetAllMessagesWithLimit(2)
+	assert.Nil(err)
+	assert.Len(messages, 2)
+	assert.True(messages[0].CreatedUTC.Before(messages[1].CreatedUTC))
+	assert.True(now.Add(3 * time.Second).Equal(messages[1].CreatedUTC))
+	assert.Equal("http://example.com/cat.png", messages[1].Attachments["url"])
+
+	conversation, err := store.GetConversationBefore(u2.ID, u1.ID, messages[1].CreatedUTC, messages[1].UUID, 10)
+	assert.Nil(err)
+	assert.Len(conversation, 3)
+
+	assert.Nil(store.SaveMessageReceipt(model.MessageReceipt{MessageUUID: messages[1].UUID, UserID: u2.ID, DeliveredUTC: &now, Sequence: 7}))
+	assert.Nil(store.SaveMessageReceipt(model.MessageReceipt{MessageUUID: messages[1].UUID, UserID: u2.ID, DeliveredUTC: &now, ReadUTC: &now, Sequence: 5}))
+	receipts, err := store.GetMessageReceipts([]string{messages[0].UUID, messages[1].UUID})
+	assert.Nil(err)
+	assert.Len(receipts[messages[1].UUID], 1)
+	assert.NotNil(receipts[messages[1].UUID][0].ReadUTC)
+	assert.Equal(int64(7), receipts[messages[1].UUID][0].Sequence)
+
+	stream, err := store.GetUserStreamAfterSequence(u1.ID, 2, 10)
+	assert.Nil(err)
+	assert.Len(stream, 3)
+	assert.Equal(int64(3), stream[0].Sequence)
+	assert.Empty(stream[0].Event)
+	assert.Equal(model.MessageEventReceipt, stream[2].Event)
+	assert.Equal(int64(7), stream[2].Sequence)
+
+	sequences, err := store.GetMessageSequences()
+	assert.Nil(err)
+	assert.Equal(int64(7), sequences[u1.ID])
+	assert.Equal(int64(4), sequences[u2.ID])
+
+	// batches are split across statements to stay under sqlite's variable limit, and are written all or nothing.
+	var batch []model.Message
+	for x := 0; x < 100; x++ {
+		batch = append(batch, model.Message{UUID: util.UUIDv4().ToShortString(), CreatedUTC: now, SenderID: u2.ID, ReceiverID: u2.ID, RoomID: 1, Body: "Test", RoomSequences: map[int]int64{u1.ID: int64(x + 10), u2.ID: int64(x + 10)}})
+	}
+	assert.Nil(store.CreateMessages(batch))
+	assert.NotNil(store.CreateMessages([]model.Message{{UUID: util.UUIDv4().ToShortString(), CreatedUTC: now, SenderID: u1.ID, ReceiverID: u2.ID, ReceiverSequence: 500}, batch[0]}))
+
+	sequences, err = store.GetMessageSequences()
+	assert.Nil(err)
+	assert.Equal(int64(109), sequences[u1.ID])
+	assert.Equal(int64(109), sequences[u2.ID])
+
+	// deleting messages keeps each user's highest sequence.
+	maxAges := model.MessageMaxAges{Default: time.Hour, Rooms: map[int]time.Duration{1: 0}}
+	expired, err := store.GetMessagesPastMaxAge(maxAges, now.Add(time.Hour+time.Second), time.Time{}, "", 1000)
+	assert.Nil(err)
+	assert.Len(expired, 1)
+	maxAges.Rooms[1] = time.Hour
+	maxAges.Conversations = map[[2]int]time.Duration{model.ConversationKey(u2.ID, u1.ID): 2 * time.Hour}
+	expired, err = store.GetMessagesPastMaxAge(maxAges, now.Add(time.Hour+time.Second), time.Time{}, "", 1000)
+	assert.Nil(err)
+	assert.Len(expired, 100)
+	expired, err = store.GetMessagesPastMaxAge(model.MessageMaxAges{Default: time.Hour}, now.Add(time.Hour+time.Second), time.Time{}, "", 1000)
+	assert.Nil(err)
+	assert.Len(expired, 101)
+	var expiredUUIDs []string
+	for _, message := range expired {
+		expiredUUIDs = append(expiredUUIDs, message.UUID)
+	}
+	assert.Nil(store.DeleteMessages(expiredUUIDs))
+
+	messages, err = store.GetAllMessagesWithLimit(1000)
+	assert.Nil(err)
+	assert.Len(messages, 3)
+	sequences, err = store.GetMessageSequences()
+	assert.Nil(err)
+	assert.Equal(int64(109), sequences[u1.ID])
+	assert.Equal(int64(109), sequences[u2.ID])
+
+	// ephemeral messages expire on time, read once messages once they're read.
+	expires := now.Add(time.Minute)
+	ephemeral := model.Message{UUID: util.UUIDv4().ToShortString(), CreatedUTC: now, SenderID: u1.ID, ReceiverID: u2.ID, Body: "Test", SenderSequence: 110, ReceiverSequence: 110, ExpiresUTC: &expires}
+	readOnce := model.Message{UUID: util.UUIDv4().ToShortString(), CreatedUTC: now, SenderID: u1.ID, ReceiverID: u2.ID, Body: "Test", SenderSequence: 111, ReceiverSequence: 111, ReadOnce: true}
+	assert.Nil(store.CreateMessages([]model.Message{ephemeral, readOnce}))
+	assert.Nil(store.SaveMessageReceipt(model.MessageReceipt{MessageUUID: readOnce.UUID, UserID: u2.ID, ReadUTC: &now}))
+
+	expired, err = store.GetExpiredMessages(now, 10)
+	assert.Nil(err)
+	assert.Len(expired, 1)
+	assert.Equal(readOnce.UUID, expired[0].UUID)
+	assert.True(expired[0].ReadOnce)
+
+	expired, err = store.GetExpiredMessages(expires, 10)
+	assert.Nil(err)
+	assert.Len(expired, 2)
+
+	// scheduled messages come back soonest first.
+	later := model.ScheduledMessage{UUID: util.UUIDv4().ToShortString(), SessionUUID: "session", ScheduledUTC: now, DeliverUTC: now.Add(time.Hour), SenderID: u1.ID, ReceiverID: u2.ID, Body: "later"}
+	sooner := model.ScheduledMessage{UUID: util.UUIDv4().ToShortString(), SessionUUID: "session", ScheduledUTC: now, DeliverUTC: now.Add(time.Minute), SenderID: u1.ID, ReceiverID: u2.ID, Body: "sooner", TTLSeconds: 60, Attachments: map[string]interface{}{"url": "http://example.com/cat.png"}}
+	assert.Nil(store.CreateScheduledMessage(later))
+	assert.Nil(store.CreateScheduledMessage(sooner))
+	scheduled, err := store.GetScheduledMessages()
+	assert.Nil(err)
+	assert.Len(scheduled, 2)
+	assert.Equal(sooner.UUID, scheduled[0].UUID)
+	assert.True(sooner.DeliverUTC.Equal(scheduled[0].DeliverUTC))
+	assert.Equal(60, scheduled[0].TTLSeconds)
+	assert.Equal("http://example.com/cat.png", scheduled[0].Attachments["url"])
+
+	assert.Nil(store.DeleteScheduledMessage(sooner.UUID))
+	scheduled, err = store.GetScheduledMessages()
+	assert.Nil(err)
+	assert.Len(scheduled, 1)
+
+	// delivering a scheduled message claims it, and stores what was sent in the same transaction; it can only be claimed once.
+	delivered := later.Message()
+	delivered.CreatedUTC = now
+	send := func() (*model.Message, error) {
+		return &delivered, nil
+	}
+	claimed, err := store.DeliverScheduledMessage(later.UUID, send)
+	assert.Nil(err)
+	assert.True(claimed)
+	scheduled, err = store.GetScheduledMessages()
+	assert.Nil(err)
+	assert.Empty(scheduled)
+	stored, err := store.GetMessage(later.UUID)
+	assert.Nil(err)
+	assert.Equal("later", stored.Body)
+	claimed, err = store.DeliverScheduledMessage(later.UUID, send)
+	assert.Nil(err)
+	assert.False(claimed)
+
+	// inbox entries are kept once per user and message, and go with their message.
+	assert.Nil(store.CreateInboxMessage(model.InboxMessage{UserID: u2.ID, MessageUUID: ephemeral.UUID, Sequence: 110, CreatedUTC: now}))
+	assert.Nil(store.CreateInboxMessage(model.InboxMessage{UserID: u2.ID, MessageUUID: ephemeral.UUID, Sequence: 110, CreatedUTC: now}))
+	assert.Nil(store.CreateInboxMessage(model.InboxMessage{UserID: u2.ID, MessageUUID: readOnce.UUID, Sequence: 111, CreatedUTC: now}))
+	entries, err := store.GetInboxMessages()
+	assert.Nil(err)
+	assert.Len(entries, 2)
+	assert.Equal(ephemeral.UUID, entries[0].MessageUUID)
+
+	byUUID, err := store.GetMessagesByUUID([]string{ephemeral.UUID, readOnce.UUID, "missing"})
+	assert.Nil(err)
+	assert.Len(byUUID, 2)
+
+	assert.Nil(store.DeleteMessages([]string{ephemeral.UUID}))
+	entries, err = store.GetInboxMessages()
+	assert.Nil(err)
+	assert.Len(entries, 1)
+	assert.Nil(store.DeleteInboxMessages(u2.ID))
+	entries, err = store.GetInboxMessages()
+	assert.Nil(err)
+	assert.Empty(entries)
+}
@@ -0,0 +1,141 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/blendlabs/chatbus/server/model"
+)
+
+const (
+	// KindPostgres is the store backed by the spiffy default db.
+	KindPostgres = "postgres"
+	// KindMemory is the in-memory store.
+	KindMemory = "memory"
+	// KindSqlite is the store backed by a sqlite database file.
+	KindSqlite = "sqlite"
+)
+
+var (
+	// ErrUnknownKind is returned when asked for a kind of store that doesn't exist.
+	ErrUnknownKind = errors.New("Unknown store kind!")
+)
+
+var (
+	_defaultLock sync.Mutex
+	_default     Store
+)
+
+// Default returns the default store, which is postgres unless it has been set.
+func Default() Store {
+	_defaultLock.Lock()
+	defer _defaultLock.Unlock()
+	if _default == nil {
+		_default = Postgres{}
+	}
+	return _default
+}
+
+// SetDefault sets the default store.
+func SetDefault(store Store) {
+	_defaultLock.Lock()
+	defer _defaultLock.Unlock()
+	_default = store
+}
+
+// Store is the persistence layer for chatbus.
+// Transactions are optional on every method; backends that don't use `database/sql` ignore them.
+type Store interface {
+	// GetUsers gets all the users.
+	GetUsers(txs ...*sql.Tx) ([]model.User, error)
+	// GetUser gets a user by id; the user is zero if it doesn't exist.
+	GetUser(id int, txs ...*sql.Tx) (*model.User, error)
+	// GetUserByUUID gets a user by uuid; the user is zero if it doesn't exist.
+	GetUserByUUID(uuid string, txs ...*sql.Tx) (*model.User, error)
+	// CreateUser creates a user, setting its id.
+	CreateUser(user *model.User, txs ...*sql.Tx) error
+	// UpdateUser updates a user.
+	UpdateUser(user *model.User, txs ...*sql.Tx) error
+	// DeleteUser deletes a user.
+	DeleteUser(user *model.User, txs ...*sql.Tx) error
+
+	// GetSessions gets all the sessions.
+	GetSessions(txs ...*sql.Tx) ([]model.Session, error)
+	// GetSession gets a session by uuid; the session is zero if it doesn't exist.
+	GetSession(uuid string, txs ...*sql.Tx) (*model.Session, error)
+	// CreateSession creates a session.
+	CreateSession(session *model.Session, txs ...*sql.Tx) error
+	// DeleteSession deletes a session.
+	DeleteSession(session *model.Session, txs ...*sql.Tx) error
+
+	// GetContacts gets all the contact list entries.
+	GetContacts(txs ...*sql.Tx) ([]model.Contacts, error)
+	// CreateContacts creates the contact list entries in both directions between two users, if they don't exist.
+	CreateContacts(sender, receiver int, txs ...*sql.Tx) error
+	// DeleteContacts deletes the contact list entries in both directions between two users.
+	DeleteContacts(sender, receiver int, txs ...*sql.Tx) error
+
+	// GetRooms gets all the rooms.
+	GetRooms(txs ...*sql.Tx) ([]model.Room, error)
+	// CreateRoom creates a room, setting its id.
+	CreateRoom(room *model.Room, txs ...*sql.Tx) error
+	// GetRoomMembers gets all the room memberships.
+	GetRoomMembers(txs ...*sql.Tx) ([]model.RoomMember, error)
+	// CreateRoomMember adds a user to a room, if they aren't a member.
+	CreateRoomMember(member model.RoomMember, txs ...*sql.Tx) error
+	// DeleteRoomMember removes a user from a room.
+	DeleteRoomMember(roomID, userID int, txs ...*sql.Tx) error
+
+	// GetMessage gets a message by uuid; the message is zero if it doesn't exist.
+	GetMessage(uuid string, txs ...*sql.Tx) (*model.Message, error)
+	// GetMessagesByUUID gets a set of messages by uuid, in no particular order; missing ones are skipped.
+	GetMessagesByUUID(uuids []string, txs ...*sql.Tx) ([]model.Message, error)
+	// GetAllMessagesWithLimit gets the newest messages up to a limit per receiver (or per room for room messages), oldest first, with their room sequences.
+	GetAllMessagesWithLimit(limit int, txs ...*sql.Tx) ([]model.Message, error)
+	// GetConversationBefore gets up to limit direct messages between two users before a cursor, newest first.
+	GetConversationBefore(userID, otherUserID int, before time.Time, beforeUUID string, limit int, txs ...*sql.Tx) ([]model.Message, error)
+	// GetMessagesPastMaxAge gets up to limit messages past their max age as of now, oldest first, after a cursor of the last page's last message.
+	GetMessagesPastMaxAge(maxAges model.MessageMaxAges, now, after time.Time, afterUUID string, limit int, txs ...*sql.Tx) ([]model.Message, error)
+	// GetExpiredMessages gets up to limit ephemeral messages that should have vanished by now: past their expiry, or read once and read.
+	GetExpiredMessages(now time.Time, limit int, txs ...*sql.Tx) ([]model.Message, error)
+	// GetMessageSequences gets the highest persisted sequence number for each user.
+	GetMessageSequences(txs ...*sql.Tx) (map[int]int64, error)
+	// CreateMessage creates a message along with its room sequences.
+	CreateMessage(message model.Message, txs ...*sql.Tx) error
+	// CreateMessages creates a batch of messages along with their room sequences, all or nothing.
+	CreateMessages(messages []model.Message, txs ...*sql.Tx) error
+	// UpdateMessageContent updates a message's body, attachments and edit / retraction timestamps.
+	UpdateMessageContent(message model.Message, txs ...*sql.Tx) error
+	// DeleteMessages deletes messages along with their sequences, receipts, change events and inbox entries.
+	// The highest sequence each user had among them is kept, so GetMessageSequences doesn't go backwards.
+	DeleteMessages(messageUUIDs []string, txs ...*sql.Tx) error
+	// CreateMessageEvent records a change event queued for a message.
+	CreateMessageEvent(event model.MessageEvent, txs ...*sql.Tx) error
+	// GetUserStreamAfterSequence gets the newest limit entries of a user's stream after a sequence, oldest first:
+	// messages with no event, change events with theirs and receipt changes as receipt events.
+	GetUserStreamAfterSequence(userID int, after int64, limit int, txs ...*sql.Tx) ([]model.MessageEvent, error)
+
+	// GetScheduledMessages gets the messages waiting to be delivered, soonest first.
+	GetScheduledMessages(txs ...*sql.Tx) ([]model.ScheduledMessage, error)
+	// CreateScheduledMessage creates a message waiting to be delivered.
+	CreateScheduledMessage(scheduled model.ScheduledMessage, txs ...*sql.Tx) error
+	// DeleteScheduledMessage deletes a message waiting to be delivered, once it's sent or cancelled.
+	DeleteScheduledMessage(uuid string, txs ...*sql.Tx) error
+	// DeliverScheduledMessage claims a scheduled message by deleting it, sends it with `send` and creates the message send returns (if any),
+	// all in one transaction. It returns false without calling send if the message was already claimed, i.e. by another server or a cancel.
+	DeliverScheduledMessage(uuid string, send func() (*model.Message, error), txs ...*sql.Tx) (bool, error)
+
+	// GetInboxMessages gets the entries for messages routed to users while they had no session, by user and then sequence.
+	GetInboxMessages(txs ...*sql.Tx) ([]model.InboxMessage, error)
+	// CreateInboxMessage records that a message was routed to a user while they had no session, if it isn't already.
+	CreateInboxMessage(entry model.InboxMessage, txs ...*sql.Tx) error
+	// DeleteInboxMessages deletes a user's inbox entries once they've been handed to a session.
+	DeleteInboxMessages(userID int, txs ...*sql.Tx) error
+
+	// GetMessageReceipts gets the receipts for a set of messages, by message uuid.
+	GetMessageReceipts(messageUUIDs []string, txs ...*sql.Tx) (map[string][]model.MessageReceipt, error)
+	// SaveMessageReceipt creates a receipt or fills in any of its timestamps that aren't set.
+	SaveMessageReceipt(receipt model.MessageReceipt, txs ...*sql.Tx) error
+}
@@ -0,0 +1,21 @@
+package viewmodel
+
+import "github.com/blendlabs/chatbus/server/model"
+
+const (
+	// EventTypeMessage is an event carrying a message.
+	EventTypeMessage = "message"
+	// EventTypeTyping is an event carrying the users currently typing to the session's user.
+	EventTypeTyping = "typing"
+	// EventTypeError is an event carrying an error for a rejected request.
+	EventTypeError = "error"
+)
+
+// Event is an item pushed to a connected session.
+// Typing is sent on typing events even when it's empty, so clients can clear the indicator once nobody is typing.
+type Event struct {
+	Type    string         `json:"type"`
+	Message *model.Message `json:"message,omitempty"`
+	Typing  []int          `json:"typing"`
+	Error   string         `json:"error,omitempty"`
+}
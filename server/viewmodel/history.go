@@ -0,0 +1,10 @@
+package viewmodel
+
+import "github.com/blendlabs/chatbus/server/model"
+
+// History is a page of a conversation, oldest message first.
+type History struct {
+	Messages []model.Message `json:"messages"`
+	// Before is the cursor for the next (older) page; it is empty when there are no more messages.
+	Before string `json:"before,omitempty"`
+}
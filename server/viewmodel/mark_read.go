@@ -0,0 +1,7 @@
+package viewmodel
+
+// MarkRead is a request to mark messages read, either a single message by uuid or everything up to a sequence number.
+type MarkRead struct {
+	UUID     string `json:"uuid,omitempty"`
+	Sequence int64  `json:"seq,omitempty"`
+}
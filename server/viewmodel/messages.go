@@ -0,0 +1,11 @@
+package viewmodel
+
+import "github.com/blendlabs/chatbus/server/model"
+
+// MessagesAfterSequence is the result of polling for messages after a sequence number.
+type MessagesAfterSequence struct {
+	Messages []model.Message `json:"messages"`
+	Sequence int64           `json:"seq"`
+	// Typing are the ids of the users currently typing to the polling user.
+	Typing []int `json:"typing"`
+}
@@ -0,0 +1,11 @@
+package viewmodel
+
+// RateLimitCounters are the counters for one rate limit, i.e. sends per session.
+type RateLimitCounters struct {
+	Kind     string `json:"kind"`
+	Scope    string `json:"scope"`
+	Allowed  uint64 `json:"allowed"`
+	Rejected uint64 `json:"rejected"`
+	// Keys is how many sessions or users the limit is currently tracking.
+	Keys int `json:"keys"`
+}
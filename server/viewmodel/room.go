@@ -0,0 +1,9 @@
+package viewmodel
+
+import "github.com/blendlabs/chatbus/server/model"
+
+// Room is a room along with its members.
+type Room struct {
+	Room      *model.Room `json:"room"`
+	MemberIDs []int       `json:"member_ids"`
+}
@@ -0,0 +1,16 @@
+package viewmodel
+
+import (
+	"time"
+
+	"github.com/blendlabs/chatbus/server/model"
+)
+
+// Session is a new session along with how many of the messages waiting for its user are unread,
+// and the bearer token to use on the `/api/me` routes in place of the session id.
+type Session struct {
+	*model.Session
+	Unread          int        `json:"unread"`
+	Token           string     `json:"token,omitempty"`
+	TokenExpiresUTC *time.Time `json:"token_expires_utc,omitempty"`
+}
@@ -0,0 +1,402 @@
+package wal
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/blendlabs/chatbus/server/model"
+	"github.com/blendlabs/chatbus/server/store"
+)
+
+const (
+	// MaxEntrySize is the largest line the log will read back.
+	MaxEntrySize = 1 << 20
+
+	// DefaultCompactSize is how big the log file gets before it is rewritten with only its pending entries, if the log doesn't say.
+	DefaultCompactSize = 64 << 20
+)
+
+var (
+	// ErrEntryTooLarge is returned for a message too big to be read back from the log.
+	ErrEntryTooLarge = errors.New("Message is too large for the write-ahead log!")
+
+	// ErrCorruptEntry is returned when the log has a line that can't be read with entries after it; only a torn last line is cut off.
+	ErrCorruptEntry = errors.New("Write-ahead log has a corrupt entry before its end!")
+)
+
+// entry is a line in the log; it either carries a message waiting to be written to the store, or marks one as written.
+type entry struct {
+	LSN     int64          `json:"lsn,omitempty"`
+	Message *model.Message `json:"message,omitempty"`
+	// the message's sequences aren't part of its json, so they're carried alongside it.
+	SenderSequence   int64         `json:"sender_seq,omitempty"`
+	ReceiverSequence int64         `json:"receiver_seq,omitempty"`
+	RoomSequences    map[int]int64 `json:"room_seqs,omitempty"`
+	// Flushed is the lsn of an entry that has been written to the store.
+	Flushed int64 `json:"flushed,omitempty"`
+}
+
+// newEntry returns the entry that appends a message.
+func newEntry(lsn int64, message model.Message) entry {
+	return entry{
+		LSN:              lsn,
+		Message:          &message,
+		SenderSequence:   message.SenderSequence,
+		ReceiverSequence: message.ReceiverSequence,
+		RoomSequences:    message.RoomSequences,
+	}
+}
+
+// line returns the entry as a line of the log, or ErrEntryTooLarge if it is too long to be read back.
+func (e entry) line() ([]byte, error) {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	line = append(line, '\n')
+	if len(line) > MaxEntrySize {
+		return nil, ErrEntryTooLarge
+	}
+	return line, nil
+}
+
+// message returns the entry's message with its sequences restored.
+func (e entry) message() model.Message {
+	message := *e.Message
+	message.SenderSequence = e.SenderSequence
+	message.ReceiverSequence = e.ReceiverSequence
+	message.RoomSequences = e.RoomSequences
+	return message
+}
+
+// Log is an append only write-ahead log of messages that have been accepted but not yet written to the store.
+// Appends are fsynced before they return, so an accepted message survives the process dying before it is flushed.
+// Flushed entries are marked with a line of their own; once nothing is pending the file is emptied, and once it passes
+// the compact size it is rewritten with only the pending entries, so it doesn't grow forever under steady traffic.
+type Log struct {
+	// BatchSize is how many messages a flush writes to the store at once.
+	BatchSize int
+	// CompactSize is how big the file gets before it is compacted; zero uses the default.
+	CompactSize int64
+
+	lock      sync.Mutex
+	flushLock sync.Mutex
+
+	path    string
+	file    *os.File
+	size    int64
+	lastLSN int64
+	pending []entry
+}
+
+// Open opens (or creates) the log at a path and reads back the entries that were never flushed.
+func Open(path string) (*Log, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	log := &Log{path: path, file: file}
+	err = log.read()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return log, nil
+}
+
+// read loads the pending entries and positions the file for appends.
+// A torn last line, from dying part way through an append, is cut off; that append never returned.
+// A bad line with entries after it is an error, since cutting it off would lose messages that were acknowledged.
+func (l *Log) read() error {
+	var entries []entry
+	flushed := map[int64]bool{}
+	var offset int64
+
+	reader := bufio.NewReaderSize(l.file, 64<<10)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		var e entry
+		if len(line) > MaxEntrySize || json.Unmarshal(line, &e) != nil {
+			if _, err = reader.Peek(1); err == nil {
+				return ErrCorruptEntry
+			}
+			if err != io.EOF {
+				return err
+			}
+			break
+		}
+		offset += int64(len(line))
+
+		if e.Flushed > 0 {
+			flushed[e.Flushed] = true
+			continue
+		}
+		if e.Message == nil {
+			continue
+		}
+		if e.LSN > l.lastLSN {
+			l.lastLSN = e.LSN
+		}
+		entries = append(entries, e)
+	}
+
+	var pending []entry
+	for _, e := range entries {
+		if !flushed[e.LSN] {
+			pending = append(pending, e)
+		}
+	}
+
+	if err := l.file.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err := l.file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	l.size = offset
+	l.pending = pending
+	return nil
+}
+
+// Check returns ErrEntryTooLarge for a message that is too big to append.
+func Check(message model.Message) error {
+	_, err := newEntry(0, message).line()
+	return err
+}
+
+// Append writes a message to the log and syncs it to disk; it returns ErrEntryTooLarge for a message that couldn't be read back.
+func (l *Log) Append(message model.Message) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	e := newEntry(l.lastLSN+1, message)
+	err := l.write(e)
+	if err != nil {
+		return err
+	}
+	l.lastLSN = e.LSN
+	l.pending = append(l.pending, e)
+	return nil
+}
+
+// Pending returns the messages that haven't been flushed to the store yet, in the order they were appended.
+func (l *Log) Pending() []model.Message {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	messages := make([]model.Message, len(l.pending))
+	for x, e := range l.pending {
+		messages[x] = e.message()
+	}
+	return messages
+}
+
+// Flush writes the pending messages to a store in order, BatchSize at a time, stopping at the first one that fails.
+// A message that is already in the store (written before a crash, but not marked as flushed) counts as written.
+func (l *Log) Flush(s store.Store, txs ...*sql.Tx) error {
+	l.flushLock.Lock()
+	defer l.flushLock.Unlock()
+
+	l.lock.Lock()
+	pending := make([]entry, len(l.pending))
+	copy(pending, l.pending)
+	l.lock.Unlock()
+
+	batchSize := l.BatchSize
+	if batchSize <= 0 {
+		batchSize = store.DefaultBatchSize
+	}
+
+	var flushed []int64
+	var err error
+	for start := 0; start < len(pending) && err == nil; start += batchSize {
+		end := start + batchSize
+		if end > len(pending) {
+			end = len(pending)
+		}
+		var written []int64
+		written, err = createMessages(s, pending[start:end], txs...)
+		flushed = append(flushed, written...)
+	}
+
+	if len(flushed) > 0 {
+		if markErr := l.markFlushed(flushed); markErr != nil && err == nil {
+			err = markErr
+		}
+	}
+	return err
+}
+
+// Close closes the log file.
+func (l *Log) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.file.Close()
+}
+
+// markFlushed records entries as written to the store; once nothing is pending the log is emptied,
+// and once it has grown past the compact size it is compacted.
+func (l *Log) markFlushed(lsns []int64) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	written := map[int64]bool{}
+	for _, lsn := range lsns {
+		written[lsn] = true
+	}
+	pending := l.pending[:0]
+	for _, e := range l.pending {
+		if !written[e.LSN] {
+			pending = append(pending, e)
+		}
+	}
+	l.pending = pending
+
+	if len(l.pending) == 0 {
+		if err := l.file.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := l.file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		l.size = 0
+		return l.file.Sync()
+	}
+	if l.size >= l.compactSize() {
+		return l.compact()
+	}
+
+	for _, lsn := range lsns {
+		if err := l.writeLine(entry{Flushed: lsn}); err != nil {
+			return err
+		}
+	}
+	return l.file.Sync()
+}
+
+func (l *Log) compactSize() int64 {
+	if l.CompactSize > 0 {
+		return l.CompactSize
+	}
+	return DefaultCompactSize
+}
+
+// compact writes the pending entries to a new file, syncs it and renames it over the log, so a crash leaves either the old file or the new one.
+func (l *Log) compact() error {
+	compactPath := l.path + ".compact"
+	file, err := os.OpenFile(compactPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	var size int64
+	writer := bufio.NewWriterSize(file, 64<<10)
+	for _, e := range l.pending {
+		line, err := e.line()
+		if err == nil {
+			_, err = writer.Write(line)
+		}
+		if err != nil {
+			file.Close()
+			return err
+		}
+		size += int64(len(line))
+	}
+	if err = writer.Flush(); err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = os.Rename(compactPath, l.path)
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if err = syncDir(filepath.Dir(l.path)); err != nil {
+		file.Close()
+		return err
+	}
+
+	l.file.Close()
+	l.file = file
+	l.size = size
+	return nil
+}
+
+// syncDir syncs a directory, so a rename in it survives a crash.
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// write appends an entry and syncs the file.
+func (l *Log) write(e entry) error {
+	if err := l.writeLine(e); err != nil {
+		return err
+	}
+	return l.file.Sync()
+}
+
+// writeLine appends an entry without syncing the file.
+func (l *Log) writeLine(e entry) error {
+	line, err := e.line()
+	if err != nil {
+		return err
+	}
+	written, err := l.file.Write(line)
+	l.size += int64(written)
+	return err
+}
+
+// createMessages writes a batch of entries to a store, returning the lsns that made it.
+// If the batch fails it is retried a message at a time, so one that is already in the store doesn't hold up the rest.
+func createMessages(s store.Store, batch []entry, txs ...*sql.Tx) ([]int64, error) {
+	messages := make([]model.Message, len(batch))
+	written := make([]int64, len(batch))
+	for x, e := range batch {
+		messages[x] = e.message()
+		written[x] = e.LSN
+	}
+	if err := s.CreateMessages(messages, txs...); err == nil {
+		return written, nil
+	}
+
+	written = written[:0]
+	for x, message := range messages {
+		if err := createMessage(s, message, txs...); err != nil {
+			return written, err
+		}
+		written = append(written, batch[x].LSN)
+	}
+	return written, nil
+}
+
+// createMessage creates a message in a store, treating a message that is already there as created.
+func createMessage(s store.Store, message model.Message, txs ...*sql.Tx) error {
+	err := s.CreateMessage(message, txs...)
+	if err == nil {
+		return nil
+	}
+	existing, getErr := s.GetMessage(message.UUID, txs...)
+	if getErr == nil && existing != nil && !existing.IsZero() {
+		return nil
+	}
+	return err
+}
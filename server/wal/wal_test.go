@@ -0,0 +1,175 @@
+package wal
+
+import (
+	"database/sql"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blendlabs/chatbus/server/model"
+	"github.com/blendlabs/chatbus/server/store"
+	assert "github.com/blendlabs/go-assert"
+)
+
+// failingStore is a store that fails to create messages.
+type failingStore struct {
+	store.Store
+}
+
+func (fs failingStore) CreateMessage(message model.Message, txs ...*sql.Tx) error {
+	return errors.New("Create failed!")
+}
+
+func (fs failingStore) CreateMessages(messages []model.Message, txs ...*sql.Tx) error {
+	return errors.New("Create failed!")
+}
+
+func (fs failingStore) GetMessage(uuid string, txs ...*sql.Tx) (*model.Message, error) {
+	return &model.Message{}, nil
+}
+
+func newTestLog(assert *assert.Assertions) (*Log, string) {
+	dir, err := ioutil.TempDir("", "chatbus_wal")
+	assert.Nil(err)
+	path := filepath.Join(dir, "chatbus.wal")
+	log, err := Open(path)
+	assert.Nil(err)
+	return log, path
+}
+
+func TestLogReplay(t *testing.T) {
+	assert := assert.New(t)
+	log, path := newTestLog(assert)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	assert.Nil(log.Append(model.Message{UUID: "m1", CreatedUTC: time.Now().UTC(), SenderID: 1, ReceiverID: 2, Body: "one", SenderSequence: 1, ReceiverSequence: 1}))
+	assert.Nil(log.Append(model.Message{UUID: "m2", CreatedUTC: time.Now().UTC(), SenderID: 1, ReceiverID: 1, RoomID: 1, Body: "two", RoomSequences: map[int]int64{1: 2, 2: 2}}))
+	assert.Nil(log.Close())
+
+	// a torn append is dropped when the log is reopened.
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	assert.Nil(err)
+	_, err = file.Write([]byte(`{"lsn":3,"message":{"uu`))
+	assert.Nil(err)
+	assert.Nil(file.Close())
+
+	log, err = Open(path)
+	assert.Nil(err)
+	defer log.Close()
+
+	pending := log.Pending()
+	assert.Len(pending, 2)
+	assert.Equal("m1", pending[0].UUID)
+	assert.Equal(int64(1), pending[0].SenderSequence)
+	assert.Equal(int64(1), pending[0].ReceiverSequence)
+	assert.Equal("m2", pending[1].UUID)
+	assert.Equal(int64(2), pending[1].RoomSequences[2])
+
+	assert.Nil(log.Append(model.Message{UUID: "m3", CreatedUTC: time.Now().UTC(), SenderID: 2, ReceiverID: 1, Body: "three"}))
+	assert.Len(log.Pending(), 3)
+
+	memory := store.NewMemory()
+	// m1 made it to the store before the crash.
+	assert.Nil(memory.CreateMessage(pending[0]))
+
+	assert.Nil(log.Flush(memory))
+	assert.Empty(log.Pending())
+
+	for _, uuid := range []string{"m1", "m2", "m3"} {
+		message, err := memory.GetMessage(uuid)
+		assert.Nil(err)
+		assert.Equal(uuid, message.UUID)
+	}
+
+	info, err := os.Stat(path)
+	assert.Nil(err)
+	assert.Equal(int64(0), info.Size())
+}
+
+func TestLogFlushFailure(t *testing.T) {
+	assert := assert.New(t)
+	log, path := newTestLog(assert)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	assert.Nil(log.Append(model.Message{UUID: "m1", CreatedUTC: time.Now().UTC(), SenderID: 1, ReceiverID: 2, Body: "one"}))
+	assert.NotNil(log.Flush(failingStore{store.NewMemory()}))
+	assert.Len(log.Pending(), 1)
+	assert.Nil(log.Close())
+
+	log, err := Open(path)
+	assert.Nil(err)
+	defer log.Close()
+	assert.Len(log.Pending(), 1)
+}
+
+func TestLogBadEntries(t *testing.T) {
+	assert := assert.New(t)
+	log, path := newTestLog(assert)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	tooLarge := model.Message{UUID: "big", SenderID: 1, ReceiverID: 2, Body: strings.Repeat("x", MaxEntrySize)}
+	assert.Equal(ErrEntryTooLarge, Check(tooLarge))
+	assert.Equal(ErrEntryTooLarge, log.Append(tooLarge))
+	assert.Nil(log.Append(model.Message{UUID: "m1", SenderID: 1, ReceiverID: 2, Body: "one"}))
+	assert.Nil(log.Close())
+
+	// a bad last line is cut off.
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	assert.Nil(err)
+	_, err = file.Write([]byte("not json\n"))
+	assert.Nil(err)
+	assert.Nil(file.Close())
+
+	log, err = Open(path)
+	assert.Nil(err)
+	assert.Len(log.Pending(), 1)
+	assert.Nil(log.Close())
+
+	// a bad line with entries after it is an error rather than losing them.
+	file, err = os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	assert.Nil(err)
+	_, err = file.Write([]byte("not json\n{\"lsn\":2,\"message\":{\"uuid\":\"m2\"}}\n"))
+	assert.Nil(err)
+	assert.Nil(file.Close())
+
+	_, err = Open(path)
+	assert.Equal(ErrCorruptEntry, err)
+}
+
+func TestLogCompact(t *testing.T) {
+	assert := assert.New(t)
+	log, path := newTestLog(assert)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	log.CompactSize = 1
+	for _, uuid := range []string{"m1", "m2", "m3"} {
+		assert.Nil(log.Append(model.Message{UUID: uuid, CreatedUTC: time.Now().UTC(), SenderID: 1, ReceiverID: 2, Body: uuid}))
+	}
+
+	// with entries still pending the flushed one is dropped from the file, rather than marked.
+	assert.Nil(log.markFlushed([]int64{1}))
+	contents, err := ioutil.ReadFile(path)
+	assert.Nil(err)
+	assert.Equal(2, strings.Count(string(contents), "\n"))
+	assert.False(strings.Contains(string(contents), `"m1"`))
+
+	// appends go to the compacted file.
+	assert.Nil(log.Append(model.Message{UUID: "m4", CreatedUTC: time.Now().UTC(), SenderID: 1, ReceiverID: 2, Body: "m4"}))
+	assert.Nil(log.Close())
+
+	log, err = Open(path)
+	assert.Nil(err)
+	defer log.Close()
+	pending := log.Pending()
+	assert.Len(pending, 3)
+	assert.Equal("m2", pending[0].UUID)
+	assert.Equal("m4", pending[2].UUID)
+
+	// lsns carry on from the compacted entries.
+	assert.Nil(log.Append(model.Message{UUID: "m5", CreatedUTC: time.Now().UTC(), SenderID: 1, ReceiverID: 2, Body: "m5"}))
+	assert.Equal(int64(5), log.lastLSN)
+}